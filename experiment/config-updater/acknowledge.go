@@ -0,0 +1,71 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+const (
+	// acknowledgeReaction reacts to the PR with eyes when its updates start.
+	acknowledgeReaction = "reaction"
+	// acknowledgeComment comments on the PR when its updates start.
+	acknowledgeComment = "comment"
+)
+
+// acknowledge tells the author of pr that its updates are starting, as they
+// can take minutes to post results. It reports whether it did, so that the
+// outcome is reacted to as well. Failing to is only logged, as the updates
+// run regardless.
+func (s *Server) acknowledge(ctx context.Context, run runInfo, pr github.PullRequest, mode string) bool {
+	org, repo := pr.Base.Repo.Owner.Login, pr.Base.Repo.Name
+	log := s.log.WithFields(logrus.Fields{"eventGUID": run.eventGUID, "acknowledge": mode})
+	var err error
+	switch mode {
+	case acknowledgeReaction:
+		err = s.github(ctx).CreateIssueReaction(org, repo, pr.Number, github.ReactionEyes)
+	case acknowledgeComment:
+		// The signature lets the comment be minimized with the others once
+		// the results are posted.
+		body := fmt.Sprintf("Processing your config changes, run `%s`.\n\n%s\n%s", run.eventGUID, commentFooter(run), commentSignature)
+		err = s.github(ctx).CreateComment(org, repo, pr.Number, body)
+	default:
+		return false
+	}
+	if err != nil {
+		log.WithError(err).Warn("Error acknowledging the PR.")
+		return false
+	}
+	return true
+}
+
+// reactToOutcome reacts to pr with a rocket if its updates all succeeded,
+// and confused otherwise.
+func (s *Server) reactToOutcome(ctx context.Context, pr github.PullRequest, results results) {
+	reaction := github.ReactionRocket
+	if !results.IsSuccess() || results.failedRollback() {
+		reaction = github.ReactionConfused
+	}
+	if err := s.github(ctx).CreateIssueReaction(pr.Base.Repo.Owner.Login, pr.Base.Repo.Name, pr.Number, reaction); err != nil {
+		s.log.WithError(err).WithField("reaction", reaction).Warn("Error reacting to the outcome.")
+	}
+}
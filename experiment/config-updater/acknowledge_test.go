@@ -0,0 +1,129 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// snapshotExecutor records what had been posted to the PR when the first
+// task ran.
+type snapshotExecutor struct {
+	recordingExecutor
+	ghc       *fakegithub.FakeClient
+	reactions []string
+	comments  []string
+	ran       bool
+}
+
+func (e *snapshotExecutor) Run(ctx context.Context, log *logrus.Entry, dir string, t task) ([]byte, []byte, error) {
+	if !e.ran {
+		e.reactions = append([]string(nil), e.ghc.IssueReactionsAdded...)
+		e.comments = append([]string(nil), e.ghc.IssueCommentsAdded...)
+		e.ran = true
+	}
+	return e.recordingExecutor.Run(ctx, log, dir, t)
+}
+
+func TestAcknowledge(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		acknowledge string
+		changes     []github.PullRequestChange
+		failed      bool
+		// expectedBefore are the reactions added before the tasks ran.
+		expectedBefore []string
+		// expectedCommentBefore is the comment posted before the tasks
+		// ran, if any.
+		expectedCommentBefore string
+		expectedReactions     []string
+	}{
+		{
+			name:    "not configured",
+			changes: []github.PullRequestChange{{Filename: "jobs/config.yaml"}},
+		},
+		{
+			name:              "reaction, applied",
+			acknowledge:       acknowledgeReaction,
+			changes:           []github.PullRequestChange{{Filename: "jobs/config.yaml"}},
+			expectedBefore:    []string{"org/repo#1:eyes"},
+			expectedReactions: []string{"org/repo#1:eyes", "org/repo#1:rocket"},
+		},
+		{
+			name:              "reaction, failed",
+			acknowledge:       acknowledgeReaction,
+			changes:           []github.PullRequestChange{{Filename: "jobs/config.yaml"}},
+			failed:            true,
+			expectedBefore:    []string{"org/repo#1:eyes"},
+			expectedReactions: []string{"org/repo#1:eyes", "org/repo#1:confused"},
+		},
+		{
+			name:                  "comment",
+			acknowledge:           acknowledgeComment,
+			changes:               []github.PullRequestChange{{Filename: "jobs/config.yaml"}},
+			expectedCommentBefore: "org/repo#1:Processing your config changes, run `guid`.",
+			expectedReactions:     []string{"org/repo#1:rocket"},
+		},
+		{
+			name:        "no matching changes",
+			acknowledge: acknowledgeReaction,
+			changes:     []github.PullRequestChange{{Filename: "README.md"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: tc.changes},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:    []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+				MaxPRFiles:  defaultMaxPRFiles,
+				Acknowledge: tc.acknowledge,
+			})
+			executor := &snapshotExecutor{
+				recordingExecutor: recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": tc.failed}},
+				ghc:               ghc,
+			}
+			s.executor = executor
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.reactions, tc.expectedBefore) {
+				t.Errorf("expected reactions %v before the tasks ran, got %v", tc.expectedBefore, executor.reactions)
+			}
+			if tc.expectedCommentBefore != "" && (len(executor.comments) != 1 || !strings.HasPrefix(executor.comments[0], tc.expectedCommentBefore)) {
+				t.Errorf("expected comment %q before the tasks ran, got %v", tc.expectedCommentBefore, executor.comments)
+			}
+			if tc.expectedCommentBefore == "" && len(executor.comments) != 0 {
+				t.Errorf("expected no comment before the tasks ran, got %v", executor.comments)
+			}
+			if !reflect.DeepEqual(ghc.IssueReactionsAdded, tc.expectedReactions) {
+				t.Errorf("expected reactions %v, got %v", tc.expectedReactions, ghc.IssueReactionsAdded)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// requireToken only lets requests that carry token as a bearer token through
+// to h. Every request is refused if the token is empty.
+func requireToken(token func() []byte, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := strings.TrimSpace(string(token()))
+		header := r.Header.Get("Authorization")
+		provided := strings.TrimPrefix(header, "Bearer ")
+		if expected == "" || provided == header || subtle.ConstantTimeCompare([]byte(provided), []byte(expected)) != 1 {
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// configHandler serves the config currently loaded by the agent as JSON.
+// Credentials must never be part of UpdateConfig so that this is safe.
+func configHandler(ca *Agent) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := json.Marshal(ca.Config())
+		if err != nil {
+			logrus.WithError(err).Error("Error marshaling config.")
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// statusHandler serves the most recent task results of s as JSON, most
+// recent first.
+func statusHandler(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := json.Marshal(s.recentResults().list())
+		if err != nil {
+			logrus.WithError(err).Error("Error marshaling status.")
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// promoteHandler runs the updates held for an environment, like commenting
+// /promote on the PR. It takes the org, repo, pr and environment as form
+// values.
+func promoteHandler(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		org, repo, environment := r.FormValue("org"), r.FormValue("repo"), r.FormValue("environment")
+		number, err := strconv.Atoi(r.FormValue("pr"))
+		if org == "" || repo == "" || environment == "" || err != nil {
+			http.Error(w, "400 Bad Request: org, repo, pr and environment are required", http.StatusBadRequest)
+			return
+		}
+		err = s.promote(r.Context(), "", org, repo, number, environment, "the /promote endpoint")
+		if promotionErr, ok := err.(*promotionError); ok {
+			http.Error(w, promotionErr.reason, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logrus.WithError(err).Error("Error promoting updates.")
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "Promoted %s/%s#%d to %s.\n", org, repo, number, environment)
+	})
+}
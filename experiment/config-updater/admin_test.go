@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestConfigEndpoint(t *testing.T) {
+	agent := &Agent{c: &UpdateConfig{
+		Targets:    []string{"config/service.yaml"},
+		Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/.*\.yaml$`)}, Target: "jobs"}},
+		MaxPRFiles: 10,
+	}}
+	handler := requireToken(func() []byte { return []byte("s3cret\n") }, configHandler(agent))
+
+	var testcases = []struct {
+		name          string
+		method        string
+		authorization string
+
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "missing token is refused",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "wrong token is refused",
+			method:         http.MethodGet,
+			authorization:  "Bearer nope",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "token without bearer scheme is refused",
+			method:         http.MethodGet,
+			authorization:  "s3cret",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "writes are refused",
+			method:         http.MethodPost,
+			authorization:  "Bearer s3cret",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "config is served",
+			method:         http.MethodGet,
+			authorization:  "Bearer s3cret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"targets":["config/service.yaml"],"matchers":[{"regex":"^jobs/.*\\.yaml$","target":"jobs"}],"max_pr_files":10}`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/config", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if tc.expectedBody == "" {
+				return
+			}
+			if body := w.Body.String(); body != tc.expectedBody {
+				t.Errorf("expected body %s, got %s", tc.expectedBody, body)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("expected JSON content type, got %q", contentType)
+			}
+		})
+	}
+
+	emptyToken := requireToken(func() []byte { return nil }, configHandler(agent))
+	req := httptest.NewRequest(http.MethodGet, "/config", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	emptyToken.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an empty token to refuse every request, got status %d", w.Code)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// notAllowedError is returned instead of running a command whose
+// executable is not allowed.
+type notAllowedError struct {
+	command    []string
+	executable string
+}
+
+func (e *notAllowedError) Error() string {
+	return fmt.Sprintf("refused to run %q: %s is not in allowed_executables", strings.Join(e.command, " "), e.executable)
+}
+
+// allowedExecutables lists the executables tasks may run, which is just make
+// unless the config says otherwise.
+func allowedExecutables(c *UpdateConfig, makeBinary string) []string {
+	if len(c.AllowedExecutables) > 0 {
+		return c.AllowedExecutables
+	}
+	return []string{makeBinary}
+}
+
+// resolveExecutable finds the file that running name from dir would
+// execute, following symlinks so that every way to refer to a binary
+// resolves the same. Names without a slash are looked up on PATH.
+func resolveExecutable(name, dir string) (string, error) {
+	path := name
+	if !strings.Contains(name, "/") {
+		var err error
+		if path, err = exec.LookPath(name); err != nil {
+			return "", err
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		// It will fail to run anyway, but that is not for us to report.
+		return path, nil
+	} else if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// checkExecutable returns a notAllowedError unless running command from dir
+// would execute one of the allowed executables.
+func checkExecutable(command []string, dir string, allowed []string) error {
+	executable, err := resolveExecutable(command[0], dir)
+	if err != nil {
+		return &notAllowedError{command: command, executable: command[0]}
+	}
+	for _, candidate := range allowed {
+		if resolved, err := resolveExecutable(candidate, "/"); err == nil && resolved == executable {
+			return nil
+		}
+	}
+	return &notAllowedError{command: command, executable: executable}
+}
+
+// hostCommands lists the commands the config runs on the host, other than
+// make targets, along with makeBinary itself.
+func hostCommands(c *UpdateConfig, makeBinary string) [][]string {
+	commands := [][]string{{makeBinary}}
+	if c.PreTaskScript != "" || c.PostTaskScript != "" {
+		commands = append(commands, []string{"/bin/sh"})
+	}
+	for _, rollback := range c.TargetRollbacks {
+		commands = append(commands, rollback.Command)
+	}
+	if c.Diff != nil {
+		commands = append(commands, c.Diff.Command)
+	}
+	if c.JJBValidation != nil {
+		commands = append(commands, c.JJBValidation.command())
+	}
+	for _, verification := range c.KindVerifications {
+		commands = append(commands, verification.Command)
+	}
+	for _, matcher := range c.Matchers {
+		if matcher.Image != "" {
+			// These commands are run in the image, not on the host.
+			continue
+		}
+		if matcher.Rollback != nil {
+			commands = append(commands, matcher.Rollback.Command)
+		}
+		if matcher.Verify != nil {
+			commands = append(commands, matcher.Verify.Command)
+		}
+	}
+	var nonEmpty [][]string
+	for _, command := range commands {
+		if len(command) > 0 {
+			nonEmpty = append(nonEmpty, command)
+		}
+	}
+	return nonEmpty
+}
+
+// helmBinaries lists the helm binaries of the matchers of c and of its
+// sections, which are only ever set by the server config.
+func (c *UpdateConfig) helmBinaries() []string {
+	var binaries []string
+	for _, matcher := range c.Matchers {
+		if matcher.HelmBinary != "" {
+			binaries = append(binaries, matcher.HelmBinary)
+		}
+	}
+	for _, section := range c.Orgs {
+		binaries = append(binaries, section.helmBinaries()...)
+	}
+	for _, section := range c.Repos {
+		binaries = append(binaries, section.helmBinaries()...)
+	}
+	return binaries
+}
+
+// validateExecutables checks that every command configured to run on the
+// host is allowed. Relative paths are refused outright, as they would run
+// whatever is at that path in the PR.
+func validateExecutables(c *UpdateConfig) error {
+	makeBinary := c.MakeBinary
+	if makeBinary == "" {
+		makeBinary = defaultMakeBinary
+	}
+	allowed := allowedExecutables(c, makeBinary)
+	for _, candidate := range allowed {
+		if !filepath.IsAbs(candidate) {
+			return fmt.Errorf("allowed executable %q must be an absolute path", candidate)
+		}
+	}
+
+	if c.KustomizeBinary != "" && c.KustomizeTarget == "" {
+		// It only needs to be allowed once the config lists executables,
+		// like make.
+		kustomizeAllowed := allowed
+		if len(c.AllowedExecutables) == 0 {
+			kustomizeAllowed = []string{c.KustomizeBinary}
+		}
+		if err := validateExecutable([]string{c.KustomizeBinary}, kustomizeAllowed); err != nil {
+			return err
+		}
+	}
+	for i, matcher := range c.Matchers {
+		if matcher.HelmBinary == "" {
+			continue
+		}
+		// Like the kustomize binary, it only needs to be allowed once the
+		// config lists executables.
+		helmAllowed := allowed
+		if len(c.AllowedExecutables) == 0 {
+			helmAllowed = []string{matcher.HelmBinary}
+		}
+		if !filepath.IsAbs(matcher.HelmBinary) {
+			return fmt.Errorf("matcher %d has helm_binary %q, which must be an absolute path", i, matcher.HelmBinary)
+		}
+		if err := validateExecutable([]string{matcher.HelmBinary}, helmAllowed); err != nil {
+			return err
+		}
+	}
+	for _, command := range hostCommands(c, makeBinary) {
+		if err := validateExecutable(command, allowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateExecutable checks that command does not use a relative path and
+// runs one of the allowed executables.
+func validateExecutable(command, allowed []string) error {
+	if strings.Contains(command[0], "/") && !filepath.IsAbs(command[0]) {
+		return fmt.Errorf("command %q must not use a relative path", strings.Join(command, " "))
+	}
+	if err := checkExecutable(command, "/", allowed); err != nil {
+		return fmt.Errorf("command %q runs %s, which is not in allowed_executables", strings.Join(command, " "), err.(*notAllowedError).executable)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestCheckExecutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allowlist")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "bin")
+	checkout := filepath.Join(dir, "checkout")
+	for _, d := range []string{bin, checkout} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+	for _, file := range []string{filepath.Join(bin, "apply"), filepath.Join(bin, "other"), filepath.Join(checkout, "apply")} {
+		if err := ioutil.WriteFile(file, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(bin, "apply"), filepath.Join(bin, "apply-link")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(bin, "other"), filepath.Join(checkout, "other-link")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", bin)
+
+	var testcases = []struct {
+		name       string
+		executable string
+		allowed    []string
+		expected   bool
+	}{
+		{name: "allowed absolute path", executable: filepath.Join(bin, "apply"), allowed: []string{filepath.Join(bin, "apply")}, expected: true},
+		{name: "other absolute path", executable: filepath.Join(bin, "other"), allowed: []string{filepath.Join(bin, "apply")}},
+		{name: "resolved on PATH", executable: "apply", allowed: []string{filepath.Join(bin, "apply")}, expected: true},
+		{name: "other binary on PATH", executable: "other", allowed: []string{filepath.Join(bin, "apply")}},
+		{name: "not on PATH", executable: "missing", allowed: []string{filepath.Join(bin, "apply")}},
+		{name: "symlink to allowed binary", executable: filepath.Join(bin, "apply-link"), allowed: []string{filepath.Join(bin, "apply")}, expected: true},
+		{name: "allowed symlink", executable: filepath.Join(bin, "apply"), allowed: []string{filepath.Join(bin, "apply-link")}, expected: true},
+		{name: "relative path in the checkout", executable: "./apply", allowed: []string{filepath.Join(bin, "apply")}},
+		{name: "relative path escaping the checkout", executable: "../bin/apply", allowed: []string{filepath.Join(bin, "apply")}, expected: true},
+		{name: "relative symlink to an allowed binary", executable: "./other-link", allowed: []string{filepath.Join(bin, "other")}, expected: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkExecutable([]string{tc.executable, "arg"}, checkout, tc.allowed)
+			if tc.expected && err != nil {
+				t.Errorf("expected %s to be allowed, got %v", tc.executable, err)
+			}
+			if !tc.expected {
+				if _, ok := err.(*notAllowedError); !ok {
+					t.Errorf("expected %s not to be allowed, got %v", tc.executable, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateExecutables(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		config      UpdateConfig
+		expectedErr string
+	}{
+		{
+			name:   "only make by default",
+			config: UpdateConfig{Targets: []string{"config/a.yaml"}},
+		},
+		{
+			name:   "custom make is allowed by default",
+			config: UpdateConfig{MakeBinary: "/usr/local/bin/gmake", KindVerifications: map[string]Verification{"Service": {Target: "verify"}}},
+		},
+		{
+			name:        "rollback command must be allowed",
+			config:      UpdateConfig{TargetRollbacks: map[string]Rollback{"config/a.yaml": {Command: []string{"/usr/bin/kubectl", "rollout", "undo"}}}},
+			expectedErr: `command "/usr/bin/kubectl rollout undo" runs /usr/bin/kubectl, which is not in allowed_executables`,
+		},
+		{
+			name: "allowed rollback command",
+			config: UpdateConfig{
+				AllowedExecutables: []string{"/usr/bin/make", "/usr/bin/kubectl"},
+				TargetRollbacks:    map[string]Rollback{"config/a.yaml": {Command: []string{"/usr/bin/kubectl", "rollout", "undo"}}},
+			},
+		},
+		{
+			name:        "scripts need a shell",
+			config:      UpdateConfig{PreTaskScript: "vault login"},
+			expectedErr: `command "/bin/sh" runs`,
+		},
+		{
+			name:        "relative paths are refused",
+			config:      UpdateConfig{AllowedExecutables: []string{"/usr/bin/make"}, Matchers: []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`.*`)}, Target: "jobs", Verify: &Verification{Command: []string{"./smoke.sh"}}}}},
+			expectedErr: `command "./smoke.sh" must not use a relative path`,
+		},
+		{
+			name:   "commands run in images are not checked",
+			config: UpdateConfig{Matchers: []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`.*`)}, Target: "jobs", Image: "tools", Verify: &Verification{Command: []string{"/usr/bin/oc", "status"}}}}},
+		},
+		{
+			name:   "kustomize binary is allowed by default",
+			config: UpdateConfig{KustomizeBinary: "/usr/bin/oc"},
+		},
+		{
+			name:        "kustomize binary must be allowed once executables are listed",
+			config:      UpdateConfig{AllowedExecutables: []string{"/usr/bin/make"}, KustomizeBinary: "/usr/bin/oc"},
+			expectedErr: `command "/usr/bin/oc" runs /usr/bin/oc, which is not in allowed_executables`,
+		},
+		{
+			name:        "kustomize binary must not be relative",
+			config:      UpdateConfig{KustomizeBinary: "bin/kustomize-apply"},
+			expectedErr: `command "bin/kustomize-apply" must not use a relative path`,
+		},
+		{
+			name:        "allowed executables must be absolute",
+			config:      UpdateConfig{AllowedExecutables: []string{"make"}},
+			expectedErr: `allowed executable "make" must be an absolute path`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateExecutables(&tc.config)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestHandleEventRefusesDisallowedExecutables(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers:           []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+		MaxPRFiles:         defaultMaxPRFiles,
+		AllowedExecutables: []string{"/usr/bin/make"},
+	})
+	s.MakeBinary = "/tmp/make"
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(executor.ran) != 0 {
+		t.Errorf("expected nothing to run, got %v", executor.ran)
+	}
+	checkComment(t, ghc, `The following internal errors occurred:
+<ul><li>refused to run &#34;/tmp/make jobs&#34;: /tmp/make is not in allowed_executables</li></ul>`)
+}
+
+func TestLoadValidatesExecutables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allowlist")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("pre_task_script: vault login\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "not in allowed_executables") {
+		t.Errorf("expected the shell to be refused, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("pre_task_script: vault login\nallowed_executables:\n- /usr/bin/make\n- /bin/sh\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"/usr/bin/make", "/bin/sh"}; !reflect.DeepEqual(config.AllowedExecutables, expected) {
+		t.Errorf("expected allowed executables %v, got %v", expected, config.AllowedExecutables)
+	}
+}
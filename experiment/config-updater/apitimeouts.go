@@ -0,0 +1,334 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// defaultAPITimeout bounds the GitHub API calls without a timeout of their
+// own in Server.APITimeouts.
+const defaultAPITimeout = 30 * time.Second
+
+// mutatingCalls are the calls of githubClient that change something on
+// GitHub, so that one that timed out may still take effect.
+var mutatingCalls = sets.NewString(
+	"AddLabel",
+	"CreateCheckRun",
+	"CreateComment",
+	"CreateDeployment",
+	"CreateDeploymentStatus",
+	"CreateFork",
+	"CreateIssue",
+	"CreateIssueReaction",
+	"CreatePullRequest",
+	"MinimizeComment",
+	"RemoveLabel",
+	"UpdateCheckRun",
+)
+
+// APITimeoutError is returned by a GitHub API call that took too long.
+type APITimeoutError struct {
+	Call    string
+	Timeout time.Duration
+	// Mutating is set for calls that change something on GitHub, which
+	// may still take effect.
+	Mutating bool
+}
+
+func (e *APITimeoutError) Error() string {
+	if e.Mutating {
+		return fmt.Sprintf("GitHub API call %s timed out after %v and may still take effect", e.Call, e.Timeout)
+	}
+	return fmt.Sprintf("GitHub API call %s timed out after %v", e.Call, e.Timeout)
+}
+
+// mutationTimeoutsKey holds whether a call made with the context that
+// changes something on GitHub timed out.
+type mutationTimeoutsKey struct{}
+
+// trackMutationTimeouts returns a context noting whether a call made with it
+// that changes something on GitHub timed out, and reports whether one did.
+func trackMutationTimeouts(ctx context.Context) (context.Context, func() bool) {
+	timedOut := new(int32)
+	return context.WithValue(ctx, mutationTimeoutsKey{}, timedOut), func() bool {
+		return atomic.LoadInt32(timedOut) != 0
+	}
+}
+
+// parseAPITimeouts parses call=duration pairs, such as CreateComment=1m,
+// into timeouts for the calls of githubClient.
+func parseAPITimeouts(pairs []string) (map[string]time.Duration, error) {
+	calls := reflect.TypeOf((*githubClient)(nil)).Elem()
+	timeouts := map[string]time.Duration{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not in the form call=duration", pair)
+		}
+		if _, ok := calls.MethodByName(parts[0]); !ok {
+			return nil, fmt.Errorf("%q is not a GitHub API call that is made", parts[0])
+		}
+		timeout, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for %s: %v", parts[0], err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("timeout for %s must be positive, not %v", parts[0], timeout)
+		}
+		timeouts[parts[0]] = timeout
+	}
+	return timeouts, nil
+}
+
+// github returns the GitHub client with every call bounded by its timeout
+// in APITimeouts, so that a slow API cannot hold up an event indefinitely.
+// The calls are not bound to the context of the event: that of a webhook is
+// done once GitHub stops waiting for the response, after which the results
+// must still be posted. ctx is used to trace the calls, and to note those
+// that change something on GitHub and time out.
+func (s *Server) github(ctx context.Context) githubClient {
+	return &timeoutGitHubClient{githubClient: s.ghc, timeouts: s.APITimeouts, server: s, ctx: ctx}
+}
+
+// timeoutGitHubClient gives up on calls once their timeout passes. The
+// client takes no context, so it cannot abort a request: a call that is
+// given up on keeps running in the background, and may still take effect,
+// but its result is dropped. A mutating call that times out is therefore
+// never retried, as that could apply it twice.
+type timeoutGitHubClient struct {
+	githubClient
+	timeouts map[string]time.Duration
+
+	// server and ctx, when set, trace each call as a child of the span in
+	// ctx, and note the mutating calls that time out in ctx.
+	server *Server
+	ctx    context.Context
+}
+
+// do runs fn, the call named call, until it returns or times out.
+func (c *timeoutGitHubClient) do(call string, fn func() error) (err error) {
+	if c.server != nil {
+		_, span := c.server.startSpan(c.ctx, "github/"+call, trace.WithSpanKind(trace.SpanKindClient))
+		defer func() { endSpan(span, err) }()
+	}
+	timeout, ok := c.timeouts[call]
+	if !ok {
+		timeout = defaultAPITimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Buffered, so that a call given up on does not block forever.
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		mutating := mutatingCalls.Has(call)
+		if mutating && c.ctx != nil {
+			if timedOut, ok := c.ctx.Value(mutationTimeoutsKey{}).(*int32); ok {
+				atomic.StoreInt32(timedOut, 1)
+			}
+		}
+		return &APITimeoutError{Call: call, Timeout: timeout, Mutating: mutating}
+	}
+}
+
+// The results of the calls are only read once they returned, as the
+// goroutine of a call given up on may still set them.
+
+func (c *timeoutGitHubClient) GetPullRequestChanges(org, repo string, number int) ([]github.PullRequestChange, error) {
+	var changes []github.PullRequestChange
+	if err := c.do("GetPullRequestChanges", func() (err error) {
+		changes, err = c.githubClient.GetPullRequestChanges(org, repo, number)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func (c *timeoutGitHubClient) GetPullRequest(org, repo string, number int) (*github.PullRequest, error) {
+	var pr *github.PullRequest
+	if err := c.do("GetPullRequest", func() (err error) {
+		pr, err = c.githubClient.GetPullRequest(org, repo, number)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+func (c *timeoutGitHubClient) FindAllIssues(query, sort string, asc bool) ([]github.Issue, error) {
+	var issues []github.Issue
+	if err := c.do("FindAllIssues", func() (err error) {
+		issues, err = c.githubClient.FindAllIssues(query, sort, asc)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return issues, nil
+}
+
+func (c *timeoutGitHubClient) CreateComment(org, repo string, number int, comment string) error {
+	return c.do("CreateComment", func() error {
+		return c.githubClient.CreateComment(org, repo, number, comment)
+	})
+}
+
+func (c *timeoutGitHubClient) ListIssueComments(org, repo string, number int) ([]github.IssueComment, error) {
+	var comments []github.IssueComment
+	if err := c.do("ListIssueComments", func() (err error) {
+		comments, err = c.githubClient.ListIssueComments(org, repo, number)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (c *timeoutGitHubClient) IsMember(org, user string) (bool, error) {
+	var member bool
+	if err := c.do("IsMember", func() (err error) {
+		member, err = c.githubClient.IsMember(org, user)
+		return err
+	}); err != nil {
+		return false, err
+	}
+	return member, nil
+}
+
+func (c *timeoutGitHubClient) MinimizeComment(org, repo string, id int) error {
+	return c.do("MinimizeComment", func() error {
+		return c.githubClient.MinimizeComment(org, repo, id)
+	})
+}
+
+func (c *timeoutGitHubClient) BotName() (string, error) {
+	var name string
+	if err := c.do("BotName", func() (err error) {
+		name, err = c.githubClient.BotName()
+		return err
+	}); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (c *timeoutGitHubClient) GetRepo(owner, name string) (github.Repo, error) {
+	var repo github.Repo
+	if err := c.do("GetRepo", func() (err error) {
+		repo, err = c.githubClient.GetRepo(owner, name)
+		return err
+	}); err != nil {
+		return github.Repo{}, err
+	}
+	return repo, nil
+}
+
+func (c *timeoutGitHubClient) CreateFork(owner, repo string) error {
+	return c.do("CreateFork", func() error {
+		return c.githubClient.CreateFork(owner, repo)
+	})
+}
+
+func (c *timeoutGitHubClient) CreatePullRequest(org, repo, title, body, head, base string, canModify bool) (int, error) {
+	var number int
+	if err := c.do("CreatePullRequest", func() (err error) {
+		number, err = c.githubClient.CreatePullRequest(org, repo, title, body, head, base, canModify)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return number, nil
+}
+
+func (c *timeoutGitHubClient) CreateIssue(org, repo, title, body string, milestone int, labels, assignees []string) (int, error) {
+	var number int
+	if err := c.do("CreateIssue", func() (err error) {
+		number, err = c.githubClient.CreateIssue(org, repo, title, body, milestone, labels, assignees)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return number, nil
+}
+
+func (c *timeoutGitHubClient) CreateCheckRun(org, repo string, opt github.CheckRunOptions) (int64, error) {
+	var id int64
+	if err := c.do("CreateCheckRun", func() (err error) {
+		id, err = c.githubClient.CreateCheckRun(org, repo, opt)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (c *timeoutGitHubClient) UpdateCheckRun(org, repo string, checkRunID int64, opt github.CheckRunOptions) error {
+	return c.do("UpdateCheckRun", func() error {
+		return c.githubClient.UpdateCheckRun(org, repo, checkRunID, opt)
+	})
+}
+
+func (c *timeoutGitHubClient) CreateDeployment(org, repo string, opt github.DeploymentOptions) (int64, error) {
+	var id int64
+	if err := c.do("CreateDeployment", func() (err error) {
+		id, err = c.githubClient.CreateDeployment(org, repo, opt)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (c *timeoutGitHubClient) CreateDeploymentStatus(org, repo string, deploymentID int64, opt github.DeploymentStatusOptions) error {
+	return c.do("CreateDeploymentStatus", func() error {
+		return c.githubClient.CreateDeploymentStatus(org, repo, deploymentID, opt)
+	})
+}
+
+func (c *timeoutGitHubClient) AddLabel(org, repo string, number int, label string) error {
+	return c.do("AddLabel", func() error {
+		return c.githubClient.AddLabel(org, repo, number, label)
+	})
+}
+
+func (c *timeoutGitHubClient) RemoveLabel(org, repo string, number int, label string) error {
+	return c.do("RemoveLabel", func() error {
+		return c.githubClient.RemoveLabel(org, repo, number, label)
+	})
+}
+
+func (c *timeoutGitHubClient) CreateIssueReaction(org, repo string, number int, reaction string) error {
+	return c.do("CreateIssueReaction", func() error {
+		return c.githubClient.CreateIssueReaction(org, repo, number, reaction)
+	})
+}
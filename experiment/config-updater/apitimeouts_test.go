@@ -0,0 +1,173 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// hangingGitHub hangs in the call named hang until release is closed.
+type hangingGitHub struct {
+	*fakegithub.FakeClient
+	hang    string
+	release chan struct{}
+}
+
+func (h *hangingGitHub) wait(call string) {
+	if call == h.hang {
+		<-h.release
+	}
+}
+
+func (h *hangingGitHub) CreateComment(org, repo string, number int, comment string) error {
+	h.wait("CreateComment")
+	return h.FakeClient.CreateComment(org, repo, number, comment)
+}
+
+func (h *hangingGitHub) GetPullRequestChanges(org, repo string, number int) ([]github.PullRequestChange, error) {
+	h.wait("GetPullRequestChanges")
+	return h.FakeClient.GetPullRequestChanges(org, repo, number)
+}
+
+func TestAPITimeouts(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		timeouts    map[string]time.Duration
+		hang        string
+		expectedErr string
+		// expectedDeadLetter is whether the event is kept to be replayed.
+		expectedDeadLetter bool
+	}{
+		{
+			name:     "fast calls",
+			timeouts: map[string]time.Duration{"CreateComment": 10 * time.Millisecond},
+		},
+		{
+			name:        "hanging call times out",
+			timeouts:    map[string]time.Duration{"CreateComment": 10 * time.Millisecond},
+			hang:        "CreateComment",
+			expectedErr: "GitHub API call CreateComment timed out after 10ms and may still take effect",
+		},
+		{
+			name:               "hanging read is replayed",
+			timeouts:           map[string]time.Duration{"GetPullRequestChanges": 10 * time.Millisecond},
+			hang:               "GetPullRequestChanges",
+			expectedErr:        "error getting pull request changes: GitHub API call GetPullRequestChanges timed out after 10ms",
+			expectedDeadLetter: true,
+		},
+		{
+			name:        "other calls keep the default",
+			timeouts:    map[string]time.Duration{"GetPullRequestChanges": 10 * time.Millisecond, "CreateComment": 20 * time.Millisecond},
+			hang:        "CreateComment",
+			expectedErr: "GitHub API call CreateComment timed out after 20ms and may still take effect",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &hangingGitHub{
+				FakeClient: &fakegithub.FakeClient{
+					IssueComments:      map[int][]github.IssueComment{},
+					PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+				},
+				hang:    tc.hang,
+				release: make(chan struct{}),
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.APITimeouts = tc.timeouts
+			queue := make(ChannelDeadLetterQueue, 1)
+			s.DeadLetters = queue
+
+			err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t))
+			close(ghc.release)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if deadLettered := len(queue) == 1; deadLettered != tc.expectedDeadLetter {
+				t.Errorf("expected the event to be kept to be replayed: %v, got %v", tc.expectedDeadLetter, deadLettered)
+			}
+		})
+	}
+}
+
+func TestParseAPITimeouts(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		pairs       []string
+		expected    map[string]time.Duration
+		expectedErr string
+	}{
+		{
+			name:     "none",
+			expected: map[string]time.Duration{},
+		},
+		{
+			name:     "several calls",
+			pairs:    []string{"CreateComment=1m", "IsMember=5s"},
+			expected: map[string]time.Duration{"CreateComment": time.Minute, "IsMember": 5 * time.Second},
+		},
+		{
+			name:        "not a pair",
+			pairs:       []string{"CreateComment"},
+			expectedErr: `"CreateComment" is not in the form call=duration`,
+		},
+		{
+			name:        "unknown call",
+			pairs:       []string{"DeleteRepo=1m"},
+			expectedErr: `"DeleteRepo" is not a GitHub API call that is made`,
+		},
+		{
+			name:        "invalid duration",
+			pairs:       []string{"CreateComment=soon"},
+			expectedErr: `invalid timeout for CreateComment: time: invalid duration "soon"`,
+		},
+		{
+			name:        "zero",
+			pairs:       []string{"CreateComment=0s"},
+			expectedErr: "timeout for CreateComment must be positive, not 0s",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			timeouts, err := parseAPITimeouts(tc.pairs)
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(timeouts, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, timeouts)
+			}
+		})
+	}
+}
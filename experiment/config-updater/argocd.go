@@ -0,0 +1,301 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultArgoCDSyncTimeout is used when a sync does not set a timeout.
+	defaultArgoCDSyncTimeout = 10 * time.Minute
+	// argoCDPollInterval is how often we check whether a sync is done.
+	argoCDPollInterval = 5 * time.Second
+
+	// argoCDSyncCommand is shown in place of the command of tasks that sync
+	// an ArgoCD application.
+	argoCDSyncCommand = "argocd-sync"
+)
+
+// ArgoCDSync syncs an application managed by ArgoCD, instead of applying
+// the configs of the matcher ourselves.
+type ArgoCDSync struct {
+	// Server is the base URL of the ArgoCD API server.
+	Server string `json:"server"`
+	// TokenFile is the path to a file holding the token to authenticate
+	// with. The token itself must never be in the config, which is served
+	// on /config.
+	TokenFile string `json:"token_file"`
+	// Application is the name of the application to sync.
+	Application string `json:"application"`
+	// Timeout bounds how long the sync may take, until the application is
+	// healthy.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// validate checks that the sync names a server, its token and an
+// application.
+func (a *ArgoCDSync) validate() error {
+	u, err := url.Parse(a.Server)
+	switch {
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		return fmt.Errorf("server %q is not an http or https URL", a.Server)
+	case a.TokenFile == "":
+		return errors.New("sets no token_file")
+	case a.Application == "":
+		return errors.New("sets no application")
+	case a.Timeout < 0:
+		return fmt.Errorf("timeout must not be negative, got %v", a.Timeout)
+	}
+	return nil
+}
+
+// argoCDAuthError is returned when ArgoCD rejects our token.
+type argoCDAuthError struct {
+	sync   ArgoCDSync
+	status string
+}
+
+func (e *argoCDAuthError) Error() string {
+	return fmt.Sprintf("ArgoCD at %s rejected the token in %s (%s): check that it is valid and allowed to sync %s", e.sync.Server, e.sync.TokenFile, e.status, e.sync.Application)
+}
+
+// argoCDNotFoundError is returned when the application does not exist.
+type argoCDNotFoundError struct {
+	sync ArgoCDSync
+}
+
+func (e *argoCDNotFoundError) Error() string {
+	return fmt.Sprintf("ArgoCD at %s has no application named %s: check the application of argocd_sync", e.sync.Server, e.sync.Application)
+}
+
+// argoCDApplication is the part of an ArgoCD application that tells how
+// its sync went.
+type argoCDApplication struct {
+	// Operation is set while a sync is requested but not yet done.
+	Operation *json.RawMessage `json:"operation,omitempty"`
+	Status    struct {
+		Sync struct {
+			Status string `json:"status"`
+		} `json:"sync"`
+		Health struct {
+			Status  string `json:"status"`
+			Message string `json:"message,omitempty"`
+		} `json:"health"`
+		OperationState *struct {
+			Phase      string `json:"phase"`
+			Message    string `json:"message,omitempty"`
+			SyncResult *struct {
+				Resources []argoCDResource `json:"resources"`
+			} `json:"syncResult,omitempty"`
+		} `json:"operationState,omitempty"`
+	} `json:"status"`
+}
+
+// argoCDResource is how syncing a resource of an application went.
+type argoCDResource struct {
+	Group     string `json:"group"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	HookPhase string `json:"hookPhase,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// failed determines whether the resource failed to sync.
+func (r argoCDResource) failed() bool {
+	return r.Status == "SyncFailed" || r.HookPhase == "Failed" || r.HookPhase == "Error"
+}
+
+// done determines whether the sync we requested is over, and if so whether
+// it failed. Health is only final once it stops progressing.
+func (a *argoCDApplication) done() (bool, error) {
+	state := a.Status.OperationState
+	if a.Operation != nil || state == nil {
+		return false, nil
+	}
+	switch state.Phase {
+	case "Failed", "Error":
+		return true, fmt.Errorf("sync %s: %s", strings.ToLower(state.Phase), state.Message)
+	case "Succeeded":
+	default:
+		return false, nil
+	}
+	switch a.Status.Health.Status {
+	case "Healthy", "Suspended":
+		return true, nil
+	case "Degraded", "Missing":
+		return true, fmt.Errorf("application is %s after the sync: %s", strings.ToLower(a.Status.Health.Status), a.Status.Health.Message)
+	}
+	return false, nil
+}
+
+// summary describes the state of the application.
+func (a *argoCDApplication) summary() string {
+	var parts []string
+	if state := a.Status.OperationState; state != nil {
+		parts = append(parts, fmt.Sprintf("Sync %s: %s", state.Phase, state.Message))
+	}
+	parts = append(parts, fmt.Sprintf("Sync status: %s", a.Status.Sync.Status))
+	parts = append(parts, fmt.Sprintf("Health: %s", a.Status.Health.Status))
+	return strings.Join(parts, "\n") + "\n"
+}
+
+// resources lists how syncing each resource went.
+func (a *argoCDApplication) resources() []objectResult {
+	state := a.Status.OperationState
+	if state == nil || state.SyncResult == nil {
+		return nil
+	}
+	var objects []objectResult
+	for _, resource := range state.SyncResult.Resources {
+		kind := resource.Kind
+		if resource.Group != "" {
+			kind = resource.Kind + "." + resource.Group
+		}
+		object := objectResult{kind: kind, namespace: resource.Namespace, name: resource.Name, action: strings.ToLower(resource.Status)}
+		if resource.failed() {
+			message := resource.Message
+			if message == "" {
+				message = resource.Status
+			}
+			object.err = errors.New(message)
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+// argoCDSyncer syncs ArgoCD applications.
+type argoCDSyncer interface {
+	// Sync syncs the application and waits for it to be healthy. It
+	// returns the last state of the application seen, if any, even if the
+	// sync failed.
+	Sync(ctx context.Context, sync ArgoCDSync) (*argoCDApplication, error)
+}
+
+// httpArgoCDSyncer syncs applications through the ArgoCD API.
+type httpArgoCDSyncer struct {
+	pollInterval time.Duration
+}
+
+func (h *httpArgoCDSyncer) Sync(ctx context.Context, sync ArgoCDSync) (*argoCDApplication, error) {
+	b, err := ioutil.ReadFile(sync.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the ArgoCD token: %v", err)
+	}
+	token := strings.TrimSpace(string(b))
+	timeout := sync.Timeout
+	if timeout == 0 {
+		timeout = defaultArgoCDSyncTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	path := "/api/v1/applications/" + url.PathEscape(sync.Application)
+	do := func(method, path string, body string) (*argoCDApplication, error) {
+		req, err := http.NewRequest(method, strings.TrimSuffix(sync.Server, "/")+path, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			return nil, &argoCDAuthError{sync: sync, status: resp.Status}
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, &argoCDNotFoundError{sync: sync}
+		case resp.StatusCode >= 300:
+			message, _ := ioutil.ReadAll(resp.Body)
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+		}
+		var app argoCDApplication
+		if err := json.NewDecoder(resp.Body).Decode(&app); err != nil {
+			return nil, fmt.Errorf("invalid application: %v", err)
+		}
+		return &app, nil
+	}
+
+	if _, err := do(http.MethodPost, path+"/sync", "{}"); err != nil {
+		switch err.(type) {
+		case *argoCDAuthError, *argoCDNotFoundError:
+			return nil, err
+		}
+		return nil, fmt.Errorf("error requesting the sync: %v", err)
+	}
+	var app *argoCDApplication
+	for {
+		current, err := do(http.MethodGet, path, "")
+		switch err.(type) {
+		case nil:
+			app = current
+			if done, err := app.done(); done {
+				return app, err
+			}
+		case *argoCDAuthError, *argoCDNotFoundError:
+			return app, err
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return app, fmt.Errorf("sync did not finish within %v: %v", timeout, err)
+			}
+			return app, fmt.Errorf("sync did not finish within %v", timeout)
+		case <-time.After(h.pollInterval):
+		}
+	}
+}
+
+// argoCD returns the client to sync ArgoCD applications with.
+func (s *Server) argoCD() argoCDSyncer {
+	if s.argoCDSyncer == nil {
+		return &httpArgoCDSyncer{pollInterval: argoCDPollInterval}
+	}
+	return s.argoCDSyncer
+}
+
+// syncArgoCD syncs the application of t and reports its final state.
+func (s *Server) syncArgoCD(ctx context.Context, eventGUID string, t task) result {
+	app, err := s.argoCD().Sync(ctx, *t.argoCD)
+	log := s.log.WithField("eventGUID", eventGUID).WithField("application", t.argoCD.Application)
+	if err != nil {
+		log.WithError(err).Error("Error syncing ArgoCD application.")
+	} else {
+		log.Info("Synced ArgoCD application.")
+	}
+	taskResult := result{command: t.command, exitCode: exitCode(err), err: err}
+	if app != nil {
+		taskResult.stdout = app.summary()
+		taskResult.objects = app.resources()
+	}
+	return taskResult
+}
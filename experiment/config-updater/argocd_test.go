@@ -0,0 +1,249 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+const (
+	runningApp   = `{"operation":{"sync":{}},"status":{"sync":{"status":"OutOfSync"},"health":{"status":"Healthy"},"operationState":{"phase":"Running"}}}`
+	syncedApp    = `{"status":{"sync":{"status":"Synced"},"health":{"status":"Healthy"},"operationState":{"phase":"Succeeded","message":"successfully synced (all tasks run)","syncResult":{"resources":[{"group":"apps","kind":"Deployment","namespace":"web","name":"frontend","status":"Synced"}]}}}}`
+	failedApp    = `{"status":{"sync":{"status":"OutOfSync"},"health":{"status":"Healthy"},"operationState":{"phase":"Failed","message":"one or more objects failed to apply","syncResult":{"resources":[{"kind":"ConfigMap","namespace":"web","name":"settings","status":"SyncFailed","message":"data: Invalid value"}]}}}}`
+	progressApp  = `{"status":{"sync":{"status":"Synced"},"health":{"status":"Progressing"},"operationState":{"phase":"Succeeded","message":"successfully synced (all tasks run)"}}}`
+	degradedApp  = `{"status":{"sync":{"status":"Synced"},"health":{"status":"Degraded","message":"Deployment has minimum availability."},"operationState":{"phase":"Succeeded","message":"successfully synced (all tasks run)"}}}`
+	argoCDSecret = "s3cret"
+)
+
+func TestHTTPArgoCDSyncer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argocd")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte(argoCDSecret+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+
+	var testcases = []struct {
+		name           string
+		token          string
+		application    string
+		states         []string
+		expectedSynced bool
+		expectedHealth string
+		expectedErr    string
+	}{
+		{
+			name:           "synced once healthy",
+			application:    "web",
+			states:         []string{runningApp, progressApp, syncedApp},
+			expectedSynced: true,
+			expectedHealth: "Healthy",
+		},
+		{
+			name:           "sync failed",
+			application:    "web",
+			states:         []string{failedApp},
+			expectedSynced: true,
+			expectedHealth: "Healthy",
+			expectedErr:    "sync failed: one or more objects failed to apply",
+		},
+		{
+			name:           "degraded after the sync",
+			application:    "web",
+			states:         []string{degradedApp},
+			expectedSynced: true,
+			expectedHealth: "Degraded",
+			expectedErr:    "application is degraded after the sync: Deployment has minimum availability.",
+		},
+		{
+			name:           "never healthy",
+			application:    "web",
+			states:         []string{progressApp},
+			expectedSynced: true,
+			expectedHealth: "Progressing",
+			expectedErr:    "sync did not finish within 50ms",
+		},
+		{
+			name:        "token rejected",
+			token:       "wrong",
+			application: "web",
+			expectedErr: "rejected the token in " + tokenFile + " (401 Unauthorized)",
+		},
+		{
+			name:        "application not found",
+			application: "api",
+			expectedErr: "has no application named api",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			synced := false
+			polls := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer "+argoCDSecret {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				switch r.URL.Path {
+				case "/api/v1/applications/web/sync":
+					if r.Method != http.MethodPost {
+						w.WriteHeader(http.StatusMethodNotAllowed)
+						return
+					}
+					synced = true
+					w.Write([]byte(runningApp))
+				case "/api/v1/applications/web":
+					state := tc.states[len(tc.states)-1]
+					if polls < len(tc.states) {
+						state = tc.states[polls]
+					}
+					polls++
+					w.Write([]byte(state))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer ts.Close()
+			file := tokenFile
+			if tc.token != "" {
+				file = filepath.Join(dir, "wrong")
+				if err := ioutil.WriteFile(file, []byte(tc.token), 0600); err != nil {
+					t.Fatalf("failed to write token: %v", err)
+				}
+				tc.expectedErr = strings.Replace(tc.expectedErr, tokenFile, file, 1)
+			}
+
+			syncer := &httpArgoCDSyncer{pollInterval: time.Millisecond}
+			app, err := syncer.Sync(context.Background(), ArgoCDSync{Server: ts.URL + "/", TokenFile: file, Application: tc.application, Timeout: 50 * time.Millisecond})
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if synced != tc.expectedSynced {
+				t.Errorf("expected a sync to be requested: %v, got %v", tc.expectedSynced, synced)
+			}
+			var health string
+			if app != nil {
+				health = app.Status.Health.Status
+			}
+			if health != tc.expectedHealth {
+				t.Errorf("expected health %q, got %q", tc.expectedHealth, health)
+			}
+		})
+	}
+}
+
+// fakeArgoCDSyncer returns app and err for every sync, recording the
+// applications synced.
+type fakeArgoCDSyncer struct {
+	app    string
+	err    error
+	synced []string
+}
+
+func (f *fakeArgoCDSyncer) Sync(ctx context.Context, sync ArgoCDSync) (*argoCDApplication, error) {
+	f.synced = append(f.synced, sync.Application)
+	if f.app == "" {
+		return nil, f.err
+	}
+	var app argoCDApplication
+	if err := json.Unmarshal([]byte(f.app), &app); err != nil {
+		return nil, err
+	}
+	return &app, f.err
+}
+
+func TestHandleEventArgoCDSync(t *testing.T) {
+	var testcases = []struct {
+		name             string
+		app              string
+		err              error
+		expectedComments []string
+	}{
+		{
+			name:             "synced",
+			app:              syncedApp,
+			expectedComments: []string{"<li><code>Deployment.apps web/frontend</code> synced</li>", "Health: Healthy"},
+		},
+		{
+			name: "resource failed to sync",
+			app:  failedApp,
+			err:  errors.New("sync failed: one or more objects failed to apply"),
+			expectedComments: []string{
+				"<code>argocd-sync web</code> failed: sync failed: one or more objects failed to apply",
+				"<li><code>ConfigMap web/settings</code> failed: data: Invalid value</li>",
+			},
+		},
+		{
+			name:             "application not found",
+			err:              &argoCDNotFoundError{sync: ArgoCDSync{Server: "https://argocd.example.com", Application: "web"}},
+			expectedComments: []string{"<code>argocd-sync web</code> failed: ArgoCD at https://argocd.example.com has no application named web"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "apps/web/values.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "apps/web/*", ArgoCDSync: &ArgoCDSync{Server: "https://argocd.example.com", TokenFile: "/etc/argocd/token", Application: "web"}}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+			syncer := &fakeArgoCDSyncer{app: tc.app, err: tc.err}
+			s.argoCDSyncer = syncer
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected := []string{"web"}; !reflect.DeepEqual(syncer.synced, expected) {
+				t.Errorf("expected to sync %q, got %q", expected, syncer.synced)
+			}
+			if len(executor.ran) != 0 {
+				t.Errorf("expected nothing to run locally, got %q", executor.ran)
+			}
+			checkComment(t, ghc, tc.expectedComments[0])
+			for _, expected := range tc.expectedComments[1:] {
+				if !strings.Contains(ghc.IssueCommentsAdded[0], expected) {
+					t.Errorf("expected comment to contain %q, got %q", expected, ghc.IssueCommentsAdded[0])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// batchKey groups the tasks for configs in Targets that can be applied by
+// the same make run, or is empty if the task must run on its own. Tasks
+// with a rollback are never batched, as it undoes a single config, and
+// neither are those whose config is not passed in WHAT.
+func batchKey(t task) string {
+	if t.config == "" || t.rollback != nil || len(t.command) != 3 || !strings.HasPrefix(t.command[2], "WHAT=") {
+		return ""
+	}
+	key := t.image + "\x00\x00" + t.workdir + "\x00\x00" + strings.Join(t.command[:2], "\x00") + "\x00\x00" + strings.Join(t.env, "\x00")
+	if t.verify != nil {
+		key += "\x00\x00" + fmt.Sprintf("%+v", *t.verify)
+	}
+	return key
+}
+
+// batchTasks merges tasks for configs in Targets that share a make target
+// into runs of up to size configs, passed in WHAT separated by spaces. Each
+// batch takes the place of the first task in it.
+func batchTasks(tasks []task, size int) []task {
+	if size < 2 {
+		return tasks
+	}
+	groups := map[string][]task{}
+	for _, t := range tasks {
+		if key := batchKey(t); key != "" {
+			groups[key] = append(groups[key], t)
+		}
+	}
+
+	var batched []task
+	for _, t := range tasks {
+		key := batchKey(t)
+		if key == "" {
+			batched = append(batched, t)
+			continue
+		}
+		group, ok := groups[key]
+		if !ok {
+			// The group was already added at its first task.
+			continue
+		}
+		if len(group) < 2 {
+			batched = append(batched, t)
+			continue
+		}
+		delete(groups, key)
+		count := (len(group) + size - 1) / size
+		for i := 0; i < count; i++ {
+			end := (i + 1) * size
+			if end > len(group) {
+				end = len(group)
+			}
+			batched = append(batched, mergeBatch(group[i*size:end], fmt.Sprintf("batch %d of %d", i+1, count)))
+		}
+	}
+	return batched
+}
+
+// mergeBatch combines tasks that only differ in their config into one.
+func mergeBatch(tasks []task, name string) task {
+	var configs []string
+	for _, t := range tasks {
+		configs = append(configs, t.config)
+	}
+	merged := tasks[0]
+	what := []string{fmt.Sprintf("WHAT=%s", strings.Join(configs, " "))}
+	merged.command = append(append([]string{}, merged.command[:2]...), what...)
+	merged.config = ""
+	merged.files = configs
+	merged.batch = name
+	if merged.verify != nil {
+		merged.verifyCommand = merged.verify.command(merged.command[0], what)
+	}
+	return merged
+}
+
+// batchWhat passes files to the target of a matcher in a single WHAT,
+// joined by its separator. If the name of a file has whitespace, shell
+// metacharacters or the separator in it, the files cannot be told apart,
+// so WHAT is not passed and that file is returned instead.
+func (m *Matcher) batchWhat(files []string) (what []string, unsafe string) {
+	separator := m.BatchSeparator
+	if separator == "" {
+		separator = " "
+	}
+	for _, file := range files {
+		if unsafeFilename(file) || strings.Contains(file, separator) {
+			return nil, file
+		}
+	}
+	return []string{fmt.Sprintf("WHAT=%s", strings.Join(files, separator))}, ""
+}
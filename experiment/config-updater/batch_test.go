@@ -0,0 +1,236 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func targetTask(target, config string) task {
+	return task{command: []string{"/usr/bin/make", target, "WHAT=" + config}, target: target, config: config, files: []string{config}}
+}
+
+func TestBatchTasks(t *testing.T) {
+	verify := &Verification{Target: "verify"}
+	verified := targetTask("apply", "d.yaml")
+	verified.verify = verify
+	verified.verifyCommand = verify.command("/usr/bin/make", []string{"WHAT=d.yaml"})
+	verifiedToo := targetTask("apply", "e.yaml")
+	verifiedToo.verify = verify
+	verifiedToo.verifyCommand = verify.command("/usr/bin/make", []string{"WHAT=e.yaml"})
+	rolledBack := targetTask("apply", "f.yaml")
+	rolledBack.rollback = &Rollback{Command: []string{"/usr/bin/make", "undo"}}
+	unsafe := task{command: []string{"/usr/bin/make", "apply"}, target: "apply", config: "my g.yaml", files: []string{"my g.yaml"}, env: []string{"CONFIG_UPDATER_WHAT=my g.yaml"}}
+	matched := task{command: []string{"/usr/bin/make", "jobs"}, target: "jobs", files: []string{"jobs/a.yaml"}}
+
+	var testcases = []struct {
+		name     string
+		tasks    []task
+		size     int
+		expected []task
+	}{
+		{
+			name:     "batching is off by default",
+			tasks:    []task{targetTask("apply", "a.yaml"), targetTask("apply", "b.yaml")},
+			expected: []task{targetTask("apply", "a.yaml"), targetTask("apply", "b.yaml")},
+		},
+		{
+			name:  "one batch",
+			tasks: []task{targetTask("apply", "a.yaml"), targetTask("apply", "b.yaml"), targetTask("apply", "c.yaml")},
+			size:  5,
+			expected: []task{
+				{command: []string{"/usr/bin/make", "apply", "WHAT=a.yaml b.yaml c.yaml"}, target: "apply", files: []string{"a.yaml", "b.yaml", "c.yaml"}, batch: "batch 1 of 1"},
+			},
+		},
+		{
+			name:  "split into batches",
+			tasks: []task{targetTask("apply", "a.yaml"), targetTask("apply", "b.yaml"), targetTask("apply", "c.yaml"), targetTask("apply", "d.yaml"), targetTask("apply", "e.yaml")},
+			size:  2,
+			expected: []task{
+				{command: []string{"/usr/bin/make", "apply", "WHAT=a.yaml b.yaml"}, target: "apply", files: []string{"a.yaml", "b.yaml"}, batch: "batch 1 of 3"},
+				{command: []string{"/usr/bin/make", "apply", "WHAT=c.yaml d.yaml"}, target: "apply", files: []string{"c.yaml", "d.yaml"}, batch: "batch 2 of 3"},
+				{command: []string{"/usr/bin/make", "apply", "WHAT=e.yaml"}, target: "apply", files: []string{"e.yaml"}, batch: "batch 3 of 3"},
+			},
+		},
+		{
+			name:  "make targets are batched separately",
+			tasks: []task{targetTask("apply", "a.yaml"), targetTask("applyTemplate", "t1.yaml"), targetTask("apply", "b.yaml"), targetTask("applyTemplate", "t2.yaml")},
+			size:  5,
+			expected: []task{
+				{command: []string{"/usr/bin/make", "apply", "WHAT=a.yaml b.yaml"}, target: "apply", files: []string{"a.yaml", "b.yaml"}, batch: "batch 1 of 1"},
+				{command: []string{"/usr/bin/make", "applyTemplate", "WHAT=t1.yaml t2.yaml"}, target: "applyTemplate", files: []string{"t1.yaml", "t2.yaml"}, batch: "batch 1 of 1"},
+			},
+		},
+		{
+			name:  "a single config for a make target is not a batch",
+			tasks: []task{targetTask("apply", "a.yaml"), targetTask("applyTemplate", "t1.yaml"), targetTask("apply", "b.yaml")},
+			size:  5,
+			expected: []task{
+				{command: []string{"/usr/bin/make", "apply", "WHAT=a.yaml b.yaml"}, target: "apply", files: []string{"a.yaml", "b.yaml"}, batch: "batch 1 of 1"},
+				targetTask("applyTemplate", "t1.yaml"),
+			},
+		},
+		{
+			name:  "verified configs are batched separately and verified together",
+			tasks: []task{targetTask("apply", "a.yaml"), verified, targetTask("apply", "b.yaml"), verifiedToo},
+			size:  5,
+			expected: []task{
+				{command: []string{"/usr/bin/make", "apply", "WHAT=a.yaml b.yaml"}, target: "apply", files: []string{"a.yaml", "b.yaml"}, batch: "batch 1 of 1"},
+				{command: []string{"/usr/bin/make", "apply", "WHAT=d.yaml e.yaml"}, target: "apply", files: []string{"d.yaml", "e.yaml"}, batch: "batch 1 of 1", verify: verify, verifyCommand: []string{"/usr/bin/make", "verify", "WHAT=d.yaml e.yaml"}},
+			},
+		},
+		{
+			name:  "rollbacks, unsafe names and matchers are not batched",
+			tasks: []task{rolledBack, targetTask("apply", "a.yaml"), unsafe, targetTask("apply", "b.yaml"), matched},
+			size:  5,
+			expected: []task{
+				rolledBack,
+				{command: []string{"/usr/bin/make", "apply", "WHAT=a.yaml b.yaml"}, target: "apply", files: []string{"a.yaml", "b.yaml"}, batch: "batch 1 of 1"},
+				unsafe,
+				matched,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := batchTasks(tc.tasks, tc.size); !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected tasks\n%+v\ngot\n%+v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandleEventBatches(t *testing.T) {
+	files := map[string]string{}
+	var changes []github.PullRequestChange
+	var targets []string
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("jobs/%d.yaml", i)
+		kind := "Service"
+		if i == 3 {
+			kind = "Template"
+		}
+		files[name] = "kind: " + kind + "\n"
+		changes = append(changes, github.PullRequestChange{Filename: name})
+		targets = append(targets, name)
+	}
+	dir := makeRepoDir(t, files)
+	defer os.RemoveAll(dir)
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+	}
+	s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+		Targets:    targets,
+		BatchSize:  2,
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{failures: map[string]bool{"/usr/bin/make apply WHAT=jobs/4.yaml jobs/5.yaml": true}}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := [][]string{
+		{"/usr/bin/make", "apply", "WHAT=jobs/1.yaml jobs/2.yaml"},
+		{"/usr/bin/make", "apply", "WHAT=jobs/4.yaml jobs/5.yaml"},
+		{"/usr/bin/make", "applyTemplate", "WHAT=jobs/3.yaml"},
+	}
+	if !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected to run %q, got %q", expected, executor.ran)
+	}
+	checkComment(t, ghc, `The following updates failed:
+<ul><li><details><summary><code>/usr/bin/make apply WHAT=jobs/4.yaml jobs/5.yaml</code> exited with code 2</summary>
+Applied batch 2 of 2: <code>jobs/4.yaml</code>, <code>jobs/5.yaml</code>
+`)
+}
+
+func TestHandleEventBatchTargets(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		matcher         Matcher
+		changes         []string
+		expectedRan     [][]string
+		expectedWarning string
+	}{
+		{
+			name:        "not batched",
+			matcher:     Matcher{Glob: "jobs/*.yaml", Target: "apply"},
+			changes:     []string{"jobs/a.yaml", "jobs/b.yaml"},
+			expectedRan: [][]string{{"/usr/bin/make", "apply"}},
+		},
+		{
+			name:        "joined by spaces",
+			matcher:     Matcher{Glob: "jobs/*.yaml", Target: "apply", BatchTargets: true},
+			changes:     []string{"jobs/a.yaml", "jobs/b.yaml", "jobs/c.yaml"},
+			expectedRan: [][]string{{"/usr/bin/make", "apply", "WHAT=jobs/a.yaml jobs/b.yaml jobs/c.yaml"}},
+		},
+		{
+			name:        "joined by commas",
+			matcher:     Matcher{Glob: "jobs/*.yaml", Target: "apply", BatchTargets: true, BatchSeparator: ","},
+			changes:     []string{"jobs/a.yaml", "jobs/b.yaml"},
+			expectedRan: [][]string{{"/usr/bin/make", "apply", "WHAT=jobs/a.yaml,jobs/b.yaml"}},
+		},
+		{
+			name:            "separator in a name",
+			matcher:         Matcher{Glob: "jobs/*.yaml", Target: "apply", BatchTargets: true, BatchSeparator: ","},
+			changes:         []string{"jobs/a.yaml", "jobs/b,c.yaml"},
+			expectedRan:     [][]string{{"/usr/bin/make", "apply"}},
+			expectedWarning: `&#34;jobs/b,c.yaml&#34; cannot be told apart from the other files in WHAT, so the files of target apply were only passed to make in CHANGED_FILES.`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var changes []github.PullRequestChange
+			for _, change := range tc.changes {
+				changes = append(changes, github.PullRequestChange{Filename: change})
+			}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{tc.matcher},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedRan) {
+				t.Errorf("expected to run %q, got %q", tc.expectedRan, executor.ran)
+			}
+			if warned := len(ghc.IssueCommentsAdded) == 1 && strings.Contains(ghc.IssueCommentsAdded[0], "The following warnings were raised"); warned != (tc.expectedWarning != "") {
+				t.Errorf("expected a warning: %v, got %v", tc.expectedWarning != "", ghc.IssueCommentsAdded)
+			} else if warned && !strings.Contains(ghc.IssueCommentsAdded[0], tc.expectedWarning) {
+				t.Errorf("expected warning %q, got %q", tc.expectedWarning, ghc.IssueCommentsAdded[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// defaultCatchUpInterval is how long to wait between the PRs handled while
+// catching up, which stays well clear of the secondary rate limits.
+const defaultCatchUpInterval = 2 * time.Second
+
+// catchUp handles the PRs merged in the repos of orgs between since and
+// until, whose webhooks may have been missed while the server was down. It
+// waits for interval between requests to GitHub and between PRs, so as not
+// to hit the secondary rate limits.
+func (s *Server) catchUp(ctx context.Context, orgs []string, since, until time.Time, interval time.Duration) error {
+	log := s.log.WithFields(logrus.Fields{"since": since, "until": until})
+	var failed int
+	for i, org := range orgs {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		query := fmt.Sprintf("org:%s is:pr is:merged merged:%s..%s", org, since.UTC().Format(time.RFC3339), until.UTC().Format(time.RFC3339))
+		issues, err := s.github(ctx).FindAllIssues(query, "updated", true)
+		if err != nil {
+			return fmt.Errorf("error searching for PRs merged in %s: %v", org, err)
+		}
+		log.WithFields(logrus.Fields{"org": org, "prs": len(issues)}).Info("Catching up on merged PRs.")
+		for _, issue := range issues {
+			time.Sleep(interval)
+			if err := s.catchUpOn(ctx, issue); err != nil {
+				log.WithError(err).WithField("url", issue.HTMLURL).Error("Error catching up on PR.")
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to catch up on %d PRs", failed)
+	}
+	return nil
+}
+
+// catchUpOn handles a PR found by catchUp as if its webhook was received.
+func (s *Server) catchUpOn(ctx context.Context, issue github.Issue) error {
+	org, repo, err := repoFromURL(issue.RepositoryURL)
+	if err != nil {
+		return err
+	}
+	pr, err := s.github(ctx).GetPullRequest(org, repo, issue.Number)
+	if err != nil {
+		return fmt.Errorf("error getting %s/%s#%d: %v", org, repo, issue.Number, err)
+	}
+	payload, err := json.Marshal(github.PullRequestEvent{
+		Action:      github.PullRequestActionClosed,
+		Number:      pr.Number,
+		PullRequest: *pr,
+		Repo:        pr.Base.Repo,
+	})
+	if err != nil {
+		return err
+	}
+	eventGUID := fmt.Sprintf("catch-up-%s-%s-%d", org, repo, pr.Number)
+	s.log.WithFields(logrus.Fields{"org": org, "repo": repo, "pr": pr.Number, "eventGUID": eventGUID}).Info("Recovered missed event.")
+	return s.handleEvent(ctx, "pull_request", eventGUID, payload)
+}
+
+// repoFromURL splits the API URL of a repo into its org and name.
+func repoFromURL(repoURL string) (string, string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid repository URL %q: %v", repoURL, err)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 3 || parts[len(parts)-3] != "repos" {
+		return "", "", fmt.Errorf("invalid repository URL %q", repoURL)
+	}
+	return parts[len(parts)-2], parts[len(parts)-1], nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// searchingGitHub records the queries searched for.
+type searchingGitHub struct {
+	*fakegithub.FakeClient
+	queries []string
+}
+
+func (s *searchingGitHub) FindAllIssues(query, sort string, asc bool) ([]github.Issue, error) {
+	s.queries = append(s.queries, query)
+	return s.FakeClient.FindAllIssues(query, sort, asc)
+}
+
+func TestCatchUp(t *testing.T) {
+	mergeSHA := "abcdef"
+	mergedPR := func(number int) *github.PullRequest {
+		return &github.PullRequest{
+			Number:   number,
+			Merged:   true,
+			MergeSHA: &mergeSHA,
+			Head:     github.PullRequestBranch{SHA: "123456"},
+			Base: github.PullRequestBranch{
+				Ref:  "master",
+				Repo: github.Repo{Owner: github.User{Login: "org"}, Name: "repo"},
+			},
+		}
+	}
+	ghc := &searchingGitHub{FakeClient: &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		Issues: []github.Issue{
+			{Number: 1, RepositoryURL: "https://api.github.com/repos/org/repo"},
+			{Number: 2, RepositoryURL: "https://api.github.com/repos/org/repo"},
+			{Number: 3, RepositoryURL: "https://api.github.com/repos/org/repo"},
+		},
+		PullRequests: map[int]*github.PullRequest{1: mergedPR(1), 2: mergedPR(2)},
+		PullRequestChanges: map[int][]github.PullRequestChange{
+			1: {{Filename: "jobs/a.yaml"}},
+			2: {{Filename: "jobs/b.yaml"}},
+		},
+	}}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	since := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	err := s.catchUp(context.Background(), []string{"org"}, since, since.Add(time.Hour), 0)
+	if err == nil || err.Error() != "failed to catch up on 1 PRs" {
+		t.Errorf("expected the missing PR to fail, got %v", err)
+	}
+	expectedQueries := []string{"org:org is:pr is:merged merged:2019-05-01T12:00:00Z..2019-05-01T13:00:00Z"}
+	if !reflect.DeepEqual(ghc.queries, expectedQueries) {
+		t.Errorf("expected queries %q, got %q", expectedQueries, ghc.queries)
+	}
+	if expected := [][]string{{"/usr/bin/make", "jobs"}, {"/usr/bin/make", "jobs"}}; !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected to run %q, got %q", expected, executor.ran)
+	}
+	if len(ghc.IssueCommentsAdded) != 2 {
+		t.Errorf("expected a comment on each PR caught up on, got %v", ghc.IssueCommentsAdded)
+	}
+}
+
+func TestRepoFromURL(t *testing.T) {
+	var testcases = []struct {
+		name         string
+		url          string
+		expectedOrg  string
+		expectedRepo string
+		expectedErr  bool
+	}{
+		{name: "github.com", url: "https://api.github.com/repos/org/repo", expectedOrg: "org", expectedRepo: "repo"},
+		{name: "enterprise", url: "https://github.example.com/api/v3/repos/org/repo", expectedOrg: "org", expectedRepo: "repo"},
+		{name: "not a repo", url: "https://api.github.com/users/org", expectedErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			org, repo, err := repoFromURL(tc.url)
+			if tc.expectedErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s/%s", org, repo)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if org != tc.expectedOrg || repo != tc.expectedRepo {
+				t.Errorf("expected %s/%s, got %s/%s", tc.expectedOrg, tc.expectedRepo, org, repo)
+			}
+		})
+	}
+}
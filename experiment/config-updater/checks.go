@@ -0,0 +1,68 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// checkRunName is the name of the check runs we create on merge commits.
+const checkRunName = pluginName
+
+// startCheckRun creates an in progress check run on the merge commit of pr
+// and returns its ID. Failing to create it does not stop the updates, so
+// the error is only logged and zero is returned.
+func (s *Server) startCheckRun(ctx context.Context, pr github.PullRequest) int64 {
+	now := time.Now()
+	id, err := s.github(ctx).CreateCheckRun(pr.Base.Repo.Owner.Login, pr.Base.Repo.Name, github.CheckRunOptions{
+		Name:      checkRunName,
+		HeadSHA:   *pr.MergeSHA,
+		Status:    github.CheckRunInProgress,
+		StartedAt: &now,
+	})
+	if err != nil {
+		s.log.WithError(err).Warn("Error creating check run.")
+		return 0
+	}
+	return id
+}
+
+// finishCheckRun completes the check run with the results, which fail it if
+// any update or rollback failed or an internal error occurred.
+func (s *Server) finishCheckRun(ctx context.Context, pr github.PullRequest, id int64, results results) {
+	conclusion := github.CheckRunSuccess
+	if !results.IsSuccess() || results.failedRollback() {
+		conclusion = github.CheckRunFailure
+	}
+	summary := results.Summary()
+	now := time.Now()
+	if err := s.github(ctx).UpdateCheckRun(pr.Base.Repo.Owner.Login, pr.Base.Repo.Name, id, github.CheckRunOptions{
+		Status:      github.CheckRunCompleted,
+		Conclusion:  conclusion,
+		CompletedAt: &now,
+		Output: &github.CheckRunOutput{
+			Title:   summary,
+			Summary: summary,
+			Text:    results.formatResults(),
+		},
+	}); err != nil {
+		s.log.WithError(err).Warn("Error completing check run.")
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestHandleEventCheckRun(t *testing.T) {
+	var testcases = []struct {
+		name               string
+		useChecksAPI       bool
+		changes            []github.PullRequestChange
+		failures           map[string]bool
+		expectedConclusion string
+		expectedText       string
+	}{
+		{
+			name:    "disabled",
+			changes: []github.PullRequestChange{{Filename: "jobs/a.yaml"}},
+		},
+		{
+			name:         "nothing to update",
+			useChecksAPI: true,
+			changes:      []github.PullRequestChange{{Filename: "README.md"}},
+		},
+		{
+			name:               "updates succeeded",
+			useChecksAPI:       true,
+			changes:            []github.PullRequestChange{{Filename: "jobs/a.yaml"}},
+			expectedConclusion: github.CheckRunSuccess,
+			expectedText:       "The following updates succeeded:",
+		},
+		{
+			name:               "update failed",
+			useChecksAPI:       true,
+			changes:            []github.PullRequestChange{{Filename: "jobs/a.yaml"}},
+			failures:           map[string]bool{"/usr/bin/make jobs": true},
+			expectedConclusion: github.CheckRunFailure,
+			expectedText:       "The following updates failed:",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: tc.changes},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.executor = &recordingExecutor{failures: tc.failures}
+			s.UseChecksAPI = tc.useChecksAPI
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.expectedConclusion == "" {
+				if len(ghc.CheckRuns) != 0 {
+					t.Errorf("expected no check runs, got %v", ghc.CheckRuns)
+				}
+				return
+			}
+			if len(ghc.CheckRuns) != 1 {
+				t.Fatalf("expected one check run, got %v", ghc.CheckRuns)
+			}
+			checkRun := ghc.CheckRuns[1]
+			if checkRun.Name != checkRunName || checkRun.HeadSHA != "abcdef" {
+				t.Errorf("expected check run %q on abcdef, got %q on %q", checkRunName, checkRun.Name, checkRun.HeadSHA)
+			}
+			if checkRun.Status != github.CheckRunCompleted || checkRun.Conclusion != tc.expectedConclusion {
+				t.Errorf("expected check run to be completed with %q, got %q with %q", tc.expectedConclusion, checkRun.Status, checkRun.Conclusion)
+			}
+			if checkRun.StartedAt == nil || checkRun.CompletedAt == nil {
+				t.Errorf("expected start and completion times, got %v and %v", checkRun.StartedAt, checkRun.CompletedAt)
+			}
+			if checkRun.Output == nil || !strings.Contains(checkRun.Output.Text, tc.expectedText) {
+				t.Errorf("expected output text containing %q, got %+v", tc.expectedText, checkRun.Output)
+			}
+			if len(ghc.IssueCommentsAdded) != 1 {
+				t.Errorf("expected results to be commented too, got %v", ghc.IssueCommentsAdded)
+			}
+		})
+	}
+}
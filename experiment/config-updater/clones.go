@@ -0,0 +1,60 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// defaultCloneWaitTimeout is how long an event waits for another clone to
+// finish before trying again.
+const defaultCloneWaitTimeout = time.Minute
+
+// acquireClone waits until fewer than MaxConcurrentClones PRs are cloned.
+// Waiting is retried like a failed clone, so an event is only given up on
+// once the git retry deadline passes. The returned func must be called once
+// the clone is cleaned up.
+func (s *Server) acquireClone(ctx context.Context) (release func(), err error) {
+	if s.MaxConcurrentClones <= 0 {
+		return func() {}, nil
+	}
+	s.initClones.Do(func() {
+		if s.clones == nil {
+			s.clones = make(chan struct{}, s.MaxConcurrentClones)
+		}
+	})
+	start := time.Now()
+	if err := s.retry(ctx, "wait for clone", func() error {
+		select {
+		case s.clones <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.CloneWaitTimeout):
+			s.log.WithField("limit", s.MaxConcurrentClones).Warn("Timed out waiting for other clones to finish.")
+			return fmt.Errorf("%d clones still running after %v", s.MaxConcurrentClones, s.CloneWaitTimeout)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if waited := time.Since(start); waited > time.Second {
+		s.log.WithField("duration", waited).Info("Waited for other clones to finish.")
+	}
+	return func() { <-s.clones }, nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestAcquireClone(t *testing.T) {
+	s := newTestServer(&fakeGit{}, &fakegithub.FakeClient{}, &UpdateConfig{})
+	s.MaxConcurrentClones = 2
+	s.CloneWaitTimeout = 10 * time.Millisecond
+	s.gitRetryDeadline = 50 * time.Millisecond
+
+	first, err := s.acquireClone(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.acquireClone(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.acquireClone(context.Background()); err == nil {
+		t.Fatal("expected waiting for a third clone to time out")
+	}
+
+	// A clone finishing while another event waits lets it go ahead.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		first()
+	}()
+	if _, err := s.acquireClone(context.Background()); err != nil {
+		t.Errorf("expected to clone once another clone finished, got %v", err)
+	}
+}
+
+func TestAcquireCloneUnlimited(t *testing.T) {
+	s := newTestServer(&fakeGit{}, &fakegithub.FakeClient{}, &UpdateConfig{})
+	for i := 0; i < 10; i++ {
+		if _, err := s.acquireClone(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestHandleEventWaitsForClones(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+	}
+	gc := &fakeGit{}
+	s := newTestServer(gc, ghc, &UpdateConfig{
+		Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	s.MaxConcurrentClones = 1
+	s.CloneWaitTimeout = 10 * time.Millisecond
+	s.gitRetryDeadline = 20 * time.Millisecond
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	release, err := s.acquireClone(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err == nil {
+		t.Error("expected an error while another clone is running")
+	}
+	if gc.clones != 0 {
+		t.Errorf("expected no clone while another is running, got %d", gc.clones)
+	}
+	checkComment(t, ghc, "error waiting for other clones to finish")
+
+	release()
+	ghc.IssueCommentsAdded = nil
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(executor.ran) != 1 {
+		t.Errorf("expected the update to run once the other clone finished, got %q", executor.ran)
+	}
+	// The clone is released once handled, so the next event can clone.
+	if _, err := s.acquireClone(context.Background()); err != nil {
+		t.Errorf("expected the clone to be released, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Cluster is a cluster that updates can be applied to. Tasks for it are run
+// with $KUBECONFIG and $CONTEXT set to its Kubeconfig and Context, for
+// those that are set.
+type Cluster struct {
+	Name string `json:"name"`
+	// Kubeconfig is the path to the kubeconfig for the cluster.
+	Kubeconfig string `json:"kubeconfig,omitempty" yaml:"kubeconfig,omitempty"`
+	// Context is the context of the cluster in the kubeconfig.
+	Context string `json:"context,omitempty" yaml:"context,omitempty"`
+}
+
+// env is the environment of tasks applied to the cluster.
+func (c Cluster) env() []string {
+	var env []string
+	if c.Kubeconfig != "" {
+		env = append(env, "KUBECONFIG="+c.Kubeconfig)
+	}
+	if c.Context != "" {
+		env = append(env, "CONTEXT="+c.Context)
+	}
+	return env
+}
+
+// validateClusters checks that clusters have unique names and say how to
+// reach them, and that selected only names those clusters.
+func validateClusters(clusters []Cluster, selected map[string][]string) error {
+	names := sets.NewString()
+	for i, cluster := range clusters {
+		switch {
+		case cluster.Name == "":
+			return fmt.Errorf("cluster %d has no name", i)
+		case names.Has(cluster.Name):
+			return fmt.Errorf("cluster %d reuses the name %q", i, cluster.Name)
+		case cluster.Kubeconfig == "" && cluster.Context == "":
+			return fmt.Errorf("cluster %q sets neither kubeconfig nor context", cluster.Name)
+		}
+		names.Insert(cluster.Name)
+	}
+	var selectors []string
+	for selector := range selected {
+		selectors = append(selectors, selector)
+	}
+	sort.Strings(selectors)
+	for _, selector := range selectors {
+		for _, name := range selected[selector] {
+			if !names.Has(name) {
+				return fmt.Errorf("%s applies to unknown cluster %q", selector, name)
+			}
+		}
+	}
+	return nil
+}
+
+// fanOutClusters replaces every task that is applied to clusters with a task
+// for each of them, in the same place. Tasks applied natively go to the
+// cluster of --native-apply instead, so they are left as they are.
+func fanOutClusters(tasks []task, clusters []Cluster) []task {
+	byName := map[string]Cluster{}
+	for _, cluster := range clusters {
+		byName[cluster.Name] = cluster
+	}
+	var fanned []task
+	for _, t := range tasks {
+		if len(t.clusters) == 0 || t.native {
+			fanned = append(fanned, t)
+			continue
+		}
+		for _, name := range t.clusters {
+			clustered := t
+			clustered.cluster = name
+			clustered.env = append(append([]string{}, t.env...), byName[name].env()...)
+			fanned = append(fanned, clustered)
+		}
+	}
+	return fanned
+}
+
+// clusterOutcome lists the clusters that tasks were applied to, in the order
+// they are configured in, and those of them that any task failed on.
+func (r *results) clusterOutcome() (applied, failed []string) {
+	touched, broken := sets.NewString(), sets.NewString()
+	for _, taskResult := range r.succeeded {
+		touched.Insert(taskResult.cluster)
+	}
+	for _, taskResult := range r.failed {
+		touched.Insert(taskResult.cluster)
+		broken.Insert(taskResult.cluster)
+	}
+	for _, name := range r.clusters {
+		if broken.Has(name) {
+			failed = append(failed, name)
+		}
+		if touched.Has(name) {
+			applied = append(applied, name)
+		}
+	}
+	return applied, failed
+}
+
+// byCluster groups results by the cluster they were applied to, in the order
+// the clusters are configured in, after the results for no cluster.
+func (r *results) byCluster(taskResults []result) []result {
+	index := map[string]int{}
+	for i, name := range r.clusters {
+		index[name] = i + 1
+	}
+	grouped := append([]result{}, taskResults...)
+	sort.SliceStable(grouped, func(i, j int) bool {
+		return index[grouped[i].cluster] < index[grouped[j].cluster]
+	})
+	return grouped
+}
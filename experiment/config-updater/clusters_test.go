@@ -0,0 +1,190 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+var testClusters = []Cluster{
+	{Name: "ci", Kubeconfig: "/etc/kube/ci"},
+	{Name: "ci-2", Kubeconfig: "/etc/kube/ci", Context: "ci-2"},
+	{Name: "build", Context: "build"},
+}
+
+func TestValidateClusters(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		clusters    []Cluster
+		selected    map[string][]string
+		expectedErr string
+	}{
+		{
+			name:     "valid",
+			clusters: testClusters,
+			selected: map[string][]string{"targets_clusters": {"ci", "build"}},
+		},
+		{
+			name:        "no name",
+			clusters:    []Cluster{{Context: "ci"}},
+			expectedErr: "cluster 0 has no name",
+		},
+		{
+			name:        "reused name",
+			clusters:    []Cluster{{Name: "ci", Context: "ci"}, {Name: "ci", Context: "ci-2"}},
+			expectedErr: `cluster 1 reuses the name "ci"`,
+		},
+		{
+			name:        "unreachable",
+			clusters:    []Cluster{{Name: "ci"}},
+			expectedErr: `cluster "ci" sets neither kubeconfig nor context`,
+		},
+		{
+			name:        "unknown cluster",
+			clusters:    testClusters,
+			selected:    map[string][]string{`matcher 0 for target "jobs"`: {"prod"}},
+			expectedErr: `matcher 0 for target "jobs" applies to unknown cluster "prod"`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateClusters(tc.clusters, tc.selected)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+// contextExecutor records tasks like recordingExecutor, and fails those
+// run with $CONTEXT set to failContext.
+type contextExecutor struct {
+	recordingExecutor
+	failContext string
+}
+
+func (e *contextExecutor) Run(ctx context.Context, log *logrus.Entry, dir string, t task) ([]byte, []byte, error) {
+	stdout, stderr, err := e.recordingExecutor.Run(ctx, log, dir, t)
+	for _, env := range t.env {
+		if e.failContext != "" && env == "CONTEXT="+e.failContext {
+			return stdout, []byte("it broke"), fakeExitError(2)
+		}
+	}
+	return stdout, stderr, err
+}
+
+func TestHandleEventClusters(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		failContext     string
+		expectedComment string
+	}{
+		{
+			name:            "applied to every cluster",
+			expectedComment: "The following updates succeeded:\n<ul><li><details><summary><code>/usr/bin/make apply WHAT=config/jenkins.yaml</code> on cluster <code>ci</code>",
+		},
+		{
+			name:            "partial failure",
+			failContext:     "build",
+			expectedComment: "**:warning: Applied to 2 of 3 clusters, failed on <code>build</code>.**\n\nThe following updates succeeded:",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := makeRepoDir(t, map[string]string{"config/jenkins.yaml": "kind: ConfigMap\n"})
+			defer os.RemoveAll(dir)
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "config/jenkins.yaml"},
+					{Filename: "jobs/ci.yaml"},
+				}},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:         []string{"config/jenkins.yaml"},
+				Clusters:        testClusters,
+				TargetsClusters: []string{"ci", "ci-2", "build"},
+				Matchers:        []Matcher{{Glob: "jobs/*.yaml", Target: "jobs", Clusters: []string{"ci"}}},
+				MaxPRFiles:      defaultMaxPRFiles,
+			})
+			executor := &contextExecutor{failContext: tc.failContext}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expectedRan := [][]string{
+				{"/usr/bin/make", "apply", "WHAT=config/jenkins.yaml"},
+				{"/usr/bin/make", "apply", "WHAT=config/jenkins.yaml"},
+				{"/usr/bin/make", "apply", "WHAT=config/jenkins.yaml"},
+				{"/usr/bin/make", "jobs"},
+			}
+			if !reflect.DeepEqual(executor.ran, expectedRan) {
+				t.Errorf("expected to run %q, got %q", expectedRan, executor.ran)
+			}
+			expectedEnv := [][]string{
+				{"KUBECONFIG=/etc/kube/ci"},
+				{"KUBECONFIG=/etc/kube/ci", "CONTEXT=ci-2"},
+				{"CONTEXT=build"},
+				{"KUBECONFIG=/etc/kube/ci"},
+			}
+			for i, env := range executor.env {
+				var clusterEnv []string
+				for _, variable := range env {
+					if strings.HasPrefix(variable, "KUBECONFIG=") || strings.HasPrefix(variable, "CONTEXT=") {
+						clusterEnv = append(clusterEnv, variable)
+					}
+				}
+				if i < len(expectedEnv) && !reflect.DeepEqual(clusterEnv, expectedEnv[i]) {
+					t.Errorf("expected task %d to run with %q, got %q", i, expectedEnv[i], clusterEnv)
+				}
+			}
+			checkComment(t, ghc, tc.expectedComment)
+		})
+	}
+}
+
+func TestResultsClusterSummary(t *testing.T) {
+	r := &results{
+		clusters:  []string{"ci", "ci-2", "build"},
+		succeeded: []result{{command: []string{"make", "apply"}, cluster: "build"}, {command: []string{"make", "apply"}, cluster: "ci"}},
+		failed:    []result{{command: []string{"make", "apply"}, cluster: "ci-2", exitCode: 2}},
+	}
+	if expected, actual := "2 succeeded, 1 failed, 0 internal errors, applied to 2 of 3 clusters", r.Summary(); actual != expected {
+		t.Errorf("expected summary %q, got %q", expected, actual)
+	}
+	var clusters []string
+	for _, taskResult := range r.byCluster(r.succeeded) {
+		clusters = append(clusters, taskResult.cluster)
+	}
+	if expected := []string{"ci", "build"}; !reflect.DeepEqual(clusters, expected) {
+		t.Errorf("expected results grouped as %q, got %q", expected, clusters)
+	}
+}
@@ -0,0 +1,436 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Condition is an expression on the objects in a changed file, such as
+//
+//	kind == "Deployment" && labels.environment == "production"
+//
+// Operands are fields of the object, as dotted paths like spec.replicas
+// with ["..."] for keys with dots in them, and string, number or boolean
+// literals. kind, name, namespace, labels and annotations are short for
+// the fields of the object and its metadata. Fields are compared with ==
+// and !=, and the comparisons combined with &&, || and ! and grouped with
+// parentheses. A field on its own holds if it is set to anything but
+// false, zero or an empty string. The condition is parsed when the config
+// is loaded.
+type Condition struct {
+	source string
+	expr   conditionExpr
+}
+
+// UnmarshalJSON parses the condition from its source text.
+func (c *Condition) UnmarshalJSON(b []byte) error {
+	var source string
+	if err := json.Unmarshal(b, &source); err != nil {
+		return err
+	}
+	return c.parse(source)
+}
+
+// UnmarshalYAML parses the condition from its source text.
+func (c *Condition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var source string
+	if err := unmarshal(&source); err != nil {
+		return err
+	}
+	return c.parse(source)
+}
+
+func (c *Condition) parse(source string) error {
+	expr, err := parseCondition(source)
+	if err != nil {
+		return fmt.Errorf("invalid condition %q: %v", source, err)
+	}
+	c.source, c.expr = source, expr
+	return nil
+}
+
+// MarshalJSON renders the condition as its source text.
+func (c Condition) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.source)
+}
+
+func (c Condition) String() string {
+	return c.source
+}
+
+// holds determines whether the condition holds for any object in the
+// config at filename in the checkout in dir. It does not hold for configs
+// that cannot be read or parsed, including removed ones.
+func (c *Condition) holds(dir, filename string) bool {
+	resolved, err := checkoutPath(dir, filename)
+	if err != nil {
+		return false
+	}
+	content, err := ioutil.ReadFile(resolved)
+	if err != nil {
+		return false
+	}
+	for _, document := range splitDocuments(filename, content) {
+		object, err := parseObject(filename, document)
+		if err != nil {
+			continue
+		}
+		if truthy(c.expr.evaluate(object)) {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionExpr evaluates part of a condition against an object.
+type conditionExpr interface {
+	evaluate(object map[string]interface{}) interface{}
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (e literalExpr) evaluate(map[string]interface{}) interface{} {
+	return e.value
+}
+
+// fieldExpr looks up a field of the object by its path, evaluating to nil
+// if it is not set.
+type fieldExpr struct {
+	path []string
+}
+
+// fieldShorthands expand the first element of a path.
+var fieldShorthands = map[string][]string{
+	"name":        {"metadata", "name"},
+	"namespace":   {"metadata", "namespace"},
+	"labels":      {"metadata", "labels"},
+	"annotations": {"metadata", "annotations"},
+}
+
+func (e fieldExpr) evaluate(object map[string]interface{}) interface{} {
+	path := e.path
+	if expanded, ok := fieldShorthands[path[0]]; ok {
+		path = append(append([]string{}, expanded...), path[1:]...)
+	}
+	var value interface{} = object
+	for _, key := range path {
+		// Nested YAML objects have keys of any type.
+		switch fields := value.(type) {
+		case map[string]interface{}:
+			value = fields[key]
+		case map[interface{}]interface{}:
+			value = fields[key]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+type notExpr struct {
+	operand conditionExpr
+}
+
+func (e notExpr) evaluate(object map[string]interface{}) interface{} {
+	return !truthy(e.operand.evaluate(object))
+}
+
+// binaryExpr is a comparison or a logical operator.
+type binaryExpr struct {
+	operator    string
+	left, right conditionExpr
+}
+
+func (e binaryExpr) evaluate(object map[string]interface{}) interface{} {
+	switch e.operator {
+	case "&&":
+		return truthy(e.left.evaluate(object)) && truthy(e.right.evaluate(object))
+	case "||":
+		return truthy(e.left.evaluate(object)) || truthy(e.right.evaluate(object))
+	}
+	left, right := e.left.evaluate(object), e.right.evaluate(object)
+	equal := left != nil && right != nil && canonical(left) == canonical(right)
+	if e.operator == "!=" {
+		return !equal
+	}
+	return equal
+}
+
+// canonical renders a value so that the same number parsed as an integer
+// and as a float compares equal.
+func canonical(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case int:
+		return strconv.Itoa(value)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	}
+	return fmt.Sprint(value)
+}
+
+// truthy determines whether a value counts as true on its own.
+func truthy(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case string:
+		return value != ""
+	case float64:
+		return value != 0
+	case int:
+		return value != 0
+	case int64:
+		return value != 0
+	}
+	return true
+}
+
+// conditionParser is a recursive descent parser of conditions, with ||
+// binding looser than &&, which binds looser than comparisons.
+type conditionParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseCondition(source string) (conditionExpr, error) {
+	tokens, err := tokenizeCondition(source)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty condition")
+	}
+	p := &conditionParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *conditionParser) or() (conditionExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{operator: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) and() (conditionExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{operator: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) unary() (conditionExpr, error) {
+	if p.peek() == "!" {
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{operand: operand}, nil
+	}
+	return p.comparison()
+}
+
+func (p *conditionParser) comparison() (conditionExpr, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if operator := p.peek(); operator == "==" || operator == "!=" {
+		p.pos++
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{operator: operator, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *conditionParser) operand() (conditionExpr, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of condition")
+	}
+	p.pos++
+	switch {
+	case token == "(":
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return expr, nil
+	case strings.HasPrefix(token, `"`):
+		value, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", token)
+		}
+		return literalExpr{value: value}, nil
+	case token == "true" || token == "false":
+		return literalExpr{value: token == "true"}, nil
+	case token[0] == '-' || unicode.IsDigit(rune(token[0])):
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", token)
+		}
+		return literalExpr{value: value}, nil
+	case isIdentifierStart(rune(token[0])):
+		return p.field(token)
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+// field parses the rest of the path starting with the identifier first.
+func (p *conditionParser) field(first string) (conditionExpr, error) {
+	path := []string{first}
+	for {
+		switch p.peek() {
+		case ".":
+			p.pos++
+			key := p.peek()
+			if key == "" || !isIdentifierStart(rune(key[0])) {
+				return nil, fmt.Errorf("expected a field name after %s.", strings.Join(path, "."))
+			}
+			p.pos++
+			path = append(path, key)
+		case "[":
+			p.pos++
+			key, err := strconv.Unquote(p.peek())
+			if err != nil || !strings.HasPrefix(p.peek(), `"`) {
+				return nil, fmt.Errorf("expected a quoted key after %s[", strings.Join(path, "."))
+			}
+			p.pos++
+			if p.peek() != "]" {
+				return nil, fmt.Errorf("missing ] after %s[%q", strings.Join(path, "."), key)
+			}
+			p.pos++
+			path = append(path, key)
+		default:
+			return fieldExpr{path: path}, nil
+		}
+	}
+}
+
+func isIdentifierStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentifierPart(r rune) bool {
+	return r == '_' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// conditionOperators are the operators two characters long.
+var conditionOperators = map[string]bool{"&&": true, "||": true, "==": true, "!=": true}
+
+// tokenizeCondition splits source into operators, punctuation, quoted
+// strings, numbers and identifiers.
+func tokenizeCondition(source string) ([]string, error) {
+	var tokens []string
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case i+1 < len(runes) && conditionOperators[string(runes[i:i+2])]:
+			tokens = append(tokens, string(runes[i:i+2]))
+			i += 2
+		case strings.ContainsRune("!().[]", r):
+			tokens = append(tokens, string(r))
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				if runes[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, string(runes[i:end+1]))
+			i = end + 1
+		case r == '-' || unicode.IsDigit(r):
+			end := i + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		case isIdentifierStart(r):
+			end := i + 1
+			for end < len(runes) && isIdentifierPart(runes[end]) {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected %q", r)
+		}
+	}
+	return tokens, nil
+}
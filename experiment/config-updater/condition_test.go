@@ -0,0 +1,178 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	yamlv2 "gopkg.in/yaml.v2"
+	"sigs.k8s.io/yaml"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestCondition(t *testing.T) {
+	object, err := parseObject("deployment.yaml", []byte(`kind: Deployment
+metadata:
+  name: web
+  labels:
+    environment: production
+    app.kubernetes.io/name: web
+spec:
+  replicas: 3
+  paused: false
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var testcases = []struct {
+		name        string
+		condition   string
+		expected    bool
+		expectedErr string
+	}{
+		{name: "kind", condition: `kind == "Deployment"`, expected: true},
+		{name: "other kind", condition: `kind == "Service"`},
+		{name: "and", condition: `kind == "Deployment" && labels.environment == "production"`, expected: true},
+		{name: "and, not holding", condition: `kind == "Deployment" && labels.environment == "staging"`},
+		{name: "or", condition: `kind == "Service" || name == "web"`, expected: true},
+		{name: "not equal", condition: `labels.environment != "staging"`, expected: true},
+		{name: "missing field is not equal", condition: `labels.team != "infra"`, expected: true},
+		{name: "missing field is not equal to anything", condition: `labels.team == ""`},
+		{name: "not", condition: `!(kind == "Service")`, expected: true},
+		{name: "precedence", condition: `kind == "Service" && name == "api" || labels.environment == "production"`, expected: true},
+		{name: "quoted key", condition: `labels["app.kubernetes.io/name"] == "web"`, expected: true},
+		{name: "number", condition: `spec.replicas == 3`, expected: true},
+		{name: "boolean", condition: `spec.paused == false`, expected: true},
+		{name: "field on its own", condition: `spec.replicas`, expected: true},
+		{name: "unset field on its own", condition: `spec.paused || labels.team`},
+		{name: "empty", condition: ` `, expectedErr: `invalid condition " ": empty condition`},
+		{name: "unterminated string", condition: `kind == "Deployment`, expectedErr: `invalid condition "kind == \"Deployment": unterminated string`},
+		{name: "missing operand", condition: `kind ==`, expectedErr: `invalid condition "kind ==": unexpected end of condition`},
+		{name: "missing parenthesis", condition: `(kind == "Service"`, expectedErr: `invalid condition "(kind == \"Service\"": missing )`},
+		{name: "single equals", condition: `kind = "Service"`, expectedErr: `invalid condition "kind = \"Service\"": unexpected '='`},
+		{name: "trailing tokens", condition: `kind "Service"`, expectedErr: `invalid condition "kind \"Service\"": unexpected "\"Service\""`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var condition Condition
+			err := condition.parse(tc.condition)
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if holds := truthy(condition.expr.evaluate(object)); holds != tc.expected {
+				t.Errorf("expected %q to be %t, got %t", tc.condition, tc.expected, holds)
+			}
+		})
+	}
+}
+
+func TestConditionUnmarshal(t *testing.T) {
+	var viaJSON, viaYAML Matcher
+	config := []byte("target: prod\ncondition: kind == \"Deployment\"\n")
+	if err := yaml.Unmarshal(config, &viaJSON); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := yamlv2.Unmarshal(config, &viaYAML); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, matcher := range []Matcher{viaJSON, viaYAML} {
+		if matcher.Condition == nil || matcher.Condition.String() != `kind == "Deployment"` {
+			t.Errorf("expected the condition to be parsed, got %v", matcher.Condition)
+		}
+	}
+
+	if err := yaml.Unmarshal([]byte("condition: kind ==\n"), &Matcher{}); err == nil {
+		t.Error("expected an invalid condition to fail to load")
+	}
+}
+
+func TestHandleEventCondition(t *testing.T) {
+	dir := makeRepoDir(t, map[string]string{
+		"apps/prod.yaml":    "kind: Deployment\nmetadata:\n  labels:\n    environment: production\n",
+		"apps/staging.yaml": "kind: Deployment\nmetadata:\n  labels:\n    environment: staging\n",
+		"apps/both.yaml":    "kind: Service\n---\nkind: Deployment\nmetadata:\n  labels:\n    environment: production\n",
+		"apps/broken.yaml":  "kind: [\n",
+	})
+	defer os.RemoveAll(dir)
+
+	var testcases = []struct {
+		name     string
+		changes  []github.PullRequestChange
+		expected [][]string
+	}{
+		{
+			name:     "condition holds",
+			changes:  []github.PullRequestChange{{Filename: "apps/prod.yaml"}},
+			expected: [][]string{{"/usr/bin/make", "apply-prod"}},
+		},
+		{
+			name:    "condition does not hold",
+			changes: []github.PullRequestChange{{Filename: "apps/staging.yaml"}},
+		},
+		{
+			name:     "condition holds for one of the documents",
+			changes:  []github.PullRequestChange{{Filename: "apps/both.yaml"}},
+			expected: [][]string{{"/usr/bin/make", "apply-prod"}},
+		},
+		{
+			name: "unparseable and removed files do not hold",
+			changes: []github.PullRequestChange{
+				{Filename: "apps/broken.yaml"},
+				{Filename: "apps/gone.yaml", Status: github.PullRequestFileRemoved},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var condition Condition
+			if err := condition.parse(`kind == "Deployment" && labels.environment == "production"`); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: tc.changes},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "apps/*", Target: "apply-prod", Condition: &condition}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+		})
+	}
+}
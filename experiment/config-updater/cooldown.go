@@ -0,0 +1,48 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+// coolingDown determines whether the updates for the PR named by key ran
+// within period, and otherwise records that they run now. A zero period
+// never cools down.
+func (s *Server) coolingDown(key string, period time.Duration) bool {
+	if period <= 0 {
+		return false
+	}
+	s.ranAtLock.Lock()
+	defer s.ranAtLock.Unlock()
+	if s.ranAt == nil {
+		s.ranAt = map[string]time.Time{}
+	}
+	now := time.Now()
+	// PRs are only merged once, so their times are dropped once they
+	// cannot cool down anymore.
+	for ran, at := range s.ranAt {
+		if now.Sub(at) >= period {
+			delete(s.ranAt, ran)
+		}
+	}
+	if _, ok := s.ranAt[key]; ok {
+		return true
+	}
+	s.ranAt[key] = now
+	return false
+}
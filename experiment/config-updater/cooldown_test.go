@@ -0,0 +1,112 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestCooldown(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		cooldown time.Duration
+		ranAt    map[string]time.Time
+		number   int
+		expected int
+	}{
+		{
+			name:     "no cooldown",
+			ranAt:    map[string]time.Time{"org/repo#1": time.Now()},
+			number:   1,
+			expected: 1,
+		},
+		{
+			name:     "ran within the cooldown",
+			cooldown: time.Hour,
+			ranAt:    map[string]time.Time{"org/repo#1": time.Now().Add(-time.Minute)},
+			number:   1,
+		},
+		{
+			name:     "ran before the cooldown",
+			cooldown: time.Hour,
+			ranAt:    map[string]time.Time{"org/repo#1": time.Now().Add(-2 * time.Hour)},
+			number:   1,
+			expected: 1,
+		},
+		{
+			name:     "another PR ran within the cooldown",
+			cooldown: time.Hour,
+			ranAt:    map[string]time.Time{"org/repo#2": time.Now().Add(-time.Minute)},
+			number:   1,
+			expected: 1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{tc.number: {{Filename: "jobs/config.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:       []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+				MaxPRFiles:     defaultMaxPRFiles,
+				CooldownPeriod: tc.cooldown,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+			s.ranAt = tc.ranAt
+
+			event := mergedPREvent(t, func(pr *github.PullRequest) { pr.Number = tc.number })
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", event); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(executor.ran) != tc.expected {
+				t.Errorf("expected %d tasks to run, got %v", tc.expected, executor.ran)
+			}
+		})
+	}
+}
+
+func TestCooldownRedelivery(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers:       []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+		MaxPRFiles:     defaultMaxPRFiles,
+		CooldownPeriod: time.Hour,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	// A redelivery has a fresh GUID, but is still skipped.
+	for _, guid := range []string{"first", "second"} {
+		if err := s.handleEvent(context.Background(), "pull_request", guid, mergedPREvent(t)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(executor.ran) != 1 {
+		t.Errorf("expected the tasks to run once, got %v", executor.ran)
+	}
+}
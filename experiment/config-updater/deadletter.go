@@ -0,0 +1,155 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DeadLetterEvent is an event that could not be handled, kept so that it
+// can be replayed once whatever broke it is fixed.
+type DeadLetterEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	EventType string    `json:"event_type"`
+	EventGUID string    `json:"event_guid"`
+	// Payload is the payload of the webhook as received, which need not
+	// be valid JSON.
+	Payload []byte `json:"payload"`
+	// Error is why handling the event failed.
+	Error string `json:"error"`
+}
+
+// DeadLetterQueue keeps the events that failed after every retry.
+type DeadLetterQueue interface {
+	Enqueue(event DeadLetterEvent) error
+}
+
+// FileDeadLetterQueue appends events to a file, one JSON object per line.
+type FileDeadLetterQueue struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+// Enqueue appends event to the file, creating it if need be.
+func (q *FileDeadLetterQueue) Enqueue(event DeadLetterEvent) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	f, err := os.OpenFile(q.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(event); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ChannelDeadLetterQueue sends events to a channel, for tests to receive.
+// Enqueue blocks until there is room in the channel.
+type ChannelDeadLetterQueue chan DeadLetterEvent
+
+// Enqueue sends event to the channel.
+func (q ChannelDeadLetterQueue) Enqueue(event DeadLetterEvent) error {
+	q <- event
+	return nil
+}
+
+// deadLetter keeps an event that failed in DeadLetters, if it is set.
+// Failing to is only logged, as there is nowhere else for the event to go.
+func (s *Server) deadLetter(eventType, eventGUID string, payload []byte, err error) {
+	if s.DeadLetters == nil {
+		return
+	}
+	event := DeadLetterEvent{
+		Timestamp: time.Now(),
+		EventType: eventType,
+		EventGUID: eventGUID,
+		Payload:   payload,
+		Error:     err.Error(),
+	}
+	if qerr := s.DeadLetters.Enqueue(event); qerr != nil {
+		s.log.WithError(qerr).WithField("eventGUID", eventGUID).Error("Error keeping the failed event, so it is lost.")
+		return
+	}
+	deadLetters.WithLabelValues(eventType).Inc()
+}
+
+// readDeadLetters reads the events that a FileDeadLetterQueue appended to
+// path.
+func readDeadLetters(path string) ([]DeadLetterEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []DeadLetterEvent
+	scanner := bufio.NewScanner(f)
+	// Payloads are bounded by --max-request-body-bytes, but base64 grows
+	// them by a third.
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event DeadLetterEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("invalid event on line %d of %s: %v", line, path, err)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// replayDeadLetters handles the events kept in path again, as if their
+// webhooks were received. The file is moved aside first, so that the events
+// failing again are appended to DeadLetters anew without being replayed
+// twice, and it is only removed once every event has been handled.
+func (s *Server) replayDeadLetters(path string) (replayed, failed int, err error) {
+	replaying := path + ".replaying"
+	if _, err := os.Stat(replaying); err == nil {
+		return 0, 0, fmt.Errorf("%s was left behind by an earlier replay, check whether its events were handled and remove it", replaying)
+	}
+	if err := os.Rename(path, replaying); os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	events, err := readDeadLetters(replaying)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, event := range events {
+		log := s.log.WithFields(logrus.Fields{"eventType": event.EventType, "eventGUID": event.EventGUID, "failedAt": event.Timestamp})
+		log.Info("Replaying failed event.")
+		replayed++
+		if err := s.handleEvent(context.Background(), event.EventType, event.EventGUID, event.Payload); err != nil {
+			log.WithError(err).Error("Replayed event failed again.")
+			failed++
+		}
+	}
+	return replayed, failed, os.Remove(replaying)
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestHandleEventDeadLetters(t *testing.T) {
+	var testcases = []struct {
+		name          string
+		cloneFailures int
+		payload       func(t *testing.T) []byte
+		expectedError string
+	}{
+		{
+			name:    "handled",
+			payload: func(t *testing.T) []byte { return mergedPREvent(t) },
+		},
+		{
+			name:          "clone retries exhausted",
+			cloneFailures: 1000,
+			payload:       func(t *testing.T) []byte { return mergedPREvent(t) },
+			expectedError: "error cloning: ",
+		},
+		{
+			name:          "invalid payload",
+			payload:       func(t *testing.T) []byte { return []byte("{") },
+			expectedError: "unexpected end of JSON input",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{cloneFailures: tc.cloneFailures}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "jobs/*.yaml", Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.gitRetryDeadline = 10 * time.Millisecond
+			queue := make(ChannelDeadLetterQueue, 1)
+			s.DeadLetters = queue
+
+			payload := tc.payload(t)
+			err := s.handleEvent(context.Background(), "pull_request", "guid", payload)
+			if (err != nil) != (tc.expectedError != "") {
+				t.Fatalf("expected error %q, got %v", tc.expectedError, err)
+			}
+			select {
+			case event := <-queue:
+				if tc.expectedError == "" {
+					t.Fatalf("expected no dead letter, got %+v", event)
+				}
+				if event.EventType != "pull_request" || event.EventGUID != "guid" || !reflect.DeepEqual(event.Payload, payload) {
+					t.Errorf("expected the event to be kept as received, got %+v", event)
+				}
+				if !strings.Contains(event.Error, tc.expectedError) {
+					t.Errorf("expected error %q, got %q", tc.expectedError, event.Error)
+				}
+			default:
+				if tc.expectedError != "" {
+					t.Errorf("expected a dead letter")
+				}
+			}
+		})
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-letters")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead-letters.jsonl")
+
+	queue := &FileDeadLetterQueue{Path: path}
+	for _, event := range []DeadLetterEvent{
+		{EventType: "pull_request", EventGUID: "fixed", Payload: mergedPREvent(t), Error: "error cloning"},
+		{EventType: "pull_request", EventGUID: "broken", Payload: []byte("{"), Error: "unexpected end of JSON input"},
+	} {
+		if err := queue.Enqueue(event); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers:   []Matcher{{Glob: "jobs/*.yaml", Target: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+	s.DeadLetters = queue
+
+	replayed, failed, err := s.replayDeadLetters(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replayed != 2 || failed != 1 {
+		t.Errorf("expected 2 events replayed and 1 failed, got %d and %d", replayed, failed)
+	}
+	if code := s.runOnceExitCode(failed > 0); code != 1 {
+		t.Errorf("expected exit code 1 as an event failed again, got %d", code)
+	}
+	if expected := [][]string{{"/usr/bin/make", "jobs"}}; !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected to run %q, got %q", expected, executor.ran)
+	}
+
+	// Only the event that failed again is left to replay.
+	events, err := readDeadLetters(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 1 || events[0].EventGUID != "broken" || string(events[0].Payload) != "{" {
+		t.Errorf("expected only the broken event to be kept, got %+v", events)
+	}
+	if _, err := os.Stat(path + ".replaying"); !os.IsNotExist(err) {
+		t.Errorf("expected the replayed file to be removed, got %v", err)
+	}
+
+	// Nothing is left behind by a replay with nothing to replay.
+	os.Remove(path)
+	if replayed, _, err := s.replayDeadLetters(path); err != nil || replayed != 0 {
+		t.Errorf("expected nothing to replay, got %d, %v", replayed, err)
+	}
+}
+
+func TestReplayDeadLettersExitCode(t *testing.T) {
+	var testcases = []struct {
+		name             string
+		failures         map[string]bool
+		expectedExitCode int
+	}{
+		{
+			name: "updates succeed",
+		},
+		{
+			name:             "updates fail",
+			failures:         map[string]bool{"/usr/bin/make jobs": true},
+			expectedExitCode: 1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dead-letters")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "dead-letters.jsonl")
+			queue := &FileDeadLetterQueue{Path: path}
+			if err := queue.Enqueue(DeadLetterEvent{EventType: "pull_request", EventGUID: "guid", Payload: mergedPREvent(t)}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "jobs/*.yaml", Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.executor = &recordingExecutor{failures: tc.failures}
+
+			// The event is handled either way, so only the results tell
+			// whether the updates failed.
+			_, failed, err := s.replayDeadLetters(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if code := s.runOnceExitCode(failed > 0); code != tc.expectedExitCode {
+				t.Errorf("expected exit code %d, got %d", tc.expectedExitCode, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// maxDeploymentDescriptionLength is the longest description GitHub accepts
+// for a deployment status.
+const maxDeploymentDescriptionLength = 140
+
+// deploymentEnvironment names the environment the deployment of t is in:
+// its environment, or else what it applies, followed by its cluster if it
+// has one.
+func (t task) deploymentEnvironment() string {
+	environment := t.environment
+	if environment == "" {
+		environment = t.escalationTarget()
+	}
+	if t.cluster != "" {
+		environment += "/" + t.cluster
+	}
+	return environment
+}
+
+// startDeployment creates a deployment of the merge commit of pr for t and
+// marks it in progress, returning its ID. Failing to create it does not
+// stop the task, so the error is only logged and zero is returned.
+func (s *Server) startDeployment(ctx context.Context, pr github.PullRequest, t task) int64 {
+	org, repo := pr.Base.Repo.Owner.Login, pr.Base.Repo.Name
+	environment := t.deploymentEnvironment()
+	log := s.log.WithField("environment", environment)
+	id, err := s.github(ctx).CreateDeployment(org, repo, github.DeploymentOptions{
+		Ref:         *pr.MergeSHA,
+		Task:        "deploy:" + t.target,
+		Environment: environment,
+		Description: deploymentDescription(strings.Join(t.command, " ")),
+	})
+	if err != nil {
+		log.WithError(err).Warn("Error creating deployment.")
+		return 0
+	}
+	if err := s.github(ctx).CreateDeploymentStatus(org, repo, id, github.DeploymentStatusOptions{
+		State:  github.DeploymentStateInProgress,
+		LogURL: pr.HTMLURL,
+	}); err != nil {
+		log.WithError(err).Warn("Error marking deployment in progress.")
+	}
+	return id
+}
+
+// finishDeployment marks the deployment succeeded or failed with the
+// result of its task, linking to the ProwJob it ran as if any, or else to
+// the PR its results are posted on.
+func (s *Server) finishDeployment(ctx context.Context, pr github.PullRequest, id int64, r result) {
+	state := github.DeploymentStateSuccess
+	description := "Applied."
+	if r.failed() {
+		state = github.DeploymentStateFailure
+		description = "Failed: " + strings.Join(strings.Fields(failureMessage(r)), " ")
+	}
+	logURL := r.url
+	if logURL == "" {
+		logURL = pr.HTMLURL
+	}
+	if err := s.github(ctx).CreateDeploymentStatus(pr.Base.Repo.Owner.Login, pr.Base.Repo.Name, id, github.DeploymentStatusOptions{
+		State:       state,
+		LogURL:      logURL,
+		Description: deploymentDescription(description),
+	}); err != nil {
+		s.log.WithError(err).WithField("deployment", id).Warn("Error completing deployment.")
+	}
+}
+
+// deploymentDescription shortens description to what GitHub accepts.
+func deploymentDescription(description string) string {
+	if len(description) > maxDeploymentDescriptionLength {
+		return description[:maxDeploymentDescriptionLength-3] + "..."
+	}
+	return description
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestDeployments(t *testing.T) {
+	const prURL = "https://github.com/org/repo/pull/1"
+	var testcases = []struct {
+		name    string
+		matcher Matcher
+		// failures are whether the target fails in each event in turn.
+		failures            []bool
+		expectedDeployments map[int64]*github.DeploymentOptions
+		expectedStatuses    map[int64][]github.DeploymentStatusOptions
+	}{
+		{
+			name:     "succeeded",
+			matcher:  Matcher{Glob: "jobs/*", Target: "jobs", Deployment: true},
+			failures: []bool{false},
+			expectedDeployments: map[int64]*github.DeploymentOptions{
+				1: {Ref: "abcdef", Task: "deploy:jobs", Environment: "jobs", Description: "/usr/bin/make jobs"},
+			},
+			expectedStatuses: map[int64][]github.DeploymentStatusOptions{
+				1: {
+					{State: github.DeploymentStateInProgress, LogURL: prURL},
+					{State: github.DeploymentStateSuccess, LogURL: prURL, Description: "Applied."},
+				},
+			},
+		},
+		{
+			name:     "failed, then succeeded when retried",
+			matcher:  Matcher{Glob: "jobs/*", Target: "jobs", Deployment: true},
+			failures: []bool{true, false},
+			expectedDeployments: map[int64]*github.DeploymentOptions{
+				1: {Ref: "abcdef", Task: "deploy:jobs", Environment: "jobs", Description: "/usr/bin/make jobs"},
+				2: {Ref: "abcdef", Task: "deploy:jobs", Environment: "jobs", Description: "/usr/bin/make jobs"},
+			},
+			expectedStatuses: map[int64][]github.DeploymentStatusOptions{
+				1: {
+					{State: github.DeploymentStateInProgress, LogURL: prURL},
+					{State: github.DeploymentStateFailure, LogURL: prURL, Description: "Failed: it broke"},
+				},
+				2: {
+					{State: github.DeploymentStateInProgress, LogURL: prURL},
+					{State: github.DeploymentStateSuccess, LogURL: prURL, Description: "Applied."},
+				},
+			},
+		},
+		{
+			name:     "environment of the matcher",
+			matcher:  Matcher{Glob: "jobs/*", Target: "jobs", Environment: "staging", Deployment: true},
+			failures: []bool{false},
+			expectedDeployments: map[int64]*github.DeploymentOptions{
+				1: {Ref: "abcdef", Task: "deploy:jobs", Environment: "staging", Description: "/usr/bin/make jobs"},
+			},
+			expectedStatuses: map[int64][]github.DeploymentStatusOptions{
+				1: {
+					{State: github.DeploymentStateInProgress, LogURL: prURL},
+					{State: github.DeploymentStateSuccess, LogURL: prURL, Description: "Applied."},
+				},
+			},
+		},
+		{
+			name:     "not opted in",
+			matcher:  Matcher{Glob: "jobs/*", Target: "jobs"},
+			failures: []bool{true, false},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{tc.matcher},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			for _, failed := range tc.failures {
+				s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": failed}}
+				event := mergedPREvent(t, func(pr *github.PullRequest) {
+					pr.HTMLURL = prURL
+				})
+				if err := s.handleEvent(context.Background(), "pull_request", "guid", event); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if !reflect.DeepEqual(ghc.Deployments, tc.expectedDeployments) {
+				t.Errorf("expected deployments %+v, got %+v", tc.expectedDeployments, ghc.Deployments)
+			}
+			if !reflect.DeepEqual(ghc.DeploymentStatuses, tc.expectedStatuses) {
+				t.Errorf("expected statuses %+v, got %+v", tc.expectedStatuses, ghc.DeploymentStatuses)
+			}
+		})
+	}
+}
+
+func TestDeploymentEnvironment(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		task     task
+		expected string
+	}{
+		{name: "target", task: task{target: "jobs"}, expected: "jobs"},
+		{name: "config", task: task{target: "apply", config: "config/prow.yaml"}, expected: "config/prow.yaml"},
+		{name: "environment", task: task{target: "jobs", environment: "production"}, expected: "production"},
+		{name: "cluster", task: task{target: "jobs", environment: "production", cluster: "us-east"}, expected: "production/us-east"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := tc.task.deploymentEnvironment(); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// diffExitCodeChanged is the exit code of kubectl diff, and of diffs in
+// general, when the cluster differs from the configs. Only greater codes
+// mean the diff failed.
+const diffExitCodeChanged = 1
+
+// Diff shows what a task applying configs in Targets will change on the
+// cluster, by running before it. Exactly one of Command and Target is set.
+type Diff struct {
+	// Command is run with the configs the task applies appended as a
+	// single comma separated argument, like kubectl diff -f expects. They
+	// are relative to the root of the checkout, like WHAT.
+	Command []string `json:"command,omitempty" yaml:"command,omitempty"`
+	// Target is a make target run with the same WHAT as the task.
+	Target string `json:"target,omitempty" yaml:"target,omitempty"`
+}
+
+// command is the command diffing the configs of t.
+func (d *Diff) command(makeBinary string, t task) []string {
+	if len(d.Command) > 0 {
+		return append(append([]string{}, d.Command...), strings.Join(t.configs(), ","))
+	}
+	return append([]string{makeBinary, d.Target}, t.command[2:]...)
+}
+
+// validate checks that exactly one of Command and Target is set, if the
+// diff is.
+func (d *Diff) validate() error {
+	switch {
+	case d == nil:
+		return nil
+	case len(d.Command) == 0 && d.Target == "":
+		return fmt.Errorf("sets neither command nor target")
+	case len(d.Command) > 0 && d.Target != "":
+		return fmt.Errorf("sets both command and target")
+	}
+	return nil
+}
+
+// diff runs the diff of task t before it is applied. Finding differences is
+// not a failure.
+func (s *Server) diff(ctx context.Context, eventGUID, dir, makeBinary string, t task) result {
+	diffResult := s.runTask(ctx, eventGUID, dir, task{command: t.diff.command(makeBinary, t), target: t.target, env: t.env, image: t.image, workdir: t.workdir, limits: t.limits})
+	if diffResult.exitCode == diffExitCodeChanged {
+		diffResult.err = nil
+	}
+	return diffResult
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// exitCodeExecutor exits with the given code for each command, and with 0
+// for the rest.
+type exitCodeExecutor struct {
+	exitCodes map[string]int
+	ran       [][]string
+}
+
+func (e *exitCodeExecutor) Run(ctx context.Context, log *logrus.Entry, dir string, t task) ([]byte, []byte, error) {
+	e.ran = append(e.ran, t.command)
+	command := strings.Join(t.command, " ")
+	if code := e.exitCodes[command]; code != 0 {
+		return []byte("diff of " + command), []byte("exited"), fakeExitError(code)
+	}
+	return []byte("running " + command), nil, nil
+}
+
+func TestDiffValidate(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		diff        *Diff
+		expectedErr string
+	}{
+		{
+			name: "not configured",
+		},
+		{
+			name: "command",
+			diff: &Diff{Command: []string{"kubectl", "diff", "-f"}},
+		},
+		{
+			name: "target",
+			diff: &Diff{Target: "diff"},
+		},
+		{
+			name:        "neither",
+			diff:        &Diff{},
+			expectedErr: "sets neither command nor target",
+		},
+		{
+			name:        "both",
+			diff:        &Diff{Command: []string{"kubectl", "diff", "-f"}, Target: "diff"},
+			expectedErr: "sets both command and target",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.diff.validate()
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestHandleEventDiff(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		diff            *Diff
+		exitCodes       map[string]int
+		expectedRan     [][]string
+		expectedComment string
+	}{
+		{
+			name: "no differences",
+			diff: &Diff{Command: []string{"/usr/bin/kubectl", "diff", "-f"}},
+			expectedRan: [][]string{
+				{"/usr/bin/kubectl", "diff", "-f", "config/app.yaml"},
+				{"/usr/bin/make", "apply", "WHAT=config/app.yaml"},
+			},
+			expectedComment: "<details><summary>Cluster diff <code>/usr/bin/kubectl diff -f config/app.yaml</code> found no differences</summary>",
+		},
+		{
+			name:      "exit code 1 means there are differences",
+			diff:      &Diff{Command: []string{"/usr/bin/kubectl", "diff", "-f"}},
+			exitCodes: map[string]int{"/usr/bin/kubectl diff -f config/app.yaml": 1},
+			expectedRan: [][]string{
+				{"/usr/bin/kubectl", "diff", "-f", "config/app.yaml"},
+				{"/usr/bin/make", "apply", "WHAT=config/app.yaml"},
+			},
+			expectedComment: "<details><summary>Cluster diff <code>/usr/bin/kubectl diff -f config/app.yaml</code> found differences</summary>\n<details><summary>stdout</summary><pre><code>\ndiff of /usr/bin/kubectl diff -f config/app.yaml\n",
+		},
+		{
+			name:      "other exit codes fail the task",
+			diff:      &Diff{Command: []string{"/usr/bin/kubectl", "diff", "-f"}},
+			exitCodes: map[string]int{"/usr/bin/kubectl diff -f config/app.yaml": 2},
+			expectedRan: [][]string{
+				{"/usr/bin/kubectl", "diff", "-f", "config/app.yaml"},
+			},
+			expectedComment: "<code>/usr/bin/make apply WHAT=config/app.yaml</code> failed: not run, as the diff failed: exit status 2",
+		},
+		{
+			name:      "make target",
+			diff:      &Diff{Target: "diff"},
+			exitCodes: map[string]int{"/usr/bin/make diff WHAT=config/app.yaml": 1},
+			expectedRan: [][]string{
+				{"/usr/bin/make", "diff", "WHAT=config/app.yaml"},
+				{"/usr/bin/make", "apply", "WHAT=config/app.yaml"},
+			},
+			expectedComment: "<details><summary>Cluster diff <code>/usr/bin/make diff WHAT=config/app.yaml</code> found differences</summary>",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := makeRepoDir(t, map[string]string{"config/app.yaml": "kind: ConfigMap\n"})
+			defer os.RemoveAll(dir)
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "config/app.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:            []string{"config/app.yaml"},
+				Diff:               tc.diff,
+				AllowedExecutables: []string{"/usr/bin/make", "/usr/bin/kubectl"},
+				MaxPRFiles:         defaultMaxPRFiles,
+			})
+			executor := &exitCodeExecutor{exitCodes: tc.exitCodes}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedRan) {
+				t.Errorf("expected to run %q, got %q", tc.expectedRan, executor.ran)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+		})
+	}
+}
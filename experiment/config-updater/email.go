@@ -0,0 +1,171 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// How the connection to the SMTP server is secured.
+const (
+	// smtpTLSStartTLS upgrades a plain connection with STARTTLS, usually on
+	// port 587.
+	smtpTLSStartTLS = "starttls"
+	// smtpTLSImplicit connects with TLS from the start, usually on port 465.
+	smtpTLSImplicit = "tls"
+	// smtpTLSNone sends in the clear, which is only fit for a relay on the
+	// same host.
+	smtpTLSNone = "none"
+)
+
+// mailSender sends a message, so that tests need no SMTP server.
+type mailSender interface {
+	Send(from string, to []string, message []byte) error
+}
+
+// EmailNotifier mails notifications to the email_recipients of the repo.
+type EmailNotifier struct {
+	From   string
+	sender mailSender
+}
+
+// NewEmailNotifier creates an EmailNotifier sending through the SMTP server
+// at addr, a host:port, secured as tlsMode says. It authenticates with
+// username and password unless username is empty.
+func NewEmailNotifier(addr, tlsMode, from, username string, password func() []byte) (*EmailNotifier, error) {
+	switch tlsMode {
+	case smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone:
+	default:
+		return nil, fmt.Errorf("TLS mode must be %s, %s or %s, not %q", smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone, tlsMode)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP server %q: %v", addr, err)
+	}
+	if username != "" && tlsMode == smtpTLSNone {
+		return nil, fmt.Errorf("refusing to authenticate to %s without TLS", addr)
+	}
+	return &EmailNotifier{
+		From:   from,
+		sender: &smtpSender{addr: addr, host: host, tlsMode: tlsMode, username: username, password: password},
+	}, nil
+}
+
+// Notify mails n to the email_recipients of config, if it has any.
+func (e *EmailNotifier) Notify(config *UpdateConfig, n Notification) error {
+	if len(config.EmailRecipients) == 0 {
+		return nil
+	}
+	return e.sender.Send(e.From, config.EmailRecipients, emailMessage(e.From, config.EmailRecipients, n))
+}
+
+// emailMessage renders n as a plain text mail.
+func emailMessage(from string, to []string, n Notification) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: Updates failed for %s\r\n", n.PR)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Updates failed for %s: %s\n%s\n", n.PR, n.Summary, n.URL)
+	for _, failure := range n.Failures {
+		fmt.Fprintf(&body, "\n%s failed:\n", failure.Command)
+		if failure.LogURL != "" {
+			fmt.Fprintf(&body, "Logs: %s\n", failure.LogURL)
+		}
+		body.WriteString(indent(failure.Error))
+	}
+	for _, err := range n.Internal {
+		body.WriteString("\nInternal error:\n")
+		body.WriteString(indent(err))
+	}
+	b.WriteString(strings.Replace(body.String(), "\n", "\r\n", -1))
+	return []byte(b.String())
+}
+
+// indent indents each line of text.
+func indent(text string) string {
+	return "    " + strings.Replace(text, "\n", "\n    ", -1) + "\n"
+}
+
+// smtpSender sends with net/smtp.
+type smtpSender struct {
+	addr     string
+	host     string
+	tlsMode  string
+	username string
+	password func() []byte
+}
+
+func (s *smtpSender) Send(from string, to []string, message []byte) error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	if s.tlsMode == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{ServerName: s.host})
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %v", s.addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error greeting %s: %v", s.addr, err)
+	}
+	defer c.Close()
+	if s.tlsMode == smtpTLSStartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return fmt.Errorf("error starting TLS with %s: %v", s.addr, err)
+		}
+	}
+	if s.username != "" {
+		auth := smtp.PlainAuth("", s.username, strings.TrimSpace(string(s.password())), s.host)
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("error authenticating to %s as %s: %v", s.addr, s.username, err)
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := c.Rcpt(recipient); err != nil {
+			return fmt.Errorf("error adding recipient %s: %v", recipient, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
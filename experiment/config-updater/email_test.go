@@ -0,0 +1,211 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeMailSender records the mails it is asked to send, failing them all if
+// err is set.
+type fakeMailSender struct {
+	from     []string
+	to       [][]string
+	messages []string
+	err      error
+}
+
+func (f *fakeMailSender) Send(from string, to []string, message []byte) error {
+	f.from = append(f.from, from)
+	f.to = append(f.to, to)
+	f.messages = append(f.messages, string(message))
+	return f.err
+}
+
+func TestEmailMessage(t *testing.T) {
+	var testcases = []struct {
+		name         string
+		notification Notification
+		expected     string
+	}{
+		{
+			name: "failed tasks",
+			notification: Notification{
+				PR:      "org/repo#1",
+				URL:     "https://github.com/org/repo/pull/1",
+				Summary: "0 succeeded, 2 failed, 0 internal errors",
+				Failures: []NotifiedFailure{
+					{Command: "/usr/bin/make jobs", Error: "it broke\nbadly"},
+					{Command: "prowjob apply", LogURL: "https://prow/logs", Error: "ProwJob apply ended in state failure"},
+				},
+			},
+			expected: "From: updater@example.com\r\n" +
+				"To: oncall@example.com, infra@example.com\r\n" +
+				"Subject: Updates failed for org/repo#1\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: text/plain; charset=UTF-8\r\n" +
+				"\r\n" +
+				"Updates failed for org/repo#1: 0 succeeded, 2 failed, 0 internal errors\r\n" +
+				"https://github.com/org/repo/pull/1\r\n" +
+				"\r\n" +
+				"/usr/bin/make jobs failed:\r\n" +
+				"    it broke\r\n" +
+				"    badly\r\n" +
+				"\r\n" +
+				"prowjob apply failed:\r\n" +
+				"Logs: https://prow/logs\r\n" +
+				"    ProwJob apply ended in state failure\r\n",
+		},
+		{
+			name: "internal error",
+			notification: Notification{
+				PR:       "org/repo#1",
+				URL:      "https://github.com/org/repo/pull/1",
+				Summary:  "0 succeeded, 0 failed, 1 internal errors",
+				Internal: []string{"error cloning org/repo"},
+			},
+			expected: "From: updater@example.com\r\n" +
+				"To: oncall@example.com, infra@example.com\r\n" +
+				"Subject: Updates failed for org/repo#1\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: text/plain; charset=UTF-8\r\n" +
+				"\r\n" +
+				"Updates failed for org/repo#1: 0 succeeded, 0 failed, 1 internal errors\r\n" +
+				"https://github.com/org/repo/pull/1\r\n" +
+				"\r\n" +
+				"Internal error:\r\n" +
+				"    error cloning org/repo\r\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := string(emailMessage("updater@example.com", []string{"oncall@example.com", "infra@example.com"}, tc.notification))
+			if actual != tc.expected {
+				t.Errorf("expected message %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		recipients  []string
+		sendErr     error
+		expectedTo  [][]string
+		expectedErr string
+	}{
+		{
+			name:       "mailed to the recipients",
+			recipients: []string{"oncall@example.com"},
+			expectedTo: [][]string{{"oncall@example.com"}},
+		},
+		{
+			name: "no recipients",
+		},
+		{
+			name:        "failed to send",
+			recipients:  []string{"oncall@example.com"},
+			sendErr:     errors.New("connection refused"),
+			expectedTo:  [][]string{{"oncall@example.com"}},
+			expectedErr: "connection refused",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			sender := &fakeMailSender{err: tc.sendErr}
+			e := &EmailNotifier{From: "updater@example.com", sender: sender}
+			err := e.Notify(&UpdateConfig{EmailRecipients: tc.recipients}, Notification{PR: "org/repo#1"})
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if !reflect.DeepEqual(sender.to, tc.expectedTo) {
+				t.Errorf("expected mails to %v, got %v", tc.expectedTo, sender.to)
+			}
+			for i, from := range sender.from {
+				if from != "updater@example.com" || !strings.Contains(sender.messages[i], "Subject: Updates failed for org/repo#1\r\n") {
+					t.Errorf("unexpected mail from %s: %q", from, sender.messages[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNewEmailNotifier(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		addr        string
+		tlsMode     string
+		username    string
+		expectedErr string
+	}{
+		{
+			name:     "STARTTLS with authentication",
+			addr:     "smtp.example.com:587",
+			tlsMode:  smtpTLSStartTLS,
+			username: "updater",
+		},
+		{
+			name:     "implicit TLS",
+			addr:     "smtp.example.com:465",
+			tlsMode:  smtpTLSImplicit,
+			username: "updater",
+		},
+		{
+			name:    "local relay",
+			addr:    "localhost:25",
+			tlsMode: smtpTLSNone,
+		},
+		{
+			name:        "unknown TLS mode",
+			addr:        "smtp.example.com:587",
+			tlsMode:     "ssl",
+			expectedErr: `TLS mode must be starttls, tls or none, not "ssl"`,
+		},
+		{
+			name:        "missing port",
+			addr:        "smtp.example.com",
+			tlsMode:     smtpTLSStartTLS,
+			expectedErr: `invalid SMTP server "smtp.example.com"`,
+		},
+		{
+			name:        "authentication without TLS",
+			addr:        "smtp.example.com:25",
+			tlsMode:     smtpTLSNone,
+			username:    "updater",
+			expectedErr: "refusing to authenticate to smtp.example.com:25 without TLS",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewEmailNotifier(tc.addr, tc.tlsMode, "updater@example.com", tc.username, func() []byte { return []byte("secret") })
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
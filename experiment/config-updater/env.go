@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// environment turns env into KEY=value pairs sorted by key, with expand
+// applied to every value.
+func environment(env map[string]string, expand func(string) string) []string {
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, expand(env[key])))
+	}
+	return pairs
+}
+
+// noGroups expands the references in values for globs.
+var noGroups = regexp.MustCompile(``)
+
+// expand substitutes $1 style references to the capture groups of the
+// matcher's regex in filename into value, as for Target and Env. Globs have
+// no capture groups, so references are dropped.
+func (m *Matcher) expand(filename, value string) string {
+	if m.Glob != "" {
+		return string(noGroups.Expand(nil, []byte(value), []byte(filename), []int{0, len(filename)}))
+	}
+	match := m.Regex.FindStringSubmatchIndex(filename)
+	return string(m.Regex.Expand(nil, []byte(value), []byte(filename), match))
+}
+
+// mergeEnvironment appends the pairs in base to env, except for those with
+// a key already set in env. The operator config wins over our own
+// variables, but is probably a mistake, so each conflict is logged.
+func mergeEnvironment(log *logrus.Entry, env, base []string) []string {
+	set := map[string]bool{}
+	for _, pair := range env {
+		set[strings.SplitN(pair, "=", 2)[0]] = true
+	}
+	merged := append([]string{}, env...)
+	for _, pair := range base {
+		key := strings.SplitN(pair, "=", 2)[0]
+		if set[key] {
+			log.WithField("variable", key).Warn("Configured environment overrides a variable set for every task.")
+			continue
+		}
+		merged = append(merged, pair)
+	}
+	return merged
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestExpand(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		matcher  Matcher
+		filename string
+		value    string
+		expected string
+	}{
+		{name: "no references", matcher: Matcher{Regex: RegexpWrapper{*regexp.MustCompile(`^clusters/(\w+)/`)}}, filename: "clusters/ci/a.yaml", value: "ci", expected: "ci"},
+		{name: "numbered group", matcher: Matcher{Regex: RegexpWrapper{*regexp.MustCompile(`^clusters/(\w+)/`)}}, filename: "clusters/ci/a.yaml", value: "$1", expected: "ci"},
+		{name: "named group", matcher: Matcher{Regex: RegexpWrapper{*regexp.MustCompile(`^clusters/(?P<cluster>\w+)/`)}}, filename: "clusters/ci/a.yaml", value: "/etc/kube/${cluster}.conf", expected: "/etc/kube/ci.conf"},
+		{name: "several groups", matcher: Matcher{Regex: RegexpWrapper{*regexp.MustCompile(`^(\w+)/(\w+)/`)}}, filename: "clusters/ci/a.yaml", value: "${2}-${1}", expected: "ci-clusters"},
+		{name: "missing group", matcher: Matcher{Regex: RegexpWrapper{*regexp.MustCompile(`^clusters/`)}}, filename: "clusters/ci/a.yaml", value: "x${1}y", expected: "xy"},
+		{name: "literal dollar", matcher: Matcher{Regex: RegexpWrapper{*regexp.MustCompile(`^clusters/(\w+)/`)}}, filename: "clusters/ci/a.yaml", value: "$$1", expected: "$1"},
+		{name: "glob has no groups", matcher: Matcher{Glob: "clusters/*/a.yaml"}, filename: "clusters/ci/a.yaml", value: "a${1}b", expected: "ab"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := tc.matcher.expand(tc.filename, tc.value); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMergeEnvironment(t *testing.T) {
+	log, hook := newRecordingLogger()
+	merged := mergeEnvironment(log, []string{"CLUSTER=ci", "PULL_AUTHOR=bot"}, []string{"PULL_NUMBER=1", "PULL_AUTHOR=author"})
+	if expected := []string{"CLUSTER=ci", "PULL_AUTHOR=bot", "PULL_NUMBER=1"}; !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected %q, got %q", expected, merged)
+	}
+	if messages := hook.Messages(); len(messages) != 1 {
+		t.Errorf("expected the conflict to be logged once, got %q", messages)
+	}
+}
+
+func TestHandleEventEnvironment(t *testing.T) {
+	dir := makeRepoDir(t, map[string]string{
+		"config/service.yaml": "kind: Service\n",
+		"config/secret.yaml":  "kind: Secret\n",
+	})
+	defer os.RemoveAll(dir)
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "clusters/ci/a.yaml"},
+			{Filename: "clusters/prod/b.yaml"},
+			{Filename: "clusters/ci/c.yaml"},
+			{Filename: "config/service.yaml"},
+			{Filename: "config/secret.yaml"},
+		}},
+	}
+	s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+		Targets: []string{"config/service.yaml", "config/secret.yaml"},
+		KindEnv: map[string]map[string]string{"Secret": {"VAULT": "on"}},
+		Matchers: []Matcher{{
+			Regex:  RegexpWrapper{*regexp.MustCompile(`^clusters/(?P<cluster>\w+)/`)},
+			Target: "clusters",
+			Env:    map[string]string{"KUBECONFIG": "/etc/kube/${cluster}", "CLUSTER": "$1", "PULL_AUTHOR": "operator"},
+		}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedRan := [][]string{
+		{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+		{"/usr/bin/make", "apply", "WHAT=config/secret.yaml"},
+		{"/usr/bin/make", "clusters"},
+		{"/usr/bin/make", "clusters"},
+	}
+	if !reflect.DeepEqual(executor.ran, expectedRan) {
+		t.Fatalf("expected to run %q, got %q", expectedRan, executor.ran)
+	}
+	pr := func(author, files string) []string {
+		return []string{
+			"PULL_NUMBER=1",
+			"PULL_BASE_REF=master",
+			"PULL_MERGE_SHA=abcdef",
+			"REPO_OWNER=org",
+			"REPO_NAME=repo",
+			"PULL_AUTHOR=" + author,
+			"CHANGED_FILES=" + files,
+		}
+	}
+	expectedEnv := [][]string{
+		pr("author", "config/service.yaml"),
+		append([]string{"VAULT=on"}, pr("author", "config/secret.yaml")...),
+		append([]string{"CLUSTER=ci", "KUBECONFIG=/etc/kube/ci", "PULL_AUTHOR=operator"}, removeEnv(pr("", "clusters/ci/a.yaml\nclusters/ci/c.yaml"), "PULL_AUTHOR")...),
+		append([]string{"CLUSTER=prod", "KUBECONFIG=/etc/kube/prod", "PULL_AUTHOR=operator"}, removeEnv(pr("", "clusters/prod/b.yaml"), "PULL_AUTHOR")...),
+	}
+	for i := range expectedEnv {
+		if !reflect.DeepEqual(executor.env[i], expectedEnv[i]) {
+			t.Errorf("expected %q to be run with\n%q\ngot\n%q", executor.ran[i], expectedEnv[i], executor.env[i])
+		}
+	}
+}
+
+func TestHandleEventTargetCaptureGroups(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "config/infra/prod/a.yaml"},
+			{Filename: "config/web/staging/b.yaml"},
+			{Filename: "config/infra/prod/c.yaml"},
+			{Filename: "config/web/prod/d.yaml"},
+			{Filename: "config/Infra/prod/e.yaml"},
+		}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers: []Matcher{{
+			Regex:  RegexpWrapper{*regexp.MustCompile(`^config/(?P<team>[a-z]+)/(?P<env>[a-z]+)/.*\.yaml$`)},
+			Target: "apply-${team}-${env}",
+			Env:    map[string]string{"ENVIRONMENT": "$2"},
+		}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedRan := [][]string{
+		{"/usr/bin/make", "apply-infra-prod"},
+		{"/usr/bin/make", "apply-web-staging"},
+		{"/usr/bin/make", "apply-web-prod"},
+	}
+	if !reflect.DeepEqual(executor.ran, expectedRan) {
+		t.Errorf("expected to run %q, got %q", expectedRan, executor.ran)
+	}
+	expectedFiles := []string{
+		"CHANGED_FILES=config/infra/prod/a.yaml\nconfig/infra/prod/c.yaml",
+		"CHANGED_FILES=config/web/staging/b.yaml",
+		"CHANGED_FILES=config/web/prod/d.yaml",
+	}
+	for i, expected := range expectedFiles {
+		if i < len(executor.env) && !sets.NewString(executor.env[i]...).Has(expected) {
+			t.Errorf("expected %q to be run with %q, got %q", executor.ran[i], expected, executor.env[i])
+		}
+	}
+}
+
+// removeEnv drops the pair for key from env.
+func removeEnv(env []string, key string) []string {
+	var removed []string
+	for _, pair := range env {
+		if !regexp.MustCompile(`^` + key + `=`).MatchString(pair) {
+			removed = append(removed, pair)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,326 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// pagerDutyEventsURL is the endpoint of the PagerDuty Events API v2.
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// Pager pages the people on call about a target that keeps failing.
+type Pager interface {
+	// Trigger opens an incident, or updates the one open with the same
+	// dedupKey.
+	Trigger(dedupKey, summary string, details map[string]string) error
+	// Resolve closes the incident opened with dedupKey.
+	Resolve(dedupKey string) error
+}
+
+// PagerDutyPager pages through the PagerDuty Events API v2.
+type PagerDutyPager struct {
+	// RoutingKey returns the integration key of the service to page,
+	// which is a secret.
+	RoutingKey func() []byte
+	// URL is the Events API, pagerDutyEventsURL unless set.
+	URL string
+}
+
+// pagerDutyEvent is an event of the PagerDuty Events API v2.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+func (p *PagerDutyPager) Trigger(dedupKey, summary string, details map[string]string) error {
+	return p.send(pagerDutyEvent{
+		EventAction: "trigger",
+		DedupKey:    dedupKey,
+		Payload:     &pagerDutyPayload{Summary: summary, Source: pluginName, Severity: "critical", CustomDetails: details},
+	})
+}
+
+func (p *PagerDutyPager) Resolve(dedupKey string) error {
+	return p.send(pagerDutyEvent{EventAction: "resolve", DedupKey: dedupKey})
+}
+
+func (p *PagerDutyPager) send(event pagerDutyEvent) error {
+	event.RoutingKey = strings.TrimSpace(string(p.RoutingKey()))
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	url := p.URL
+	if url == "" {
+		url = pagerDutyEventsURL
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error sending %s event to PagerDuty: %v", event.EventAction, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("PagerDuty refused %s event with %s: %s", event.EventAction, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// PagerDutyAlerter triggers PagerDuty incidents about targets, one for each
+// target however many times it is triggered.
+type PagerDutyAlerter struct {
+	// RoutingKey returns the integration key of the service to page,
+	// which is a secret.
+	RoutingKey func() []byte
+	// URL is the Events API, pagerDutyEventsURL unless set.
+	URL string
+}
+
+// Trigger opens an incident about target, such as org/repo/jobs, or
+// updates the one already open about it.
+func (a *PagerDutyAlerter) Trigger(summary, target string) error {
+	pager := &PagerDutyPager{RoutingKey: a.RoutingKey, URL: a.URL}
+	return pager.Trigger(pluginName+"/"+target, summary, nil)
+}
+
+// Escalation counts the consecutive failures of a target.
+type Escalation struct {
+	Failures int `json:"failures"`
+	// FailedAt are when the last consecutive failures within the
+	// escalation window happened, up to escalate_after of them.
+	FailedAt []time.Time `json:"failed_at,omitempty"`
+	// FailedIn are the PRs the failures in FailedAt happened in, when they
+	// are counted towards a tracking issue.
+	FailedIn []string `json:"failed_in,omitempty"`
+	// Triggered is set once an incident is open for the target.
+	Triggered bool `json:"triggered"`
+}
+
+// EscalationStore keeps the consecutive failures of each target, and those
+// counted towards its tracking issue.
+type EscalationStore struct {
+	// Path, when set, is the file the failures are written to whenever
+	// they change, so that they survive restarts.
+	Path string
+
+	lock        sync.Mutex
+	escalations map[string]Escalation
+}
+
+// LoadEscalationStore loads the failures saved at path, if any.
+func LoadEscalationStore(path string) (*EscalationStore, error) {
+	e := &EscalationStore{Path: path, escalations: map[string]Escalation{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &e.escalations); err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s: %v", path, err)
+	}
+	return e, nil
+}
+
+// update applies fn to the escalation of key, dropping it once it has no
+// failures and no incident, and saves the result. fn runs with the lock
+// held, so that the failures of a target are counted one event at a time,
+// and so must not page.
+func (e *EscalationStore) update(key string, fn func(*Escalation)) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.escalations == nil {
+		e.escalations = map[string]Escalation{}
+	}
+	escalation := e.escalations[key]
+	fn(&escalation)
+	if escalation.Failures == 0 && !escalation.Triggered {
+		delete(e.escalations, key)
+	} else {
+		e.escalations[key] = escalation
+	}
+	return e.save()
+}
+
+// save writes the failures to Path. It must be called with the lock held.
+func (e *EscalationStore) save() error {
+	if e.Path == "" {
+		return nil
+	}
+	b, err := json.Marshal(e.escalations)
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(e.Path, b); err != nil {
+		return fmt.Errorf("error saving escalations: %v", err)
+	}
+	return nil
+}
+
+// escalations returns the store of failures, which is in memory unless
+// Escalations is set.
+func (s *Server) escalations() *EscalationStore {
+	s.initEscalations.Do(func() {
+		if s.Escalations == nil {
+			s.Escalations = &EscalationStore{escalations: map[string]Escalation{}}
+		}
+	})
+	return s.Escalations
+}
+
+// escalationTarget names what t applies: its config if it is one of the
+// Targets, or else its target.
+func (t task) escalationTarget() string {
+	if t.config != "" {
+		return t.config
+	}
+	return t.target
+}
+
+// escalateAfter is how many times in a row a target may fail before it is
+// paged for, from either of EscalateAfter and AlertThreshold.
+func (c *UpdateConfig) escalateAfter() int {
+	if c.EscalateAfter != 0 {
+		return c.EscalateAfter
+	}
+	return c.AlertThreshold
+}
+
+// escalate counts the consecutive failures of the target of t, paging once
+// there are EscalateAfter of them and resolving the incident once it
+// succeeds again. Failing to page is only logged, as the results are
+// reported on the PR regardless.
+func (s *Server) escalate(c *UpdateConfig, pr github.PullRequest, t task, r result) {
+	escalateAfter := c.escalateAfter()
+	if s.Pager == nil || escalateAfter == 0 {
+		return
+	}
+	repo := pr.Base.Repo.Owner.Login + "/" + pr.Base.Repo.Name
+	target := t.escalationTarget()
+	dedupKey := fmt.Sprintf("%s/%s/%s", pluginName, repo, target)
+	log := s.log.WithField("dedupKey", dedupKey)
+	// What to page is decided with the store locked, but paged once it is
+	// unlocked, so that a slow pager does not hold up every other target.
+	var resolve, trigger, wasTriggered bool
+	var failures int
+	var summary string
+	err := s.escalations().update(dedupKey, func(escalation *Escalation) {
+		wasTriggered = escalation.Triggered
+		if !r.failed() {
+			escalation.Failures = 0
+			escalation.FailedAt = nil
+			resolve = escalation.Triggered
+			escalation.Triggered = false
+			return
+		}
+		escalation.Failures++
+		var trimmed bool
+		escalation.FailedAt, trimmed = recentFailures(escalation.FailedAt, time.Now(), c.EscalateWindow, escalateAfter)
+		summary = fmt.Sprintf("%s failed %d times in a row for %s", target, escalation.Failures, repo)
+		if c.EscalateWindow > 0 {
+			escalation.Failures = len(escalation.FailedAt)
+			times := fmt.Sprintf("%d times", escalation.Failures)
+			if trimmed {
+				times = "at least " + times
+			}
+			summary = fmt.Sprintf("%s failed %s within %v for %s", target, times, c.EscalateWindow, repo)
+		}
+		failures = escalation.Failures
+		trigger = escalation.Failures >= escalateAfter
+		escalation.Triggered = escalation.Triggered || trigger
+	})
+	if err != nil {
+		log.WithError(err).Error("Error saving escalations.")
+	}
+
+	switch {
+	case resolve:
+		if err := s.Pager.Resolve(dedupKey); err != nil {
+			log.WithError(err).Error("Error resolving incident.")
+			// The incident is still open, so the next success resolves it.
+			s.restoreTriggered(dedupKey, true, log)
+			return
+		}
+		log.Info("Resolved incident.")
+	case trigger:
+		details := map[string]string{
+			"pull_request": pr.HTMLURL,
+			"command":      strings.Join(r.command, " "),
+			"error":        firstLines(failureMessage(r)),
+		}
+		if err := s.Pager.Trigger(dedupKey, summary, details); err != nil {
+			log.WithError(err).Error("Error triggering incident.")
+			s.restoreTriggered(dedupKey, wasTriggered, log)
+			return
+		}
+		log.WithField("failures", failures).Info("Triggered incident.")
+	}
+}
+
+// recentFailures adds a failure at now to failedAt, keeping only those
+// within window. Only the last escalateAfter are kept, as they are enough to
+// know whether to page, so that a target failing in a loop cannot grow the
+// store without bound, and trimmed is set when older ones were dropped. None
+// are kept without a window.
+func recentFailures(failedAt []time.Time, now time.Time, window time.Duration, escalateAfter int) (recent []time.Time, trimmed bool) {
+	if window <= 0 {
+		return nil, false
+	}
+	for _, t := range failedAt {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) > escalateAfter {
+		return recent[len(recent)-escalateAfter:], true
+	}
+	return recent, false
+}
+
+// restoreTriggered notes whether an incident is open for dedupKey after
+// failing to page for it.
+func (s *Server) restoreTriggered(dedupKey string, triggered bool, log *logrus.Entry) {
+	if err := s.escalations().update(dedupKey, func(escalation *Escalation) {
+		escalation.Triggered = triggered
+	}); err != nil {
+		log.WithError(err).Error("Error saving escalations.")
+	}
+}
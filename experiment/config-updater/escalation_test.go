@@ -0,0 +1,321 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// fakePager records the incidents it is asked to trigger and resolve.
+type fakePager struct {
+	calls   []string
+	details []map[string]string
+	// triggerFailures and resolveFailures are how many of each fail before
+	// they start succeeding.
+	triggerFailures int
+	resolveFailures int
+	// escalations, when set, must not be locked while paging.
+	escalations *EscalationStore
+}
+
+func (p *fakePager) Trigger(dedupKey, summary string, details map[string]string) error {
+	p.calls = append(p.calls, "trigger "+dedupKey+": "+summary)
+	p.details = append(p.details, details)
+	return p.page(&p.triggerFailures)
+}
+
+func (p *fakePager) Resolve(dedupKey string) error {
+	p.calls = append(p.calls, "resolve "+dedupKey)
+	return p.page(&p.resolveFailures)
+}
+
+func (p *fakePager) page(failures *int) error {
+	if p.escalations != nil {
+		if !p.escalations.lock.TryLock() {
+			p.calls = append(p.calls, "paged with the escalations locked")
+		} else {
+			p.escalations.lock.Unlock()
+		}
+	}
+	if *failures > 0 {
+		*failures--
+		return errors.New("pager is down")
+	}
+	return nil
+}
+
+func TestEscalate(t *testing.T) {
+	var testcases = []struct {
+		name           string
+		escalateAfter  int
+		alertThreshold int
+		escalateWindow time.Duration
+		// failures are whether the target fails in each event in turn.
+		failures        []bool
+		triggerFailures int
+		resolveFailures int
+		expectedCalls   []string
+		// expectedFailedAt is how many failure times are kept in the end.
+		expectedFailedAt int
+	}{
+		{
+			name:          "fail, fail, fail, succeed",
+			escalateAfter: 3,
+			failures:      []bool{true, true, true, false},
+			expectedCalls: []string{
+				"trigger config-updater/org/repo/jobs: jobs failed 3 times in a row for org/repo",
+				"resolve config-updater/org/repo/jobs",
+			},
+		},
+		{
+			name:           "alert threshold",
+			alertThreshold: 2,
+			failures:       []bool{true, true},
+			expectedCalls: []string{
+				"trigger config-updater/org/repo/jobs: jobs failed 2 times in a row for org/repo",
+			},
+		},
+		{
+			name:          "repeated failures update the incident",
+			escalateAfter: 3,
+			failures:      []bool{true, true, true, true},
+			expectedCalls: []string{
+				"trigger config-updater/org/repo/jobs: jobs failed 3 times in a row for org/repo",
+				"trigger config-updater/org/repo/jobs: jobs failed 4 times in a row for org/repo",
+			},
+		},
+		{
+			name:          "a success resets the count",
+			escalateAfter: 3,
+			failures:      []bool{true, true, false, true, true, false},
+		},
+		{
+			name:           "failures within the window",
+			escalateAfter:  3,
+			escalateWindow: time.Hour,
+			failures:       []bool{true, true, true},
+			expectedCalls: []string{
+				"trigger config-updater/org/repo/jobs: jobs failed 3 times within 1h0m0s for org/repo",
+			},
+			expectedFailedAt: 3,
+		},
+		{
+			name:           "only the failures needed to page are kept",
+			escalateAfter:  2,
+			escalateWindow: time.Hour,
+			failures:       []bool{true, true, true, true},
+			expectedCalls: []string{
+				"trigger config-updater/org/repo/jobs: jobs failed 2 times within 1h0m0s for org/repo",
+				"trigger config-updater/org/repo/jobs: jobs failed at least 2 times within 1h0m0s for org/repo",
+				"trigger config-updater/org/repo/jobs: jobs failed at least 2 times within 1h0m0s for org/repo",
+			},
+			expectedFailedAt: 2,
+		},
+		{
+			name:             "failures outside the window do not count",
+			escalateAfter:    2,
+			escalateWindow:   time.Nanosecond,
+			failures:         []bool{true, true, true},
+			expectedFailedAt: 1,
+		},
+		{
+			name:             "a success resets the count within the window",
+			escalateAfter:    2,
+			escalateWindow:   time.Hour,
+			failures:         []bool{true, false, true},
+			expectedFailedAt: 1,
+		},
+		{
+			name:            "failing to trigger retries on the next failure",
+			escalateAfter:   2,
+			failures:        []bool{true, true, true, false},
+			triggerFailures: 1,
+			expectedCalls: []string{
+				"trigger config-updater/org/repo/jobs: jobs failed 2 times in a row for org/repo",
+				"trigger config-updater/org/repo/jobs: jobs failed 3 times in a row for org/repo",
+				"resolve config-updater/org/repo/jobs",
+			},
+		},
+		{
+			name:            "failing to resolve retries on the next success",
+			escalateAfter:   1,
+			failures:        []bool{true, false, false},
+			resolveFailures: 1,
+			expectedCalls: []string{
+				"trigger config-updater/org/repo/jobs: jobs failed 1 times in a row for org/repo",
+				"resolve config-updater/org/repo/jobs",
+				"resolve config-updater/org/repo/jobs",
+			},
+		},
+		{
+			name:     "disabled",
+			failures: []bool{true, true, true, true},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "escalations")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "escalations.json")
+
+			pager := &fakePager{triggerFailures: tc.triggerFailures, resolveFailures: tc.resolveFailures}
+			for _, failed := range tc.failures {
+				// Each event is handled by a new server, loading the
+				// failures saved by the last, as after a restart.
+				escalations, err := LoadEscalationStore(path)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				ghc := &fakegithub.FakeClient{
+					IssueComments:      map[int][]github.IssueComment{},
+					PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+				}
+				s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+					Matchers:       []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+					MaxPRFiles:     defaultMaxPRFiles,
+					EscalateAfter:  tc.escalateAfter,
+					AlertThreshold: tc.alertThreshold,
+					EscalateWindow: tc.escalateWindow,
+				})
+				s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": failed}}
+				s.Pager = pager
+				s.Escalations = escalations
+				pager.escalations = escalations
+
+				if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if !reflect.DeepEqual(pager.calls, tc.expectedCalls) {
+				t.Errorf("expected calls %v, got %v", tc.expectedCalls, pager.calls)
+			}
+			escalations, err := LoadEscalationStore(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual := len(escalations.escalations["config-updater/org/repo/jobs"].FailedAt); actual != tc.expectedFailedAt {
+				t.Errorf("expected %d failure times to be kept, got %d", tc.expectedFailedAt, actual)
+			}
+			for _, details := range pager.details {
+				if details["command"] != "/usr/bin/make jobs" || details["error"] != "it broke" {
+					t.Errorf("unexpected details %v", details)
+				}
+			}
+		})
+	}
+}
+
+func TestPagerDutyPager(t *testing.T) {
+	var testcases = []struct {
+		name          string
+		status        int
+		send          func(p *PagerDutyPager) error
+		expectedEvent string
+		expectedErr   string
+	}{
+		{
+			name:   "trigger",
+			status: http.StatusAccepted,
+			send: func(p *PagerDutyPager) error {
+				return p.Trigger("config-updater/org/repo/jobs", "jobs failed 3 times in a row for org/repo", map[string]string{"command": "/usr/bin/make jobs"})
+			},
+			expectedEvent: `{"routing_key":"key","event_action":"trigger","dedup_key":"config-updater/org/repo/jobs","payload":{"summary":"jobs failed 3 times in a row for org/repo","source":"config-updater","severity":"critical","custom_details":{"command":"/usr/bin/make jobs"}}}`,
+		},
+		{
+			name:   "resolve",
+			status: http.StatusAccepted,
+			send: func(p *PagerDutyPager) error {
+				return p.Resolve("config-updater/org/repo/jobs")
+			},
+			expectedEvent: `{"routing_key":"key","event_action":"resolve","dedup_key":"config-updater/org/repo/jobs"}`,
+		},
+		{
+			name:   "refused",
+			status: http.StatusBadRequest,
+			send: func(p *PagerDutyPager) error {
+				return p.Resolve("config-updater/org/repo/jobs")
+			},
+			expectedEvent: `{"routing_key":"key","event_action":"resolve","dedup_key":"config-updater/org/repo/jobs"}`,
+			expectedErr:   "PagerDuty refused resolve event with 400 Bad Request: invalid event",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var event json.RawMessage
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+					t.Errorf("invalid event: %v", err)
+				}
+				w.WriteHeader(tc.status)
+				if tc.status != http.StatusAccepted {
+					w.Write([]byte("invalid event"))
+				}
+			}))
+			defer server.Close()
+
+			p := &PagerDutyPager{RoutingKey: func() []byte { return []byte("key\n") }, URL: server.URL}
+			err := tc.send(p)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+			if string(event) != tc.expectedEvent {
+				t.Errorf("expected event %s, got %s", tc.expectedEvent, event)
+			}
+		})
+	}
+}
+
+func TestPagerDutyAlerter(t *testing.T) {
+	var event json.RawMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("invalid event: %v", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	a := &PagerDutyAlerter{RoutingKey: func() []byte { return []byte("key\n") }, URL: server.URL}
+	if err := a.Trigger("jobs failed 3 times in a row for org/repo", "org/repo/jobs"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := `{"routing_key":"key","event_action":"trigger","dedup_key":"config-updater/org/repo/jobs","payload":{"summary":"jobs failed 3 times in a row for org/repo","source":"config-updater","severity":"critical"}}`
+	if string(event) != expected {
+		t.Errorf("expected event %s, got %s", expected, event)
+	}
+}
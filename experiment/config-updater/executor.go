@@ -0,0 +1,180 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxLoggedLines is the number of output lines per stream that are
+	// logged in each logInterval; the rest are only counted.
+	maxLoggedLines = 50
+	logInterval    = 10 * time.Second
+)
+
+// Executor runs the tasks determined for a PR.
+type Executor interface {
+	// Run executes the task in dir and returns what it wrote to stdout and
+	// stderr. Output should also be streamed to log as it is produced.
+	Run(ctx context.Context, log *logrus.Entry, dir string, t task) (stdout, stderr []byte, err error)
+}
+
+// imageRunner is implemented by executors that run tasks in their image
+// themselves, rather than through the container runtime.
+type imageRunner interface {
+	runsImages() bool
+}
+
+// execExecutor runs tasks as local processes.
+type execExecutor struct{}
+
+func (e *execExecutor) Run(ctx context.Context, log *logrus.Entry, dir string, t task) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	stdoutLog := newLogWriter(log.WithField("stream", "stdout"))
+	stderrLog := newLogWriter(log.WithField("stream", "stderr"))
+	c := exec.CommandContext(ctx, t.command[0], t.command[1:]...)
+	c.Dir = filepath.Join(dir, t.workdir)
+	c.Env = append(os.Environ(), t.env...)
+	if t.stdin != "" {
+		c.Stdin = strings.NewReader(t.stdin)
+	}
+	var stdoutBuffer, stderrBuffer io.Writer = &stdout, &stderr
+	if t.outputMode == outputModeCombined {
+		// Both streams are written to concurrently, so they share a lock
+		// to interleave whole writes.
+		combined := &syncWriter{w: &stdout}
+		stdoutBuffer, stderrBuffer = combined, combined
+	}
+	c.Stdout = io.MultiWriter(stdoutBuffer, stdoutLog)
+	c.Stderr = io.MultiWriter(stderrBuffer, stderrLog)
+	if t.limits == nil {
+		err := c.Run()
+		stdoutLog.Close()
+		stderrLog.Close()
+		return stdout.Bytes(), stderr.Bytes(), err
+	}
+
+	enforcer := &enforcer{}
+	if t.limits.MaxOutputBytes > 0 {
+		limiter := &outputLimiter{limit: t.limits.MaxOutputBytes, enforcer: enforcer}
+		c.Stdout = limiter.wrap(c.Stdout)
+		c.Stderr = limiter.wrap(c.Stderr)
+	}
+	setProcessGroup(c)
+	if err := c.Start(); err != nil {
+		stdoutLog.Close()
+		stderrLog.Close()
+		return nil, nil, err
+	}
+	enforcer.started(c.Process.Pid)
+	if err := setRlimits(c.Process.Pid, *t.limits); err != nil {
+		log.WithError(err).Warn("Error setting rlimits, only polling the resource usage of the task.")
+	}
+	stop := make(chan struct{})
+	go monitor(enforcer, c.Process.Pid, *t.limits, stop)
+	err := c.Wait()
+	close(stop)
+	stdoutLog.Close()
+	stderrLog.Close()
+	if limitErr := enforcer.exceeded(); limitErr != nil {
+		err = limitErr
+	} else if exceededCPURlimit(c.ProcessState) {
+		err = &limitError{limit: "CPU time", value: t.limits.MaxCPUTime.String()}
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// syncWriter serializes writes to w.
+type syncWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.w.Write(p)
+}
+
+// logWriter logs every line written to it, up to maxLoggedLines in every
+// logInterval so that chatty commands do not flood the logs.
+type logWriter struct {
+	log     *logrus.Entry
+	partial []byte
+
+	windowStart time.Time
+	logged      int
+	suppressed  int
+}
+
+func newLogWriter(log *logrus.Entry) *logWriter {
+	return &logWriter{log: log, windowStart: time.Now()}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.logLine(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *logWriter) logLine(line string) {
+	if time.Since(w.windowStart) >= logInterval {
+		w.flushSuppressed()
+		w.windowStart = time.Now()
+		w.logged = 0
+	}
+	if w.logged >= maxLoggedLines {
+		w.suppressed++
+		return
+	}
+	w.logged++
+	w.log.Info(line)
+}
+
+func (w *logWriter) flushSuppressed() {
+	if w.suppressed > 0 {
+		w.log.Infof("Suppressed %d lines of output.", w.suppressed)
+		w.suppressed = 0
+	}
+}
+
+// Close logs any trailing partial line and the count of suppressed lines.
+func (w *logWriter) Close() {
+	if len(w.partial) > 0 {
+		w.logLine(string(w.partial))
+		w.partial = nil
+	}
+	w.flushSuppressed()
+}
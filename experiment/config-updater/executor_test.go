@@ -0,0 +1,342 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// recordingHook keeps the messages of every entry logged.
+type recordingHook struct {
+	sync.Mutex
+	messages []string
+}
+
+func (h *recordingHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *recordingHook) Fire(entry *logrus.Entry) error {
+	h.Lock()
+	defer h.Unlock()
+	h.messages = append(h.messages, entry.Message)
+	return nil
+}
+
+func (h *recordingHook) Messages() []string {
+	h.Lock()
+	defer h.Unlock()
+	return append([]string{}, h.messages...)
+}
+
+func newRecordingLogger() (*logrus.Entry, *recordingHook) {
+	hook := &recordingHook{}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(hook)
+	return logrus.NewEntry(logger), hook
+}
+
+func TestExecExecutorStreamsOutput(t *testing.T) {
+	log, hook := newRecordingLogger()
+	done := make(chan struct{})
+	var stdout, stderr []byte
+	var err error
+	go func() {
+		defer close(done)
+		stdout, stderr, err = (&execExecutor{}).Run(context.Background(), log, "", task{command: []string{"sh", "-c", "echo one; echo oops >&2; sleep 2; echo two"}})
+	}()
+
+	// The first lines must be logged while the command is still sleeping.
+	deadline := time.Now().Add(time.Second)
+	for {
+		messages := hook.Messages()
+		if len(messages) == 2 {
+			select {
+			case <-done:
+				t.Fatal("command finished before its output was checked")
+			default:
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected output to be logged while the command runs, got %v", messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	<-done
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(stdout) != "one\ntwo\n" {
+		t.Errorf("expected stdout %q, got %q", "one\ntwo\n", string(stdout))
+	}
+	if string(stderr) != "oops\n" {
+		t.Errorf("expected stderr %q, got %q", "oops\n", string(stderr))
+	}
+	messages := hook.Messages()
+	if len(messages) != 3 || messages[2] != "two" {
+		t.Errorf("expected three lines to be logged ending with two, got %v", messages)
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		writes   []string
+		expected []string
+	}{
+		{
+			name:     "lines split across writes",
+			writes:   []string{"on", "e\ntw", "o\nthree"},
+			expected: []string{"one", "two", "three"},
+		},
+		{
+			name:   "chatty output is suppressed",
+			writes: []string{strings.Repeat("line\n", maxLoggedLines+5)},
+			expected: append(
+				strings.Split(strings.TrimSuffix(strings.Repeat("line\n", maxLoggedLines), "\n"), "\n"),
+				fmt.Sprintf("Suppressed %d lines of output.", 5),
+			),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			log, hook := newRecordingLogger()
+			w := newLogWriter(log)
+			for _, write := range tc.writes {
+				if _, err := w.Write([]byte(write)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			w.Close()
+			if messages := hook.Messages(); !reflect.DeepEqual(messages, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, messages)
+			}
+		})
+	}
+}
+
+func TestExecExecutorEnvironment(t *testing.T) {
+	os.Setenv("PULL_NUMBER", "from-server")
+	defer os.Unsetenv("PULL_NUMBER")
+
+	log, _ := newRecordingLogger()
+	stdout, _, err := (&execExecutor{}).Run(context.Background(), log, "", task{
+		command: []string{"sh", "-c", "echo $PULL_NUMBER $REPO_NAME"},
+		env:     []string{"PULL_NUMBER=1", "REPO_NAME=repo"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(stdout) != "1 repo\n" {
+		t.Errorf("expected task variables to override the server's, got %q", string(stdout))
+	}
+}
+
+func TestExecExecutorStdin(t *testing.T) {
+	var testcases = []struct {
+		name   string
+		limits *Limits
+	}{
+		{name: "without limits"},
+		{name: "with limits", limits: &Limits{MaxOutputBytes: 1024}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			log, _ := newRecordingLogger()
+			stdout, _, err := (&execExecutor{}).Run(context.Background(), log, "", task{
+				command: []string{"sh", "-c", "read answer; echo \"answered $answer\"; cat"},
+				stdin:   "yes\nand more\n",
+				limits:  tc.limits,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected := "answered yes\nand more\n"; string(stdout) != expected {
+				t.Errorf("expected stdout %q, got %q", expected, string(stdout))
+			}
+		})
+	}
+}
+
+func TestExecExecutorOutputMode(t *testing.T) {
+	var testcases = []struct {
+		name           string
+		outputMode     string
+		expectedStdout string
+		expectedStderr string
+	}{
+		{
+			name:           "split by default",
+			expectedStdout: "one\nthree\n",
+			expectedStderr: "two\n",
+		},
+		{
+			name:           "combined",
+			outputMode:     outputModeCombined,
+			expectedStdout: "one\ntwo\nthree\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			log, _ := newRecordingLogger()
+			stdout, stderr, err := (&execExecutor{}).Run(context.Background(), log, "", task{
+				command:    []string{"sh", "-c", "echo one; sleep 0.1; echo two >&2; sleep 0.1; echo three"},
+				outputMode: tc.outputMode,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(stdout) != tc.expectedStdout {
+				t.Errorf("expected stdout %q, got %q", tc.expectedStdout, string(stdout))
+			}
+			if string(stderr) != tc.expectedStderr {
+				t.Errorf("expected stderr %q, got %q", tc.expectedStderr, string(stderr))
+			}
+		})
+	}
+}
+
+// TestHelperProcess is not a real test. It is run by other tests in a child
+// process to use up resources as told by its last argument.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("CONFIG_UPDATER_HELPER_PROCESS") != "1" {
+		return
+	}
+	switch os.Args[len(os.Args)-1] {
+	case "memory":
+		hog := make([]byte, 256<<20)
+		for i := range hog {
+			hog[i] = 1
+		}
+		time.Sleep(time.Minute)
+		fmt.Println(len(hog))
+	case "cpu":
+		for i := 0; ; i++ {
+		}
+	case "output":
+		for {
+			fmt.Println(strings.Repeat("x", 1023))
+		}
+	case "ok":
+		fmt.Println("done")
+	}
+	os.Exit(0)
+}
+
+func TestExecExecutorLimits(t *testing.T) {
+	helper := []string{os.Args[0], "-test.run=TestHelperProcess", "--"}
+	env := []string{"CONFIG_UPDATER_HELPER_PROCESS=1"}
+	var testcases = []struct {
+		name    string
+		command []string
+		limits  Limits
+
+		expectedErr    string
+		expectedStdout string
+	}{
+		{
+			name:           "within limits",
+			command:        append(helper, "ok"),
+			limits:         Limits{MaxRSSBytes: 256 << 20, MaxCPUTime: time.Minute, MaxOutputBytes: 1024},
+			expectedStdout: "done\n",
+		},
+		{
+			name:        "memory hog in a child process",
+			command:     []string{"sh", "-c", strings.Join(append(helper, "memory"), " ")},
+			limits:      Limits{MaxRSSBytes: 64 << 20},
+			expectedErr: "killed for exceeding the memory limit of 67108864 bytes",
+		},
+		{
+			name:        "CPU hog",
+			command:     append(helper, "cpu"),
+			limits:      Limits{MaxCPUTime: 300 * time.Millisecond},
+			expectedErr: "killed for exceeding the CPU time limit of 300ms",
+		},
+		{
+			name:           "chatty process",
+			command:        append(helper, "output"),
+			limits:         Limits{MaxOutputBytes: 2048},
+			expectedErr:    "killed for exceeding the output limit of 2048 bytes",
+			expectedStdout: strings.Repeat(strings.Repeat("x", 1023)+"\n", 2),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			log, _ := newRecordingLogger()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			stdout, _, err := (&execExecutor{}).Run(ctx, log, "", task{command: tc.command, env: env, limits: &tc.limits})
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if tc.expectedStdout != "" && string(stdout) != tc.expectedStdout {
+				t.Errorf("expected stdout %q, got %q", tc.expectedStdout, string(stdout))
+			}
+		})
+	}
+}
+
+func TestSetRlimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("rlimits are only set on linux")
+	}
+	c := exec.Command("sleep", "30")
+	if err := c.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() {
+		c.Process.Kill()
+		c.Wait()
+	}()
+	if err := setRlimits(c.Process.Pid, Limits{MaxCPUTime: 1500 * time.Millisecond, MaxAddressSpaceBytes: 1 << 30}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/limits", c.Process.Pid))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{
+		`Max cpu time\s+2\s+3\s+seconds`,
+		`Max address space\s+1073741824\s+1073741824\s+bytes`,
+	} {
+		if !regexp.MustCompile(expected).Match(b) {
+			t.Errorf("expected limits matching %q, got:\n%s", expected, string(b))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// maxFileDiffLines bounds how much of the diff of a file is shown, so that
+// a large change does not push the results out of the comment.
+const maxFileDiffLines = 500
+
+// fileDiff is how the PR changed a file that the tasks updated.
+type fileDiff struct {
+	file string
+	diff string
+}
+
+// diffFiles diffs each file updated by tasks once, against the merge base
+// of base, in the order the tasks update them.
+func diffFiles(r gitRepo, base string, tasks []task) ([]fileDiff, []error) {
+	var diffs []fileDiff
+	var errs []error
+	seen := map[string]bool{}
+	for _, t := range tasks {
+		for _, file := range t.files {
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+			diff, err := r.FileDiff(base, file)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			diffs = append(diffs, fileDiff{file: file, diff: diff})
+		}
+	}
+	return diffs, errs
+}
+
+// truncateDiff keeps the first maxFileDiffLines lines of diff.
+func truncateDiff(diff string) string {
+	lines := strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+	if len(lines) <= maxFileDiffLines {
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(lines[:maxFileDiffLines], "\n") + fmt.Sprintf("\n... %d more lines, see the files of the PR for the rest", len(lines)-maxFileDiffLines)
+}
+
+func formatFileDiffs(diffs []fileDiff) string {
+	var b strings.Builder
+	b.WriteString("The updated files were changed as follows:\n")
+	b.WriteString("<ul>")
+	for _, d := range diffs {
+		if d.diff == "" {
+			b.WriteString(fmt.Sprintf("<li><code>%s</code> is unchanged</li>", html.EscapeString(d.file)))
+			continue
+		}
+		b.WriteString(fmt.Sprintf("<li><details><summary><code>%s</code></summary><pre><code>\n%s\n</code></pre></details></li>", html.EscapeString(d.file), html.EscapeString(sanitize(truncateDiff(d.diff)))))
+	}
+	b.WriteString("</ul>\n")
+	return b.String()
+}
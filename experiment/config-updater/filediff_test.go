@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestTruncateDiff(t *testing.T) {
+	var long []string
+	for i := 0; i < maxFileDiffLines+20; i++ {
+		long = append(long, fmt.Sprintf("+line %d", i))
+	}
+	var testcases = []struct {
+		name     string
+		diff     string
+		expected string
+	}{
+		{
+			name:     "short",
+			diff:     "-kind: Service\n+kind: Deployment\n",
+			expected: "-kind: Service\n+kind: Deployment",
+		},
+		{
+			name:     "long",
+			diff:     strings.Join(long, "\n") + "\n",
+			expected: strings.Join(long[:maxFileDiffLines], "\n") + "\n... 20 more lines, see the files of the PR for the rest",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := truncateDiff(tc.diff); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandleEventShowDiff(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		showDiff        bool
+		expectedComment string
+		unexpected      string
+	}{
+		{
+			name:     "shown before the results",
+			showDiff: true,
+			expectedComment: "The updated files were changed as follows:\n" +
+				"<ul><li><details><summary><code>jobs/a.yaml</code></summary><pre><code>\n-image: app:&lt;old&gt;\n+image: app:&lt;new&gt;\n</code></pre></details></li>" +
+				"<li><code>jobs/b.yaml</code> is unchanged</li></ul>\n" +
+				"The following updates succeeded:\n",
+		},
+		{
+			name:            "not shown by default",
+			expectedComment: "The following updates succeeded:\n",
+			unexpected:      "The updated files were changed as follows",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "jobs/a.yaml"},
+					{Filename: "jobs/b.yaml"},
+				}},
+			}
+			s := newTestServer(&fakeGit{fileDiffs: map[string]string{
+				"jobs/a.yaml": "-image: app:<old>\n+image: app:<new>\n",
+				"jobs/b.yaml": "",
+			}}, ghc, &UpdateConfig{
+				// Both matchers update jobs/a.yaml, which is only shown once.
+				Matchers: []Matcher{
+					{Glob: "jobs/*.yaml", Target: "jobs"},
+					{Glob: "jobs/a.yaml", Target: "audit"},
+				},
+				ShowDiff:   tc.showDiff,
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+			if tc.unexpected != "" && strings.Contains(ghc.IssueCommentsAdded[0], tc.unexpected) {
+				t.Errorf("expected comment not to contain %q, got %q", tc.unexpected, ghc.IssueCommentsAdded[0])
+			}
+		})
+	}
+}
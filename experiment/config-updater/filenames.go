@@ -0,0 +1,83 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+const (
+	// unsafeFilenamesEnv passes unsafe config names in whatEnv.
+	unsafeFilenamesEnv = "env"
+	// unsafeFilenamesFile passes unsafe config names in a file named by
+	// WHAT_FILE, relative to the checkout.
+	unsafeFilenamesFile = "file"
+
+	whatEnv        = "CONFIG_UPDATER_WHAT"
+	whatFilePrefix = ".config-updater-what-"
+)
+
+// shellMetacharacters have a special meaning to the shell even when they
+// are not at the start of a word.
+const shellMetacharacters = "`$\\\"'!#&()*;<>?[]{}|~"
+
+// unsafeFilename determines whether name would break, or worse, be run,
+// when a Makefile interpolates $(WHAT) into a shell command. Other
+// characters, including non-ASCII letters, are passed through untouched.
+func unsafeFilename(name string) bool {
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(shellMetacharacters, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// whatFor returns how to tell make which config to update, which is as the
+// WHAT variable unless its name is unsafe. Then it is passed as configured
+// by UnsafeFilenames, and a warning explains why.
+func (c *UpdateConfig) whatFor(dir, config string) (args, env []string, warning string, err error) {
+	if !unsafeFilename(config) {
+		return []string{fmt.Sprintf("WHAT=%s", config)}, nil, "", nil
+	}
+	switch c.UnsafeFilenames {
+	case "", unsafeFilenamesEnv:
+		env = []string{fmt.Sprintf("%s=%s", whatEnv, config)}
+		warning = fmt.Sprintf("%q has whitespace or shell metacharacters in its name, so it was passed to make in $%s instead of WHAT.", config, whatEnv)
+		return nil, env, warning, nil
+	case unsafeFilenamesFile:
+		// The file is written into the checkout, so that tasks run in a
+		// container find it at the same relative path.
+		f, err := ioutil.TempFile(dir, whatFilePrefix)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("error writing the name of %q to a file: %v", config, err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(config + "\x00"); err != nil {
+			return nil, nil, "", fmt.Errorf("error writing the name of %q to a file: %v", config, err)
+		}
+		name := filepath.Base(f.Name())
+		warning = fmt.Sprintf("%q has whitespace or shell metacharacters in its name, so it was passed to make in the file WHAT_FILE=%s instead of WHAT.", config, name)
+		return []string{fmt.Sprintf("WHAT_FILE=%s", name)}, nil, warning, nil
+	default:
+		return nil, nil, "", fmt.Errorf("unknown unsafe_filenames %q", c.UnsafeFilenames)
+	}
+}
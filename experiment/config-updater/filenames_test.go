@@ -0,0 +1,191 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestUnsafeFilename(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		filename string
+		expected bool
+	}{
+		{name: "plain path", filename: "config/jobs-1_2.yaml"},
+		{name: "non-ASCII letters", filename: "config/größe-設定.yaml"},
+		{name: "equals, plus, comma and at", filename: "config/a=b+c,d@e.yaml"},
+		{name: "space", filename: "config/my jobs.yaml", expected: true},
+		{name: "tab", filename: "config/my\tjobs.yaml", expected: true},
+		{name: "newline", filename: "config/my\njobs.yaml", expected: true},
+		{name: "non-breaking space", filename: "config/my jobs.yaml", expected: true},
+		{name: "dollar", filename: "config/$(reboot).yaml", expected: true},
+		{name: "backtick", filename: "config/`reboot`.yaml", expected: true},
+		{name: "single quote", filename: "config/it's.yaml", expected: true},
+		{name: "double quote", filename: `config/"jobs".yaml`, expected: true},
+		{name: "semicolon", filename: "config/a;reboot.yaml", expected: true},
+		{name: "glob", filename: "config/*.yaml", expected: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := unsafeFilename(tc.filename); actual != tc.expected {
+				t.Errorf("expected unsafeFilename(%q) to be %t, got %t", tc.filename, tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWhatFor(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		mode            string
+		config          string
+		expectedArgs    []string
+		expectedEnv     []string
+		expectedFile    string
+		expectedWarning string
+		expectedErr     bool
+	}{
+		{
+			name:         "safe name is passed as WHAT",
+			config:       "config/jobs.yaml",
+			expectedArgs: []string{"WHAT=config/jobs.yaml"},
+		},
+		{
+			name:         "non-ASCII name is passed as WHAT",
+			mode:         unsafeFilenamesFile,
+			config:       "config/設定.yaml",
+			expectedArgs: []string{"WHAT=config/設定.yaml"},
+		},
+		{
+			name:            "unsafe name is passed in the environment by default",
+			config:          "config/my jobs.yaml",
+			expectedEnv:     []string{"CONFIG_UPDATER_WHAT=config/my jobs.yaml"},
+			expectedWarning: `"config/my jobs.yaml" has whitespace or shell metacharacters in its name, so it was passed to make in $CONFIG_UPDATER_WHAT instead of WHAT.`,
+		},
+		{
+			name:            "unsafe name is passed in the environment",
+			mode:            unsafeFilenamesEnv,
+			config:          `config/"$HOME".yaml`,
+			expectedEnv:     []string{`CONFIG_UPDATER_WHAT=config/"$HOME".yaml`},
+			expectedWarning: `"config/\"$HOME\".yaml" has whitespace or shell metacharacters in its name, so it was passed to make in $CONFIG_UPDATER_WHAT instead of WHAT.`,
+		},
+		{
+			name:            "unsafe name is passed in a file",
+			mode:            unsafeFilenamesFile,
+			config:          "config/it's größer.yaml",
+			expectedFile:    "config/it's größer.yaml\x00",
+			expectedWarning: `has whitespace or shell metacharacters in its name, so it was passed to make in the file WHAT_FILE=.config-updater-what-`,
+		},
+		{
+			name:        "unknown mode",
+			mode:        "quote",
+			config:      "config/my jobs.yaml",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "config-updater")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			c := &UpdateConfig{UnsafeFilenames: tc.mode}
+			args, env, warning, err := c.whatFor(dir, tc.config)
+			if tc.expectedErr != (err != nil) {
+				t.Fatalf("expected error %t, got %v", tc.expectedErr, err)
+			}
+			if !reflect.DeepEqual(env, tc.expectedEnv) {
+				t.Errorf("expected env %q, got %q", tc.expectedEnv, env)
+			}
+			if !strings.Contains(warning, tc.expectedWarning) || (tc.expectedWarning == "") != (warning == "") {
+				t.Errorf("expected warning containing %q, got %q", tc.expectedWarning, warning)
+			}
+			if tc.expectedFile == "" {
+				if !reflect.DeepEqual(args, tc.expectedArgs) {
+					t.Errorf("expected args %q, got %q", tc.expectedArgs, args)
+				}
+				return
+			}
+			if len(args) != 1 || !strings.HasPrefix(args[0], "WHAT_FILE="+whatFilePrefix) {
+				t.Fatalf("expected WHAT_FILE to be set, got %q", args)
+			}
+			content, err := ioutil.ReadFile(filepath.Join(dir, strings.TrimPrefix(args[0], "WHAT_FILE=")))
+			if err != nil {
+				t.Fatalf("failed to read file list: %v", err)
+			}
+			if string(content) != tc.expectedFile {
+				t.Errorf("expected file list %q, got %q", tc.expectedFile, content)
+			}
+		})
+	}
+}
+
+func TestHandleEventUnsafeFilenames(t *testing.T) {
+	dir := makeRepoDir(t, map[string]string{
+		"config/my jobs.yaml": "kind: Service\n",
+		"config/größe.yaml":   "kind: Service\n",
+	})
+	defer os.RemoveAll(dir)
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "config/my jobs.yaml"},
+			{Filename: "config/größe.yaml"},
+		}},
+	}
+	s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+		Targets:           []string{"config/my jobs.yaml", "config/größe.yaml"},
+		KindVerifications: map[string]Verification{"Service": {Target: "verify"}},
+		MaxPRFiles:        defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := [][]string{
+		{"/usr/bin/make", "apply"},
+		{"/usr/bin/make", "verify"},
+		{"/usr/bin/make", "apply", "WHAT=config/größe.yaml"},
+		{"/usr/bin/make", "verify", "WHAT=config/größe.yaml"},
+	}
+	if !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected to run %q, got %q", expected, executor.ran)
+	}
+	for _, i := range []int{0, 1} {
+		if env := executor.env[i]; len(env) == 0 || env[0] != "CONFIG_UPDATER_WHAT=config/my jobs.yaml" {
+			t.Errorf("expected %q to be run with the config in the environment, got %q", executor.ran[i], env)
+		}
+	}
+	checkComment(t, ghc, `The following warnings were raised:
+<ul><li>&#34;config/my jobs.yaml&#34; has whitespace or shell metacharacters in its name, so it was passed to make in $CONFIG_UPDATER_WHAT instead of WHAT.</li></ul>`)
+}
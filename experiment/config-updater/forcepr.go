@@ -0,0 +1,58 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// forceRunMarker marks the updates run for a PR that is not merged, so that
+// nobody mistakes them for those of the merged PR.
+const forceRunMarker = "[FORCE RUN - NOT MERGED]"
+
+// forceRun runs the updates for an open PR as if it was merged, to test the
+// config of a repo against a real PR. It is only reachable with --force-pr,
+// never from a webhook.
+func (s *Server) forceRun(ctx context.Context, org, repo string, number int) error {
+	pr, err := s.github(ctx).GetPullRequest(org, repo, number)
+	if err != nil {
+		return fmt.Errorf("error getting %s/%s#%d: %v", org, repo, number, err)
+	}
+	if pr.State != "open" {
+		return fmt.Errorf("%s/%s#%d is %s, not open", org, repo, number, pr.State)
+	}
+	// GitHub sets the merge commit of an open PR to a test merge, unless
+	// the PR conflicts with its base, when its head is the best we have.
+	if pr.MergeSHA == nil {
+		pr.MergeSHA = &pr.Head.SHA
+	}
+	pre := github.PullRequestEvent{
+		Action:      github.PullRequestActionClosed,
+		Number:      pr.Number,
+		PullRequest: *pr,
+		Repo:        pr.Base.Repo,
+	}
+	eventGUID := fmt.Sprintf("force-%s-%s-%d", org, repo, number)
+	s.log = s.log.WithFields(logrus.Fields{"org": org, "repo": repo, "pr": number, "eventGUID": eventGUID})
+	s.log.Warn("Forcing updates for a PR that is not merged.")
+	return s.update(ctx, eventGUID, pre, nil, true)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestForceRun(t *testing.T) {
+	mergeSHA := "abcdef"
+	var testcases = []struct {
+		name             string
+		pr               github.PullRequest
+		failures         map[string]bool
+		expectedRan      [][]string
+		expectedComments []string
+		expectedErr      string
+		expectedExitCode int
+	}{
+		{
+			name:        "open PR",
+			pr:          github.PullRequest{State: "open", MergeSHA: &mergeSHA},
+			expectedRan: [][]string{{"/usr/bin/make", "jobs"}},
+			expectedComments: []string{
+				"**[FORCE RUN - NOT MERGED]** These updates were run with <code>--force-pr</code> before the PR was merged.",
+				"<li><details><summary>[FORCE RUN - NOT MERGED] <code>/usr/bin/make jobs</code>",
+			},
+		},
+		{
+			name:        "conflicting PR runs its head",
+			pr:          github.PullRequest{State: "open"},
+			expectedRan: [][]string{{"/usr/bin/make", "jobs"}},
+			expectedComments: []string{
+				"<li><details><summary>[FORCE RUN - NOT MERGED] <code>/usr/bin/make jobs</code>",
+			},
+		},
+		{
+			name:             "failed updates are marked",
+			pr:               github.PullRequest{State: "open", MergeSHA: &mergeSHA},
+			failures:         map[string]bool{"/usr/bin/make jobs": true},
+			expectedRan:      [][]string{{"/usr/bin/make", "jobs"}},
+			expectedExitCode: 1,
+			expectedComments: []string{
+				"The following updates failed:\n<ul><li><details><summary>[FORCE RUN - NOT MERGED] <code>/usr/bin/make jobs</code>",
+			},
+		},
+		{
+			name:             "closed PR",
+			pr:               github.PullRequest{State: "closed", MergeSHA: &mergeSHA},
+			expectedErr:      "org/repo#1 is closed, not open",
+			expectedExitCode: 1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			pr := tc.pr
+			pr.Number = 1
+			pr.Head = github.PullRequestBranch{SHA: "123456"}
+			pr.Base = github.PullRequestBranch{
+				Ref:  "master",
+				Repo: github.Repo{Owner: github.User{Login: "org"}, Name: "repo"},
+			}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequests:       map[int]*github.PullRequest{1: &pr},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{failures: tc.failures}
+			s.executor = executor
+
+			err := s.forceRun(context.Background(), "org", "repo", 1)
+			if tc.expectedErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Fatalf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedRan) {
+				t.Errorf("expected to run %q, got %q", tc.expectedRan, executor.ran)
+			}
+			if code := s.runOnceExitCode(err != nil); code != tc.expectedExitCode {
+				t.Errorf("expected exit code %d, got %d", tc.expectedExitCode, code)
+			}
+			if len(tc.expectedComments) == 0 {
+				if len(ghc.IssueCommentsAdded) != 0 {
+					t.Errorf("expected no comments, got %v", ghc.IssueCommentsAdded)
+				}
+				return
+			}
+			if len(ghc.IssueCommentsAdded) != 1 {
+				t.Fatalf("expected one comment, got %v", ghc.IssueCommentsAdded)
+			}
+			for _, expected := range tc.expectedComments {
+				if !strings.Contains(ghc.IssueCommentsAdded[0], expected) {
+					t.Errorf("expected comment to contain %q, got %q", expected, ghc.IssueCommentsAdded[0])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"k8s.io/test-infra/prow/git"
+	"k8s.io/test-infra/prow/github"
+)
+
+// gitClient is the subset of git.Client used by the server.
+type gitClient interface {
+	Clone(ctx context.Context, repo string) (gitRepo, error)
+}
+
+// gitRepo is the subset of git.Repo used by the server.
+type gitRepo interface {
+	Directory() string
+	Checkout(ctx context.Context, commitlike string) error
+	Fetch(ctx context.Context, commitlike string) error
+	ReadFile(ctx context.Context, commitlike, file string) ([]byte, error)
+	Changes(base, head string) ([]github.PullRequestChange, error)
+	FileDiff(base, file string) (string, error)
+	CheckoutNewBranch(branch string) error
+	Commit(name, email, message string) error
+	Push(repo, branch string) error
+	Clean() error
+}
+
+// clientWrapper adapts a git.Client to the gitClient interface.
+type clientWrapper struct {
+	*git.Client
+}
+
+// Clone clones repo unless ctx is already cancelled. The clone itself
+// cannot be interrupted.
+func (c *clientWrapper) Clone(ctx context.Context, repo string) (gitRepo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := c.Client.Clone(repo)
+	if err != nil {
+		return nil, err
+	}
+	return &repoWrapper{r}, nil
+}
+
+// repoWrapper adapts a git.Repo to the gitRepo interface.
+type repoWrapper struct {
+	*git.Repo
+}
+
+func (r *repoWrapper) Directory() string {
+	return r.Dir
+}
+
+// Fetch explicitly fetches commitlike from origin, for when it was not yet
+// available at the time of the clone.
+func (r *repoWrapper) Fetch(ctx context.Context, commitlike string) error {
+	cmd := exec.CommandContext(ctx, "git", "fetch", "origin", commitlike)
+	cmd.Dir = r.Dir
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error fetching %s: %v. output: %s", commitlike, err, string(b))
+	}
+	return nil
+}
+
+// Checkout checks out commitlike, stopping if ctx is cancelled.
+func (r *repoWrapper) Checkout(ctx context.Context, commitlike string) error {
+	cmd := exec.CommandContext(ctx, "git", "checkout", commitlike)
+	cmd.Dir = r.Dir
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error checking out %s: %v. output: %s", commitlike, err, string(b))
+	}
+	return nil
+}
+
+// ReadFile reads file as it is in commitlike, without checking it out. The
+// error satisfies os.IsNotExist if commitlike does not have the file.
+func (r *repoWrapper) ReadFile(ctx context.Context, commitlike, file string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-tree", "--name-only", commitlike, "--", file)
+	cmd.Dir = r.Dir
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s in %s: %v. output: %s", file, commitlike, err, string(b))
+	}
+	if len(b) == 0 {
+		return nil, &os.PathError{Op: "read", Path: commitlike + ":" + file, Err: os.ErrNotExist}
+	}
+	cmd = exec.CommandContext(ctx, "git", "show", commitlike+":"+file)
+	cmd.Dir = r.Dir
+	b, err = cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			b = exitErr.Stderr
+		}
+		return nil, fmt.Errorf("error reading %s in %s: %v. output: %s", file, commitlike, err, string(b))
+	}
+	return b, nil
+}
+
+// Commit stages every change in the worktree and commits it as the given
+// author.
+func (r *repoWrapper) Commit(name, email, message string) error {
+	cmd := exec.Command("git", "add", "--all")
+	cmd.Dir = r.Dir
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error staging changes: %v. output: %s", err, string(b))
+	}
+	cmd = exec.Command("git", "-c", "user.name="+name, "-c", "user.email="+email, "commit", "--message", message)
+	cmd.Dir = r.Dir
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error committing: %v. output: %s", err, string(b))
+	}
+	return nil
+}
+
+// Changes lists the files changed between base and head, in the same form
+// as the GitHub API would.
+func (r *repoWrapper) Changes(base, head string) ([]github.PullRequestChange, error) {
+	// Without -z, paths with unusual characters are quoted.
+	cmd := exec.Command("git", "diff", "--name-status", "-z", "-M", base, head)
+	cmd.Dir = r.Dir
+	b, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			b = exitErr.Stderr
+		}
+		return nil, fmt.Errorf("error diffing %s..%s: %v. output: %s", base, head, err, string(b))
+	}
+	return parseNameStatus(string(b))
+}
+
+// FileDiff shows how file changed between the merge base of base and HEAD,
+// and HEAD.
+func (r *repoWrapper) FileDiff(base, file string) (string, error) {
+	cmd := exec.Command("git", "diff", base+"...HEAD", "--", file)
+	cmd.Dir = r.Dir
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error diffing %s against %s: %v. output: %s", file, base, err, string(b))
+	}
+	return string(b), nil
+}
+
+// parseNameStatus converts the output of git diff --name-status -z, in which
+// each status is followed by one path, or by two for renames and copies, all
+// terminated by NUL, into the changes GitHub would report for the same diff.
+func parseNameStatus(output string) ([]github.PullRequestChange, error) {
+	var changes []github.PullRequestChange
+	fields := strings.Split(strings.TrimSuffix(output, "\x00"), "\x00")
+	if output == "" {
+		fields = nil
+	}
+	for i := 0; i < len(fields); {
+		status := fields[i]
+		paths := 1
+		if strings.HasPrefix(status, "R") || strings.HasPrefix(status, "C") {
+			paths = 2
+		}
+		if status == "" || i+paths >= len(fields) {
+			return nil, fmt.Errorf("unexpected diff entry %q", strings.Join(fields[i:], " "))
+		}
+		change := github.PullRequestChange{Filename: fields[i+paths]}
+		switch status[0] {
+		case 'A':
+			change.Status = "added"
+		case 'D':
+			change.Status = "removed"
+		case 'M', 'T':
+			change.Status = "modified"
+		case 'R':
+			change.Status = "renamed"
+			change.PreviousFilename = fields[i+1]
+		case 'C':
+			change.Status = "copied"
+			change.PreviousFilename = fields[i+1]
+		default:
+			return nil, fmt.Errorf("unknown status %q in diff", status)
+		}
+		changes = append(changes, change)
+		i += paths + 1
+	}
+	return changes, nil
+}
+
+// splitRenames replaces each renamed file in changes with the removal of
+// its previous name and the addition of the new one, and each copied file
+// with its addition, so that they are matched by those statuses. The
+// removal keeps the previous name as its PreviousFilename, for
+// renamedAway.
+func splitRenames(changes []github.PullRequestChange) []github.PullRequestChange {
+	var split []github.PullRequestChange
+	for _, change := range changes {
+		switch change.Status {
+		case github.PullRequestFileRenamed:
+			removed := change
+			removed.Filename = change.PreviousFilename
+			removed.Status = github.PullRequestFileRemoved
+			added := change
+			added.Status = github.PullRequestFileAdded
+			added.PreviousFilename = ""
+			if removed.Filename != "" {
+				split = append(split, removed)
+			}
+			split = append(split, added)
+		case "copied":
+			change.Status = github.PullRequestFileAdded
+			change.PreviousFilename = ""
+			split = append(split, change)
+		default:
+			split = append(split, change)
+		}
+	}
+	return split
+}
+
+// renamedAway determines whether change is the removal splitRenames made of
+// the previous name of a renamed file.
+func renamedAway(change github.PullRequestChange) bool {
+	return change.Status == github.PullRequestFileRemoved && change.PreviousFilename != "" && change.PreviousFilename == change.Filename
+}
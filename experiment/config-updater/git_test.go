@@ -0,0 +1,231 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/git/localgit"
+	"k8s.io/test-infra/prow/github"
+)
+
+func TestChanges(t *testing.T) {
+	lg, c, err := localgit.New()
+	if err != nil {
+		t.Fatalf("Making local git repo: %v", err)
+	}
+	defer func() {
+		if err := lg.Clean(); err != nil {
+			t.Errorf("Error cleaning LocalGit: %v", err)
+		}
+		if err := c.Clean(); err != nil {
+			t.Errorf("Error cleaning Client: %v", err)
+		}
+	}()
+	if err := lg.MakeFakeRepo("org", "repo"); err != nil {
+		t.Fatalf("Making fake repo: %v", err)
+	}
+	if err := lg.AddCommit("org", "repo", map[string][]byte{
+		"config/old.yaml":     []byte("kind: ConfigMap\ndata:\n  a: b\n  c: d\n  e: f\n"),
+		"config/changed.yaml": []byte("kind: Service\n"),
+		"config/deleted.yaml": []byte("kind: Template\n"),
+	}); err != nil {
+		t.Fatalf("Adding base commit: %v", err)
+	}
+	base, err := lg.RevParse("org", "repo", "HEAD")
+	if err != nil {
+		t.Fatalf("Getting base SHA: %v", err)
+	}
+	if err := lg.CheckoutNewBranch("org", "repo", "pr"); err != nil {
+		t.Fatalf("Checking out PR branch: %v", err)
+	}
+	for _, cmd := range [][]string{
+		{"mv", "config/old.yaml", "config/new.yaml"},
+		{"rm", "config/deleted.yaml"},
+	} {
+		if err := runGit(lg, cmd...); err != nil {
+			t.Fatalf("Running git %v: %v", cmd, err)
+		}
+	}
+	if err := lg.AddCommit("org", "repo", map[string][]byte{
+		"config/changed.yaml":      []byte("kind: Deployment\n"),
+		"config/added.yaml":        []byte("kind: Route\n"),
+		"config/spaced \"ü\".yaml": []byte("kind: Secret\n"),
+	}); err != nil {
+		t.Fatalf("Adding PR commit: %v", err)
+	}
+	head, err := lg.RevParse("org", "repo", "HEAD")
+	if err != nil {
+		t.Fatalf("Getting head SHA: %v", err)
+	}
+	// Another PR is merged after the base of this one, which must not be
+	// counted as a change of this one.
+	if err := lg.Checkout("org", "repo", base); err != nil {
+		t.Fatalf("Checking out base: %v", err)
+	}
+	if err := lg.AddCommit("org", "repo", map[string][]byte{"config/other.yaml": []byte("kind: Pod\n")}); err != nil {
+		t.Fatalf("Adding other commit: %v", err)
+	}
+	if err := runGit(lg, "merge", "--no-ff", "--no-edit", "pr"); err != nil {
+		t.Fatalf("Merging PR: %v", err)
+	}
+	merge, err := lg.RevParse("org", "repo", "HEAD")
+	if err != nil {
+		t.Fatalf("Getting merge SHA: %v", err)
+	}
+
+	r, err := (&clientWrapper{c}).Clone(context.Background(), "org/repo")
+	if err != nil {
+		t.Fatalf("Cloning: %v", err)
+	}
+	defer r.Clean()
+
+	changes, err := r.Changes(merge+"^1", merge)
+	if err != nil {
+		t.Fatalf("Listing changes: %v", err)
+	}
+	expected := []github.PullRequestChange{
+		{Filename: "config/added.yaml", Status: "added"},
+		{Filename: "config/changed.yaml", Status: "modified"},
+		{Filename: "config/deleted.yaml", Status: "removed"},
+		{Filename: "config/new.yaml", Status: "renamed", PreviousFilename: "config/old.yaml"},
+		{Filename: "config/spaced \"ü\".yaml", Status: "added"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+
+	if err := r.Checkout(context.Background(), head); err != nil {
+		t.Fatalf("Checking out head: %v", err)
+	}
+	diff, err := r.FileDiff(base, "config/changed.yaml")
+	if err != nil {
+		t.Fatalf("Diffing file: %v", err)
+	}
+	if !strings.Contains(diff, "-kind: Service\n+kind: Deployment\n") || strings.Contains(diff, "added.yaml") {
+		t.Errorf("expected only the diff of config/changed.yaml, got %q", diff)
+	}
+
+	// Files are read from the commit asked for, not from the checkout.
+	b, err := r.ReadFile(context.Background(), merge, "config/other.yaml")
+	if err != nil {
+		t.Fatalf("Reading file: %v", err)
+	}
+	if string(b) != "kind: Pod\n" {
+		t.Errorf("expected config/other.yaml of the merge commit, got %q", string(b))
+	}
+	if _, err := r.ReadFile(context.Background(), merge, "config/old.yaml"); !os.IsNotExist(err) {
+		t.Errorf("expected reading a file the merge commit does not have to fail as not existing, got %v", err)
+	}
+}
+
+func runGit(lg *localgit.LocalGit, arg ...string) error {
+	cmd := exec.Command(lg.Git, arg...)
+	cmd.Dir = filepath.Join(lg.Dir, "org", "repo")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, string(b))
+	}
+	return nil
+}
+
+func TestParseNameStatus(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		output   string
+		expected []github.PullRequestChange
+		err      bool
+	}{
+		{
+			name:   "empty diff",
+			output: "",
+		},
+		{
+			name:   "all statuses",
+			output: "A\x00a\x00M\x00b\x00T\x00c\x00D\x00d\x00R095\x00e\x00f\x00C100\x00g\x00h\x00",
+			expected: []github.PullRequestChange{
+				{Filename: "a", Status: "added"},
+				{Filename: "b", Status: "modified"},
+				{Filename: "c", Status: "modified"},
+				{Filename: "d", Status: "removed"},
+				{Filename: "f", Status: "renamed", PreviousFilename: "e"},
+				{Filename: "h", Status: "copied", PreviousFilename: "g"},
+			},
+		},
+		{
+			name:   "paths are not quoted",
+			output: "A\x00with space.yaml\x00M\x00tab\there \"ü\".yaml\x00R100\x00old\nline\x00new\x00",
+			expected: []github.PullRequestChange{
+				{Filename: "with space.yaml", Status: "added"},
+				{Filename: "tab\there \"ü\".yaml", Status: "modified"},
+				{Filename: "new", Status: "renamed", PreviousFilename: "old\nline"},
+			},
+		},
+		{
+			name:   "status without a path",
+			output: "A\x00",
+			err:    true,
+		},
+		{
+			name:   "rename without a destination",
+			output: "R100\x00a\x00",
+			err:    true,
+		},
+		{
+			name:   "unknown status",
+			output: "X\x00a\x00",
+			err:    true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			changes, err := parseNameStatus(tc.output)
+			if tc.err != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if !reflect.DeepEqual(changes, tc.expected) {
+				t.Errorf("expected changes %v, got %v", tc.expected, changes)
+			}
+		})
+	}
+}
+
+func TestSplitRenames(t *testing.T) {
+	changes := []github.PullRequestChange{
+		{Filename: "a", Status: "added"},
+		{Filename: "c", Status: "renamed", PreviousFilename: "b"},
+		{Filename: "e", Status: "copied", PreviousFilename: "d"},
+		{Filename: "f", Status: "removed"},
+	}
+	expected := []github.PullRequestChange{
+		{Filename: "a", Status: "added"},
+		{Filename: "b", Status: "removed", PreviousFilename: "b"},
+		{Filename: "c", Status: "added"},
+		{Filename: "e", Status: "added"},
+		{Filename: "f", Status: "removed"},
+	}
+	if split := splitRenames(changes); !reflect.DeepEqual(split, expected) {
+		t.Errorf("expected %+v, got %+v", expected, split)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// defaultHelmTarget applies charts in Targets when the config does not set
+// HelmTarget.
+const defaultHelmTarget = "applyHelm"
+
+// helmTaskTarget names the tasks running the HelmBinary of a matcher, which
+// have no make target, in logs and metrics.
+const helmTaskTarget = "helm"
+
+// valuesFile matches the values files at the root of a chart, such as
+// values.yaml and values-prod.yaml.
+var valuesFile = regexp.MustCompile(`^values([-._].*)?\.ya?ml$`)
+
+// chartFor returns the directory of the chart that config is part of in the
+// checkout in dir, or an empty string if it is not in one. Subcharts are
+// part of the chart they are in, which is the one returned.
+func chartFor(dir, config string) string {
+	var chart string
+	for current := path.Dir(config); ; current = path.Dir(current) {
+		resolved, err := checkoutPath(dir, path.Join(current, "Chart.yaml"))
+		if err == nil {
+			if info, err := os.Stat(resolved); err == nil && !info.IsDir() {
+				chart = current
+			}
+		}
+		if current == "." || current == "/" {
+			return chart
+		}
+	}
+}
+
+// inChart determines whether filename is in the chart in chartDir.
+func inChart(chartDir, filename string) bool {
+	return chartDir == "." || strings.HasPrefix(filename, chartDir+"/")
+}
+
+// helmTask returns the task applying the chart in chartDir if any of
+// changes is in it, which rolls the changes up into a single task for the
+// chart. VALUES lists the values files at its root that changed. It returns
+// nil if no change is in the chart.
+func (c *UpdateConfig) helmTask(makeBinary, chartDir, target string, changes []github.PullRequestChange) (*task, error) {
+	var files, values []string
+	for _, change := range changes {
+		if !hasStatus(c.TargetsStatuses, change) || !inChart(chartDir, change.Filename) {
+			continue
+		}
+		files = append(files, change.Filename)
+		if path.Dir(change.Filename) == chartDir && valuesFile.MatchString(path.Base(change.Filename)) && change.Status != github.PullRequestFileRemoved {
+			values = append(values, change.Filename)
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	for _, name := range append([]string{chartDir}, values...) {
+		if unsafeFilename(name) {
+			return nil, fmt.Errorf("cannot pass %q to make, as its name has whitespace or shell metacharacters", name)
+		}
+	}
+
+	command := []string{makeBinary, c.helmTarget(), fmt.Sprintf("CHART=%s", chartDir)}
+	if len(values) > 0 {
+		command = append(command, fmt.Sprintf("VALUES=%s", strings.Join(values, " ")))
+	}
+	t := &task{command: command, target: command[1], files: files, workdir: c.TargetsWorkdir, limits: c.Limits}
+	if rollback, ok := c.TargetRollbacks[target]; ok {
+		t.rollback = &rollback
+	}
+	return t, nil
+}
+
+// isChartFile determines whether config in the checkout in dir is the
+// Chart.yaml or a values file of a chart, with the Chart.yaml next to it.
+func isChartFile(dir, config string) bool {
+	if name := path.Base(config); name != "Chart.yaml" && !valuesFile.MatchString(name) {
+		return false
+	}
+	resolved, err := checkoutPath(dir, path.Join(path.Dir(config), "Chart.yaml"))
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(resolved)
+	return err == nil && !info.IsDir()
+}
+
+// helmUpgradeTasks returns a task running helm upgrade --install for each
+// chart in the checkout in dir that files change the Chart.yaml or values
+// files of, passing the values files that changed with -f. It also returns
+// the files that are not part of a chart, which are not applied.
+func (m *Matcher) helmUpgradeTasks(dir string, files []string) ([]task, []string, error) {
+	var charts, skipped []string
+	filesByChart := map[string][]string{}
+	for _, file := range files {
+		if !isChartFile(dir, file) {
+			skipped = append(skipped, file)
+			continue
+		}
+		chartDir := path.Dir(file)
+		if _, ok := filesByChart[chartDir]; !ok {
+			charts = append(charts, chartDir)
+		}
+		filesByChart[chartDir] = append(filesByChart[chartDir], file)
+	}
+
+	var tasks []task
+	for _, chartDir := range charts {
+		chartFiles := filesByChart[chartDir]
+		release := path.Base(chartDir)
+		if m.HelmReleaseName != "" {
+			release = m.expand(chartFiles[0], m.HelmReleaseName)
+		}
+		if release == "" || release == "." {
+			return nil, nil, fmt.Errorf("cannot name the release of the chart in %s, so it was not applied: set helm_release_name", chartDir)
+		}
+		command := []string{m.HelmBinary, "upgrade", "--install", release, chartDir}
+		for _, file := range chartFiles {
+			if valuesFile.MatchString(path.Base(file)) {
+				command = append(command, "-f", file)
+			}
+		}
+		tasks = append(tasks, task{command: command, target: helmTaskTarget, files: chartFiles, helm: true})
+	}
+	return tasks, skipped, nil
+}
+
+// helmTarget is the make target to apply charts with.
+func (c *UpdateConfig) helmTarget() string {
+	if c.HelmTarget != "" {
+		return c.HelmTarget
+	}
+	return defaultHelmTarget
+}
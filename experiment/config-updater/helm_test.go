@@ -0,0 +1,250 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// helmLayout is a chart for Jenkins agents with a subchart, next to a plain
+// config.
+var helmLayout = map[string]string{
+	"charts/agents/Chart.yaml":                      "apiVersion: v2\nname: agents\n",
+	"charts/agents/values.yaml":                     "replicas: 1\n",
+	"charts/agents/values-prod.yaml":                "replicas: 3\n",
+	"charts/agents/templates/deployment.yaml":       "kind: Deployment\nmetadata:\n  name: {{ .Release.Name }}\n",
+	"charts/agents/charts/cache/Chart.yaml":         "apiVersion: v2\nname: cache\n",
+	"charts/agents/charts/cache/values.yaml":        "size: 1Gi\n",
+	"charts/agents/charts/cache/templates/pvc.yaml": "kind: PersistentVolumeClaim\n",
+	"jobs/job.yaml":                                 "kind: BuildConfig\nmetadata:\n  name: job\n",
+}
+
+func TestChartFor(t *testing.T) {
+	dir := makeRepoDir(t, helmLayout)
+	defer os.RemoveAll(dir)
+
+	var testcases = []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{name: "chart", config: "charts/agents/Chart.yaml", expected: "charts/agents"},
+		{name: "template", config: "charts/agents/templates/deployment.yaml", expected: "charts/agents"},
+		{name: "subchart values are part of the chart", config: "charts/agents/charts/cache/values.yaml", expected: "charts/agents"},
+		{name: "not in a chart", config: "jobs/job.yaml"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if chart := chartFor(dir, tc.config); chart != tc.expected {
+				t.Errorf("expected chart %q, got %q", tc.expected, chart)
+			}
+		})
+	}
+}
+
+func TestHandleEventHelm(t *testing.T) {
+	dir := makeRepoDir(t, helmLayout)
+	defer os.RemoveAll(dir)
+
+	var testcases = []struct {
+		name       string
+		changes    []github.PullRequestChange
+		helmTarget string
+		expected   [][]string
+	}{
+		{
+			name:     "template changes",
+			changes:  []github.PullRequestChange{{Filename: "charts/agents/templates/deployment.yaml"}},
+			expected: [][]string{{"/usr/bin/make", "applyHelm", "CHART=charts/agents"}},
+		},
+		{
+			name: "values changes",
+			changes: []github.PullRequestChange{
+				{Filename: "charts/agents/values.yaml"},
+				{Filename: "charts/agents/values-prod.yaml"},
+				{Filename: "charts/agents/templates/deployment.yaml"},
+			},
+			expected: [][]string{{"/usr/bin/make", "applyHelm", "CHART=charts/agents", "VALUES=charts/agents/values.yaml charts/agents/values-prod.yaml"}},
+		},
+		{
+			name:     "removed values file",
+			changes:  []github.PullRequestChange{{Filename: "charts/agents/values-staging.yaml", Status: github.PullRequestFileRemoved}},
+			expected: [][]string{{"/usr/bin/make", "applyHelm", "CHART=charts/agents"}},
+		},
+		{
+			name: "subchart changes apply the chart",
+			changes: []github.PullRequestChange{
+				{Filename: "charts/agents/charts/cache/values.yaml"},
+				{Filename: "charts/agents/charts/cache/templates/pvc.yaml"},
+			},
+			expected: [][]string{{"/usr/bin/make", "applyHelm", "CHART=charts/agents"}},
+		},
+		{
+			name: "charts and plain configs",
+			changes: []github.PullRequestChange{
+				{Filename: "charts/agents/Chart.yaml"},
+				{Filename: "jobs/job.yaml"},
+			},
+			helmTarget: "helm",
+			expected: [][]string{
+				{"/usr/bin/make", "helm", "CHART=charts/agents"},
+				{"/usr/bin/make", "apply", "WHAT=jobs/job.yaml"},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: tc.changes},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:    []string{"charts/agents/Chart.yaml", "charts/agents/values.yaml", "jobs/job.yaml"},
+				HelmTarget: tc.helmTarget,
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+		})
+	}
+}
+
+func TestHandleEventHelmMatcher(t *testing.T) {
+	dir := makeRepoDir(t, helmLayout)
+	defer os.RemoveAll(dir)
+
+	var testcases = []struct {
+		name             string
+		changes          []github.PullRequestChange
+		releaseName      string
+		expected         [][]string
+		expectedWarnings bool
+	}{
+		{
+			name:     "chart changes",
+			changes:  []github.PullRequestChange{{Filename: "charts/agents/Chart.yaml"}},
+			expected: [][]string{{"/usr/local/bin/helm", "upgrade", "--install", "agents", "charts/agents"}},
+		},
+		{
+			name: "values changes",
+			changes: []github.PullRequestChange{
+				{Filename: "charts/agents/values.yaml"},
+				{Filename: "charts/agents/values-prod.yaml"},
+			},
+			expected: [][]string{{"/usr/local/bin/helm", "upgrade", "--install", "agents", "charts/agents", "-f", "charts/agents/values.yaml", "-f", "charts/agents/values-prod.yaml"}},
+		},
+		{
+			name:        "release named from the path",
+			changes:     []github.PullRequestChange{{Filename: "charts/agents/charts/cache/values.yaml"}},
+			releaseName: "agents-${1}",
+			expected:    [][]string{{"/usr/local/bin/helm", "upgrade", "--install", "agents-cache", "charts/agents/charts/cache", "-f", "charts/agents/charts/cache/values.yaml"}},
+		},
+		{
+			name: "files next to no Chart.yaml are not applied",
+			changes: []github.PullRequestChange{
+				{Filename: "charts/agents/Chart.yaml"},
+				{Filename: "charts/agents/templates/deployment.yaml"},
+			},
+			expected:         [][]string{{"/usr/local/bin/helm", "upgrade", "--install", "agents", "charts/agents"}},
+			expectedWarnings: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: tc.changes},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Matchers: []Matcher{{
+					Regex:           RegexpWrapper{*regexp.MustCompile(`^charts/(?:agents/charts/)?([^/]+)/`)},
+					HelmBinary:      "/usr/local/bin/helm",
+					HelmReleaseName: tc.releaseName,
+				}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+			warned := len(ghc.IssueCommentsAdded) == 1 && strings.Contains(ghc.IssueCommentsAdded[0], "helm did not apply them")
+			if warned != tc.expectedWarnings {
+				t.Errorf("expected a warning to be %t, got comments %v", tc.expectedWarnings, ghc.IssueCommentsAdded)
+			}
+		})
+	}
+}
+
+func TestRunTaskHelmBinary(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		command     []string
+		expectedRan bool
+	}{
+		{
+			name:        "helm binary of the server config",
+			command:     []string{"/usr/local/bin/helm", "upgrade", "--install", "agents", "charts/agents"},
+			expectedRan: true,
+		},
+		{
+			name:    "any other binary",
+			command: []string{"/bin/sh", "upgrade", "--install", "agents", "charts/agents"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(&fakeGit{}, &fakegithub.FakeClient{}, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "charts/**", HelmBinary: "/usr/local/bin/helm"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			r := s.runTask(context.Background(), "guid", "/", task{command: tc.command, helm: true})
+			if ran := len(executor.ran) == 1; ran != tc.expectedRan {
+				t.Errorf("expected running to be %t, got %t with error %v", tc.expectedRan, ran, r.err)
+			}
+			if _, refused := r.err.(*notAllowedError); refused == tc.expectedRan {
+				t.Errorf("expected refusing to be %t, got error %v", !tc.expectedRan, r.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// JenkinsTrigger starts builds of jobs on a Jenkins controller through its
+// remote access API.
+type JenkinsTrigger struct {
+	// URL is the base URL of the Jenkins controller.
+	URL string
+	// Token is the authentication token configured on the jobs to allow
+	// remote builds.
+	Token string
+}
+
+// Trigger requests a build of jobName.
+func (j *JenkinsTrigger) Trigger(jobName string) error {
+	u := fmt.Sprintf("%s/job/%s/build?token=%s", strings.TrimSuffix(j.URL, "/"), url.PathEscape(jobName), url.QueryEscape(j.Token))
+	resp, err := http.Post(u, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("response not 2XX: %s", resp.Status)
+	}
+	return nil
+}
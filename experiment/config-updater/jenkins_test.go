@@ -0,0 +1,79 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJenkinsTrigger(t *testing.T) {
+	var testcases = []struct {
+		name   string
+		job    string
+		status int
+
+		expectedURI string
+		expectedErr bool
+	}{
+		{
+			name:   "build is triggered",
+			job:    "my-job",
+			status: http.StatusCreated,
+
+			expectedURI: "/job/my-job/build?token=s%26cret",
+		},
+		{
+			name:   "job names are escaped",
+			job:    "my job",
+			status: http.StatusCreated,
+
+			expectedURI: "/job/my%20job/build?token=s%26cret",
+		},
+		{
+			name:   "error status is reported",
+			job:    "my-job",
+			status: http.StatusForbidden,
+
+			expectedURI: "/job/my-job/build?token=s%26cret",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var method, uri string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, uri = r.Method, r.RequestURI
+				w.WriteHeader(tc.status)
+			}))
+			defer ts.Close()
+
+			err := (&JenkinsTrigger{URL: ts.URL + "/", Token: "s&cret"}).Trigger(tc.job)
+			if tc.expectedErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if method != http.MethodPost {
+				t.Errorf("expected a POST, got %s", method)
+			}
+			if uri != tc.expectedURI {
+				t.Errorf("expected request to %s, got %s", tc.expectedURI, uri)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// maxJJBErrorLength bounds the error reported for a job definition, which
+// is the last line of a traceback that may be far longer.
+const maxJJBErrorLength = 300
+
+// defaultJJBCommand tests job definitions without touching Jenkins.
+var defaultJJBCommand = []string{"/usr/bin/jenkins-jobs", "test"}
+
+// JJBValidation tests the Jenkins Job Builder definitions that matchers
+// apply before running the matchers, so that a broken definition fails on
+// its own with a short error rather than deep inside the make target.
+type JJBValidation struct {
+	// Paths are globs, matched like Matcher.Glob, of the files holding job
+	// definitions.
+	Paths []string `json:"paths"`
+	// Command is run with each changed file appended. It is
+	// /usr/bin/jenkins-jobs test by default, which must then be in
+	// allowed_executables like any other command.
+	Command []string `json:"command,omitempty" yaml:"command,omitempty"`
+}
+
+// command is the command testing a file, without the file.
+func (j *JJBValidation) command() []string {
+	if len(j.Command) > 0 {
+		return j.Command
+	}
+	return defaultJJBCommand
+}
+
+// validate checks that the validation has valid paths, if it is set.
+func (j *JJBValidation) validate() error {
+	if j == nil {
+		return nil
+	}
+	if len(j.Paths) == 0 {
+		return fmt.Errorf("sets no paths")
+	}
+	for _, path := range j.Paths {
+		if _, err := filepath.Match(path, ""); err != nil {
+			return fmt.Errorf("has invalid path %q: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// matches determines whether filename holds job definitions.
+func (j *JJBValidation) matches(filename string) bool {
+	for _, path := range j.Paths {
+		if matched, _ := filepath.Match(path, filename); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateJobs tests the job definitions among files, returning the files
+// that may be applied and a failure for each broken definition. Files are
+// only tested once per event, however many matchers apply them, with the
+// failures of those already tested in validated.
+func (s *Server) validateJobs(ctx context.Context, eventGUID, dir string, j *JJBValidation, files []string, validated map[string]*result) (valid []string, failed []result) {
+	for _, file := range files {
+		if !j.matches(file) {
+			valid = append(valid, file)
+			continue
+		}
+		failure, ok := validated[file]
+		if !ok {
+			command := append(append([]string{}, j.command()...), file)
+			validation := s.runTask(ctx, eventGUID, dir, task{command: command, target: "jjb-validation"})
+			if validation.err != nil {
+				failure = &result{command: command, exitCode: validation.exitCode, stderr: conciseJJBError(validation), err: validation.err}
+				failed = append(failed, *failure)
+			}
+			validated[file] = failure
+		}
+		if failure == nil {
+			valid = append(valid, file)
+		}
+	}
+	return valid, failed
+}
+
+// conciseJJBError picks the line explaining why a definition is broken,
+// which jenkins-jobs prints last, after any traceback.
+func conciseJJBError(r result) string {
+	for _, output := range []string{r.stderr, r.stdout} {
+		lines := strings.Split(strings.TrimSpace(output), "\n")
+		if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+			if len(last) > maxJJBErrorLength {
+				last = last[:maxJJBErrorLength-3] + "..."
+			}
+			return last
+		}
+	}
+	return r.err.Error()
+}
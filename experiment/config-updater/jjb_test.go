@@ -0,0 +1,150 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestJJBValidationValidate(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		validation  *JJBValidation
+		expectedErr string
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:       "valid",
+			validation: &JJBValidation{Paths: []string{"jobs/*.yaml"}},
+		},
+		{
+			name:        "no paths",
+			validation:  &JJBValidation{Command: []string{"/usr/bin/jenkins-jobs", "test"}},
+			expectedErr: "sets no paths",
+		},
+		{
+			name:        "invalid path",
+			validation:  &JJBValidation{Paths: []string{"jobs/["}},
+			expectedErr: `has invalid path "jobs/["`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.validation.validate()
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestConciseJJBError(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		result   result
+		expected string
+	}{
+		{
+			name: "last line of the traceback",
+			result: result{
+				stderr: "Traceback (most recent call last):\n  File \"/usr/bin/jenkins-jobs\", line 10\njenkins_jobs.errors.JenkinsJobsException: Unknown entry point or macro 'shel' for component type: 'builder'.\n\n",
+				err:    fakeExitError(1),
+			},
+			expected: "jenkins_jobs.errors.JenkinsJobsException: Unknown entry point or macro 'shel' for component type: 'builder'.",
+		},
+		{
+			name:     "falls back to stdout",
+			result:   result{stdout: "INFO:jenkins_jobs.builder:Number of jobs generated:  0\nno jobs\n", err: fakeExitError(1)},
+			expected: "no jobs",
+		},
+		{
+			name:     "falls back to the error",
+			result:   result{err: fakeExitError(1)},
+			expected: "exit status 1",
+		},
+		{
+			name:     "long lines are truncated",
+			result:   result{stderr: strings.Repeat("x", 400), err: fakeExitError(1)},
+			expected: strings.Repeat("x", maxJJBErrorLength-3) + "...",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := conciseJJBError(tc.result); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandleEventJJBValidation(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "jobs/good.yaml"},
+			{Filename: "jobs/bad.yaml"},
+			{Filename: "jobs/README.md"},
+		}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers: []Matcher{
+			{Glob: "jobs/*", Target: "jobs"},
+			{Glob: "jobs/*.yaml", Target: "jobs-audit"},
+		},
+		JJBValidation:      &JJBValidation{Paths: []string{"jobs/*.yaml"}},
+		AllowedExecutables: []string{"/usr/bin/make", "/usr/bin/jenkins-jobs"},
+		MaxPRFiles:         defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{failures: map[string]bool{"/usr/bin/jenkins-jobs test jobs/bad.yaml": true}}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Each definition is tested once, before anything is applied.
+	expected := [][]string{
+		{"/usr/bin/jenkins-jobs", "test", "jobs/good.yaml"},
+		{"/usr/bin/jenkins-jobs", "test", "jobs/bad.yaml"},
+		{"/usr/bin/make", "jobs"},
+		{"/usr/bin/make", "jobs-audit"},
+	}
+	if !reflect.DeepEqual(executor.ran, expected) {
+		t.Fatalf("expected to run %q, got %q", expected, executor.ran)
+	}
+	for i, files := range []string{"jobs/good.yaml\njobs/README.md", "jobs/good.yaml"} {
+		env := executor.env[i+2]
+		if changed := env[len(env)-1]; changed != "CHANGED_FILES="+files {
+			t.Errorf("expected %s to apply %q, got %q", expected[i+2][1], files, changed)
+		}
+	}
+	checkComment(t, ghc, "<code>/usr/bin/jenkins-jobs test jobs/bad.yaml</code> exited with code 2")
+	if comment := ghc.IssueCommentsAdded[0]; strings.Count(comment, "jenkins-jobs test jobs/bad.yaml</code> exited") != 1 || !strings.Contains(comment, "it broke") {
+		t.Errorf("expected a single concise failure for the broken definition, got %q", comment)
+	}
+}
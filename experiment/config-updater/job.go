@@ -0,0 +1,330 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// defaultJobDeadline bounds how long a Job may take, scheduling
+	// included.
+	defaultJobDeadline = 30 * time.Minute
+	// defaultJobPollInterval is how often we check whether a Job is done.
+	defaultJobPollInterval = 5 * time.Second
+	// defaultCloneImage clones the repo into the workspace of each Job.
+	defaultCloneImage = "alpine/git"
+	// jobTTL lets the cluster clean up Jobs we failed to delete.
+	jobTTL = int32(time.Hour / time.Second)
+
+	jobContainer = "task"
+)
+
+// JobExecutor runs tasks as Kubernetes Jobs, so that a runaway task cannot
+// take down the server along with it. The Job clones the repo at the commit
+// checked out locally, so the local checkout is only used to find that out.
+//
+// The output of a task is read from the logs of its container once the Job
+// is done, so nothing is streamed while it runs, stdout and stderr come
+// merged, and the output of the clone is not reported. Every Job is
+// deleted when Run returns, including when it is cancelled or runs out of
+// time; one that cannot be deleted is left for the cluster to remove after
+// jobTTL.
+type JobExecutor struct {
+	Client    kubernetes.Interface
+	Namespace string
+	// Image runs tasks that do not have an image of their own.
+	Image          string
+	ServiceAccount string
+	Resources      corev1.ResourceRequirements
+	// CloneImage must have git, and clones the repo for the task.
+	CloneImage string
+	// CloneBase is prefixed to org/repo to get the URL to clone.
+	CloneBase string
+	// Deadline bounds how long each Job may take, including the time it
+	// takes to be scheduled.
+	Deadline     time.Duration
+	PollInterval time.Duration
+
+	// logs streams the output of a container. It is replaced in tests, as
+	// the fake clientset cannot serve logs.
+	logs func(namespace, pod, container string) (io.ReadCloser, error)
+}
+
+// NewJobExecutor creates a JobExecutor that runs Jobs in namespace.
+func NewJobExecutor(client kubernetes.Interface, namespace, image string) *JobExecutor {
+	e := &JobExecutor{
+		Client:       client,
+		Namespace:    namespace,
+		Image:        image,
+		CloneImage:   defaultCloneImage,
+		CloneBase:    "https://github.com",
+		Deadline:     defaultJobDeadline,
+		PollInterval: defaultJobPollInterval,
+	}
+	e.logs = func(namespace, pod, container string) (io.ReadCloser, error) {
+		return e.Client.CoreV1().Pods(namespace).GetLogs(pod, &corev1.PodLogOptions{Container: container}).Stream()
+	}
+	return e
+}
+
+// runsImages tells the server not to wrap commands for a container runtime,
+// as the Job already runs them in the image of the task.
+func (e *JobExecutor) runsImages() bool {
+	return true
+}
+
+func (e *JobExecutor) Run(ctx context.Context, log *logrus.Entry, dir string, t task) ([]byte, []byte, error) {
+	revision, err := revParse(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	job, err := e.job(t, revision)
+	if err != nil {
+		return nil, nil, err
+	}
+	job, err = e.Client.BatchV1().Jobs(e.Namespace).Create(job)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating job: %v", err)
+	}
+	log = log.WithField("job", job.Name)
+	log.Info("Created job.")
+	defer func() {
+		propagation := metav1.DeletePropagationBackground
+		if err := e.Client.BatchV1().Jobs(e.Namespace).Delete(job.Name, &metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil {
+			log.WithError(err).Warn("Error deleting job, leaving it to expire.")
+		}
+	}()
+
+	pod, err := e.wait(ctx, job.Name)
+	if pod == nil {
+		return nil, nil, err
+	}
+	// Jobs merge stdout and stderr, so all output is reported as stdout.
+	var stdout bytes.Buffer
+	if logs, logErr := e.logs(e.Namespace, pod.Name, jobContainer); logErr != nil {
+		log.WithError(logErr).Warn("Error getting job logs.")
+	} else {
+		logWriter := newLogWriter(log.WithField("stream", "stdout"))
+		if _, logErr := io.Copy(io.MultiWriter(&stdout, logWriter), logs); logErr != nil {
+			log.WithError(logErr).Warn("Error reading job logs.")
+		}
+		logWriter.Close()
+		logs.Close()
+	}
+	return stdout.Bytes(), nil, err
+}
+
+// job describes the Job that runs t with the repo cloned at revision.
+func (e *JobExecutor) job(t task, revision string) (*batchv1.Job, error) {
+	var env []corev1.EnvVar
+	values := map[string]string{}
+	for _, variable := range t.env {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		values[parts[0]] = parts[1]
+		env = append(env, corev1.EnvVar{Name: parts[0], Value: parts[1]})
+	}
+	if t.stdin != "" {
+		return nil, fmt.Errorf("cannot write to the standard input of %q when running it as a job", strings.Join(t.command, " "))
+	}
+	if values["REPO_OWNER"] == "" || values["REPO_NAME"] == "" {
+		return nil, fmt.Errorf("cannot run %q as a job without knowing which repo to clone", strings.Join(t.command, " "))
+	}
+	image := e.Image
+	if t.image != "" {
+		image = t.image
+	}
+	if image == "" {
+		return nil, fmt.Errorf("no image to run %q in", strings.Join(t.command, " "))
+	}
+	cloneURL := fmt.Sprintf("%s/%s/%s", e.CloneBase, values["REPO_OWNER"], values["REPO_NAME"])
+
+	backoffLimit := int32(0)
+	deadline := int64(e.Deadline / time.Second)
+	ttl := jobTTL
+	workspace := []corev1.VolumeMount{{Name: "workspace", MountPath: containerWorkDir}}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "config-updater-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+			Labels: map[string]string{"app": pluginName, "target": labelValue(t.target)},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			ActiveDeadlineSeconds:   &deadline,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": pluginName},
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: e.ServiceAccount,
+					InitContainers: []corev1.Container{{
+						Name:         "clone",
+						Image:        e.CloneImage,
+						Command:      []string{"/bin/sh", "-c", `git clone "$0" "$1" && git -C "$1" checkout "$2"`, cloneURL, containerWorkDir, revision},
+						VolumeMounts: workspace,
+					}},
+					Containers: []corev1.Container{{
+						Name:         jobContainer,
+						Image:        image,
+						Command:      t.command,
+						WorkingDir:   path.Join(containerWorkDir, t.workdir),
+						Env:          env,
+						Resources:    e.Resources,
+						VolumeMounts: workspace,
+					}},
+					Volumes: []corev1.Volume{{
+						Name:         "workspace",
+						VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+					}},
+				},
+			},
+		},
+	}, nil
+}
+
+// wait polls the Job until it finishes or runs out of time, and returns
+// its pod, if it got one.
+func (e *JobExecutor) wait(ctx context.Context, name string) (*corev1.Pod, error) {
+	deadline := time.NewTimer(e.Deadline)
+	defer deadline.Stop()
+	ticker := time.NewTicker(e.PollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := e.Client.BatchV1().Jobs(e.Namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting job %s: %v", name, err)
+		}
+		pods, err := e.Client.CoreV1().Pods(e.Namespace).List(metav1.ListOptions{LabelSelector: "job-name=" + name})
+		if err != nil {
+			return nil, fmt.Errorf("error listing pods of job %s: %v", name, err)
+		}
+		var pod *corev1.Pod
+		if len(pods.Items) > 0 {
+			pod = &pods.Items[0]
+		}
+
+		if job.Status.Succeeded > 0 {
+			return pod, nil
+		}
+		for _, condition := range job.Status.Conditions {
+			if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+				if message := unschedulable(pod); message != "" {
+					return nil, fmt.Errorf("job %s could not be scheduled: %s", name, message)
+				}
+				return pod, &jobError{name: name, reason: condition.Message, exitCode: containerExitCode(pod)}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return pod, ctx.Err()
+		case <-deadline.C:
+			if message := unschedulable(pod); message != "" {
+				return nil, fmt.Errorf("job %s could not be scheduled: %s", name, message)
+			}
+			return pod, fmt.Errorf("job %s did not finish within %v", name, e.Deadline)
+		case <-ticker.C:
+		}
+	}
+}
+
+// jobError is returned when the task in a Job fails.
+type jobError struct {
+	name     string
+	reason   string
+	exitCode int
+}
+
+func (e *jobError) Error() string {
+	return fmt.Sprintf("job %s failed: %s", e.name, e.reason)
+}
+
+func (e *jobError) ExitCode() int {
+	return e.exitCode
+}
+
+// unschedulable explains why pod could not be scheduled, or returns the
+// empty string if it could.
+func unschedulable(pod *corev1.Pod) string {
+	if pod == nil {
+		return "no pod was created"
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+			return condition.Message
+		}
+	}
+	return ""
+}
+
+// containerExitCode returns the exit code of the task in pod, or -1 if it
+// did not exit.
+func containerExitCode(pod *corev1.Pod) int {
+	if pod == nil {
+		return -1
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == jobContainer && status.State.Terminated != nil {
+			return int(status.State.Terminated.ExitCode)
+		}
+	}
+	return -1
+}
+
+// labelValue shortens s to fit in a label value.
+func labelValue(s string) string {
+	s = strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, s), "-_.")
+	if len(s) > 63 {
+		s = strings.Trim(s[:63], "-_.")
+	}
+	return s
+}
+
+// revParse returns the commit checked out in dir.
+func revParse(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	b, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error getting the commit checked out in %s: %v", dir, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
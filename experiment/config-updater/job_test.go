@@ -0,0 +1,263 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"k8s.io/test-infra/prow/git/localgit"
+)
+
+func TestJobExecutor(t *testing.T) {
+	lg, c, err := localgit.New()
+	if err != nil {
+		t.Fatalf("Making local git repo: %v", err)
+	}
+	defer func() {
+		if err := lg.Clean(); err != nil {
+			t.Errorf("Error cleaning LocalGit: %v", err)
+		}
+		if err := c.Clean(); err != nil {
+			t.Errorf("Error cleaning Client: %v", err)
+		}
+	}()
+	if err := lg.MakeFakeRepo("org", "repo"); err != nil {
+		t.Fatalf("Making fake repo: %v", err)
+	}
+	revision, err := lg.RevParse("org", "repo", "HEAD")
+	if err != nil {
+		t.Fatalf("Getting SHA: %v", err)
+	}
+	revision = strings.TrimSpace(revision)
+	dir := filepath.Join(lg.Dir, "org", "repo")
+
+	env := []string{"REPO_OWNER=org", "REPO_NAME=repo", "PULL_NUMBER=1"}
+	var testcases = []struct {
+		name   string
+		task   task
+		status batchv1.JobStatus
+		pod    *corev1.Pod
+
+		expectedImage    string
+		expectedStdout   string
+		expectedErr      string
+		expectedExitCode int
+		expectedJob      bool
+	}{
+		{
+			name:             "job succeeds",
+			task:             task{command: []string{"/usr/bin/make", "jobs"}, target: "jobs", env: env},
+			status:           batchv1.JobStatus{Succeeded: 1},
+			pod:              jobPod(0),
+			expectedImage:    "quay.io/org/tools:latest",
+			expectedStdout:   "applied\n",
+			expectedExitCode: 0,
+			expectedJob:      true,
+		},
+		{
+			name:             "task image overrides the default",
+			task:             task{command: []string{"/usr/bin/make", "jobs"}, target: "jobs", env: env, image: "quay.io/org/tools:v1"},
+			status:           batchv1.JobStatus{Succeeded: 1},
+			pod:              jobPod(0),
+			expectedImage:    "quay.io/org/tools:v1",
+			expectedStdout:   "applied\n",
+			expectedExitCode: 0,
+			expectedJob:      true,
+		},
+		{
+			name: "job fails",
+			task: task{command: []string{"/usr/bin/make", "jobs"}, target: "jobs", env: env},
+			status: batchv1.JobStatus{Failed: 1, Conditions: []batchv1.JobCondition{
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "Job has reached the specified backoff limit"},
+			}},
+			pod:              jobPod(2),
+			expectedImage:    "quay.io/org/tools:latest",
+			expectedStdout:   "applied\n",
+			expectedErr:      "failed: Job has reached the specified backoff limit",
+			expectedExitCode: 2,
+			expectedJob:      true,
+		},
+		{
+			name: "job cannot be scheduled",
+			task: task{command: []string{"/usr/bin/make", "jobs"}, target: "jobs", env: env},
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "jobs"},
+				Status: corev1.PodStatus{Conditions: []corev1.PodCondition{
+					{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Message: "0/3 nodes are available: 3 Insufficient memory."},
+				}},
+			},
+			expectedImage:    "quay.io/org/tools:latest",
+			expectedErr:      "could not be scheduled: 0/3 nodes are available: 3 Insufficient memory.",
+			expectedExitCode: -1,
+			expectedJob:      true,
+		},
+		{
+			name:             "stdin cannot be written",
+			task:             task{command: []string{"/usr/bin/make", "jobs"}, target: "jobs", env: env, stdin: "yes\n"},
+			expectedErr:      "cannot write to the standard input",
+			expectedExitCode: -1,
+		},
+		{
+			name:             "repo is unknown",
+			task:             task{command: []string{"/usr/bin/make", "jobs"}, target: "jobs"},
+			expectedErr:      "without knowing which repo to clone",
+			expectedExitCode: -1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			var created *batchv1.Job
+			client.PrependReactor("create", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				created = action.(clienttesting.CreateAction).GetObject().(*batchv1.Job)
+				return false, nil, nil
+			})
+			client.PrependReactor("get", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				job := created.DeepCopy()
+				job.Status = tc.status
+				return true, job, nil
+			})
+			client.PrependReactor("list", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				pods := &corev1.PodList{}
+				if selector := action.(clienttesting.ListAction).GetListRestrictions().Labels.String(); selector != "job-name="+created.Name {
+					t.Errorf("expected to list the pods of %s, got selector %q", created.Name, selector)
+				}
+				if tc.pod != nil {
+					pod := tc.pod.DeepCopy()
+					pod.Labels = map[string]string{"job-name": created.Name}
+					pods.Items = append(pods.Items, *pod)
+				}
+				return true, pods, nil
+			})
+			e := NewJobExecutor(client, "jobs", "quay.io/org/tools:latest")
+			e.ServiceAccount = "updater"
+			e.Resources = corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}}
+			e.Deadline = 50 * time.Millisecond
+			e.PollInterval = 10 * time.Millisecond
+			e.logs = func(namespace, pod, container string) (io.ReadCloser, error) {
+				if namespace != "jobs" || pod != "pod" || container != "task" {
+					t.Errorf("unexpected logs requested for %s/%s/%s", namespace, pod, container)
+				}
+				return ioutil.NopCloser(strings.NewReader("applied\n")), nil
+			}
+
+			s := newTestServer(&fakeGit{}, nil, &UpdateConfig{})
+			s.executor = e
+			result := s.runTask(context.Background(), "guid", dir, tc.task)
+
+			if result.exitCode != tc.expectedExitCode {
+				t.Errorf("expected exit code %d, got %d", tc.expectedExitCode, result.exitCode)
+			}
+			if tc.expectedErr == "" && result.err != nil {
+				t.Errorf("unexpected error: %v", result.err)
+			} else if tc.expectedErr != "" && (result.err == nil || !strings.Contains(result.err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, result.err)
+			}
+			if result.stdout != tc.expectedStdout {
+				t.Errorf("expected stdout %q, got %q", tc.expectedStdout, result.stdout)
+			}
+			if !tc.expectedJob {
+				if created != nil {
+					t.Errorf("expected no job to be created, got %v", created)
+				}
+				return
+			}
+			if created == nil {
+				t.Fatal("expected a job to be created")
+			}
+
+			spec := created.Spec.Template.Spec
+			if spec.ServiceAccountName != "updater" {
+				t.Errorf("expected service account updater, got %q", spec.ServiceAccountName)
+			}
+			clone := spec.InitContainers[0].Command
+			if expected := []string{"https://github.com/org/repo", "/workspace", revision}; !reflect.DeepEqual(clone[3:], expected) {
+				t.Errorf("expected to clone %v, got %v", expected, clone[3:])
+			}
+			container := spec.Containers[0]
+			if container.Image != tc.expectedImage {
+				t.Errorf("expected image %q, got %q", tc.expectedImage, container.Image)
+			}
+			if !reflect.DeepEqual(container.Command, tc.task.command) {
+				t.Errorf("expected command %v, got %v", tc.task.command, container.Command)
+			}
+			if len(container.Env) != len(env) || container.Env[0] != (corev1.EnvVar{Name: "REPO_OWNER", Value: "org"}) {
+				t.Errorf("expected the task environment, got %v", container.Env)
+			}
+			if memory := container.Resources.Requests[corev1.ResourceMemory]; memory.String() != "1Gi" {
+				t.Errorf("expected a memory request of 1Gi, got %s", memory.String())
+			}
+
+			deleted := false
+			for _, action := range client.Actions() {
+				if action.Matches("delete", "jobs") && action.(clienttesting.DeleteAction).GetName() == created.Name {
+					deleted = true
+				}
+			}
+			if !deleted {
+				t.Error("expected the job to be deleted")
+			}
+		})
+	}
+}
+
+// jobPod is the pod of a Job whose task exited with exitCode.
+func jobPod(exitCode int32) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "jobs"},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "task",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode}},
+		}}},
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{name: "valid value is kept", value: "deploy-jobs", expected: "deploy-jobs"},
+		{name: "invalid characters are replaced", value: "/bin/sh -c x", expected: "bin-sh--c-x"},
+		{name: "long value is truncated", value: strings.Repeat("a", 70), expected: strings.Repeat("a", 63)},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := labelValue(tc.value); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultSecretRefreshInterval is how often a Kubernetes Secret is re-read.
+const defaultSecretRefreshInterval = time.Minute
+
+// KubeSecretAgent reads a key of a Kubernetes Secret from the API and keeps
+// it up to date, so that the secret can be rotated without a restart.
+type KubeSecretAgent struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Name      string
+	Key       string
+
+	lock  sync.Mutex
+	value []byte
+}
+
+// Start reads the secret and then re-reads it every interval. If the first
+// read fails, Start returns the error. Later failures are logged and the
+// last value read is kept.
+func (a *KubeSecretAgent) Start(interval time.Duration) error {
+	if err := a.load(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := a.load(); err != nil {
+				logrus.WithFields(logrus.Fields{"namespace": a.Namespace, "name": a.Name}).WithError(err).Error("Error reading secret.")
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *KubeSecretAgent) load() error {
+	secret, err := a.Client.CoreV1().Secrets(a.Namespace).Get(a.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	value, ok := secret.Data[a.Key]
+	if !ok {
+		return fmt.Errorf("secret %s/%s has no key %q", a.Namespace, a.Name, a.Key)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.value = value
+	return nil
+}
+
+// GetSecret returns the latest value of the secret.
+func (a *KubeSecretAgent) GetSecret() []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.value
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubeSecretAgent(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		secretName  string
+		key         string
+		expected    string
+		expectedErr bool
+	}{
+		{name: "secret is read", secretName: "hmac", key: "hmac", expected: "abc"},
+		{name: "missing secret", secretName: "other", key: "hmac", expectedErr: true},
+		{name: "missing key", secretName: "hmac", key: "token", expectedErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "webhooks", Name: "hmac"},
+				Data:       map[string][]byte{"hmac": []byte("abc")},
+			})
+			agent := &KubeSecretAgent{Client: client, Namespace: "webhooks", Name: tc.secretName, Key: tc.key}
+			err := agent.Start(time.Hour)
+			if tc.expectedErr != (err != nil) {
+				t.Fatalf("expected error %t, got %v", tc.expectedErr, err)
+			}
+			if secret := string(agent.GetSecret()); secret != tc.expected {
+				t.Errorf("expected secret %q, got %q", tc.expected, secret)
+			}
+		})
+	}
+}
+
+func TestKubeSecretAgentRefresh(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "webhooks", Name: "hmac"},
+		Data:       map[string][]byte{"hmac": []byte("abc")},
+	}
+	client := fake.NewSimpleClientset(secret)
+	agent := &KubeSecretAgent{Client: client, Namespace: "webhooks", Name: "hmac", Key: "hmac"}
+	if err := agent.Start(10 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rotated := secret.DeepCopy()
+	rotated.Data["hmac"] = []byte("def")
+	if _, err := client.CoreV1().Secrets("webhooks").Update(rotated); err != nil {
+		t.Fatalf("failed to rotate secret: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for string(agent.GetSecret()) != "def" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the rotated secret to be read, still have %q", agent.GetSecret())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.CoreV1().Secrets("webhooks").Delete("hmac", &metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete secret: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if secret := string(agent.GetSecret()); secret != "def" {
+		t.Errorf("expected the last secret to be kept, got %q", secret)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+const (
+	// defaultKustomizeBinary applies kustomizations in Targets with
+	// apply -k when the config does not set KustomizeBinary.
+	defaultKustomizeBinary = "/usr/bin/kubectl"
+
+	// kustomizationKind is the kind of newer kustomizations, which older
+	// ones leave out.
+	kustomizationKind = "Kustomization"
+
+	// kustomizeTaskTarget names the tasks applying kustomizations with
+	// apply -k, which have no make target, in logs and metrics.
+	kustomizeTaskTarget = "kustomize"
+)
+
+// kustomizationFiles are the names kustomize looks for in a directory.
+var kustomizationFiles = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// isKustomization determines whether config in the checkout in dir is a
+// kustomization, by its name or else its kind.
+func isKustomization(dir, config string) bool {
+	for _, name := range kustomizationFiles {
+		if path.Base(config) == name {
+			return true
+		}
+	}
+	kind, err := determineKindForConfig(dir, config)
+	return err == nil && kind == kustomizationKind
+}
+
+// findKustomization returns the kustomization in kustomizeDir of the
+// checkout in dir, or an empty string if it has none.
+func findKustomization(dir, kustomizeDir string) string {
+	for _, name := range kustomizationFiles {
+		candidate := path.Join(kustomizeDir, name)
+		resolved, err := checkoutPath(dir, candidate)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(resolved); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// kustomizationSources lists the paths, relative to the checkout in dir,
+// that the kustomization at config is built from: its own directory and the
+// resources, bases and components it refers to, following those that are
+// kustomizations themselves. Remote and escaping references are ignored.
+func kustomizationSources(dir, config string) ([]string, error) {
+	var sources []string
+	visited := map[string]bool{}
+	var visit func(config string) error
+	visit = func(config string) error {
+		kustomizeDir := path.Dir(config)
+		if visited[kustomizeDir] {
+			return nil
+		}
+		visited[kustomizeDir] = true
+		sources = append(sources, kustomizeDir)
+
+		resolved, err := checkoutPath(dir, config)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(resolved)
+		if err != nil {
+			return fmt.Errorf("cannot read kustomization %v", config)
+		}
+		object, err := parseObject(config, content)
+		if err != nil {
+			return fmt.Errorf("cannot parse kustomization %v", config)
+		}
+		for _, field := range []string{"resources", "bases", "components"} {
+			references, _ := object[field].([]interface{})
+			for _, reference := range references {
+				reference, ok := reference.(string)
+				if !ok || strings.Contains(reference, "://") || strings.HasPrefix(reference, "github.com/") {
+					continue
+				}
+				source := path.Join(kustomizeDir, reference)
+				if _, err := checkoutPath(dir, source); err != nil {
+					continue
+				}
+				if nested := findKustomization(dir, source); nested != "" {
+					if err := visit(nested); err != nil {
+						return err
+					}
+					continue
+				}
+				sources = append(sources, source)
+			}
+		}
+		return nil
+	}
+	if err := visit(config); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// inSources determines whether filename is one of sources or in one of
+// them, if it is a directory.
+func inSources(sources []string, filename string) bool {
+	for _, source := range sources {
+		if source == "." || filename == source || strings.HasPrefix(filename, source+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// kustomizeTask returns the task applying the kustomization at target if
+// any of changes is in what it is built from, which rolls the changes up into
+// a single task for its directory. It returns nil if none is.
+func (c *UpdateConfig) kustomizeTask(makeBinary, dir, target string, changes []github.PullRequestChange) (*task, string, error) {
+	if _, err := os.Stat(filepath.Join(dir, target)); os.IsNotExist(err) {
+		// A removed overlay cannot be applied.
+		return nil, "", nil
+	}
+	sources, err := kustomizationSources(dir, target)
+	if err != nil {
+		return nil, "", err
+	}
+	var files []string
+	for _, change := range changes {
+		if hasStatus(c.TargetsStatuses, change) && inSources(sources, change.Filename) {
+			files = append(files, change.Filename)
+		}
+	}
+	if len(files) == 0 {
+		return nil, "", nil
+	}
+
+	kustomizeDir := path.Dir(target)
+	what, env, warning, err := c.whatFor(dir, kustomizeDir)
+	if err != nil {
+		return nil, "", err
+	}
+	var command []string
+	if c.KustomizeTarget != "" {
+		command = append([]string{makeBinary, c.KustomizeTarget}, what...)
+	} else {
+		commands, _ := determineTargetForConfig(makeBinary, c.kustomizeBinary(), dir, target)
+		command = commands[0]
+	}
+	t := &task{command: command, target: c.KustomizeTarget, config: kustomizeDir, files: files, env: env, workdir: c.TargetsWorkdir, limits: c.Limits}
+	if c.KustomizeTarget == "" {
+		// apply -k gets the directory as an argument, so only a make target
+		// verifying it needs WHAT.
+		t.target, t.kustomize = kustomizeTaskTarget, true
+		if _, ok := c.KindVerifications[kustomizationKind]; !ok {
+			warning = ""
+		}
+	}
+	if rollback, ok := c.TargetRollbacks[target]; ok {
+		t.rollback = &rollback
+	}
+	if verify, ok := c.KindVerifications[kustomizationKind]; ok {
+		t.verify = &verify
+		t.verifyCommand = verify.command(makeBinary, what)
+	}
+	t.env = append(t.env, environment(c.KindEnv[kustomizationKind], func(value string) string { return value })...)
+	return t, warning, nil
+}
+
+// kustomizeBinary is the binary to run apply -k with, when kustomizations
+// are not applied with a make target.
+func (c *UpdateConfig) kustomizeBinary() string {
+	if c.KustomizeBinary != "" {
+		return c.KustomizeBinary
+	}
+	return defaultKustomizeBinary
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// kustomizeLayout is a base with two overlays, one of which refers to the
+// base in the older bases field and has no kind.
+var kustomizeLayout = map[string]string{
+	"base/kustomization.yaml":                  "resources:\n- deployment.yaml\n- service.yaml\n",
+	"base/deployment.yaml":                     "kind: Deployment\nmetadata:\n  name: web\n",
+	"base/service.yaml":                        "kind: Service\nmetadata:\n  name: web\n",
+	"components/monitoring/kustomization.yaml": "kind: Component\nresources:\n- monitor.yaml\n",
+	"components/monitoring/monitor.yaml":       "kind: ServiceMonitor\nmetadata:\n  name: web\n",
+	"overlays/prod/kustomization.yaml":         "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n- ../../base\n- https://github.com/org/remote//config\n- ../../shared/quota.yaml\ncomponents:\n- ../../components/monitoring\npatchesStrategicMerge:\n- replicas.yaml\n",
+	"overlays/prod/replicas.yaml":              "kind: Deployment\nmetadata:\n  name: web\n",
+	"overlays/staging/kustomization.yml":       "bases:\n- ../../base\n",
+	"shared/quota.yaml":                        "kind: ResourceQuota\nmetadata:\n  name: quota\n",
+	"shared/limits.yaml":                       "kind: LimitRange\nmetadata:\n  name: limits\n",
+	"jobs/job.yaml":                            "kind: BuildConfig\nmetadata:\n  name: job\n",
+}
+
+func TestKustomizationSources(t *testing.T) {
+	dir := makeRepoDir(t, kustomizeLayout)
+	defer os.RemoveAll(dir)
+
+	var testcases = []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name:     "base",
+			config:   "base/kustomization.yaml",
+			expected: []string{"base", "base/deployment.yaml", "base/service.yaml"},
+		},
+		{
+			name:     "overlay with a component and a shared resource",
+			config:   "overlays/prod/kustomization.yaml",
+			expected: []string{"overlays/prod", "base", "base/deployment.yaml", "base/service.yaml", "shared/quota.yaml", "components/monitoring", "components/monitoring/monitor.yaml"},
+		},
+		{
+			name:     "overlay with bases",
+			config:   "overlays/staging/kustomization.yml",
+			expected: []string{"overlays/staging", "base", "base/deployment.yaml", "base/service.yaml"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			sources, err := kustomizationSources(dir, tc.config)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(sources, tc.expected) {
+				t.Errorf("expected sources %q, got %q", tc.expected, sources)
+			}
+		})
+	}
+}
+
+func TestHandleEventKustomize(t *testing.T) {
+	dir := makeRepoDir(t, kustomizeLayout)
+	defer os.RemoveAll(dir)
+
+	var testcases = []struct {
+		name            string
+		changes         []string
+		kustomizeBinary string
+		kustomizeTarget string
+		expected        [][]string
+	}{
+		{
+			name:    "changing the base applies every overlay",
+			changes: []string{"base/deployment.yaml", "base/service.yaml"},
+			expected: [][]string{
+				{"/usr/bin/kubectl", "apply", "-k", "overlays/prod"},
+				{"/usr/bin/kubectl", "apply", "-k", "overlays/staging"},
+			},
+		},
+		{
+			name:     "changing an overlay applies only it",
+			changes:  []string{"overlays/prod/replicas.yaml"},
+			expected: [][]string{{"/usr/bin/kubectl", "apply", "-k", "overlays/prod"}},
+		},
+		{
+			name:     "changing a component or shared resource applies the overlay using it",
+			changes:  []string{"components/monitoring/monitor.yaml", "shared/quota.yaml"},
+			expected: [][]string{{"/usr/bin/kubectl", "apply", "-k", "overlays/prod"}},
+		},
+		{
+			name:     "changing an unused shared file applies nothing",
+			changes:  []string{"shared/limits.yaml"},
+			expected: nil,
+		},
+		{
+			name:    "configs in targets are rolled up into the overlay",
+			changes: []string{"overlays/prod/kustomization.yaml", "overlays/prod/replicas.yaml", "jobs/job.yaml"},
+			expected: [][]string{
+				{"/usr/bin/kubectl", "apply", "-k", "overlays/prod"},
+				{"/usr/bin/make", "apply", "WHAT=jobs/job.yaml"},
+			},
+		},
+		{
+			name:            "configured kustomize binary",
+			changes:         []string{"overlays/staging/kustomization.yml"},
+			kustomizeBinary: "/usr/bin/oc",
+			expected:        [][]string{{"/usr/bin/oc", "apply", "-k", "overlays/staging"}},
+		},
+		{
+			name:            "configured kustomize target",
+			changes:         []string{"overlays/staging/kustomization.yml"},
+			kustomizeTarget: "kustomize",
+			expected:        [][]string{{"/usr/bin/make", "kustomize", "WHAT=overlays/staging"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var changes []github.PullRequestChange
+			for _, change := range tc.changes {
+				changes = append(changes, github.PullRequestChange{Filename: change})
+			}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:         []string{"overlays/prod/kustomization.yaml", "overlays/prod/replicas.yaml", "overlays/staging/kustomization.yml", "jobs/job.yaml"},
+				KustomizeBinary: tc.kustomizeBinary,
+				KustomizeTarget: tc.kustomizeTarget,
+				MaxPRFiles:      defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+			if len(ghc.IssueCommentsAdded) > 0 && len(tc.expected) == 0 {
+				t.Errorf("expected no comment, got %v", ghc.IssueCommentsAdded)
+			}
+		})
+	}
+}
+
+func TestHandleEventKustomizeAllowedExecutables(t *testing.T) {
+	dir := makeRepoDir(t, kustomizeLayout)
+	defer os.RemoveAll(dir)
+
+	var testcases = []struct {
+		name     string
+		allowed  []string
+		expected [][]string
+	}{
+		{
+			name:     "kustomize binary runs by default",
+			expected: [][]string{{"/usr/bin/kubectl", "apply", "-k", "overlays/staging"}},
+		},
+		{
+			name:    "kustomize binary must be listed with allowed executables",
+			allowed: []string{"/usr/bin/make"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "overlays/staging/kustomization.yml"}}},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:            []string{"overlays/staging/kustomization.yml"},
+				AllowedExecutables: tc.allowed,
+				MaxPRFiles:         defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+			if tc.expected == nil {
+				checkComment(t, ghc, `refused to run &#34;/usr/bin/kubectl apply -k overlays/staging&#34;`)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+const (
+	// defaultAppliedLabel is used when outcome labels set no applied label.
+	defaultAppliedLabel = "config-applied"
+	// defaultApplyFailedLabel is used when outcome labels set no failed
+	// label.
+	defaultApplyFailedLabel = "config-apply-failed"
+)
+
+// OutcomeLabels label each PR with whether its updates were applied, so
+// that the PRs that failed to apply can be searched for.
+type OutcomeLabels struct {
+	// Applied labels the PRs whose updates all succeeded,
+	// config-applied by default.
+	Applied string `json:"applied,omitempty" yaml:"applied,omitempty"`
+	// Failed labels the PRs with an update that failed or an internal
+	// error, config-apply-failed by default.
+	Failed string `json:"failed,omitempty" yaml:"failed,omitempty"`
+}
+
+// validate checks that the outcomes are labeled apart, if they are labeled.
+func (l *OutcomeLabels) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.applied() == l.failed() {
+		return fmt.Errorf("applied and failed must be different labels, not both %q", l.applied())
+	}
+	return nil
+}
+
+func (l *OutcomeLabels) applied() string {
+	if l.Applied == "" {
+		return defaultAppliedLabel
+	}
+	return l.Applied
+}
+
+func (l *OutcomeLabels) failed() string {
+	if l.Failed == "" {
+		return defaultApplyFailedLabel
+	}
+	return l.Failed
+}
+
+// labelOutcome labels pr with the outcome of results, removing the label of
+// the other outcome, which an earlier attempt may have added. Failing to
+// label is only logged, as the results are posted regardless.
+func (s *Server) labelOutcome(ctx context.Context, pr github.PullRequest, results results) {
+	updateConfig, ok := s.configAgent.Config().ForRepo(pr.Base.Repo.Owner.Login, pr.Base.Repo.Name)
+	if !ok || updateConfig.OutcomeLabels == nil {
+		return
+	}
+	add, remove := updateConfig.OutcomeLabels.applied(), updateConfig.OutcomeLabels.failed()
+	if !results.IsSuccess() || results.failedRollback() {
+		add, remove = remove, add
+	}
+	org, repo := pr.Base.Repo.Owner.Login, pr.Base.Repo.Name
+	log := s.log.WithFields(logrus.Fields{"add": add, "remove": remove})
+	if err := s.github(ctx).AddLabel(org, repo, pr.Number, add); err != nil {
+		log.WithError(err).Warn("Error adding outcome label.")
+	}
+	// Removing a label the PR does not have succeeds.
+	if err := s.github(ctx).RemoveLabel(org, repo, pr.Number, remove); err != nil {
+		log.WithError(err).Warn("Error removing outcome label.")
+	}
+}
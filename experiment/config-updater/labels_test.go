@@ -0,0 +1,109 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestLabelOutcome(t *testing.T) {
+	var testcases = []struct {
+		name   string
+		labels *OutcomeLabels
+		// repoLabels, when set, are the only labels that can be added.
+		repoLabels []string
+		// failures are whether the target fails in each event in turn.
+		failures        []bool
+		expectedAdded   []string
+		expectedRemoved []string
+	}{
+		{
+			name:            "applied",
+			labels:          &OutcomeLabels{},
+			failures:        []bool{false},
+			expectedAdded:   []string{"org/repo#1:config-applied"},
+			expectedRemoved: []string{"org/repo#1:config-apply-failed"},
+		},
+		{
+			name:            "failed",
+			labels:          &OutcomeLabels{},
+			failures:        []bool{true},
+			expectedAdded:   []string{"org/repo#1:config-apply-failed"},
+			expectedRemoved: []string{"org/repo#1:config-applied"},
+		},
+		{
+			name:            "failed, then succeeded when retried",
+			labels:          &OutcomeLabels{},
+			failures:        []bool{true, false},
+			expectedAdded:   []string{"org/repo#1:config-apply-failed", "org/repo#1:config-applied"},
+			expectedRemoved: []string{"org/repo#1:config-applied", "org/repo#1:config-apply-failed"},
+		},
+		{
+			name:            "custom labels",
+			labels:          &OutcomeLabels{Applied: "applied", Failed: "broken"},
+			failures:        []bool{false},
+			expectedAdded:   []string{"org/repo#1:applied"},
+			expectedRemoved: []string{"org/repo#1:broken"},
+		},
+		{
+			name:            "failing to label is ignored",
+			labels:          &OutcomeLabels{},
+			repoLabels:      []string{"other"},
+			failures:        []bool{false},
+			expectedRemoved: []string{"org/repo#1:config-apply-failed"},
+		},
+		{
+			name:     "not configured",
+			failures: []bool{true, false},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+				RepoLabelsExisting: tc.repoLabels,
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:      []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+				MaxPRFiles:    defaultMaxPRFiles,
+				OutcomeLabels: tc.labels,
+			})
+			for _, failed := range tc.failures {
+				s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": failed}}
+				if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if len(ghc.IssueCommentsAdded) != len(tc.failures) {
+				t.Errorf("expected a comment for each event, got %v", ghc.IssueCommentsAdded)
+			}
+			if !reflect.DeepEqual(ghc.IssueLabelsAdded, tc.expectedAdded) {
+				t.Errorf("expected labels %v to be added, got %v", tc.expectedAdded, ghc.IssueLabelsAdded)
+			}
+			if !reflect.DeepEqual(ghc.IssueLabelsRemoved, tc.expectedRemoved) {
+				t.Errorf("expected labels %v to be removed, got %v", tc.expectedRemoved, ghc.IssueLabelsRemoved)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// limitPollInterval is how often the resource usage of a task is checked.
+const limitPollInterval = 100 * time.Millisecond
+
+// Limits bound the resources a task run as a local process may use. The
+// memory and CPU limits cover every process the task starts, and are only
+// enforced on Linux. Zero means unlimited.
+type Limits struct {
+	MaxRSSBytes    int64         `json:"max_rss_bytes,omitempty" yaml:"max_rss_bytes,omitempty"`
+	MaxCPUTime     time.Duration `json:"max_cpu_time,omitempty" yaml:"max_cpu_time,omitempty"`
+	MaxOutputBytes int64         `json:"max_output_bytes,omitempty" yaml:"max_output_bytes,omitempty"`
+	// MaxAddressSpaceBytes is the RLIMIT_AS of each process of the task,
+	// which makes allocations past it fail rather than letting them take
+	// the memory of the host before MaxRSSBytes is next checked. It bounds
+	// the virtual memory of every process, which runtimes such as Go's
+	// reserve far more of than they use, so it is separate from
+	// MaxRSSBytes.
+	MaxAddressSpaceBytes int64 `json:"max_address_space_bytes,omitempty" yaml:"max_address_space_bytes,omitempty"`
+}
+
+// limitError is returned for a task that was killed for exceeding a limit.
+type limitError struct {
+	limit string
+	value string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("killed for exceeding the %s limit of %s", e.limit, e.value)
+}
+
+// enforcer kills the process group of a task the first time it exceeds one
+// of its limits, and remembers which one.
+type enforcer struct {
+	lock sync.Mutex
+	pid  int
+	err  error
+}
+
+// started records the process to kill, which may have exceeded a limit
+// already.
+func (e *enforcer) started(pid int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.pid = pid
+	if e.err != nil {
+		killProcessGroup(pid)
+	}
+}
+
+func (e *enforcer) kill(err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.err != nil {
+		return
+	}
+	e.err = err
+	if e.pid != 0 {
+		killProcessGroup(e.pid)
+	}
+}
+
+func (e *enforcer) exceeded() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.err
+}
+
+// outputLimiter counts the bytes written to all of the writers it wraps and
+// kills the task once they add up to more than the limit.
+type outputLimiter struct {
+	limit    int64
+	enforcer *enforcer
+
+	lock    sync.Mutex
+	written int64
+}
+
+func (l *outputLimiter) wrap(w io.Writer) io.Writer {
+	return limitedWriter{w: w, limiter: l}
+}
+
+// add counts n more bytes and returns how many of them fit in the limit.
+func (l *outputLimiter) add(n int) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	allowed := l.limit - l.written
+	l.written += int64(n)
+	if int64(n) <= allowed {
+		return n
+	}
+	l.enforcer.kill(&limitError{limit: "output", value: fmt.Sprintf("%d bytes", l.limit)})
+	if allowed < 0 {
+		return 0
+	}
+	return int(allowed)
+}
+
+type limitedWriter struct {
+	w       io.Writer
+	limiter *outputLimiter
+}
+
+func (w limitedWriter) Write(p []byte) (int, error) {
+	if n := w.limiter.add(len(p)); n > 0 {
+		if _, err := w.w.Write(p[:n]); err != nil {
+			return 0, err
+		}
+	}
+	// Claim to have written everything so the output is drained until the
+	// process is gone.
+	return len(p), nil
+}
+
+// monitor kills the task when the processes in the group pgid use more
+// memory or CPU time than allowed, until stop is closed. The rlimits set by
+// setRlimits only cover each process on its own, and only once they are
+// set, so the group is polled as well.
+func monitor(e *enforcer, pgid int, limits Limits, stop <-chan struct{}) {
+	if limits.MaxRSSBytes == 0 && limits.MaxCPUTime == 0 {
+		return
+	}
+	ticker := time.NewTicker(limitPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		rss, cpu, err := groupUsage(pgid)
+		if err != nil {
+			continue
+		}
+		if limits.MaxRSSBytes > 0 && rss > limits.MaxRSSBytes {
+			e.kill(&limitError{limit: "memory", value: fmt.Sprintf("%d bytes", limits.MaxRSSBytes)})
+			return
+		}
+		if limits.MaxCPUTime > 0 && cpu > limits.MaxCPUTime {
+			e.kill(&limitError{limit: "CPU time", value: limits.MaxCPUTime.String()})
+			return
+		}
+	}
+}
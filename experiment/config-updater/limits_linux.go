@@ -0,0 +1,142 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// clockTicks is the unit of CPU times in /proc, which is fixed for
+// userspace on Linux.
+const clockTicks = 100
+
+// setProcessGroup makes c start a new process group, so that everything it
+// starts can be killed together.
+func setProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(pid int) {
+	syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// setRlimits sets the CPU time and address space rlimits of the running
+// process pid, which the processes it starts from then on inherit. The CPU
+// time rlimit is in whole seconds, so it is rounded up; the process gets
+// SIGXCPU once it is reached, and SIGKILL a second later.
+func setRlimits(pid int, limits Limits) error {
+	if limits.MaxCPUTime > 0 {
+		seconds := uint64((limits.MaxCPUTime + time.Second - 1) / time.Second)
+		if err := prlimit(pid, syscall.RLIMIT_CPU, syscall.Rlimit{Cur: seconds, Max: seconds + 1}); err != nil {
+			return fmt.Errorf("error limiting CPU time: %v", err)
+		}
+	}
+	if limits.MaxAddressSpaceBytes > 0 {
+		size := uint64(limits.MaxAddressSpaceBytes)
+		if err := prlimit(pid, syscall.RLIMIT_AS, syscall.Rlimit{Cur: size, Max: size}); err != nil {
+			return fmt.Errorf("error limiting address space: %v", err)
+		}
+	}
+	return nil
+}
+
+func prlimit(pid int, resource int, limit syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// exceededCPURlimit determines whether the process was killed by the
+// SIGXCPU its CPU time rlimit sends.
+func exceededCPURlimit(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGXCPU
+}
+
+// groupUsage sums the resident memory and CPU time of the processes in the
+// process group pgid, including that of their children that have exited.
+func groupUsage(pgid int) (int64, time.Duration, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	var rss, ticks int64
+	found := false
+	for _, stat := range stats {
+		b, err := ioutil.ReadFile(stat)
+		if err != nil {
+			// The process exited since we listed it.
+			continue
+		}
+		fields, err := parseStat(string(b))
+		if err != nil {
+			return 0, 0, err
+		}
+		if fields.pgrp != pgid {
+			continue
+		}
+		found = true
+		rss += fields.rssPages * int64(os.Getpagesize())
+		ticks += fields.cpuTicks
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("no processes in group %d", pgid)
+	}
+	return rss, time.Duration(ticks) * time.Second / clockTicks, nil
+}
+
+type procStat struct {
+	pgrp     int
+	cpuTicks int64
+	rssPages int64
+}
+
+// parseStat reads the fields we need from /proc/<pid>/stat, described in
+// proc(5).
+func parseStat(stat string) (procStat, error) {
+	// The command name may contain anything, so skip past its last
+	// closing parenthesis. The fields after it start at the third one.
+	i := strings.LastIndex(stat, ")")
+	if i < 0 {
+		return procStat{}, fmt.Errorf("malformed stat %q", stat)
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 22 {
+		return procStat{}, fmt.Errorf("malformed stat %q", stat)
+	}
+	field := func(n int) int64 {
+		value, _ := strconv.ParseInt(fields[n-3], 10, 64)
+		return value
+	}
+	return procStat{
+		pgrp: int(field(5)),
+		// utime, stime, cutime and cstime.
+		cpuTicks: field(14) + field(15) + field(16) + field(17),
+		rssPages: field(24),
+	}, nil
+}
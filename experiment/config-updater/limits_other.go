@@ -0,0 +1,48 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+)
+
+func setProcessGroup(c *exec.Cmd) {}
+
+// killProcessGroup can only kill the process itself on this platform.
+func killProcessGroup(pid int) {
+	if p, err := os.FindProcess(pid); err == nil {
+		p.Kill()
+	}
+}
+
+func setRlimits(pid int, limits Limits) error {
+	return nil
+}
+
+func exceededCPURlimit(state *os.ProcessState) bool {
+	return false
+}
+
+func groupUsage(pgid int) (int64, time.Duration, error) {
+	return 0, 0, errors.New("resource usage is only available on linux")
+}
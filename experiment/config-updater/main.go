@@ -19,44 +19,221 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	prowclientset "k8s.io/test-infra/prow/client/clientset/versioned"
 	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/config/secret"
+	"k8s.io/test-infra/prow/flagutil"
 
 	"k8s.io/test-infra/prow/git"
 	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/kube"
 )
 
+// shutdownTimeout bounds how long the servers wait for the requests in
+// progress when shutting down.
+const shutdownTimeout = 30 * time.Second
+
 var (
-	port              = flag.Int("port", 8888, "Port to listen on.")
-	dryRun            = flag.Bool("dry-run", true, "Dry run for testing. Uses API tokens but does not mutate.")
-	githubEndpoint    = flag.String("github-endpoint", "https://api.github.com", "GitHub's API endpoint.")
-	githubTokenFile   = flag.String("github-token-file", "/etc/github/oauth", "Path to the file containing the GitHub OAuth secret.")
-	webhookSecretFile = flag.String("hmac-secret-file", "/etc/webhook/hmac", "Path to the file containing the GitHub HMAC secret.")
-	updateConfigFile  = flag.String("update-config-file", "/etc/config/update.yaml", "Path to the file containing the configurations to update.")
+	logLevel            = flag.String("log-level", "info", "Minimum level to log at: trace, debug, info, warn or error.")
+	logFormat           = flag.String("log-format", "json", "Format to log in: text or json.")
+	listenAddr          = flag.String("listen-addr", ":8888", "Address to listen on.")
+	port                = flag.Int("port", 8888, "Port to listen on. Deprecated: use --listen-addr.")
+	metricsPort         = flag.Int("metrics-port", 9090, "Port to serve Prometheus metrics on, apart from webhooks.")
+	tlsCert             = flag.String("tls-cert", "", "Path to the TLS certificate to serve with. Requires --tls-key.")
+	tlsKey              = flag.String("tls-key", "", "Path to the TLS private key to serve with. Requires --tls-cert.")
+	dryRun              = flag.Bool("dry-run", true, "Dry run for testing. Uses API tokens but does not mutate.")
+	githubEndpoint      = flag.String("github-endpoint", "https://api.github.com", "GitHub's API endpoint.")
+	githubTokenFile     = flag.String("github-token-file", "/etc/github/oauth", "Path to the file containing the GitHub OAuth secret.")
+	webhookSecretFile   = flag.String("hmac-secret-file", "/etc/webhook/hmac", "Path to the file containing the GitHub HMAC secret.")
+	hmacSecretName      = flag.String("hmac-secret-name", "", "Name of the Kubernetes Secret holding the GitHub HMAC secret, read from the API instead of --hmac-secret-file. Requires --hmac-secret-namespace.")
+	hmacSecretNamespace = flag.String("hmac-secret-namespace", "", "Namespace of the Kubernetes Secret named by --hmac-secret-name.")
+	hmacSecretKey       = flag.String("hmac-secret-key", "hmac", "Key of the HMAC secret in the Kubernetes Secret named by --hmac-secret-name.")
+	hmacSecretRefresh   = flag.Duration("hmac-secret-refresh", defaultSecretRefreshInterval, "How often to re-read the Kubernetes Secret named by --hmac-secret-name.")
+	updateConfigFile    = flag.String("update-config-file", "/etc/config/update.yaml", "Path to the file containing the configurations to update.")
+	validateConfig      = flag.Bool("validate-config", false, "Check --update-config-file, print a summary of what it updates and exit, with 1 if it is invalid. Other flags that affect the checks, such as --config-schema, --make-binary and --executor, still apply.")
+	configSchema        = flag.String("config-schema", "", "Path to a JSON Schema to validate --update-config-file against at startup, or builtin for the bundled schema. Disabled if empty.")
+	gitRetryDeadline    = flag.Duration("git-retry-deadline", 2*time.Minute, "How long to keep retrying failed clones and checkouts before giving up.")
+	jenkinsURL          = flag.String("jenkins-url", "", "Jenkins controller on which to build the job named by each successfully applied config. Disabled if empty.")
+	jenkinsTokenFile    = flag.String("jenkins-token-file", "/etc/jenkins/token", "Path to the file containing the Jenkins remote build token.")
+	makeBinary          = flag.String("make-binary", "", "Path to the make binary, overriding the one in the update config.")
+	containerRuntime    = flag.String("container-runtime", defaultContainerRuntime, "Docker compatible binary, such as podman, used to run tasks that have an image.")
+	executor            = flag.String("executor", "local", "How to run tasks: local runs them as processes of the server, kubernetes runs each one as a Job.")
+	kubeconfig          = flag.String("kubeconfig", "", "Path to the kubeconfig for the cluster running Jobs, holding the HMAC secret and applied to natively. Defaults to the cluster the server runs in.")
+	jobNamespace        = flag.String("job-namespace", "default", "Namespace to run Jobs in.")
+	jobImage            = flag.String("job-image", "", "Image to run tasks in as Jobs, unless their matcher sets an image.")
+	jobServiceAccount   = flag.String("job-service-account", "", "Service account to run Jobs as.")
+	jobCPU              = flag.String("job-cpu", "", "CPU to request for each Job.")
+	jobMemory           = flag.String("job-memory", "", "Memory to request for each Job.")
+	jobDeadline         = flag.Duration("job-deadline", defaultJobDeadline, "How long a Job may take, including being scheduled, before it is failed.")
+	commentTemplateFile = flag.String("comment-template-file", "", "Path to a text/template used to render comments instead of the default format.")
+	maxRequestBodyBytes = flag.Int64("max-request-body-bytes", defaultMaxRequestBodyBytes, "Largest webhook payload to accept, in bytes. Zero means unlimited.")
+	requireSHA256       = flag.Bool("require-sha256-signature", false, "Refuse webhooks that are only signed with HMAC-SHA1 in X-Hub-Signature, rather than HMAC-SHA256 in X-Hub-Signature-256.")
+	maxCacheEntries     = flag.Int("max-cache-entries", defaultMaxCacheEntries, "How many PRs to cache the changed files of for a few minutes, in case their events are retried. Zero disables the cache.")
+	minimizeOldComments = flag.Bool("minimize-old-comments", false, "Hide the comments posted earlier on a PR as outdated when posting a new one.")
+	statsDAddr          = flag.String("statsd-addr", "", "host:port of a StatsD server to send the duration and outcome of every task to over UDP. Disabled if empty.")
+	reportFile          = flag.String("report-file", "", "Path to append the result of every task to as a line of JSON, once it is posted on the PR. Disabled if empty.")
+	deadLetterFile      = flag.String("dead-letter-file", "", "Path to append the events that fail to as lines of JSON, so that they can be replayed with --replay-dead-letter. Failed events are only logged if empty.")
+	replayDeadLetter    = flag.Bool("replay-dead-letter", false, "Handle the events in --dead-letter-file again and exit. Those that fail again are kept in the file.")
+	promotionFile       = flag.String("promotion-file", "", "Path to keep the updates pending promotion in, so that they survive restarts. They are only kept in memory if empty.")
+	prowConfigPath      = flag.String("prow-config-path", "", "Path to the Prow config, whose postsubmits matchers with a prowjob are run as ProwJobs in the cluster in --kubeconfig. Matchers with a prowjob fail if empty.")
+	jobConfigPath       = flag.String("job-config-path", "", "Path to the Prow job configs, if they are not all in --prow-config-path.")
+	prowJobTimeout      = flag.Duration("prowjob-schedule-timeout", defaultProwJobScheduleTimeout, "How long a ProwJob may wait to be scheduled before it is aborted.")
+	nativeApply         = flag.Bool("native-apply", false, "Apply the configs of kinds that kind_backends maps to native with server-side apply, to the cluster in --kubeconfig.")
+	useChecksAPI        = flag.Bool("use-checks-api", false, "Report results in a check run on the merge commit as well as in a comment. Requires authenticating as a GitHub App.")
+	catchUpSince        = flag.String("catchup-since", "", "RFC3339 time to catch up from at startup, handling the PRs merged in the --catchup-org orgs since then. Disabled if empty.")
+	catchUpInterval     = flag.Duration("catchup-interval", defaultCatchUpInterval, "How long to wait between PRs while catching up, to avoid the secondary rate limits of GitHub.")
+	adminTokenFile      = flag.String("admin-token-file", "", "Path to the file containing the bearer token required to access the /config, /status and /promote endpoints. The endpoints are disabled if unset.")
+	maxConcurrentClones = flag.Int("max-concurrent-clones", 0, "How many PRs may be cloned at once. Events for other PRs wait for a clone to finish. Zero means unlimited.")
+	cloneWaitTimeout    = flag.Duration("clone-wait-timeout", defaultCloneWaitTimeout, "How long an event waits for another clone to finish before retrying, until --git-retry-deadline.")
+	slackWebhookFile    = flag.String("slack-webhook-file", "", "Path to the file containing the URL of the Slack incoming webhook to notify the slack_channel of a repo through when its updates fail. Disabled if empty.")
+	smtpServer          = flag.String("smtp-server", "", "host:port of the SMTP server to mail the email_recipients of a repo through when its updates fail. Disabled if empty.")
+	smtpTLS             = flag.String("smtp-tls", smtpTLSStartTLS, "How to secure the connection to --smtp-server: starttls, tls or none.")
+	smtpFrom            = flag.String("smtp-from", "", "Address to mail notifications from. Required with --smtp-server.")
+	smtpUsername        = flag.String("smtp-username", "", "Username to authenticate to --smtp-server as. Does not authenticate if empty.")
+	smtpPasswordFile    = flag.String("smtp-password-file", "", "Path to the file containing the password of --smtp-username.")
+	pagerDutyKeyFile    = flag.String("pagerduty-routing-key-file", "", "Path to the file containing the PagerDuty Events API v2 routing key to page with when a target fails escalate_after times in a row. Disabled if empty.")
+	escalationFile      = flag.String("escalation-file", "", "Path to keep the failures of targets counted towards paging and tracking issues in, so that they survive restarts. They are only kept in memory if empty.")
+	forcePR             = flag.Bool("force-pr", false, "Run the updates for the open PR named by --org, --repo and --pr as if it was merged, post the results marked as a force run and exit. For testing the config of a repo before merging.")
+	forceOrg            = flag.String("org", "", "Org of the PR to run with --force-pr.")
+	forceRepo           = flag.String("repo", "", "Repo of the PR to run with --force-pr.")
+	forcePRNumber       = flag.Int("pr", 0, "Number of the PR to run with --force-pr.")
+	otlpEndpoint        = flag.String("otlp-endpoint", "", "Base URL of an OpenTelemetry collector, such as http://collector:4318, to export a trace of every event to with OTLP over HTTP. Disabled if empty.")
+	statusEntries       = flag.Int("status-entries", defaultStatusEntries, "How many of the most recent task results to report on the /status endpoint.")
 )
 
+var catchUpOrgs = flagutil.NewStrings()
+var githubTokenPool = flagutil.NewStrings()
+var githubAPITimeouts = flagutil.NewStrings()
+
+func init() {
+	flag.Var(&githubTokenPool, "github-token-pool", "Path to a file containing another GitHub OAuth token, used once those before it exhaust their rate limit, starting with --github-token-file. May be repeated.")
+	flag.Var(&githubAPITimeouts, "github-api-timeout", "call=duration bounding the GitHub API call named by a method of the client, such as CreateComment=1m, instead of the default of 30s. May be repeated.")
+	flag.Var(&catchUpOrgs, "catchup-org", "Org to catch up on merged PRs in with --catchup-since. May be repeated.")
+}
+
 func main() {
 	flag.Parse()
-	logrus.SetFormatter(&logrus.JSONFormatter{})
-	// Ignore SIGTERM so that we don't drop hooks when the pod is removed.
-	// We'll get SIGTERM first and then SIGKILL after our graceful termination
-	// deadline.
-	signal.Ignore(syscall.SIGTERM)
+	if flag.Arg(0) == "version" {
+		fmt.Println(currentVersion())
+		os.Exit(0)
+	}
+	if err := configureLogging(logrus.StandardLogger(), *logLevel, *logFormat); err != nil {
+		logrus.WithError(err).Fatal("Invalid logging flags.")
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "port" {
+			*listenAddr = ":" + strconv.Itoa(*port)
+		}
+	})
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logrus.Fatal("--tls-cert and --tls-key must be specified together.")
+	}
+	if *metricsPort <= 0 || *metricsPort > 65535 {
+		logrus.Fatalf("Invalid --metrics-port %d.", *metricsPort)
+	}
+	if *replayDeadLetter && *deadLetterFile == "" {
+		logrus.Fatal("--replay-dead-letter requires --dead-letter-file.")
+	}
+	if *forcePR && (*forceOrg == "" || *forceRepo == "" || *forcePRNumber <= 0) {
+		logrus.Fatal("--force-pr requires --org, --repo and --pr.")
+	}
+	if !*forcePR && (*forceOrg != "" || *forceRepo != "" || *forcePRNumber != 0) {
+		logrus.Fatal("--org, --repo and --pr require --force-pr.")
+	}
+	if (*hmacSecretName == "") != (*hmacSecretNamespace == "") {
+		logrus.Fatal("--hmac-secret-name and --hmac-secret-namespace must be specified together.")
+	}
+	if *smtpServer != "" && *smtpFrom == "" {
+		logrus.Fatal("--smtp-server requires --smtp-from.")
+	}
+	if *smtpUsername != "" && *smtpPasswordFile == "" {
+		logrus.Fatal("--smtp-username requires --smtp-password-file.")
+	}
+	var catchUpFrom time.Time
+	if *catchUpSince != "" {
+		var err error
+		if catchUpFrom, err = time.Parse(time.RFC3339, *catchUpSince); err != nil {
+			logrus.WithError(err).Fatal("Invalid --catchup-since.")
+		}
+		if len(catchUpOrgs.Strings()) == 0 {
+			logrus.Fatal("--catchup-since requires at least one --catchup-org.")
+		}
+	}
+	checked, err := checkConfig(*updateConfigFile, configCheck{
+		SchemaPath:       *configSchema,
+		MakeBinary:       *makeBinary,
+		ContainerRuntime: *containerRuntime,
+		Local:            *executor == "local",
+	})
+	if err != nil {
+		if schemaErr, ok := err.(*SchemaError); ok {
+			for _, violation := range schemaErr.Violations {
+				logrus.WithFields(logrus.Fields{"path": violation.Path, "violation": violation.Message}).Error("Config does not match the schema.")
+			}
+		}
+		logrus.WithError(err).Fatal("Invalid config.")
+	}
+	if *validateConfig {
+		fmt.Printf("%s is valid.\n%s", *updateConfigFile, configSummary(checked))
+		os.Exit(0)
+	}
 
 	configAgent := &Agent{}
 	if err := configAgent.Start(*updateConfigFile); err != nil {
 		logrus.WithError(err).Fatal("Error starting config agent.")
 	}
 
-	secretAgent := &config.SecretAgent{}
-	if err := secretAgent.Start([]string{*webhookSecretFile, *githubTokenFile}); err != nil {
+	var commentTemplate string
+	if *commentTemplateFile != "" {
+		b, err := ioutil.ReadFile(*commentTemplateFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error reading comment template.")
+		}
+		if _, err := parseCommentTemplate(string(b)); err != nil {
+			logrus.WithError(err).Fatal("Error parsing comment template.")
+		}
+		commentTemplate = string(b)
+	}
+
+	secrets := append([]string{*githubTokenFile}, githubTokenPool.Strings()...)
+	if *hmacSecretName == "" {
+		secrets = append(secrets, *webhookSecretFile)
+	}
+	if *jenkinsURL != "" {
+		secrets = append(secrets, *jenkinsTokenFile)
+	}
+	if *adminTokenFile != "" {
+		secrets = append(secrets, *adminTokenFile)
+	}
+	if *slackWebhookFile != "" {
+		secrets = append(secrets, *slackWebhookFile)
+	}
+	if *smtpUsername != "" {
+		secrets = append(secrets, *smtpPasswordFile)
+	}
+	if *pagerDutyKeyFile != "" {
+		secrets = append(secrets, *pagerDutyKeyFile)
+	}
+	secretAgent := &secret.Agent{}
+	if err := secretAgent.Start(secrets); err != nil {
 		logrus.WithError(err).Fatal("Error starting secrets agent.")
 	}
 
@@ -64,9 +241,19 @@ func main() {
 		logrus.WithError(err).Fatal("Must specify a valid --github-endpoint URL.")
 	}
 
-	githubClient := github.NewClient(secretAgent.GetTokenGenerator(*githubTokenFile), *githubEndpoint)
+	getToken := secretAgent.GetTokenGenerator(*githubTokenFile)
+	var tokens *RotatingTokenSource
+	if len(githubTokenPool.Strings()) > 0 {
+		generators := []func() []byte{getToken}
+		for _, path := range githubTokenPool.Strings() {
+			generators = append(generators, secretAgent.GetTokenGenerator(path))
+		}
+		tokens = NewRotatingTokenSource(generators)
+		getToken = tokens.Generator
+	}
+	githubClient := github.NewClient(getToken, *githubEndpoint)
 	if *dryRun {
-		githubClient = github.NewDryRunClient(secretAgent.GetTokenGenerator(*githubTokenFile), *githubEndpoint)
+		githubClient = github.NewDryRunClient(getToken, *githubEndpoint)
 	}
 
 	gitClient, err := git.NewClient()
@@ -75,10 +262,285 @@ func main() {
 	}
 
 	botname, _ := githubClient.BotName()
-	gitClient.SetCredentials(botname, secretAgent.GetTokenGenerator(*githubTokenFile))
+	gitClient.SetCredentials(botname, getToken)
 
-	server := NewServer(secretAgent.GetTokenGenerator(*webhookSecretFile), gitClient, githubClient, configAgent)
+	hmacSecret := secretAgent.GetTokenGenerator(*webhookSecretFile)
+	if *hmacSecretName != "" {
+		client, err := kube.GetKubernetesClient("", *kubeconfig)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error getting Kubernetes client.")
+		}
+		hmacAgent := &KubeSecretAgent{Client: client, Namespace: *hmacSecretNamespace, Name: *hmacSecretName, Key: *hmacSecretKey}
+		if err := hmacAgent.Start(*hmacSecretRefresh); err != nil {
+			logrus.WithError(err).Fatal("Error reading HMAC secret.")
+		}
+		hmacSecret = hmacAgent.GetSecret
+	}
+
+	server := NewServer(hmacSecret, gitClient, githubClient, configAgent, *gitRetryDeadline)
+	if tokens != nil {
+		server.ghc = &rotatingGitHubClient{githubClient: server.ghc, tokens: tokens, log: server.log}
+	}
+	server.CommentTemplate = commentTemplate
+	server.MakeBinary = *makeBinary
+	server.ContainerRuntime = *containerRuntime
+	server.MaxRequestBodyBytes = *maxRequestBodyBytes
+	server.RequireSHA256Signature = *requireSHA256
+	server.UseChecksAPI = *useChecksAPI
+	server.MinimizeOldComments = *minimizeOldComments
+	server.MaxCacheEntries = *maxCacheEntries
+	server.StatusEntries = *statusEntries
+	server.MaxConcurrentClones = *maxConcurrentClones
+	server.CloneWaitTimeout = *cloneWaitTimeout
+	// flushTraces exports the spans that are left before exiting.
+	flushTraces := func() {}
+	if *otlpEndpoint != "" {
+		tracerProvider := NewOTLPTracerProvider(*otlpEndpoint, server.log)
+		flushTraces = func() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				logrus.WithError(err).Error("Error exporting the remaining spans.")
+			}
+		}
+		server.TracerProvider = tracerProvider
+	}
+	apiTimeouts, err := parseAPITimeouts(githubAPITimeouts.Strings())
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid --github-api-timeout.")
+	}
+	server.APITimeouts = apiTimeouts
+	server.StatsDAddr = *statsDAddr
+	if *reportFile != "" {
+		server.Report = &Report{Path: *reportFile}
+	}
+	if *slackWebhookFile != "" {
+		server.Notifiers = append(server.Notifiers, &SlackNotifier{WebhookURL: secretAgent.GetTokenGenerator(*slackWebhookFile)})
+	}
+	if *smtpServer != "" {
+		emailNotifier, err := NewEmailNotifier(*smtpServer, *smtpTLS, *smtpFrom, *smtpUsername, secretAgent.GetTokenGenerator(*smtpPasswordFile))
+		if err != nil {
+			logrus.WithError(err).Fatal("Error setting up email notifications.")
+		}
+		server.Notifiers = append(server.Notifiers, emailNotifier)
+	}
+	if *deadLetterFile != "" {
+		server.DeadLetters = &FileDeadLetterQueue{Path: *deadLetterFile}
+	}
+	if *pagerDutyKeyFile != "" {
+		server.Pager = &PagerDutyPager{RoutingKey: secretAgent.GetTokenGenerator(*pagerDutyKeyFile)}
+	}
+	if *escalationFile != "" {
+		escalations, err := LoadEscalationStore(*escalationFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error loading escalations.")
+		}
+		server.Escalations = escalations
+	}
+	if *promotionFile != "" {
+		promotions, err := LoadPromotionStore(*promotionFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error loading pending promotions.")
+		}
+		server.Promotions = promotions
+	}
+	if *prowConfigPath != "" {
+		prowJobs, err := newProwJobRunnerFromFlags()
+		if err != nil {
+			logrus.WithError(err).Fatal("Error setting up ProwJobs.")
+		}
+		server.ProwJobs = prowJobs
+	}
+	if *nativeApply {
+		cluster, err := newKubeClusterFromFlags()
+		if err != nil {
+			logrus.WithError(err).Fatal("Error setting up native apply.")
+		}
+		server.cluster = cluster
+	}
+	switch *executor {
+	case "local":
+	case "kubernetes":
+		jobExecutor, err := newJobExecutorFromFlags()
+		if err != nil {
+			logrus.WithError(err).Fatal("Error setting up the Job executor.")
+		}
+		server.executor = jobExecutor
+	default:
+		logrus.Fatalf("Unknown --executor %q, must be local or kubernetes.", *executor)
+	}
+	if *jenkinsURL != "" {
+		server.JenkinsURL = *jenkinsURL
+		server.JenkinsToken = secretAgent.GetTokenGenerator(*jenkinsTokenFile)
+	}
+
+	if *replayDeadLetter {
+		replayed, failed, err := server.replayDeadLetters(*deadLetterFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error replaying failed events.")
+		}
+		logrus.WithFields(logrus.Fields{"replayed": replayed, "failed": failed}).Info("Replayed failed events.")
+		flushTraces()
+		os.Exit(server.runOnceExitCode(failed > 0))
+	}
+	if *forcePR {
+		if err := server.forceRun(context.Background(), *forceOrg, *forceRepo, *forcePRNumber); err != nil {
+			logrus.WithError(err).Fatal("Error forcing updates.")
+		}
+		flushTraces()
+		os.Exit(server.runOnceExitCode(false))
+	}
 
 	http.Handle("/", server)
-	logrus.Fatal(http.ListenAndServe(":"+strconv.Itoa(*port), nil))
+	http.HandleFunc("/healthz", server.ServeHealth)
+	http.HandleFunc("/version", versionHandler)
+	if *adminTokenFile != "" {
+		http.Handle("/config", requireToken(secretAgent.GetTokenGenerator(*adminTokenFile), configHandler(configAgent)))
+		http.Handle("/status", requireToken(secretAgent.GetTokenGenerator(*adminTokenFile), statusHandler(server)))
+		http.Handle("/promote", requireToken(secretAgent.GetTokenGenerator(*adminTokenFile), promoteHandler(server)))
+	}
+	if *catchUpSince != "" {
+		until := time.Now()
+		go func() {
+			if err := server.catchUp(server.lifetime(), catchUpOrgs.Strings(), catchUpFrom, until, *catchUpInterval); err != nil {
+				logrus.WithError(err).Error("Error catching up on merged PRs.")
+			}
+		}()
+	}
+
+	// The servers live and die together: once either stops, or on an
+	// interrupt, both are shut down, letting the requests in progress finish.
+	webhookServer := &http.Server{Addr: *listenAddr}
+	metricsServer := NewMetricsServer(*metricsPort)
+	errs := make(chan error, 2)
+	go func() {
+		var err error
+		if *tlsCert != "" {
+			err = webhookServer.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			err = webhookServer.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		errs <- err
+	}()
+	go func() {
+		errs <- metricsServer.Start()
+	}()
+	// When the pod is removed we get SIGTERM first and then SIGKILL after the
+	// termination grace period, so shut down on SIGTERM to drain the events in
+	// progress within it instead of dropping them.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	var serveErr error
+	select {
+	case serveErr = <-errs:
+		logrus.WithError(serveErr).Error("Server stopped, shutting down.")
+	case <-interrupt:
+		logrus.Info("Interrupted, shutting down.")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := webhookServer.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Error("Error shutting down the webhook server.")
+	}
+	// Events still being handled past the deadline are stopped.
+	server.Shutdown()
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Error("Error shutting down the metrics server.")
+	}
+	flushTraces()
+	if serveErr != nil {
+		os.Exit(1)
+	}
+}
+
+// newProwJobRunnerFromFlags creates the runner of ProwJobs, as configured by
+// the flags.
+func newProwJobRunnerFromFlags() (*ProwJobRunner, error) {
+	configAgent := &config.Agent{}
+	if err := configAgent.Start(*prowConfigPath, *jobConfigPath); err != nil {
+		return nil, fmt.Errorf("error loading the Prow config: %v", err)
+	}
+	restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := prowclientset.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	runner := NewProwJobRunner(client, configAgent.Config)
+	runner.ScheduleTimeout = *prowJobTimeout
+	return runner, nil
+}
+
+// newKubeClusterFromFlags creates the cluster that objects are applied to
+// natively, as configured by the flags.
+func newKubeClusterFromFlags() (*kubeCluster, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &kubeCluster{client: client, dynamic: dynamicClient}, nil
+}
+
+// newJobExecutorFromFlags creates a JobExecutor as configured by the flags.
+func newJobExecutorFromFlags() (*JobExecutor, error) {
+	client, err := kube.GetKubernetesClient("", *kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	e := NewJobExecutor(client, *jobNamespace, *jobImage)
+	e.ServiceAccount = *jobServiceAccount
+	e.Deadline = *jobDeadline
+	requests := corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{corev1.ResourceCPU: *jobCPU, corev1.ResourceMemory: *jobMemory} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s request %q: %v", name, value, err)
+		}
+		requests[name] = quantity
+	}
+	e.Resources.Requests = requests
+	return e, nil
+}
+
+// configureLogging sets the level and format of logger. Our version of
+// logrus has no trace level, so trace logs everything debug does.
+func configureLogging(logger *logrus.Logger, level, format string) error {
+	if level == "trace" {
+		level = "debug"
+	}
+	switch level {
+	case "debug", "info", "warn", "error":
+		parsed, err := logrus.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		logger.SetLevel(parsed)
+	default:
+		return fmt.Errorf("unknown --log-level %q", level)
+	}
+	switch format {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown --log-format %q", format)
+	}
+	return nil
 }
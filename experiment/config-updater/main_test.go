@@ -0,0 +1,63 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConfigureLogging(t *testing.T) {
+	var testcases = []struct {
+		name   string
+		level  string
+		format string
+
+		expectedLevel logrus.Level
+		expectedJSON  bool
+		expectedErr   bool
+	}{
+		{name: "defaults", level: "info", format: "text", expectedLevel: logrus.InfoLevel},
+		{name: "json", level: "warn", format: "json", expectedLevel: logrus.WarnLevel, expectedJSON: true},
+		{name: "trace logs at debug", level: "trace", format: "text", expectedLevel: logrus.DebugLevel},
+		{name: "unknown level", level: "panic", format: "text", expectedErr: true},
+		{name: "unknown format", level: "info", format: "xml", expectedErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := logrus.New()
+			err := configureLogging(logger, tc.level, tc.format)
+			if tc.expectedErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if logger.Level != tc.expectedLevel {
+				t.Errorf("expected level %v, got %v", tc.expectedLevel, logger.Level)
+			}
+			if _, isJSON := logger.Formatter.(*logrus.JSONFormatter); isJSON != tc.expectedJSON {
+				t.Errorf("expected JSON formatter: %v, got %T", tc.expectedJSON, logger.Formatter)
+			}
+		})
+	}
+}
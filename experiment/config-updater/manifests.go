@@ -0,0 +1,371 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// unknownKindsWarn and unknownKindsFail are what ManifestValidation
+	// does with objects whose kind has no schema.
+	unknownKindsWarn = "warn"
+	unknownKindsFail = "fail"
+)
+
+// ManifestValidation validates the objects in the configs in Targets that
+// changed against the schemas of their kinds before any task runs. Configs
+// with an invalid object are not applied, and fail instead.
+type ManifestValidation struct {
+	// SchemaDir is a directory holding a JSON Schema for each kind, named
+	// like the standalone schemas kubeval uses, such as
+	// deployment-apps-v1.json or service-v1.json. A schema may refer to
+	// the others in the directory. These take the place of the built-in
+	// schemas for the same kinds.
+	SchemaDir string `json:"schema_dir,omitempty" yaml:"schema_dir,omitempty"`
+	// UnknownKinds is warn, the default, to only warn about objects of a
+	// kind that has no schema, or fail to fail their configs. An apiVersion
+	// that has no schema for a kind that has one in another version always
+	// fails, as it is most likely a typo.
+	UnknownKinds string `json:"unknown_kinds,omitempty" yaml:"unknown_kinds,omitempty"`
+}
+
+// validate checks the settings of the validation, if it is configured.
+func (m *ManifestValidation) validate() error {
+	if m == nil {
+		return nil
+	}
+	switch m.UnknownKinds {
+	case "", unknownKindsWarn, unknownKindsFail:
+	default:
+		return fmt.Errorf("unknown_kinds must be %s or %s, not %q", unknownKindsWarn, unknownKindsFail, m.UnknownKinds)
+	}
+	if m.SchemaDir != "" && !filepath.IsAbs(m.SchemaDir) {
+		return fmt.Errorf("schema_dir %q must be an absolute path", m.SchemaDir)
+	}
+	return nil
+}
+
+// schemaName is the name of the schema for objects of kind in apiVersion,
+// without its extension.
+func schemaName(apiVersion, kind string) string {
+	return strings.ToLower(kind + "-" + strings.Replace(apiVersion, "/", "-", -1))
+}
+
+// builtinManifestSchemasURL is the URL builtinManifestSchemas is known by
+// to the compiler.
+const builtinManifestSchemasURL = "config-updater://manifests.json"
+
+// schemaFor returns the schema for objects of kind in apiVersion, or nil if
+// there is none.
+func (m *ManifestValidation) schemaFor(apiVersion, kind string) (*jsonschema.Schema, error) {
+	name := schemaName(apiVersion, kind)
+	compiler := jsonschema.NewCompiler()
+	if m.SchemaDir != "" {
+		path := filepath.Join(m.SchemaDir, name+".json")
+		if _, err := os.Stat(path); err == nil {
+			schema, err := compiler.Compile(path)
+			if err != nil {
+				return nil, fmt.Errorf("error compiling schema %s.json: %v", name, err)
+			}
+			return schema, nil
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error reading schema %s.json: %v", name, err)
+		}
+	}
+	if _, ok := builtinSchemaDefinitions()[name]; !ok {
+		return nil, nil
+	}
+	if err := compiler.AddResource(builtinManifestSchemasURL, strings.NewReader(builtinManifestSchemas)); err != nil {
+		return nil, fmt.Errorf("error parsing built-in schemas: %v", err)
+	}
+	schema, err := compiler.Compile(builtinManifestSchemasURL + "#/definitions/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling built-in schema %s: %v", name, err)
+	}
+	return schema, nil
+}
+
+// versionsOf lists the apiVersions that have a schema for kind.
+func (m *ManifestValidation) versionsOf(kind string) []string {
+	prefix := strings.ToLower(kind) + "-"
+	versions := sets.NewString()
+	for name, definition := range builtinSchemaDefinitions() {
+		if apiVersion, ok := definition.(map[string]interface{})["x-api-version"].(string); ok && strings.HasPrefix(name, prefix) {
+			versions.Insert(apiVersion)
+		}
+	}
+	if m.SchemaDir != "" {
+		names, _ := filepath.Glob(filepath.Join(m.SchemaDir, prefix+"*.json"))
+		for _, name := range names {
+			version := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), prefix), ".json")
+			// Group and version are joined with a dash in the name, and the
+			// version is the last part.
+			if i := strings.LastIndex(version, "-"); i >= 0 {
+				version = version[:i] + "/" + version[i+1:]
+			}
+			versions.Insert(version)
+		}
+	}
+	return versions.List()
+}
+
+// validateManifest validates every object in config, in the checkout in
+// dir. It returns warnings about objects that could not be validated, and an
+// error describing every violation if any object is invalid. Documents
+// that cannot be parsed, or have no kind, are left to
+// determineTargetForConfig to report.
+func (m *ManifestValidation) validateManifest(dir, config string) ([]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, config))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read object YAML/JSON from %v", config)
+	}
+	documents := splitDocuments(config, content)
+	var warnings, problems []string
+	for i, document := range documents {
+		source := config
+		if len(documents) > 1 {
+			source = fmt.Sprintf("document %d of %v", i+1, config)
+		}
+		var object interface{}
+		if err := yaml.Unmarshal(document, &object); err != nil {
+			continue
+		}
+		fields, _ := object.(map[string]interface{})
+		kind, ok := fields["kind"].(string)
+		if !ok {
+			continue
+		}
+		apiVersion, _ := fields["apiVersion"].(string)
+
+		schema, err := m.schemaFor(apiVersion, kind)
+		if err != nil {
+			return nil, err
+		}
+		if schema == nil {
+			if versions := m.versionsOf(kind); len(versions) > 0 {
+				problems = append(problems, fmt.Sprintf("%s: %s has no apiVersion %q, only %s", source, kind, apiVersion, strings.Join(versions, ", ")))
+			} else if m.UnknownKinds == unknownKindsFail {
+				problems = append(problems, fmt.Sprintf("%s: there is no schema for %s in %q", source, kind, apiVersion))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("%s was not validated, as there is no schema for %s in %q.", source, kind, apiVersion))
+			}
+			continue
+		}
+
+		if err := schema.Validate(object); err != nil {
+			validationErr, ok := err.(*jsonschema.ValidationError)
+			if !ok {
+				return nil, fmt.Errorf("error validating %s: %v", source, err)
+			}
+			var violations []SchemaViolation
+			collectViolations(validationErr, &violations)
+			problems = append(problems, (&SchemaError{Path: source, Violations: violations}).Error())
+		}
+	}
+	if len(problems) > 0 {
+		return warnings, errors.New(strings.Join(problems, "; "))
+	}
+	return warnings, nil
+}
+
+// builtinSchemaRoot is builtinManifestSchemas, parsed.
+var builtinSchemaRoot = func() map[string]interface{} {
+	var root map[string]interface{}
+	if err := json.Unmarshal([]byte(builtinManifestSchemas), &root); err != nil {
+		panic(fmt.Sprintf("error parsing built-in schemas: %v", err))
+	}
+	return root
+}()
+
+// builtinSchemaDefinitions are the definitions in builtinSchemaRoot.
+func builtinSchemaDefinitions() map[string]interface{} {
+	return builtinSchemaRoot["definitions"].(map[string]interface{})
+}
+
+// builtinManifestSchemas holds the schemas for common kinds, used when
+// ManifestValidation.SchemaDir has none for a kind. Each definition is named
+// like the schemas there, and x-api-version is the apiVersion it is for.
+// Only the fields that are most often mistyped are checked strictly; pod
+// templates and status are left open.
+const builtinManifestSchemas = `{
+  "definitions": {
+    "objectMeta": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "name": {"type": "string"},
+        "generateName": {"type": "string"},
+        "namespace": {"type": "string"},
+        "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+        "annotations": {"type": "object", "additionalProperties": {"type": "string"}},
+        "ownerReferences": {"type": "array"},
+        "finalizers": {"type": "array", "items": {"type": "string"}},
+        "uid": {"type": "string"},
+        "resourceVersion": {"type": "string"},
+        "generation": {"type": "integer"},
+        "creationTimestamp": {"type": ["string", "null"]},
+        "deletionTimestamp": {"type": ["string", "null"]},
+        "deletionGracePeriodSeconds": {"type": "integer"},
+        "selfLink": {"type": "string"},
+        "managedFields": {"type": "array"}
+      }
+    },
+    "stringMap": {"type": "object", "additionalProperties": {"type": "string"}},
+    "configmap-v1": {
+      "x-api-version": "v1",
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["apiVersion", "kind", "metadata"],
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"$ref": "#/definitions/objectMeta"},
+        "data": {"$ref": "#/definitions/stringMap"},
+        "binaryData": {"$ref": "#/definitions/stringMap"},
+        "immutable": {"type": "boolean"}
+      }
+    },
+    "secret-v1": {
+      "x-api-version": "v1",
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["apiVersion", "kind", "metadata"],
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"$ref": "#/definitions/objectMeta"},
+        "type": {"type": "string"},
+        "data": {"$ref": "#/definitions/stringMap"},
+        "stringData": {"$ref": "#/definitions/stringMap"},
+        "immutable": {"type": "boolean"}
+      }
+    },
+    "service-v1": {
+      "x-api-version": "v1",
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["apiVersion", "kind", "metadata", "spec"],
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"$ref": "#/definitions/objectMeta"},
+        "spec": {
+          "type": "object",
+          "additionalProperties": false,
+          "properties": {
+            "type": {"type": "string", "enum": ["ClusterIP", "NodePort", "LoadBalancer", "ExternalName"]},
+            "selector": {"$ref": "#/definitions/stringMap"},
+            "ports": {
+              "type": "array",
+              "items": {
+                "type": "object",
+                "additionalProperties": false,
+                "required": ["port"],
+                "properties": {
+                  "name": {"type": "string"},
+                  "protocol": {"type": "string", "enum": ["TCP", "UDP", "SCTP"]},
+                  "appProtocol": {"type": "string"},
+                  "port": {"type": "integer"},
+                  "targetPort": {"type": ["integer", "string"]},
+                  "nodePort": {"type": "integer"}
+                }
+              }
+            },
+            "clusterIP": {"type": "string"},
+            "clusterIPs": {"type": "array", "items": {"type": "string"}},
+            "externalIPs": {"type": "array", "items": {"type": "string"}},
+            "externalName": {"type": "string"},
+            "externalTrafficPolicy": {"type": "string"},
+            "internalTrafficPolicy": {"type": "string"},
+            "healthCheckNodePort": {"type": "integer"},
+            "ipFamily": {"type": "string"},
+            "ipFamilies": {"type": "array", "items": {"type": "string"}},
+            "ipFamilyPolicy": {"type": "string"},
+            "loadBalancerIP": {"type": "string"},
+            "loadBalancerClass": {"type": "string"},
+            "loadBalancerSourceRanges": {"type": "array", "items": {"type": "string"}},
+            "allocateLoadBalancerNodePorts": {"type": "boolean"},
+            "publishNotReadyAddresses": {"type": "boolean"},
+            "sessionAffinity": {"type": "string", "enum": ["None", "ClientIP"]},
+            "sessionAffinityConfig": {"type": "object"},
+            "topologyKeys": {"type": "array", "items": {"type": "string"}}
+          }
+        },
+        "status": {"type": "object"}
+      }
+    },
+    "deployment-apps-v1": {
+      "x-api-version": "apps/v1",
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["apiVersion", "kind", "metadata", "spec"],
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"$ref": "#/definitions/objectMeta"},
+        "spec": {
+          "type": "object",
+          "additionalProperties": false,
+          "required": ["selector", "template"],
+          "properties": {
+            "replicas": {"type": "integer", "minimum": 0},
+            "selector": {
+              "type": "object",
+              "additionalProperties": false,
+              "properties": {
+                "matchLabels": {"$ref": "#/definitions/stringMap"},
+                "matchExpressions": {"type": "array"}
+              }
+            },
+            "template": {
+              "type": "object",
+              "additionalProperties": false,
+              "properties": {
+                "metadata": {"$ref": "#/definitions/objectMeta"},
+                "spec": {"type": "object"}
+              }
+            },
+            "strategy": {
+              "type": "object",
+              "additionalProperties": false,
+              "properties": {
+                "type": {"type": "string", "enum": ["Recreate", "RollingUpdate"]},
+                "rollingUpdate": {"type": "object"}
+              }
+            },
+            "minReadySeconds": {"type": "integer", "minimum": 0},
+            "revisionHistoryLimit": {"type": "integer", "minimum": 0},
+            "progressDeadlineSeconds": {"type": "integer", "minimum": 0},
+            "paused": {"type": "boolean"}
+          }
+        },
+        "status": {"type": "object"}
+      }
+    }
+  }
+}`
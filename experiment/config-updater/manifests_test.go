@@ -0,0 +1,252 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// manifests are configs with objects that are valid, invalid, or of kinds
+// without a built-in schema.
+var manifests = map[string]string{
+	"config/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx
+`,
+	"config/invalid-field.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replica: 2
+  selector:
+    matchLabels:
+      app: web
+  template:
+    spec: {}
+`,
+	"config/wrong-type.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: http
+`,
+	"config/typo-version.yaml": `apiVersion: apps/v1beta7
+kind: Deployment
+metadata:
+  name: web
+spec: {}
+`,
+	"config/unknown-kind.yaml": `apiVersion: monitoring.coreos.com/v1
+kind: ServiceMonitor
+metadata:
+  name: web
+`,
+	"config/mixed.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  debug: "true"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  label:
+    app: web
+spec: {}
+`,
+}
+
+func TestValidateManifest(t *testing.T) {
+	dir := makeRepoDir(t, manifests)
+	defer os.RemoveAll(dir)
+	schemaDir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(schemaDir)
+	monitor := `{"type": "object", "required": ["spec"]}`
+	if err := ioutil.WriteFile(filepath.Join(schemaDir, "servicemonitor-monitoring.coreos.com-v1.json"), []byte(monitor), 0644); err != nil {
+		t.Fatalf("failed to write schema: %v", err)
+	}
+
+	var testcases = []struct {
+		name             string
+		config           string
+		validation       ManifestValidation
+		expectedWarnings []string
+		expectedErr      string
+	}{
+		{
+			name:   "valid deployment",
+			config: "config/deployment.yaml",
+		},
+		{
+			name:        "invalid field",
+			config:      "config/invalid-field.yaml",
+			expectedErr: "config/invalid-field.yaml does not match the schema: /spec: additionalProperties 'replica' not allowed",
+		},
+		{
+			name:        "wrong type",
+			config:      "config/wrong-type.yaml",
+			expectedErr: "config/wrong-type.yaml does not match the schema: /spec/ports/0/port: expected integer, but got string",
+		},
+		{
+			name:        "typo in apiVersion",
+			config:      "config/typo-version.yaml",
+			expectedErr: `config/typo-version.yaml: Deployment has no apiVersion "apps/v1beta7", only apps/v1`,
+		},
+		{
+			name:             "unknown kind warns by default",
+			config:           "config/unknown-kind.yaml",
+			expectedWarnings: []string{`config/unknown-kind.yaml was not validated, as there is no schema for ServiceMonitor in "monitoring.coreos.com/v1".`},
+		},
+		{
+			name:        "unknown kind can fail",
+			config:      "config/unknown-kind.yaml",
+			validation:  ManifestValidation{UnknownKinds: unknownKindsFail},
+			expectedErr: `config/unknown-kind.yaml: there is no schema for ServiceMonitor in "monitoring.coreos.com/v1"`,
+		},
+		{
+			name:        "schema from the schema dir",
+			config:      "config/unknown-kind.yaml",
+			validation:  ManifestValidation{SchemaDir: schemaDir},
+			expectedErr: `config/unknown-kind.yaml does not match the schema: /: missing properties: 'spec'`,
+		},
+		{
+			name:        "each document is validated",
+			config:      "config/mixed.yaml",
+			expectedErr: "document 2 of config/mixed.yaml does not match the schema: /metadata: additionalProperties 'label' not allowed",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			warnings, err := tc.validation.validateManifest(dir, tc.config)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if !reflect.DeepEqual(warnings, tc.expectedWarnings) {
+				t.Errorf("expected warnings %q, got %q", tc.expectedWarnings, warnings)
+			}
+		})
+	}
+}
+
+func TestManifestValidationValidate(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		validation  *ManifestValidation
+		expectedErr string
+	}{
+		{
+			name: "not configured",
+		},
+		{
+			name:       "defaults",
+			validation: &ManifestValidation{},
+		},
+		{
+			name:        "unknown unknown_kinds",
+			validation:  &ManifestValidation{UnknownKinds: "ignore"},
+			expectedErr: `unknown_kinds must be warn or fail, not "ignore"`,
+		},
+		{
+			name:        "relative schema dir",
+			validation:  &ManifestValidation{SchemaDir: "schemas"},
+			expectedErr: `schema_dir "schemas" must be an absolute path`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.validation.validate()
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestHandleEventValidatesManifests(t *testing.T) {
+	dir := makeRepoDir(t, manifests)
+	defer os.RemoveAll(dir)
+	configs := []string{"config/deployment.yaml", "config/invalid-field.yaml", "config/unknown-kind.yaml"}
+	var changes []github.PullRequestChange
+	for _, config := range configs {
+		changes = append(changes, github.PullRequestChange{Filename: config})
+	}
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+	}
+	s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+		Targets:            configs,
+		ManifestValidation: &ManifestValidation{},
+		MaxPRFiles:         defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := [][]string{
+		{"/usr/bin/make", "apply", "WHAT=config/deployment.yaml"},
+		{"/usr/bin/make", "apply", "WHAT=config/unknown-kind.yaml"},
+	}
+	if !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected to run %q, got %q", expected, executor.ran)
+	}
+	checkComment(t, ghc, "The following updates failed:\n<ul><li><details><summary><code>/usr/bin/make apply WHAT=config/invalid-field.yaml</code> failed: config/invalid-field.yaml does not match the schema: /spec: additionalProperties &#39;replica&#39; not allowed</summary>")
+	if comment := ghc.IssueCommentsAdded[0]; !strings.Contains(comment, "config/unknown-kind.yaml was not validated") {
+		t.Errorf("expected a warning about the unknown kind, got %s", comment)
+	}
+}
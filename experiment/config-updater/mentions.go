@@ -0,0 +1,79 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxFailureMentions is the most users and teams mentioned in a comment, so
+// that a PR failing many updates does not ping everyone.
+const maxFailureMentions = 10
+
+// validateNotify checks that users are logins and teams are org/team slugs,
+// without the @ they are mentioned with.
+func validateNotify(users, teams []string) error {
+	for _, user := range users {
+		if user == "" || strings.ContainsAny(user, "@/ ") {
+			return fmt.Errorf("notify_users must be GitHub logins without @, not %q", user)
+		}
+	}
+	for _, team := range teams {
+		parts := strings.Split(team, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(team, "@ ") {
+			return fmt.Errorf("notify_teams must be org/team slugs without @, not %q", team)
+		}
+	}
+	return nil
+}
+
+// mentions are who to mention when a task of m fails, those of the config
+// if m names nobody.
+func (c *UpdateConfig) mentions(m *Matcher) []string {
+	users, teams := c.NotifyUsers, c.NotifyTeams
+	if m != nil && (len(m.NotifyUsers) > 0 || len(m.NotifyTeams) > 0) {
+		users, teams = m.NotifyUsers, m.NotifyTeams
+	}
+	return union(append([]string{}, users...), teams)
+}
+
+// failureMentions are who to mention for the failed updates, up to
+// maxFailureMentions, and how many more there were.
+func (r *results) failureMentions() ([]string, int) {
+	var mentions []string
+	for _, failed := range r.failed {
+		mentions = union(mentions, failed.notify)
+	}
+	if len(mentions) > maxFailureMentions {
+		return mentions[:maxFailureMentions], len(mentions) - maxFailureMentions
+	}
+	return mentions, 0
+}
+
+// formatMentions pings the owners of the failed updates, if any.
+func (r *results) formatMentions() string {
+	mentions, more := r.failureMentions()
+	if len(mentions) == 0 {
+		return ""
+	}
+	line := "cc @" + strings.Join(mentions, " @")
+	if more > 0 {
+		line += fmt.Sprintf(" and %d more", more)
+	}
+	return line + "\n\n"
+}
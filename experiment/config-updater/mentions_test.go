@@ -0,0 +1,115 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestFailureMentions(t *testing.T) {
+	var manyUsers []string
+	for i := 0; i < maxFailureMentions+2; i++ {
+		manyUsers = append(manyUsers, fmt.Sprintf("user%d", i))
+	}
+
+	var testcases = []struct {
+		name        string
+		config      UpdateConfig
+		failed      bool
+		expected    string
+		notExpected string
+	}{
+		{
+			name:     "users",
+			config:   UpdateConfig{NotifyUsers: []string{"alice", "bob"}},
+			failed:   true,
+			expected: "</ul>\ncc @alice @bob\n\n",
+		},
+		{
+			name:     "teams",
+			config:   UpdateConfig{NotifyTeams: []string{"org/config-owners"}},
+			failed:   true,
+			expected: "</ul>\ncc @org/config-owners\n\n",
+		},
+		{
+			name:     "users and teams",
+			config:   UpdateConfig{NotifyUsers: []string{"alice"}, NotifyTeams: []string{"org/config-owners"}},
+			failed:   true,
+			expected: "cc @alice @org/config-owners\n\n",
+		},
+		{
+			name: "matcher replaces the default",
+			config: UpdateConfig{
+				NotifyUsers: []string{"alice"},
+				Matchers:    []Matcher{{Glob: "jobs/*", Target: "jobs", NotifyTeams: []string{"org/jobs"}}},
+			},
+			failed:   true,
+			expected: "cc @org/jobs\n\n",
+		},
+		{
+			name:     "capped",
+			config:   UpdateConfig{NotifyUsers: manyUsers},
+			failed:   true,
+			expected: fmt.Sprintf("@user%d and 2 more\n\n", maxFailureMentions-1),
+		},
+		{
+			name:        "succeeded",
+			config:      UpdateConfig{NotifyUsers: []string{"alice"}},
+			notExpected: "@alice",
+		},
+		{
+			name:        "nobody to notify",
+			failed:      true,
+			notExpected: "cc @",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+			}
+			config := tc.config
+			if len(config.Matchers) == 0 {
+				config.Matchers = []Matcher{{Glob: "jobs/*", Target: "jobs"}}
+			}
+			config.MaxPRFiles = defaultMaxPRFiles
+			s := newTestServer(&fakeGit{}, ghc, &config)
+			s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": tc.failed}}
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(ghc.IssueCommentsAdded) != 1 {
+				t.Fatalf("expected one comment, got %v", ghc.IssueCommentsAdded)
+			}
+			comment := ghc.IssueCommentsAdded[0]
+			if tc.expected != "" && !strings.Contains(comment, tc.expected) {
+				t.Errorf("expected comment to contain %q, got %q", tc.expected, comment)
+			}
+			if tc.notExpected != "" && strings.Contains(comment, tc.notExpected) {
+				t.Errorf("expected comment not to contain %q, got %q", tc.notExpected, comment)
+			}
+		})
+	}
+}
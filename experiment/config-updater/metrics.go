@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Define all metrics for the config-updater here.
+	taskExitCodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_updater_task_exit_codes",
+		Help: "A counter of the exit codes of the tasks run, by make target. Tasks that could not run report -1.",
+	}, []string{"target", "exit_code"})
+	failedRollbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_updater_failed_rollbacks",
+		Help: "A counter of rollbacks that failed after a task failed, by make target.",
+	}, []string{"target"})
+	pathEscapes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_updater_path_escapes",
+		Help: "A counter of changed files refused because their path resolved to outside of the checkout, by repository.",
+	}, []string{"org", "repo"})
+	excludedFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_updater_excluded_files",
+		Help: "A counter of changed files ignored because they matched an exclude, by repository.",
+	}, []string{"org", "repo"})
+	deadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_updater_dead_letters",
+		Help: "A counter of events that failed and were kept in the dead letter queue, by event type.",
+	}, []string{"event_type"})
+	inflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "jenkins_updater_inflight_requests",
+		Help: "The number of webhook events currently being handled.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(taskExitCodes)
+	prometheus.MustRegister(failedRollbacks)
+	prometheus.MustRegister(pathEscapes)
+	prometheus.MustRegister(excludedFiles)
+	prometheus.MustRegister(deadLetters)
+	prometheus.MustRegister(inflightRequests)
+}
+
+// MetricsServer serves /metrics on a port of its own, so that webhooks can
+// never reach it, nor metrics scrapes the webhook handler.
+type MetricsServer struct {
+	server *http.Server
+}
+
+// NewMetricsServer creates a server for the metrics on port.
+func NewMetricsServer(port int) *MetricsServer {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &MetricsServer{server: &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux}}
+}
+
+// Start serves the metrics until Shutdown is called, returning nil then, or
+// the error that stopped it otherwise.
+func (m *MetricsServer) Start() error {
+	if err := m.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops the server, waiting for scrapes in progress until ctx is
+// done.
+func (m *MetricsServer) Shutdown(ctx context.Context) error {
+	return m.server.Shutdown(ctx)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetricsServer(t *testing.T) {
+	var testcases = []struct {
+		name           string
+		path           string
+		expectedStatus int
+	}{
+		{
+			name:           "metrics",
+			path:           "/metrics",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "webhooks are not served",
+			path:           "/",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	m := NewMetricsServer(9090)
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			m.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tc.path, nil))
+			if w.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestMetricsServerShutdown(t *testing.T) {
+	m := NewMetricsServer(0)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- m.Start()
+	}()
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("expected no error once shut down, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the server to stop")
+	}
+}
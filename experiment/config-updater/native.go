@@ -0,0 +1,332 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	backendMake   = "make"
+	backendNative = "native"
+
+	// nativeApplyTarget stands in for the make target of tasks applied
+	// natively, in logs and metrics.
+	nativeApplyTarget = "native-apply"
+
+	defaultFieldManager = "config-updater"
+
+	// applyPatchType is the patch type of server-side apply, which the
+	// vendored client-go predates.
+	applyPatchType = types.PatchType("application/apply-patch+yaml")
+
+	crdPollInterval     = time.Second
+	crdEstablishTimeout = time.Minute
+)
+
+// crdResource is where CustomResourceDefinitions are served.
+var crdResource = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1beta1", Resource: "customresourcedefinitions"}
+
+// cluster is what applying objects natively needs of the API server.
+type cluster interface {
+	// resourceFor finds the resource serving kind, and whether it is
+	// namespaced. It returns a *noResourceError if there is none.
+	resourceFor(kind schema.GroupVersionKind) (schema.GroupVersionResource, bool, error)
+	get(resource schema.GroupVersionResource, namespace, name string) (*unstructured.Unstructured, error)
+	// apply applies the object in data with server-side apply.
+	apply(resource schema.GroupVersionResource, namespace, name string, data []byte, fieldManager string) (*unstructured.Unstructured, error)
+}
+
+// noResourceError is returned when the API server serves no resource for a
+// kind, as happens until the CustomResourceDefinition of the kind is
+// established.
+type noResourceError struct {
+	kind schema.GroupVersionKind
+}
+
+func (e *noResourceError) Error() string {
+	return fmt.Sprintf("the server has no resource for %s in %q", e.kind.Kind, e.kind.GroupVersion())
+}
+
+// kubeCluster is the cluster that a Kubernetes client talks to.
+type kubeCluster struct {
+	client  kubernetes.Interface
+	dynamic dynamic.Interface
+}
+
+func (c *kubeCluster) resourceFor(kind schema.GroupVersionKind) (schema.GroupVersionResource, bool, error) {
+	resources, err := c.client.Discovery().ServerResourcesForGroupVersion(kind.GroupVersion().String())
+	if errors.IsNotFound(err) {
+		return schema.GroupVersionResource{}, false, &noResourceError{kind: kind}
+	} else if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	for _, resource := range resources.APIResources {
+		// Subresources, such as deployments/scale, have the kind of what
+		// they read and write rather than of the object.
+		if resource.Kind == kind.Kind && !strings.Contains(resource.Name, "/") {
+			return kind.GroupVersion().WithResource(resource.Name), resource.Namespaced, nil
+		}
+	}
+	return schema.GroupVersionResource{}, false, &noResourceError{kind: kind}
+}
+
+func (c *kubeCluster) get(resource schema.GroupVersionResource, namespace, name string) (*unstructured.Unstructured, error) {
+	return c.dynamic.Resource(resource).Namespace(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (c *kubeCluster) apply(resource schema.GroupVersionResource, namespace, name string, data []byte, fieldManager string) (*unstructured.Unstructured, error) {
+	// The dynamic client cannot set the field manager, so the patch is
+	// sent with the client that discovery uses.
+	path := []string{"apis", resource.Group, resource.Version}
+	if resource.Group == "" {
+		path = []string{"api", resource.Version}
+	}
+	if namespace != "" {
+		path = append(path, "namespaces", namespace)
+	}
+	path = append(path, resource.Resource, name)
+	raw, err := c.client.Discovery().RESTClient().Patch(applyPatchType).AbsPath(path...).Param("fieldManager", fieldManager).Body(data).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	object := &unstructured.Unstructured{}
+	return object, object.UnmarshalJSON(raw)
+}
+
+// fieldManager is the field manager objects are applied natively as.
+func (c *UpdateConfig) fieldManager() string {
+	if c.FieldManager != "" {
+		return c.FieldManager
+	}
+	return defaultFieldManager
+}
+
+// objectResult is the outcome of applying a single object natively.
+type objectResult struct {
+	kind      string
+	namespace string
+	name      string
+	// action is created, configured or unchanged, if the object was
+	// applied.
+	action string
+	err    error
+}
+
+// String describes how applying the object went in HTML, for the comment.
+func (r objectResult) String() string {
+	name := r.name
+	if r.namespace != "" {
+		name = r.namespace + "/" + name
+	}
+	object := html.EscapeString(r.kind + " " + name)
+	if r.err != nil {
+		return fmt.Sprintf("<code>%s</code> failed: %s", object, html.EscapeString(r.err.Error()))
+	}
+	return fmt.Sprintf("<code>%s</code> %s", object, html.EscapeString(r.action))
+}
+
+// nativeApplier applies the configs of a PR with server-side apply.
+type nativeApplier struct {
+	cluster      cluster
+	fieldManager string
+	// crds are the CustomResourceDefinitions applied for the PR so far, by
+	// the kind they define, so that objects of those kinds can wait for
+	// them to be established.
+	crds map[schema.GroupKind]string
+
+	pollInterval     time.Duration
+	establishTimeout time.Duration
+}
+
+func newNativeApplier(c cluster, fieldManager string) *nativeApplier {
+	return &nativeApplier{
+		cluster:          c,
+		fieldManager:     fieldManager,
+		crds:             map[schema.GroupKind]string{},
+		pollInterval:     crdPollInterval,
+		establishTimeout: crdEstablishTimeout,
+	}
+}
+
+// apply applies every object in config, CustomResourceDefinitions first.
+// An object that fails does not keep the rest from being applied.
+func (a *nativeApplier) apply(ctx context.Context, dir, config string) ([]objectResult, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, config))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read object YAML/JSON from %v", config)
+	}
+	var objects []*unstructured.Unstructured
+	for i, document := range splitDocuments(config, content) {
+		raw, err := yaml.YAMLToJSON(document)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse object YAML/JSON from document %d of %v: %v", i+1, config, err)
+		}
+		object := &unstructured.Unstructured{}
+		if err := object.UnmarshalJSON(raw); err != nil {
+			return nil, fmt.Errorf("cannot parse object YAML/JSON from document %d of %v: %v", i+1, config, err)
+		}
+		objects = append(objects, object)
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return isCRD(objects[i]) && !isCRD(objects[j])
+	})
+
+	var results []objectResult
+	for _, object := range objects {
+		results = append(results, a.applyObject(ctx, object))
+	}
+	return results, nil
+}
+
+func (a *nativeApplier) applyObject(ctx context.Context, object *unstructured.Unstructured) objectResult {
+	r := objectResult{kind: object.GetKind(), namespace: object.GetNamespace(), name: object.GetName()}
+	kind := object.GroupVersionKind()
+	resource, namespaced, err := a.cluster.resourceFor(kind)
+	if _, missing := err.(*noResourceError); missing {
+		if crd, ok := a.crds[kind.GroupKind()]; ok {
+			if err = a.waitEstablished(ctx, crd); err == nil {
+				resource, namespaced, err = a.cluster.resourceFor(kind)
+			}
+		}
+	}
+	if err != nil {
+		r.err = err
+		return r
+	}
+	switch {
+	case !namespaced:
+		r.namespace = ""
+	case r.namespace == "":
+		r.namespace = metav1.NamespaceDefault
+	}
+	object.SetNamespace(r.namespace)
+
+	data, err := object.MarshalJSON()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	before, err := a.cluster.get(resource, r.namespace, r.name)
+	if err != nil && !errors.IsNotFound(err) {
+		r.err = err
+		return r
+	}
+	after, err := a.cluster.apply(resource, r.namespace, r.name, data, a.fieldManager)
+	switch {
+	case err != nil:
+		r.err = err
+		return r
+	case before == nil:
+		r.action = "created"
+	case before.GetResourceVersion() == after.GetResourceVersion():
+		r.action = "unchanged"
+	default:
+		r.action = "configured"
+	}
+
+	if isCRD(object) {
+		group, _, _ := unstructured.NestedString(object.Object, "spec", "group")
+		definedKind, _, _ := unstructured.NestedString(object.Object, "spec", "names", "kind")
+		a.crds[schema.GroupKind{Group: group, Kind: definedKind}] = r.name
+	}
+	return r
+}
+
+// waitEstablished waits for the CustomResourceDefinition named crd to be
+// established, after which its resource is served.
+func (a *nativeApplier) waitEstablished(ctx context.Context, crd string) error {
+	ctx, cancel := context.WithTimeout(ctx, a.establishTimeout)
+	defer cancel()
+	ticker := time.NewTicker(a.pollInterval)
+	defer ticker.Stop()
+	for {
+		object, err := a.cluster.get(crdResource, "", crd)
+		if err == nil && isEstablished(object) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("CustomResourceDefinition %s was not established within %s", crd, a.establishTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func isCRD(object *unstructured.Unstructured) bool {
+	return object.GroupVersionKind().GroupKind() == schema.GroupKind{Group: crdResource.Group, Kind: "CustomResourceDefinition"}
+}
+
+// isEstablished determines whether a CustomResourceDefinition has the
+// Established condition.
+func isEstablished(crd *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, condition := range conditions {
+		condition, ok := condition.(map[string]interface{})
+		if ok && condition["type"] == "Established" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyNatively applies the configs of task t with a, in place of running
+// its command.
+func (s *Server) applyNatively(ctx context.Context, a *nativeApplier, dir string, t task) result {
+	taskResult := result{command: t.command}
+	if a.cluster == nil {
+		taskResult.exitCode = -1
+		taskResult.err = fmt.Errorf("objects cannot be applied natively, as the server was not started with --native-apply")
+		return taskResult
+	}
+	var failed int
+	for _, config := range t.configs() {
+		objects, err := a.apply(ctx, dir, config)
+		if err != nil {
+			taskResult.exitCode = -1
+			taskResult.err = err
+			return taskResult
+		}
+		for _, object := range objects {
+			if object.err != nil {
+				failed++
+			}
+		}
+		taskResult.objects = append(taskResult.objects, objects...)
+	}
+	if failed > 0 {
+		taskResult.exitCode = -1
+		taskResult.err = fmt.Errorf("%d of %d objects could not be applied", failed, len(taskResult.objects))
+	}
+	return taskResult
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// fakeResource is a resource served by fakeCluster.
+type fakeResource struct {
+	resource   schema.GroupVersionResource
+	namespaced bool
+}
+
+// fakeCluster serves the resources it is given, and those of the
+// CustomResourceDefinitions applied to it once they have been polled
+// establishAfter times.
+type fakeCluster struct {
+	resources      map[schema.GroupVersionKind]fakeResource
+	objects        map[string]*unstructured.Unstructured
+	establishAfter int
+	polls          int
+	// applied lists the objects applied, with their field manager.
+	applied []string
+}
+
+func newFakeCluster(objects ...string) *fakeCluster {
+	c := &fakeCluster{
+		resources: map[schema.GroupVersionKind]fakeResource{
+			{Version: "v1", Kind: "ConfigMap"}: {resource: schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, namespaced: true},
+			{Version: "v1", Kind: "Namespace"}: {resource: schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}},
+			{Group: "apiextensions.k8s.io", Version: "v1beta1", Kind: "CustomResourceDefinition"}: {resource: crdResource},
+		},
+		objects: map[string]*unstructured.Unstructured{},
+	}
+	for _, object := range objects {
+		u := &unstructured.Unstructured{}
+		raw, _ := yaml.YAMLToJSON([]byte(object))
+		if err := u.UnmarshalJSON(raw); err != nil {
+			panic(err)
+		}
+		u.SetResourceVersion("1")
+		resource := c.resources[u.GroupVersionKind()]
+		c.objects[c.key(resource.resource, u.GetNamespace(), u.GetName())] = u
+	}
+	return c
+}
+
+func (c *fakeCluster) key(resource schema.GroupVersionResource, namespace, name string) string {
+	return resource.String() + "/" + namespace + "/" + name
+}
+
+func (c *fakeCluster) resourceFor(kind schema.GroupVersionKind) (schema.GroupVersionResource, bool, error) {
+	resource, ok := c.resources[kind]
+	if !ok {
+		return schema.GroupVersionResource{}, false, &noResourceError{kind: kind}
+	}
+	return resource.resource, resource.namespaced, nil
+}
+
+func (c *fakeCluster) get(resource schema.GroupVersionResource, namespace, name string) (*unstructured.Unstructured, error) {
+	object, ok := c.objects[c.key(resource, namespace, name)]
+	if !ok {
+		return nil, errors.NewNotFound(resource.GroupResource(), name)
+	}
+	if resource == crdResource {
+		c.polls++
+		if c.polls >= c.establishAfter {
+			c.establish(object)
+		}
+	}
+	return object.DeepCopy(), nil
+}
+
+func (c *fakeCluster) establish(crd *unstructured.Unstructured) {
+	unstructured.SetNestedSlice(crd.Object, []interface{}{map[string]interface{}{"type": "Established", "status": "True"}}, "status", "conditions")
+	group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	version, _, _ := unstructured.NestedString(crd.Object, "spec", "version")
+	kind, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "kind")
+	plural, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+	scope, _, _ := unstructured.NestedString(crd.Object, "spec", "scope")
+	c.resources[schema.GroupVersionKind{Group: group, Version: version, Kind: kind}] = fakeResource{
+		resource:   schema.GroupVersionResource{Group: group, Version: version, Resource: plural},
+		namespaced: scope == "Namespaced",
+	}
+}
+
+func (c *fakeCluster) apply(resource schema.GroupVersionResource, namespace, name string, data []byte, fieldManager string) (*unstructured.Unstructured, error) {
+	c.applied = append(c.applied, fmt.Sprintf("%s %s/%s by %s", resource.Resource, namespace, name, fieldManager))
+	object := &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	key := c.key(resource, namespace, name)
+	version := 1
+	if existing, ok := c.objects[key]; ok {
+		version, _ = strconv.Atoi(existing.GetResourceVersion())
+		existing = existing.DeepCopy()
+		unstructured.RemoveNestedField(existing.Object, "metadata", "resourceVersion")
+		if !reflect.DeepEqual(existing.Object["data"], object.Object["data"]) || !reflect.DeepEqual(existing.Object["metadata"], object.Object["metadata"]) {
+			version++
+		}
+	}
+	object.SetResourceVersion(strconv.Itoa(version))
+	c.objects[key] = object
+	return object.DeepCopy(), nil
+}
+
+var nativeConfigs = map[string]string{
+	"config/settings.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  debug: "true"
+`,
+	"config/namespace.yaml": `apiVersion: v1
+kind: Namespace
+metadata:
+  name: tools
+`,
+	"config/mixed.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: tools
+---
+apiVersion: monitoring.coreos.com/v1
+kind: ServiceMonitor
+metadata:
+  name: web
+`,
+	"config/crd.yaml": `apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: gear
+---
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  version: v1
+  scope: Namespaced
+  names:
+    kind: Widget
+    plural: widgets
+`,
+}
+
+func TestNativeApplierApply(t *testing.T) {
+	dir := makeRepoDir(t, nativeConfigs)
+	defer os.RemoveAll(dir)
+
+	var testcases = []struct {
+		name            string
+		config          string
+		existing        []string
+		establishAfter  int
+		expected        []string
+		expectedApplied []string
+	}{
+		{
+			name:            "created in the default namespace",
+			config:          "config/settings.yaml",
+			expected:        []string{"<code>ConfigMap default/settings</code> created"},
+			expectedApplied: []string{"configmaps default/settings by config-updater"},
+		},
+		{
+			name:            "unchanged",
+			config:          "config/settings.yaml",
+			existing:        []string{"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n  namespace: default\ndata:\n  debug: \"true\"\n"},
+			expected:        []string{"<code>ConfigMap default/settings</code> unchanged"},
+			expectedApplied: []string{"configmaps default/settings by config-updater"},
+		},
+		{
+			name:            "configured",
+			config:          "config/settings.yaml",
+			existing:        []string{"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n  namespace: default\ndata:\n  debug: \"false\"\n"},
+			expected:        []string{"<code>ConfigMap default/settings</code> configured"},
+			expectedApplied: []string{"configmaps default/settings by config-updater"},
+		},
+		{
+			name:            "cluster scoped",
+			config:          "config/namespace.yaml",
+			expected:        []string{"<code>Namespace tools</code> created"},
+			expectedApplied: []string{"namespaces /tools by config-updater"},
+		},
+		{
+			name:   "unknown kind does not stop the rest",
+			config: "config/mixed.yaml",
+			expected: []string{
+				"<code>ConfigMap tools/settings</code> created",
+				`<code>ServiceMonitor web</code> failed: the server has no resource for ServiceMonitor in &#34;monitoring.coreos.com/v1&#34;`,
+			},
+			expectedApplied: []string{"configmaps tools/settings by config-updater"},
+		},
+		{
+			name:           "custom resource waits for its definition",
+			config:         "config/crd.yaml",
+			establishAfter: 3,
+			expected: []string{
+				"<code>CustomResourceDefinition widgets.example.com</code> created",
+				"<code>Widget default/gear</code> created",
+			},
+			expectedApplied: []string{"customresourcedefinitions /widgets.example.com by config-updater", "widgets default/gear by config-updater"},
+		},
+		{
+			name:           "definition never established",
+			config:         "config/crd.yaml",
+			establishAfter: 1000,
+			expected: []string{
+				"<code>CustomResourceDefinition widgets.example.com</code> created",
+				"<code>Widget gear</code> failed: CustomResourceDefinition widgets.example.com was not established within 50ms",
+			},
+			expectedApplied: []string{"customresourcedefinitions /widgets.example.com by config-updater"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cluster := newFakeCluster(tc.existing...)
+			cluster.establishAfter = tc.establishAfter
+			a := newNativeApplier(cluster, defaultFieldManager)
+			a.pollInterval = time.Millisecond
+			a.establishTimeout = 50 * time.Millisecond
+
+			objects, err := a.apply(context.Background(), dir, tc.config)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var actual []string
+			for _, object := range objects {
+				actual = append(actual, object.String())
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected results %q, got %q", tc.expected, actual)
+			}
+			if !reflect.DeepEqual(cluster.applied, tc.expectedApplied) {
+				t.Errorf("expected to apply %q, got %q", tc.expectedApplied, cluster.applied)
+			}
+		})
+	}
+}
+
+func TestHandleEventNativeBackend(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		cluster         cluster
+		expectedComment string
+	}{
+		{
+			name:            "applied natively",
+			cluster:         newFakeCluster(),
+			expectedComment: "The following updates succeeded:\n<ul><li><details><summary><code>apply config/settings.yaml</code> exited with code 0</summary>\n<ul><li><code>ConfigMap default/settings</code> created</li></ul>\n</details></li>",
+		},
+		{
+			name:            "not enabled",
+			expectedComment: "<code>apply config/settings.yaml</code> failed: objects cannot be applied natively, as the server was not started with --native-apply",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := makeRepoDir(t, map[string]string{
+				"config/settings.yaml": nativeConfigs["config/settings.yaml"],
+				"config/service.yaml":  "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n",
+			})
+			defer os.RemoveAll(dir)
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "config/settings.yaml"},
+					{Filename: "config/service.yaml"},
+				}},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:      []string{"config/settings.yaml", "config/service.yaml"},
+				KindBackends: map[string]string{"ConfigMap": backendNative},
+				MaxPRFiles:   defaultMaxPRFiles,
+			})
+			s.cluster = tc.cluster
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected := [][]string{{"/usr/bin/make", "apply", "WHAT=config/service.yaml"}}; !reflect.DeepEqual(executor.ran, expected) {
+				t.Errorf("expected to run %q, got %q", expected, executor.ran)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+		})
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+const (
+	// defaultNotifyInterval is how long we wait before notifying about the
+	// same PR again, so that retried or replayed events do not flood the
+	// channel.
+	defaultNotifyInterval = time.Hour
+	// maxNotificationErrorLines bounds how much of the error of each task
+	// is quoted in a notification.
+	maxNotificationErrorLines = 5
+	// notifyTimeout bounds how long posting a notification may take.
+	notifyTimeout = 30 * time.Second
+)
+
+// Notification describes the updates of a PR that failed.
+type Notification struct {
+	// PR is the PR, as org/repo#number.
+	PR  string
+	URL string
+	// Summary is the summary of all the results.
+	Summary  string
+	Failures []NotifiedFailure
+	// Internal are the internal errors, each cut to its first lines.
+	Internal []string
+}
+
+// NotifiedFailure is a task that failed.
+type NotifiedFailure struct {
+	Command string
+	// LogURL links to the logs of the task, if it ran somewhere that keeps
+	// them.
+	LogURL string
+	// Error is the first lines of the error.
+	Error string
+}
+
+// Notifier tells the people on call that updates failed, as the comment on
+// the PR is only seen by its author.
+type Notifier interface {
+	// Notify sends n to where the config of the repo of the PR says, if
+	// anywhere.
+	Notify(config *UpdateConfig, n Notification) error
+}
+
+// newNotification describes the failures in results.
+func newNotification(pr github.PullRequest, results results) Notification {
+	n := Notification{
+		PR:      fmt.Sprintf("%s/%s#%d", pr.Base.Repo.Owner.Login, pr.Base.Repo.Name, pr.Number),
+		URL:     pr.HTMLURL,
+		Summary: results.Summary(),
+	}
+	for _, failed := range results.failed {
+		n.Failures = append(n.Failures, NotifiedFailure{Command: strings.Join(failed.command, " "), LogURL: failed.url, Error: firstLines(failureMessage(failed))})
+	}
+	for _, err := range results.internal {
+		n.Internal = append(n.Internal, firstLines(err.Error()))
+	}
+	return n
+}
+
+// failureMessage explains why the task of r failed: what it wrote to
+// stderr, or else its error.
+func failureMessage(r result) string {
+	if strings.TrimSpace(r.stderr) == "" && r.err != nil {
+		return r.err.Error()
+	}
+	return r.stderr
+}
+
+// firstLines keeps the first maxNotificationErrorLines lines of output.
+func firstLines(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > maxNotificationErrorLines {
+		lines = append(lines[:maxNotificationErrorLines], "…")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SlackNotifier posts notifications to the slack_channel of the repo with a
+// Slack incoming webhook.
+type SlackNotifier struct {
+	// WebhookURL returns the URL of the webhook, which is a secret.
+	WebhookURL func() []byte
+}
+
+// Notify posts n to the slack_channel of config, if it has one.
+func (s *SlackNotifier) Notify(config *UpdateConfig, n Notification) error {
+	if config.SlackChannel == "" {
+		return nil
+	}
+	body, err := json.Marshal(map[string]string{"channel": config.SlackChannel, "text": formatSlackNotification(n)})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(strings.TrimSpace(string(s.WebhookURL())), "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error holds the URL, which must not be logged.
+		return fmt.Errorf("error posting to the Slack webhook")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Slack webhook returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// formatSlackNotification renders n with Slack markup.
+func formatSlackNotification(n Notification) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Updates failed for <%s|%s>: %s\n", n.URL, n.PR, n.Summary)
+	for _, failure := range n.Failures {
+		if failure.LogURL != "" {
+			fmt.Fprintf(&b, "• `%s` failed (<%s|logs>):\n```\n%s\n```\n", failure.Command, failure.LogURL, failure.Error)
+		} else {
+			fmt.Fprintf(&b, "• `%s` failed:\n```\n%s\n```\n", failure.Command, failure.Error)
+		}
+	}
+	for _, err := range n.Internal {
+		fmt.Fprintf(&b, "• Internal error:\n```\n%s\n```\n", err)
+	}
+	return b.String()
+}
+
+// notifyFailure notifies the people on call for the repo of pr that some
+// of results failed, unless they were notified about pr within
+// NotifyInterval. Failing to notify is only logged, as the results are
+// already posted.
+func (s *Server) notifyFailure(pr github.PullRequest, results results) {
+	if len(s.Notifiers) == 0 || results.IsSuccess() {
+		return
+	}
+	updateConfig, ok := s.configAgent.Config().ForRepo(pr.Base.Repo.Owner.Login, pr.Base.Repo.Name)
+	if !ok {
+		return
+	}
+	n := newNotification(pr, results)
+	s.notifiedLock.Lock()
+	defer s.notifiedLock.Unlock()
+	if s.notified == nil {
+		s.notified = map[string]time.Time{}
+	}
+	now := time.Now()
+	for notified, at := range s.notified {
+		if now.Sub(at) >= s.NotifyInterval {
+			delete(s.notified, notified)
+		}
+	}
+	if _, ok := s.notified[n.PR]; ok {
+		s.log.Debug("Already notified about the PR recently, skipping.")
+		return
+	}
+	for _, notifier := range s.Notifiers {
+		if err := notifier.Notify(updateConfig, n); err != nil {
+			s.log.WithError(err).Errorf("Error notifying about failed updates with %T.", notifier)
+			continue
+		}
+		s.notified[n.PR] = now
+	}
+}
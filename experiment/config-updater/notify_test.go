@@ -0,0 +1,218 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// fakeNotifier records the notifications it is asked to post to the
+// slack_channel of the repo, failing them all if err is set.
+type fakeNotifier struct {
+	channels      []string
+	notifications []Notification
+	err           error
+}
+
+func (n *fakeNotifier) Notify(config *UpdateConfig, notification Notification) error {
+	if config.SlackChannel == "" {
+		return nil
+	}
+	n.channels = append(n.channels, config.SlackChannel)
+	n.notifications = append(n.notifications, notification)
+	return n.err
+}
+
+func TestNotifyFailure(t *testing.T) {
+	jobs := Matcher{Glob: "jobs/*", Target: "jobs"}
+	var testcases = []struct {
+		name             string
+		config           UpdateConfig
+		failures         map[string]bool
+		events           int
+		interval         time.Duration
+		notifyErr        error
+		expectedChannels []string
+		expectedMessage  []string
+	}{
+		{
+			name:             "failed update",
+			config:           UpdateConfig{SlackChannel: "#oncall", Matchers: []Matcher{jobs}},
+			failures:         map[string]bool{"/usr/bin/make jobs": true},
+			events:           1,
+			interval:         time.Hour,
+			expectedChannels: []string{"#oncall"},
+			expectedMessage:  []string{"Updates failed for <https://github.com/org/repo/pull/1|org/repo#1>: 0 succeeded, 1 failed", "• `/usr/bin/make jobs` failed:\n```\nit broke\n```"},
+		},
+		{
+			name:     "successful update",
+			config:   UpdateConfig{SlackChannel: "#oncall", Matchers: []Matcher{jobs}},
+			events:   1,
+			interval: time.Hour,
+		},
+		{
+			name:     "no channel",
+			config:   UpdateConfig{Matchers: []Matcher{jobs}},
+			failures: map[string]bool{"/usr/bin/make jobs": true},
+			events:   1,
+			interval: time.Hour,
+		},
+		{
+			name: "channel of the repo",
+			config: UpdateConfig{
+				SlackChannel: "#oncall",
+				Repos:        map[string]UpdateConfig{"org/repo": {SlackChannel: "#repo-oncall", Matchers: []Matcher{jobs}}},
+			},
+			failures:         map[string]bool{"/usr/bin/make jobs": true},
+			events:           1,
+			interval:         time.Hour,
+			expectedChannels: []string{"#repo-oncall"},
+		},
+		{
+			name:             "the same PR is only notified once per interval",
+			config:           UpdateConfig{SlackChannel: "#oncall", Matchers: []Matcher{jobs}},
+			failures:         map[string]bool{"/usr/bin/make jobs": true},
+			events:           2,
+			interval:         time.Hour,
+			expectedChannels: []string{"#oncall"},
+		},
+		{
+			name:             "the same PR is notified again after the interval",
+			config:           UpdateConfig{SlackChannel: "#oncall", Matchers: []Matcher{jobs}},
+			failures:         map[string]bool{"/usr/bin/make jobs": true},
+			events:           2,
+			expectedChannels: []string{"#oncall", "#oncall"},
+		},
+		{
+			name:             "failing to notify does not fail the event",
+			config:           UpdateConfig{SlackChannel: "#oncall", Matchers: []Matcher{jobs}},
+			failures:         map[string]bool{"/usr/bin/make jobs": true},
+			events:           2,
+			interval:         time.Hour,
+			notifyErr:        errors.New("slack is down"),
+			expectedChannels: []string{"#oncall", "#oncall"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+			}
+			tc.config.MaxPRFiles = defaultMaxPRFiles
+			notifier := &fakeNotifier{err: tc.notifyErr}
+			s := newTestServer(&fakeGit{}, ghc, &tc.config)
+			s.executor = &recordingExecutor{failures: tc.failures}
+			s.Notifiers = []Notifier{notifier}
+			s.NotifyInterval = tc.interval
+
+			for i := 0; i < tc.events; i++ {
+				event := mergedPREvent(t, func(pr *github.PullRequest) {
+					pr.HTMLURL = "https://github.com/org/repo/pull/1"
+				})
+				if err := s.handleEvent(context.Background(), "pull_request", "guid", event); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if strings.Join(notifier.channels, ",") != strings.Join(tc.expectedChannels, ",") {
+				t.Errorf("expected notifications to %v, got %v", tc.expectedChannels, notifier.channels)
+			}
+			for _, expected := range tc.expectedMessage {
+				if len(notifier.notifications) == 0 || !strings.Contains(formatSlackNotification(notifier.notifications[0]), expected) {
+					t.Errorf("expected notification containing %q, got %v", expected, notifier.notifications)
+				}
+			}
+		})
+	}
+}
+
+func TestFirstLines(t *testing.T) {
+	expected := "1\n2\n3\n4\n5\n…"
+	if actual := firstLines("1\n2\n3\n4\n5\n6\n7\n"); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var testcases = []struct {
+		name         string
+		channel      string
+		status       int
+		expectedText string
+		expectedErr  string
+	}{
+		{
+			name:         "posted",
+			channel:      "#oncall",
+			status:       http.StatusOK,
+			expectedText: "Updates failed for <https://github.com/org/repo/pull/1|org/repo#1>: 0 succeeded, 1 failed, 0 internal errors\n• `prowjob apply` failed (<https://prow/logs|logs>):\n```\nit broke\n```\n",
+		},
+		{
+			name: "no channel",
+		},
+		{
+			name:         "rejected",
+			channel:      "#oncall",
+			status:       http.StatusNotFound,
+			expectedText: "Updates failed for",
+			expectedErr:  "Slack webhook returned 404 Not Found: channel_not_found",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var payload map[string]string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Errorf("invalid payload: %v", err)
+				}
+				w.WriteHeader(tc.status)
+				if tc.status != http.StatusOK {
+					w.Write([]byte("channel_not_found"))
+				}
+			}))
+			defer server.Close()
+
+			n := &SlackNotifier{WebhookURL: func() []byte { return []byte(server.URL + "\n") }}
+			err := n.Notify(&UpdateConfig{SlackChannel: tc.channel}, Notification{
+				PR:       "org/repo#1",
+				URL:      "https://github.com/org/repo/pull/1",
+				Summary:  "0 succeeded, 1 failed, 0 internal errors",
+				Failures: []NotifiedFailure{{Command: "prowjob apply", LogURL: "https://prow/logs", Error: "it broke"}},
+			})
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if payload["channel"] != tc.channel || !strings.HasPrefix(payload["text"], tc.expectedText) {
+				t.Errorf("unexpected payload %v", payload)
+			}
+		})
+	}
+}
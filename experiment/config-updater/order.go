@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// cycleError is returned when tasks are configured to run after each other.
+type cycleError struct {
+	// cycle names the tasks in the cycle, ending with the first one again.
+	cycle []string
+}
+
+func (e *cycleError) Error() string {
+	return fmt.Sprintf("tasks cannot be ordered, as their matchers run after each other in a cycle: %s", strings.Join(e.cycle, " -> "))
+}
+
+// orderTasks sorts tasks so that each one runs after the tasks of the
+// matchers it is configured to run after. Tasks are otherwise kept in the
+// order they are in.
+func orderTasks(tasks []task) ([]task, error) {
+	// The tasks are the nodes of a graph with an edge from every task to
+	// each of the tasks it must run after.
+	deps := make([][]int, len(tasks))
+	for i, t := range tasks {
+		after := sets.NewString(t.after...)
+		for j, other := range tasks {
+			if i != j && after.HasAny(other.names...) {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+
+	done := make([]bool, len(tasks))
+	ready := func(i int) bool {
+		for _, j := range deps[i] {
+			if !done[j] {
+				return false
+			}
+		}
+		return true
+	}
+	var ordered []task
+	for len(ordered) < len(tasks) {
+		next := -1
+		for i := range tasks {
+			if !done[i] && ready(i) {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			return nil, &cycleError{cycle: findCycle(tasks, deps, done)}
+		}
+		done[next] = true
+		ordered = append(ordered, tasks[next])
+	}
+	return ordered, nil
+}
+
+// findCycle follows the dependencies that are not done from the first task
+// that is not done, which must lead to a cycle if none of them are ready.
+func findCycle(tasks []task, deps [][]int, done []bool) []string {
+	seen := map[int]int{}
+	var path []int
+	i := 0
+	for done[i] {
+		i++
+	}
+	for {
+		if start, ok := seen[i]; ok {
+			var cycle []string
+			for _, j := range append(path[start:], i) {
+				cycle = append(cycle, strings.Join(tasks[j].names, "/"))
+			}
+			return cycle
+		}
+		seen[i] = len(path)
+		path = append(path, i)
+		for _, j := range deps[i] {
+			if !done[j] {
+				i = j
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestOrderTasks(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		tasks       []task
+		expected    []string
+		expectedErr string
+	}{
+		{
+			name:     "no constraints keeps the order",
+			tasks:    []task{{target: "a", names: []string{"a"}}, {target: "b"}, {target: "c", names: []string{"c"}}},
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			name: "dependency moves before its dependent",
+			tasks: []task{
+				{target: "service", names: []string{"service"}, after: []string{"lib"}},
+				{target: "other"},
+				{target: "lib", names: []string{"lib"}},
+			},
+			expected: []string{"other", "lib", "service"},
+		},
+		{
+			name: "chain of dependencies",
+			tasks: []task{
+				{target: "c", names: []string{"c"}, after: []string{"b"}},
+				{target: "b", names: []string{"b"}, after: []string{"a"}},
+				{target: "a", names: []string{"a"}},
+			},
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			name: "every task of a matcher runs first",
+			tasks: []task{
+				{target: "service", names: []string{"service"}, after: []string{"lib"}},
+				{target: "lib-1", names: []string{"lib"}},
+				{target: "lib-2", names: []string{"lib"}},
+			},
+			expected: []string{"lib-1", "lib-2", "service"},
+		},
+		{
+			name: "matcher without tasks is ignored",
+			tasks: []task{
+				{target: "service", names: []string{"service"}, after: []string{"lib"}},
+			},
+			expected: []string{"service"},
+		},
+		{
+			name: "cycle",
+			tasks: []task{
+				{target: "other"},
+				{target: "a", names: []string{"a"}, after: []string{"c"}},
+				{target: "b", names: []string{"b"}, after: []string{"a"}},
+				{target: "c", names: []string{"c"}, after: []string{"b"}},
+			},
+			expectedErr: "tasks cannot be ordered, as their matchers run after each other in a cycle: a -> c -> b -> a",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ordered, err := orderTasks(tc.tasks)
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var targets []string
+			for _, task := range ordered {
+				targets = append(targets, task.target)
+			}
+			if !reflect.DeepEqual(targets, tc.expected) {
+				t.Errorf("expected order %v, got %v", tc.expected, targets)
+			}
+		})
+	}
+}
+
+func TestHandleEventOrder(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		matchers        []Matcher
+		expected        [][]string
+		expectedComment string
+	}{
+		{
+			name: "library is applied before the service",
+			matchers: []Matcher{
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^services/`)}, Target: "services", Name: "services", After: []string{"libraries"}},
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^libraries/`)}, Target: "libraries", Name: "libraries"},
+			},
+			expected: [][]string{{"/usr/bin/make", "libraries"}, {"/usr/bin/make", "services"}},
+		},
+		{
+			name: "cycle runs nothing",
+			matchers: []Matcher{
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^services/`)}, Target: "services", Name: "services", After: []string{"libraries"}},
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^libraries/`)}, Target: "libraries", Name: "libraries", After: []string{"services"}},
+			},
+			expectedComment: "services -&gt; libraries -&gt; services, so no updates were run",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "services/api.yaml"},
+					{Filename: "libraries/common.yaml"},
+				}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{Matchers: tc.matchers, MaxPRFiles: defaultMaxPRFiles})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+			if tc.expectedComment != "" && !strings.Contains(strings.Join(ghc.IssueCommentsAdded, "\n"), tc.expectedComment) {
+				t.Errorf("expected a comment containing %q, got %v", tc.expectedComment, ghc.IssueCommentsAdded)
+			}
+		})
+	}
+}
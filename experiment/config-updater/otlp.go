@@ -0,0 +1,285 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// otlpBufferSize bounds how many spans wait to be exported, past which
+	// they are dropped rather than holding up the updates.
+	otlpBufferSize = 1000
+	// otlpBatchSize is how many spans are exported at once.
+	otlpBatchSize = 100
+	// otlpFlushInterval is how long spans wait for a batch to fill up.
+	otlpFlushInterval = 5 * time.Second
+)
+
+// NewOTLPTracerProvider traces with the OpenTelemetry SDK, exporting the
+// spans to endpoint in batches in the background. It must be shut down to
+// export the spans that are left.
+func NewOTLPTracerProvider(endpoint string, log *logrus.Entry) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(NewOTLPExporter(endpoint, log),
+			sdktrace.WithMaxQueueSize(otlpBufferSize),
+			sdktrace.WithMaxExportBatchSize(otlpBatchSize),
+			sdktrace.WithBatchTimeout(otlpFlushInterval),
+		),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(pluginName),
+			semconv.ServiceVersionKey.String(version),
+		)),
+	)
+}
+
+// OTLPExporter exports spans to an OpenTelemetry collector with OTLP over
+// HTTP, encoded as JSON. The OTLP exporters of OpenTelemetry need gRPC and
+// its gateway, which are too new for the ones vendored here.
+type OTLPExporter struct {
+	// Endpoint is the base URL of the collector, such as
+	// http://collector:4318, to which /v1/traces is added.
+	Endpoint string
+
+	client *http.Client
+	log    *logrus.Entry
+}
+
+// NewOTLPExporter exports the spans it is handed to endpoint.
+func NewOTLPExporter(endpoint string, log *logrus.Entry) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: notifyTimeout},
+		log:      log,
+	}
+}
+
+// ExportSpans sends spans to the collector. Spans are best effort, so they
+// are not retried, and an error is logged rather than returned, as the SDK
+// would only log it again without saying where it came from.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if err := e.export(ctx, spans); err != nil {
+		e.log.WithError(err).WithField("spans", len(spans)).Warn("Error exporting spans.")
+	}
+	return nil
+}
+
+// Shutdown does nothing, as no spans are held.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (e *OTLPExporter) export(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error sending spans to %s: %v", e.Endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s refused spans with %s: %s", e.Endpoint, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// The OTLP trace request, in the JSON encoding of its protobuf messages.
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	SchemaURL  string           `json:"schemaUrl,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope     otlpScope  `json:"scope"`
+	Spans     []otlpSpan `json:"spans"`
+	SchemaURL string     `json:"schemaUrl,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	// IntValue is a string, as JSON numbers cannot hold every int64.
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// The kinds and status codes of OTLP spans.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+
+	otlpStatusUnset = 0
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+// otlpRequest groups spans by the resource and the instrumentation scope
+// that made them, keeping their order.
+func otlpRequest(spans []sdktrace.ReadOnlySpan) otlpTraceRequest {
+	var request otlpTraceRequest
+	resources := map[attribute.Distinct]int{}
+	scopes := map[attribute.Distinct]map[string]int{}
+	for _, span := range spans {
+		res := span.Resource()
+		key := res.Equivalent()
+		r, ok := resources[key]
+		if !ok {
+			r = len(request.ResourceSpans)
+			resources[key] = r
+			scopes[key] = map[string]int{}
+			request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+				Resource:  otlpResource{Attributes: otlpAttributes(res.Attributes())},
+				SchemaURL: res.SchemaURL(),
+			})
+		}
+		library := span.InstrumentationLibrary()
+		scopeKey := library.Name + "@" + library.Version
+		s, ok := scopes[key][scopeKey]
+		if !ok {
+			s = len(request.ResourceSpans[r].ScopeSpans)
+			scopes[key][scopeKey] = s
+			request.ResourceSpans[r].ScopeSpans = append(request.ResourceSpans[r].ScopeSpans, otlpScopeSpans{
+				Scope:     otlpScope{Name: library.Name, Version: library.Version},
+				SchemaURL: library.SchemaURL,
+			})
+		}
+		scope := &request.ResourceSpans[r].ScopeSpans[s]
+		scope.Spans = append(scope.Spans, otlpSpanFrom(span))
+	}
+	return request
+}
+
+func otlpSpanFrom(span sdktrace.ReadOnlySpan) otlpSpan {
+	converted := otlpSpan{
+		TraceID:           span.SpanContext().TraceID().String(),
+		SpanID:            span.SpanContext().SpanID().String(),
+		Name:              span.Name(),
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime().UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.EndTime().UnixNano(), 10),
+		Attributes:        otlpAttributes(span.Attributes()),
+		Status:            otlpStatus{Code: otlpStatusUnset},
+	}
+	if span.Parent().HasSpanID() {
+		converted.ParentSpanID = span.Parent().SpanID().String()
+	}
+	switch span.SpanKind() {
+	case trace.SpanKindServer:
+		converted.Kind = otlpKindServer
+	case trace.SpanKindClient:
+		converted.Kind = otlpKindClient
+	}
+	switch status := span.Status(); status.Code {
+	case codes.Ok:
+		converted.Status = otlpStatus{Code: otlpStatusOK}
+	case codes.Error:
+		converted.Status = otlpStatus{Code: otlpStatusError, Message: status.Description}
+	}
+	return converted
+}
+
+// otlpAttributes converts the attributes of a span or resource, sorted by
+// key.
+func otlpAttributes(attributes []attribute.KeyValue) []otlpAttribute {
+	var converted []otlpAttribute
+	for _, kv := range attributes {
+		var v otlpValue
+		switch kv.Value.Type() {
+		case attribute.STRING:
+			s := kv.Value.AsString()
+			v.StringValue = &s
+		case attribute.BOOL:
+			b := kv.Value.AsBool()
+			v.BoolValue = &b
+		case attribute.INT64:
+			s := strconv.FormatInt(kv.Value.AsInt64(), 10)
+			v.IntValue = &s
+		case attribute.FLOAT64:
+			f := kv.Value.AsFloat64()
+			v.DoubleValue = &f
+		default:
+			s := kv.Value.Emit()
+			v.StringValue = &s
+		}
+		converted = append(converted, otlpAttribute{Key: string(kv.Key), Value: v})
+	}
+	sort.Slice(converted, func(i, j int) bool { return converted[i].Key < converted[j].Key })
+	return converted
+}
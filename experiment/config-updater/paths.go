@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pathEscapeError is returned for a changed file whose path resolves to
+// somewhere outside of the checkout.
+type pathEscapeError struct {
+	filename string
+}
+
+func (e *pathEscapeError) Error() string {
+	return fmt.Sprintf("refused to handle %q: it resolves to outside of the checkout", e.filename)
+}
+
+// resolvePath makes path absolute and follows any symlinks in it. Files that
+// do not exist, like those deleted by the PR, are resolved as far as their
+// closest existing parent.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path, nil
+		}
+		if parent, err = resolvePath(parent); err != nil {
+			return "", err
+		}
+		return filepath.Join(parent, filepath.Base(path)), nil
+	} else if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// validateWorkdir checks that workdir is a relative path that does not
+// obviously leave the checkout. Symlinks are only checked by checkWorkdir.
+func validateWorkdir(workdir string) error {
+	if filepath.IsAbs(workdir) {
+		return fmt.Errorf("%q must be relative to the root of the checkout", workdir)
+	}
+	if clean := filepath.Clean(workdir); clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%q must stay inside the checkout", workdir)
+	}
+	return nil
+}
+
+// checkWorkdir checks that workdir is a directory inside the checkout at dir.
+// The root of the checkout is used when workdir is empty.
+func checkWorkdir(dir, workdir string) error {
+	if filepath.Clean(workdir) == "." {
+		return nil
+	}
+	path, err := checkoutPath(dir, workdir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return fmt.Errorf("workdir %q is not a directory in the checkout", workdir)
+	}
+	return nil
+}
+
+// checkoutPath returns the canonical path of filename in the checkout at
+// dir, or a pathEscapeError if it is not under dir.
+func checkoutPath(dir, filename string) (string, error) {
+	if filepath.IsAbs(filename) {
+		return "", &pathEscapeError{filename: filename}
+	}
+	root, err := resolvePath(dir)
+	if err != nil {
+		return "", err
+	}
+	path, err := resolvePath(filepath.Join(root, filename))
+	if err != nil {
+		return "", err
+	}
+	if path == root || !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return "", &pathEscapeError{filename: filename}
+	}
+	return path, nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// makeCheckout creates a checkout next to a directory outside of it, with
+// symlinks pointing both ways.
+func makeCheckout(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "paths")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	checkout := filepath.Join(dir, "checkout")
+	for _, d := range []string{filepath.Join(checkout, "config"), filepath.Join(dir, "outside")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+	for _, file := range []string{filepath.Join(checkout, "config", "a.yaml"), filepath.Join(dir, "outside", "secret.yaml")} {
+		if err := ioutil.WriteFile(file, []byte("kind: Secret\n"), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(checkout, "config", "escape.yaml"): filepath.Join(dir, "outside", "secret.yaml"),
+		filepath.Join(checkout, "escape"):                filepath.Join(dir, "outside"),
+		filepath.Join(checkout, "config", "b.yaml"):      "a.yaml",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("failed to create symlink: %v", err)
+		}
+	}
+	return checkout, func() { os.RemoveAll(dir) }
+}
+
+func TestCheckoutPath(t *testing.T) {
+	checkout, cleanup := makeCheckout(t)
+	defer cleanup()
+
+	var testcases = []struct {
+		name     string
+		filename string
+		escapes  bool
+	}{
+		{name: "file in the checkout", filename: "config/a.yaml"},
+		{name: "deleted file", filename: "config/deleted.yaml"},
+		{name: "file in a deleted directory", filename: "deleted/a.yaml"},
+		{name: "dot dot staying in the checkout", filename: "config/../config/a.yaml"},
+		{name: "symlink within the checkout", filename: "config/b.yaml"},
+		{name: "dot dot escaping the checkout", filename: "../outside/secret.yaml", escapes: true},
+		{name: "deep dot dot escaping the checkout", filename: "config/../../../../etc/passwd", escapes: true},
+		{name: "checkout itself", filename: "config/..", escapes: true},
+		{name: "absolute filename", filename: "/etc/passwd", escapes: true},
+		{name: "absolute filename in the checkout", filename: filepath.Join(checkout, "config", "a.yaml"), escapes: true},
+		{name: "symlinked file escaping the checkout", filename: "config/escape.yaml", escapes: true},
+		{name: "symlinked directory escaping the checkout", filename: "escape/secret.yaml", escapes: true},
+		{name: "deleted file in a symlinked directory escaping the checkout", filename: "escape/deleted.yaml", escapes: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := checkoutPath(checkout, tc.filename)
+			_, escaped := err.(*pathEscapeError)
+			if tc.escapes && !escaped {
+				t.Errorf("expected %q to escape the checkout, got %v", tc.filename, err)
+			}
+			if !tc.escapes && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestHandleEventRefusesEscapingPaths(t *testing.T) {
+	checkout, cleanup := makeCheckout(t)
+	defer cleanup()
+
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "config/a.yaml"},
+			{Filename: "../outside/secret.yaml"},
+			{Filename: "config/escape.yaml"},
+		}},
+	}
+	s := newTestServer(&fakeGit{dir: checkout}, ghc, &UpdateConfig{
+		Targets:    []string{"config/a.yaml", "../outside/secret.yaml", "config/escape.yaml"},
+		Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`secret|escape`)}, Target: "secrets"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(executor.ran) != 1 || executor.ran[0][2] != "WHAT=config/a.yaml" {
+		t.Errorf("expected only config/a.yaml to be applied, got %v", executor.ran)
+	}
+	checkComment(t, ghc, `The following internal errors occurred:
+<ul><li>refused to handle &#34;../outside/secret.yaml&#34;: it resolves to outside of the checkout</li><li>refused to handle &#34;config/escape.yaml&#34;: it resolves to outside of the checkout</li></ul>`)
+}
+
+func TestValidateWorkdir(t *testing.T) {
+	var testcases = []struct {
+		name    string
+		workdir string
+		valid   bool
+	}{
+		{name: "root by default", valid: true},
+		{name: "nested", workdir: "cluster/ci/jenkins", valid: true},
+		{name: "dot dot staying inside", workdir: "cluster/../jobs", valid: true},
+		{name: "name starting with dots", workdir: "..jobs", valid: true},
+		{name: "absolute", workdir: "/etc"},
+		{name: "parent", workdir: ".."},
+		{name: "dot dot escaping", workdir: "cluster/../../etc"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validateWorkdir(tc.workdir); tc.valid != (err == nil) {
+				t.Errorf("expected %q to be valid %t, got %v", tc.workdir, tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestHandleEventWorkdir(t *testing.T) {
+	checkout, cleanup := makeCheckout(t)
+	defer cleanup()
+	if err := os.MkdirAll(filepath.Join(checkout, "cluster", "ci", "jenkins"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+
+	var testcases = []struct {
+		name             string
+		workdir          string
+		expectedWorkdirs []string
+		expectedComment  string
+	}{
+		{
+			name:             "root by default",
+			expectedWorkdirs: []string{""},
+			expectedComment:  `<code>/usr/bin/make jobs</code> exited with code 0`,
+		},
+		{
+			name:             "nested workdir",
+			workdir:          "cluster/ci/jenkins",
+			expectedWorkdirs: []string{"cluster/ci/jenkins"},
+			expectedComment:  `<code>/usr/bin/make jobs</code> in <code>cluster/ci/jenkins</code> exited with code 0`,
+		},
+		{
+			name:            "missing workdir",
+			workdir:         "cluster/cd",
+			expectedComment: `<li>not running &#34;/usr/bin/make jobs&#34;: workdir &#34;cluster/cd&#34; is not a directory in the checkout</li>`,
+		},
+		{
+			name:            "workdir is a file",
+			workdir:         "config/a.yaml",
+			expectedComment: `<li>not running &#34;/usr/bin/make jobs&#34;: workdir &#34;config/a.yaml&#34; is not a directory in the checkout</li>`,
+		},
+		{
+			name:            "symlinked workdir escaping the checkout",
+			workdir:         "escape",
+			expectedComment: `<li>not running &#34;/usr/bin/make jobs&#34;: refused to handle &#34;escape&#34;: it resolves to outside of the checkout</li>`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "config/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{dir: checkout}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^config/`)}, Target: "jobs", Workdir: tc.workdir}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.workdirs, tc.expectedWorkdirs) {
+				t.Errorf("expected to run in %q, got %q", tc.expectedWorkdirs, executor.workdirs)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+		})
+	}
+}
+
+func TestExecExecutorWorkdir(t *testing.T) {
+	checkout, cleanup := makeCheckout(t)
+	defer cleanup()
+	root, err := filepath.EvalSymlinks(checkout)
+	if err != nil {
+		t.Fatalf("failed to resolve checkout: %v", err)
+	}
+
+	log, _ := newRecordingLogger()
+	stdout, _, err := (&execExecutor{}).Run(context.Background(), log, root, task{command: []string{"/bin/pwd"}, workdir: "config"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := filepath.Join(root, "config") + "\n"; string(stdout) != expected {
+		t.Errorf("expected to run in %q, got %q", expected, stdout)
+	}
+	if command := containerCommand("docker", "tools", root, task{command: []string{"make"}, workdir: "config"}); command[6] != "/workspace/config" {
+		t.Errorf("expected the container to run in /workspace/config, got %q", command)
+	}
+}
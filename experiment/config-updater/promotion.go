@@ -0,0 +1,343 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/plugins"
+)
+
+// defaultPromotionExpiry is used when the config does not set
+// PromotionExpiry.
+const defaultPromotionExpiry = 7 * 24 * time.Hour
+
+// promoteCommand matches a comment promoting the held updates of a PR to
+// an environment.
+var promoteCommand = regexp.MustCompile(`(?m)^/promote\s+(\S+)\s*$`)
+
+// promotionExpiry is how long held updates can be promoted for.
+func (c *UpdateConfig) promotionExpiry() time.Duration {
+	if c.PromotionExpiry == 0 {
+		return defaultPromotionExpiry
+	}
+	return c.PromotionExpiry
+}
+
+// Promotion is an environment that the updates of a merged PR are held for.
+// The PR is kept as it was when it merged, so that the updates are run for
+// the same commits when promoted.
+type Promotion struct {
+	Environment string             `json:"environment"`
+	PullRequest github.PullRequest `json:"pull_request"`
+	Expires     time.Time          `json:"expires"`
+}
+
+func (p Promotion) key() string {
+	return promotionKey(p.PullRequest.Base.Repo.Owner.Login, p.PullRequest.Base.Repo.Name, p.PullRequest.Number, p.Environment)
+}
+
+func promotionKey(org, repo string, number int, environment string) string {
+	return fmt.Sprintf("%s/%s#%d/%s", org, repo, number, environment)
+}
+
+// PromotionStore keeps the promotions that are pending.
+type PromotionStore struct {
+	// Path, when set, is the file the promotions are written to whenever
+	// they change, so that they survive restarts.
+	Path string
+
+	lock       sync.Mutex
+	promotions map[string]Promotion
+}
+
+// LoadPromotionStore reads the promotions kept at path, if there are any.
+func LoadPromotionStore(path string) (*PromotionStore, error) {
+	p := &PromotionStore{Path: path, promotions: map[string]Promotion{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var promotions []Promotion
+	if err := json.Unmarshal(b, &promotions); err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s: %v", path, err)
+	}
+	for _, promotion := range promotions {
+		p.promotions[promotion.key()] = promotion
+	}
+	return p, nil
+}
+
+// hold adds promotion, replacing any for the same PR and environment, and
+// forgets those that expired before now.
+func (p *PromotionStore) hold(promotion Promotion, now time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.promotions == nil {
+		p.promotions = map[string]Promotion{}
+	}
+	for key, pending := range p.promotions {
+		if now.After(pending.Expires) {
+			delete(p.promotions, key)
+		}
+	}
+	p.promotions[promotion.key()] = promotion
+	return p.save()
+}
+
+// take removes the promotion of the PR to environment, so that it is only
+// ever run once, reporting whether there was one. Expired promotions are
+// returned too, for the caller to refuse.
+func (p *PromotionStore) take(org, repo string, number int, environment string) (Promotion, bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key := promotionKey(org, repo, number, environment)
+	promotion, ok := p.promotions[key]
+	if !ok {
+		return Promotion{}, false, nil
+	}
+	delete(p.promotions, key)
+	return promotion, true, p.save()
+}
+
+// save writes the promotions to Path, replacing the file in one go so that
+// it is never left half written. It must be called with the lock held.
+func (p *PromotionStore) save() error {
+	if p.Path == "" {
+		return nil
+	}
+	var keys []string
+	for key := range p.promotions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	promotions := []Promotion{}
+	for _, key := range keys {
+		promotions = append(promotions, p.promotions[key])
+	}
+	b, err := json.Marshal(promotions)
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(p.Path, b); err != nil {
+		return fmt.Errorf("error saving promotions: %v", err)
+	}
+	return nil
+}
+
+// replaceFile writes b to path through a temporary file, so that readers
+// never see the file half written.
+func replaceFile(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// pendingPromotions returns the store of promotions, which is in memory
+// unless Promotions is set.
+func (s *Server) pendingPromotions() *PromotionStore {
+	s.initPromotions.Do(func() {
+		if s.Promotions == nil {
+			s.Promotions = &PromotionStore{promotions: map[string]Promotion{}}
+		}
+	})
+	return s.Promotions
+}
+
+// promotionRequest is a request by someone to run the updates held for an
+// environment.
+type promotionRequest struct {
+	environment string
+	by          string
+}
+
+// pendingPromotion describes the updates held for an environment.
+type pendingPromotion struct {
+	environment string
+	expires     time.Time
+	updates     []string
+}
+
+// pendingCount counts the updates held for promotion.
+func (r *results) pendingCount() int {
+	count := 0
+	for _, pending := range r.pending {
+		count += len(pending.updates)
+	}
+	return count
+}
+
+// holdForPromotion splits off the tasks for PromotedEnvironments, which are
+// held rather than run. When promoting, only the tasks for the environment
+// being promoted are run instead, and none are held.
+func holdForPromotion(c *UpdateConfig, tasks []task, promoting *promotionRequest) (run, held []task) {
+	promoted := sets.NewString(c.PromotedEnvironments...)
+	for _, t := range tasks {
+		switch {
+		case promoting != nil:
+			if t.environment == promoting.environment {
+				run = append(run, t)
+			}
+		case promoted.Has(t.environment):
+			held = append(held, t)
+		default:
+			run = append(run, t)
+		}
+	}
+	return run, held
+}
+
+// holdPromotions records a promotion of pr for every environment that tasks
+// are held for.
+func (s *Server) holdPromotions(pr github.PullRequest, c *UpdateConfig, held []task) ([]pendingPromotion, error) {
+	now := time.Now()
+	var pending []pendingPromotion
+	index := map[string]int{}
+	for _, t := range held {
+		i, ok := index[t.environment]
+		if !ok {
+			i = len(pending)
+			index[t.environment] = i
+			pending = append(pending, pendingPromotion{environment: t.environment, expires: now.Add(c.promotionExpiry())})
+		}
+		update := strings.Join(t.command, " ")
+		if t.cluster != "" {
+			update += " on cluster " + t.cluster
+		}
+		pending[i].updates = append(pending[i].updates, update)
+	}
+	for _, promotion := range pending {
+		if err := s.pendingPromotions().hold(Promotion{Environment: promotion.environment, PullRequest: pr, Expires: promotion.expires}, now); err != nil {
+			return pending, fmt.Errorf("error holding the updates for %s, so they cannot be promoted: %v", promotion.environment, err)
+		}
+	}
+	return pending, nil
+}
+
+func formatPending(pending pendingPromotion) string {
+	var b strings.Builder
+	environment := html.EscapeString(pending.environment)
+	b.WriteString(fmt.Sprintf("The following updates are pending promotion to <code>%s</code>. An org member can comment <code>/promote %s</code> to run them until %s:\n", environment, environment, pending.expires.UTC().Format(time.RFC1123)))
+	b.WriteString("<ul>")
+	for _, update := range pending.updates {
+		b.WriteString(fmt.Sprintf(`<li><code>%s</code></li>`, html.EscapeString(update)))
+	}
+	b.WriteString("</ul>\n")
+	return b.String()
+}
+
+// promotionError explains why updates could not be promoted.
+type promotionError struct {
+	reason string
+}
+
+func (e *promotionError) Error() string {
+	return e.reason
+}
+
+// promote runs the updates of the PR held for environment, on behalf of by.
+func (s *Server) promote(ctx context.Context, eventGUID, org, repo string, number int, environment, by string) error {
+	promotion, ok, err := s.pendingPromotions().take(org, repo, number, environment)
+	if err != nil {
+		s.log.WithError(err).Error("Error saving pending promotions.")
+	}
+	if !ok {
+		return &promotionError{reason: fmt.Sprintf("No updates of %s/%s#%d are pending promotion to %s.", org, repo, number, environment)}
+	}
+	if time.Now().After(promotion.Expires) {
+		return &promotionError{reason: fmt.Sprintf("The updates of %s/%s#%d pending promotion to %s expired at %s, so they were not run. Please apply them manually.", org, repo, number, environment, promotion.Expires.UTC().Format(time.RFC1123))}
+	}
+	s.log.WithFields(map[string]interface{}{"environment": environment, "by": by}).Info("Promoting updates.")
+	pre := github.PullRequestEvent{
+		Action:      github.PullRequestActionClosed,
+		Number:      number,
+		PullRequest: promotion.PullRequest,
+		Repo:        promotion.PullRequest.Base.Repo,
+	}
+	return s.update(ctx, eventGUID, pre, &promotionRequest{environment: environment, by: by}, false)
+}
+
+// handleComment promotes held updates when an org member comments /promote
+// with the environment on the PR.
+func (s *Server) handleComment(ctx context.Context, eventGUID string, payload []byte) error {
+	var ice github.IssueCommentEvent
+	if err := json.Unmarshal(payload, &ice); err != nil {
+		return err
+	}
+	if ice.Action != github.IssueCommentActionCreated || !ice.Issue.IsPullRequest() {
+		return nil
+	}
+	match := promoteCommand.FindStringSubmatch(ice.Comment.Body)
+	if match == nil {
+		return nil
+	}
+	org, repo, number, user := ice.Repo.Owner.Login, ice.Repo.Name, ice.Issue.Number, ice.Comment.User.Login
+	s.log = s.log.WithFields(map[string]interface{}{
+		"org":  org,
+		"repo": repo,
+		"pr":   number,
+		"url":  ice.Comment.HTMLURL,
+	})
+	reply := func(message string) error {
+		return s.github(ctx).CreateComment(org, repo, number, plugins.FormatICResponse(ice.Comment, message))
+	}
+
+	member, err := s.github(ctx).IsMember(org, user)
+	if err != nil {
+		return fmt.Errorf("error checking whether %s is a member of %s: %v", user, org, err)
+	}
+	if !member {
+		s.log.WithField("user", user).Info("Refusing promotion by a non-member.")
+		return reply(fmt.Sprintf("Only members of %s can promote updates.", org))
+	}
+	err = s.promote(ctx, eventGUID, org, repo, number, match[1], "@"+user)
+	if promotionErr, ok := err.(*promotionError); ok {
+		return reply(promotionErr.reason)
+	}
+	return err
+}
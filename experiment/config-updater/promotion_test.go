@@ -0,0 +1,274 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func promotionConfig() *UpdateConfig {
+	return &UpdateConfig{
+		Matchers: []Matcher{
+			{Glob: "jobs/*.yaml", Target: "staging", Environment: "staging"},
+			{Glob: "jobs/*.yaml", Target: "production", Environment: "production"},
+		},
+		PromotedEnvironments: []string{"production"},
+		MaxPRFiles:           defaultMaxPRFiles,
+	}
+}
+
+func promoteCommentEvent(t *testing.T, user, body string) []byte {
+	payload, err := json.Marshal(github.IssueCommentEvent{
+		Action:  github.IssueCommentActionCreated,
+		Issue:   github.Issue{Number: 1, PullRequest: &struct{}{}},
+		Comment: github.IssueComment{Body: body, User: github.User{Login: user}},
+		Repo:    github.Repo{Owner: github.User{Login: "org"}, Name: "repo"},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	return payload
+}
+
+func TestHandleEventHoldsPromotedEnvironments(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, promotionConfig())
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := [][]string{{"/usr/bin/make", "staging"}}; !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected to run %q, got %q", expected, executor.ran)
+	}
+	checkComment(t, ghc, "The following updates are pending promotion to <code>production</code>. An org member can comment <code>/promote production</code> to run them until ")
+	if !strings.Contains(ghc.IssueCommentsAdded[0], "<ul><li><code>/usr/bin/make production</code></li></ul>") {
+		t.Errorf("expected the held update to be listed, got %q", ghc.IssueCommentsAdded[0])
+	}
+	promotion, ok := s.pendingPromotions().promotions[promotionKey("org", "repo", 1, "production")]
+	if !ok {
+		t.Fatalf("expected a pending promotion, got %v", s.pendingPromotions().promotions)
+	}
+	if promotion.PullRequest.Head.SHA != "123456" || *promotion.PullRequest.MergeSHA != "abcdef" {
+		t.Errorf("expected the merged commits to be recorded, got %+v", promotion.PullRequest)
+	}
+}
+
+func TestHandleCommentPromote(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		user            string
+		body            string
+		expires         time.Duration
+		expectedRan     [][]string
+		expectedComment string
+		expectedPending bool
+	}{
+		{
+			name:            "promoted by a member",
+			user:            "member",
+			body:            "Looks good on staging.\n/promote production",
+			expires:         time.Hour,
+			expectedRan:     [][]string{{"/usr/bin/make", "production"}},
+			expectedComment: "Promoted to <code>production</code> by @member.\n\nThe following updates succeeded:\n<ul><li><details><summary><code>/usr/bin/make production</code>",
+		},
+		{
+			name:            "expired",
+			user:            "member",
+			body:            "/promote production",
+			expires:         -time.Hour,
+			expectedComment: "The updates of org/repo#1 pending promotion to production expired at ",
+		},
+		{
+			name:            "unauthorized",
+			user:            "stranger",
+			body:            "/promote production",
+			expires:         time.Hour,
+			expectedComment: "Only members of org can promote updates.",
+			expectedPending: true,
+		},
+		{
+			name:            "nothing pending",
+			user:            "member",
+			body:            "/promote staging",
+			expires:         time.Hour,
+			expectedComment: "No updates of org/repo#1 are pending promotion to staging.",
+			expectedPending: true,
+		},
+		{
+			name:            "not a command",
+			user:            "member",
+			body:            "Should we /promote production yet?",
+			expires:         time.Hour,
+			expectedPending: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+				OrgMembers:         map[string][]string{"org": {"member"}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, promotionConfig())
+			var pre github.PullRequestEvent
+			if err := json.Unmarshal(mergedPREvent(t), &pre); err != nil {
+				t.Fatalf("failed to unmarshal event: %v", err)
+			}
+			if err := s.pendingPromotions().hold(Promotion{Environment: "production", PullRequest: pre.PullRequest, Expires: time.Now().Add(tc.expires)}, time.Now().Add(-2*time.Hour)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "issue_comment", "guid", promoteCommentEvent(t, tc.user, tc.body)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedRan) {
+				t.Errorf("expected to run %q, got %q", tc.expectedRan, executor.ran)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+			if _, pending := s.pendingPromotions().promotions[promotionKey("org", "repo", 1, "production")]; pending != tc.expectedPending {
+				t.Errorf("expected the promotion to be pending: %v", tc.expectedPending)
+			}
+		})
+	}
+}
+
+func TestPromotionStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promotions")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "promotions.json")
+
+	store, err := LoadPromotionStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error loading a missing file: %v", err)
+	}
+	now := time.Now()
+	pr := github.PullRequest{Number: 1, Base: github.PullRequestBranch{Repo: github.Repo{Owner: github.User{Login: "org"}, Name: "repo"}}}
+	if err := store.hold(Promotion{Environment: "old", PullRequest: pr, Expires: now.Add(-time.Minute)}, now.Add(-time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, environment := range []string{"production", "canary"} {
+		if err := store.hold(Promotion{Environment: environment, PullRequest: pr, Expires: now.Add(time.Hour)}, now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, ok, err := store.take("org", "repo", 1, "canary"); !ok || err != nil {
+		t.Fatalf("expected to take the canary promotion, got %v, %v", ok, err)
+	}
+
+	// A restarted server only knows of what is left.
+	restarted, err := LoadPromotionStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var environments []string
+	for _, promotion := range restarted.promotions {
+		environments = append(environments, promotion.Environment)
+	}
+	if expected := []string{"production"}; !reflect.DeepEqual(environments, expected) {
+		t.Errorf("expected promotions for %q, got %q", expected, environments)
+	}
+}
+
+func TestPromoteHandler(t *testing.T) {
+	var testcases = []struct {
+		name         string
+		method       string
+		form         url.Values
+		expectedCode int
+		expectedRan  [][]string
+	}{
+		{
+			name:         "promoted",
+			method:       http.MethodPost,
+			form:         url.Values{"org": {"org"}, "repo": {"repo"}, "pr": {"1"}, "environment": {"production"}},
+			expectedCode: http.StatusOK,
+			expectedRan:  [][]string{{"/usr/bin/make", "production"}},
+		},
+		{
+			name:         "nothing pending",
+			method:       http.MethodPost,
+			form:         url.Values{"org": {"org"}, "repo": {"repo"}, "pr": {"2"}, "environment": {"production"}},
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "missing pr",
+			method:       http.MethodPost,
+			form:         url.Values{"org": {"org"}, "repo": {"repo"}, "environment": {"production"}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "wrong method",
+			method:       http.MethodGet,
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, promotionConfig())
+			var pre github.PullRequestEvent
+			if err := json.Unmarshal(mergedPREvent(t), &pre); err != nil {
+				t.Fatalf("failed to unmarshal event: %v", err)
+			}
+			if err := s.pendingPromotions().hold(Promotion{Environment: "production", PullRequest: pre.PullRequest, Expires: time.Now().Add(time.Hour)}, time.Now()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			req := httptest.NewRequest(tc.method, "/promote", strings.NewReader(tc.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			promoteHandler(s).ServeHTTP(w, req)
+			if w.Code != tc.expectedCode {
+				t.Errorf("expected code %d, got %d: %s", tc.expectedCode, w.Code, w.Body.String())
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedRan) {
+				t.Errorf("expected to run %q, got %q", tc.expectedRan, executor.ran)
+			}
+		})
+	}
+}
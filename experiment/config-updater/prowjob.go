@@ -0,0 +1,159 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowclientset "k8s.io/test-infra/prow/client/clientset/versioned"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/pjutil"
+)
+
+const (
+	// defaultProwJobScheduleTimeout bounds how long a ProwJob may wait to
+	// be scheduled before we give up on it.
+	defaultProwJobScheduleTimeout = 10 * time.Minute
+	// defaultProwJobPollInterval is how often we check whether a ProwJob is
+	// done.
+	defaultProwJobPollInterval = 10 * time.Second
+
+	// prowJobCommand is shown in place of the command of tasks run as
+	// ProwJobs.
+	prowJobCommand = "prowjob"
+)
+
+// ProwJobRunner runs the tasks of matchers with a ProwJob as the postsubmit
+// of that name in the Prow config, so that they get the decoration and
+// visibility of any other job, rather than running make in our own pod.
+type ProwJobRunner struct {
+	Client prowclientset.Interface
+	// Config is the Prow config, holding the postsubmits and the namespace
+	// to create ProwJobs in.
+	Config config.Getter
+	// ScheduleTimeout bounds how long a ProwJob may stay triggered, for
+	// instance when no cluster can run it, before it is aborted.
+	ScheduleTimeout time.Duration
+	PollInterval    time.Duration
+}
+
+// NewProwJobRunner creates a ProwJobRunner for the jobs in the Prow config.
+func NewProwJobRunner(client prowclientset.Interface, config config.Getter) *ProwJobRunner {
+	return &ProwJobRunner{
+		Client:          client,
+		Config:          config,
+		ScheduleTimeout: defaultProwJobScheduleTimeout,
+		PollInterval:    defaultProwJobPollInterval,
+	}
+}
+
+// Run creates a ProwJob for the postsubmit named job, at the merge commit
+// of pr, and waits for it to complete. It returns the URL of the job once
+// it is known, whether or not the job succeeded.
+func (p *ProwJobRunner) Run(ctx context.Context, log *logrus.Entry, eventGUID string, pr github.PullRequest, job string) (string, error) {
+	cfg := p.Config()
+	repo := pr.Base.Repo.Owner.Login + "/" + pr.Base.Repo.Name
+	var postsubmit *config.Postsubmit
+	for i, candidate := range cfg.Postsubmits[repo] {
+		if candidate.Name == job {
+			postsubmit = &cfg.Postsubmits[repo][i]
+			break
+		}
+	}
+	if postsubmit == nil {
+		return "", fmt.Errorf("there is no postsubmit named %s for %s in the Prow config", job, repo)
+	}
+
+	refs := prowapi.Refs{
+		Org:      pr.Base.Repo.Owner.Login,
+		Repo:     pr.Base.Repo.Name,
+		RepoLink: pr.Base.Repo.HTMLURL,
+		BaseRef:  pr.Base.Ref,
+		BaseSHA:  *pr.MergeSHA,
+		BaseLink: fmt.Sprintf("%s/commit/%s", pr.Base.Repo.HTMLURL, *pr.MergeSHA),
+	}
+	labels := map[string]string{}
+	for k, v := range postsubmit.Labels {
+		labels[k] = v
+	}
+	labels[github.EventGUID] = eventGUID
+	pj := pjutil.NewProwJob(pjutil.PostsubmitSpec(*postsubmit, refs), labels)
+	pj.Namespace = cfg.ProwJobNamespace
+	client := p.Client.ProwV1().ProwJobs(cfg.ProwJobNamespace)
+	created, err := client.Create(&pj)
+	if err != nil {
+		return "", fmt.Errorf("error creating ProwJob: %v", err)
+	}
+	log = log.WithField("prowjob", created.Name)
+	log.Info("Created ProwJob.")
+
+	scheduleDeadline := time.Now().Add(p.ScheduleTimeout)
+	for {
+		current, err := client.Get(created.Name, metav1.GetOptions{})
+		if err != nil {
+			log.WithError(err).Warn("Error getting ProwJob.")
+		} else if current.Complete() {
+			return current.Status.URL, prowJobError(current)
+		} else if current.Status.State == prowapi.TriggeredState && time.Now().After(scheduleDeadline) {
+			// Abort it, so that it does not run long after we reported
+			// that it did not.
+			current.SetComplete()
+			current.Status.State = prowapi.AbortedState
+			current.Status.Description = "Not scheduled in time."
+			if _, err := client.Update(current); err != nil {
+				log.WithError(err).Warn("Error aborting ProwJob.")
+			}
+			return current.Status.URL, fmt.Errorf("ProwJob %s was not scheduled within %v", created.Name, p.ScheduleTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("stopped waiting for ProwJob %s: %v", created.Name, ctx.Err())
+		case <-time.After(p.PollInterval):
+		}
+	}
+}
+
+// prowJobError describes why a completed ProwJob did not succeed.
+func prowJobError(pj *prowapi.ProwJob) error {
+	if pj.Status.State == prowapi.SuccessState {
+		return nil
+	}
+	if pj.Status.Description != "" {
+		return fmt.Errorf("ProwJob %s ended in state %s: %s", pj.Name, pj.Status.State, pj.Status.Description)
+	}
+	return fmt.Errorf("ProwJob %s ended in state %s", pj.Name, pj.Status.State)
+}
+
+// runProwJob runs t as a ProwJob, with the result linking to the job.
+func (s *Server) runProwJob(ctx context.Context, eventGUID string, pr github.PullRequest, t task) result {
+	if s.ProwJobs == nil {
+		return result{command: t.command, exitCode: -1, err: fmt.Errorf("not run, as ProwJobs are not configured")}
+	}
+	log := s.log.WithFields(logrus.Fields{"eventGUID": eventGUID, "job": t.prowJob})
+	url, err := s.ProwJobs.Run(ctx, log, eventGUID, pr, t.prowJob)
+	if err != nil {
+		log.WithError(err).Error("ProwJob failed.")
+	}
+	return result{command: t.command, url: url, exitCode: exitCode(err), err: err}
+}
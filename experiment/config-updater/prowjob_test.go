@@ -0,0 +1,188 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+
+	prowapi "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/client/clientset/versioned/fake"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// fakeProwJobs creates a ProwJobRunner whose jobs are in state once
+// created, recording the jobs created and updated.
+func fakeProwJobs(state prowapi.ProwJobState, description string) (*ProwJobRunner, *[]*prowapi.ProwJob, *[]*prowapi.ProwJob) {
+	client := fake.NewSimpleClientset()
+	var created, updated []*prowapi.ProwJob
+	client.PrependReactor("create", "prowjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		created = append(created, action.(clienttesting.CreateAction).GetObject().(*prowapi.ProwJob))
+		return false, nil, nil
+	})
+	client.PrependReactor("update", "prowjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updated = append(updated, action.(clienttesting.UpdateAction).GetObject().(*prowapi.ProwJob))
+		return false, nil, nil
+	})
+	client.PrependReactor("get", "prowjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		pj := created[len(created)-1].DeepCopy()
+		pj.Status.State = state
+		pj.Status.Description = description
+		if state != prowapi.TriggeredState {
+			pj.Status.URL = "https://prow.example.com/view/" + pj.Name
+		}
+		if state != prowapi.TriggeredState && state != prowapi.PendingState {
+			pj.SetComplete()
+		}
+		return true, pj, nil
+	})
+	cfg := &config.Config{ProwConfig: config.ProwConfig{ProwJobNamespace: "prowjobs"}}
+	cfg.Postsubmits = map[string][]config.Postsubmit{"org/repo": {{JobBase: config.JobBase{Name: "apply-jobs", Labels: map[string]string{"team": "infra"}}}}}
+	runner := NewProwJobRunner(client, func() *config.Config { return cfg })
+	runner.ScheduleTimeout = 10 * time.Millisecond
+	runner.PollInterval = time.Millisecond
+	return runner, &created, &updated
+}
+
+func TestProwJobRunner(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		job             string
+		state           prowapi.ProwJobState
+		description     string
+		expectedCreated bool
+		expectedAborted bool
+		expectedURL     bool
+		expectedErr     string
+	}{
+		{
+			name:            "succeeded",
+			job:             "apply-jobs",
+			state:           prowapi.SuccessState,
+			expectedCreated: true,
+			expectedURL:     true,
+		},
+		{
+			name:            "failed",
+			job:             "apply-jobs",
+			state:           prowapi.FailureState,
+			description:     "Job failed.",
+			expectedCreated: true,
+			expectedURL:     true,
+			expectedErr:     "ended in state failure: Job failed.",
+		},
+		{
+			name:            "never scheduled",
+			job:             "apply-jobs",
+			state:           prowapi.TriggeredState,
+			expectedCreated: true,
+			expectedAborted: true,
+			expectedErr:     "was not scheduled within 10ms",
+		},
+		{
+			name:        "unknown job",
+			job:         "apply-all",
+			expectedErr: "there is no postsubmit named apply-all for org/repo in the Prow config",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			runner, created, updated := fakeProwJobs(tc.state, tc.description)
+			mergeSHA := "abcdef"
+			pr := github.PullRequest{
+				Number:   1,
+				MergeSHA: &mergeSHA,
+				Base:     github.PullRequestBranch{Ref: "master", Repo: github.Repo{Owner: github.User{Login: "org"}, Name: "repo"}},
+			}
+
+			url, err := runner.Run(context.Background(), logrus.WithField("test", tc.name), "guid", pr, tc.job)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if (len(*created) == 1) != tc.expectedCreated {
+				t.Fatalf("expected a ProwJob to be created: %v, got %d", tc.expectedCreated, len(*created))
+			}
+			if tc.expectedCreated {
+				pj := (*created)[0]
+				if pj.Namespace != "prowjobs" || pj.Spec.Job != "apply-jobs" || pj.Spec.Type != prowapi.PostsubmitJob {
+					t.Errorf("expected a postsubmit for apply-jobs in prowjobs, got %+v", pj)
+				}
+				expectedRefs := &prowapi.Refs{Org: "org", Repo: "repo", BaseRef: "master", BaseSHA: "abcdef", BaseLink: "/commit/abcdef"}
+				if !reflect.DeepEqual(pj.Spec.Refs, expectedRefs) {
+					t.Errorf("expected refs %+v, got %+v", expectedRefs, pj.Spec.Refs)
+				}
+				if pj.Labels["team"] != "infra" || pj.Labels[github.EventGUID] != "guid" {
+					t.Errorf("expected the labels of the job and the event, got %v", pj.Labels)
+				}
+			}
+			if aborted := len(*updated) == 1 && (*updated)[0].Status.State == prowapi.AbortedState; aborted != tc.expectedAborted {
+				t.Errorf("expected the ProwJob to be aborted: %v, got %v", tc.expectedAborted, aborted)
+			}
+			if (url != "") != tc.expectedURL {
+				t.Errorf("expected a URL: %v, got %q", tc.expectedURL, url)
+			}
+		})
+	}
+}
+
+func TestHandleEventProwJob(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "jobs/a.yaml"},
+			{Filename: "docs/README.md"},
+		}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers: []Matcher{
+			{Glob: "jobs/*.yaml", ProwJob: "apply-jobs"},
+			{Glob: "docs/*.md", Target: "docs"},
+		},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+	runner, created, _ := fakeProwJobs(prowapi.FailureState, "Job failed.")
+	s.ProwJobs = runner
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*created) != 1 {
+		t.Fatalf("expected one ProwJob, got %d", len(*created))
+	}
+	if expected := [][]string{{"/usr/bin/make", "docs"}}; !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected only %q to run locally, got %q", expected, executor.ran)
+	}
+	name := (*created)[0].Name
+	checkComment(t, ghc, `<code>prowjob apply-jobs</code> failed: ProwJob `+name+` ended in state failure: Job failed.`)
+	if comment := ghc.IssueCommentsAdded[0]; !strings.Contains(comment, `Ran as <a href="https://prow.example.com/view/`+name+`">a ProwJob</a>`) {
+		t.Errorf("expected the comment to link to the ProwJob, got %q", comment)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// reloadEndpointDisk reloads the configuration from disk, like the
+	// Reload Configuration from Disk button.
+	reloadEndpointDisk = "reload"
+	// reloadEndpointCasC reloads the configuration-as-code plugin.
+	reloadEndpointCasC = "configuration-as-code"
+
+	// defaultReloadTimeout is used when a reload does not set a timeout.
+	defaultReloadTimeout = 5 * time.Minute
+	// reloadPollInterval is how often we check whether Jenkins is back.
+	reloadPollInterval = 2 * time.Second
+)
+
+// JenkinsReload reloads the configuration of a Jenkins controller once the
+// tasks of a matcher succeed, so that it stops serving the stale one.
+type JenkinsReload struct {
+	// URL is the base URL of the Jenkins controller.
+	URL string `json:"url"`
+	// Endpoint is what to reload: reload, the default, reloads the
+	// configuration from disk, and configuration-as-code reloads that
+	// plugin.
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	// CredentialsFile is the path to a file holding user:api-token to
+	// authenticate as. The credentials themselves must never be in the
+	// config, which is served on /config.
+	CredentialsFile string `json:"credentials_file,omitempty" yaml:"credentials_file,omitempty"`
+	// Timeout bounds how long Jenkins may take to come back healthy.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// validate checks that the reload names a controller and what to reload.
+func (j *JenkinsReload) validate() error {
+	u, err := url.Parse(j.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q is not an http or https URL", j.URL)
+	}
+	switch j.Endpoint {
+	case "", reloadEndpointDisk, reloadEndpointCasC:
+	default:
+		return fmt.Errorf("endpoint %q must be %s or %s", j.Endpoint, reloadEndpointDisk, reloadEndpointCasC)
+	}
+	if j.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %v", j.Timeout)
+	}
+	return nil
+}
+
+// path is the path of the endpoint that reloads the configuration.
+func (j *JenkinsReload) path() string {
+	if j.Endpoint == reloadEndpointCasC {
+		return "/configuration-as-code/reload"
+	}
+	return "/reload"
+}
+
+// jenkinsReloader reloads the configuration of Jenkins controllers.
+type jenkinsReloader interface {
+	Reload(ctx context.Context, reload JenkinsReload) error
+}
+
+// httpJenkinsReloader reloads Jenkins controllers through their HTTP API.
+type httpJenkinsReloader struct {
+	pollInterval time.Duration
+}
+
+// Reload asks the controller to reload, with a CSRF crumb if it issues
+// them, and waits for it to serve requests again. Jenkins answers 503
+// while it reloads.
+func (j *httpJenkinsReloader) Reload(ctx context.Context, reload JenkinsReload) error {
+	var user, token string
+	if reload.CredentialsFile != "" {
+		b, err := ioutil.ReadFile(reload.CredentialsFile)
+		if err != nil {
+			return fmt.Errorf("error reading credentials: %v", err)
+		}
+		parts := strings.SplitN(strings.TrimSpace(string(b)), ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("credentials in %s are not user:api-token", reload.CredentialsFile)
+		}
+		user, token = parts[0], parts[1]
+	}
+	timeout := reload.Timeout
+	if timeout == 0 {
+		timeout = defaultReloadTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Crumbs are tied to the session, so the cookies are kept across
+	// requests. Reloading redirects to the dashboard, which is not
+	// followed as it is unavailable until the reload is done.
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	base := strings.TrimSuffix(reload.URL, "/")
+	do := func(method, path string, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequest(method, base+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if user != "" {
+			req.SetBasicAuth(user, token)
+		}
+		return client.Do(req)
+	}
+
+	header := http.Header{}
+	resp, err := do(http.MethodGet, "/crumbIssuer/api/json", nil)
+	if err != nil {
+		return fmt.Errorf("error getting a crumb: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var crumb struct {
+			Crumb             string `json:"crumb"`
+			CrumbRequestField string `json:"crumbRequestField"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&crumb)
+		resp.Body.Close()
+		if err != nil || crumb.CrumbRequestField == "" {
+			return fmt.Errorf("invalid crumb: %v", err)
+		}
+		header.Set(crumb.CrumbRequestField, crumb.Crumb)
+	case http.StatusNotFound:
+		// CSRF protection is disabled.
+		resp.Body.Close()
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("error getting a crumb: %s", resp.Status)
+	}
+
+	resp, err = do(http.MethodPost, reload.path(), header)
+	if err != nil {
+		return fmt.Errorf("error requesting the reload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusServiceUnavailable {
+		return fmt.Errorf("error requesting the reload: %s", resp.Status)
+	}
+
+	for {
+		resp, err := do(http.MethodGet, "/api/json", nil)
+		if err == nil {
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusOK:
+				return nil
+			case resp.StatusCode != http.StatusServiceUnavailable:
+				return fmt.Errorf("Jenkins is unhealthy after the reload: %s", resp.Status)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("Jenkins did not come back within %v: %v", timeout, err)
+			}
+			return fmt.Errorf("Jenkins did not come back within %v", timeout)
+		case <-time.After(j.pollInterval):
+		}
+	}
+}
+
+// reloader returns the client to reload Jenkins controllers with.
+func (s *Server) reloader() jenkinsReloader {
+	if s.jenkins == nil {
+		return &httpJenkinsReloader{pollInterval: reloadPollInterval}
+	}
+	return s.jenkins
+}
+
+// reloadResult is how reloading a Jenkins controller went.
+type reloadResult struct {
+	url      string
+	duration time.Duration
+	err      error
+}
+
+// reloadJenkins reloads the controller of reload and records how it went.
+func (s *Server) reloadJenkins(ctx context.Context, reload JenkinsReload) reloadResult {
+	started := time.Now()
+	err := s.reloader().Reload(ctx, reload)
+	log := s.log.WithField("jenkins", reload.URL).WithField("duration", time.Since(started))
+	if err != nil {
+		log.WithError(err).Error("Error reloading Jenkins.")
+	} else {
+		log.Info("Reloaded Jenkins.")
+	}
+	return reloadResult{url: reload.URL, duration: time.Since(started), err: err}
+}
+
+// failedReloads counts the reloads that failed.
+func (r *results) failedReloads() int {
+	failed := 0
+	for _, reload := range r.reloads {
+		if reload.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+func formatReloads(reloads []reloadResult) string {
+	var b strings.Builder
+	b.WriteString("The following Jenkins controllers were reloaded:\n")
+	b.WriteString("<ul>")
+	for _, reload := range reloads {
+		if reload.err != nil {
+			b.WriteString(fmt.Sprintf("<li><code>%s</code> failed to reload: %s</li>", html.EscapeString(reload.url), html.EscapeString(reload.err.Error())))
+			continue
+		}
+		b.WriteString(fmt.Sprintf("<li><code>%s</code> reloaded in %s</li>", html.EscapeString(reload.url), reload.duration.Round(time.Second)))
+	}
+	b.WriteString("</ul>\n")
+	return b.String()
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestHTTPJenkinsReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jenkins")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	credentials := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(credentials, []byte("updater:s3cret\n"), 0600); err != nil {
+		t.Fatalf("failed to write credentials: %v", err)
+	}
+
+	var testcases = []struct {
+		name          string
+		endpoint      string
+		csrfDisabled  bool
+		reloadStatus  int
+		unavailable   int
+		healthyStatus int
+		expectedPath  string
+		expectedErr   string
+	}{
+		{
+			name:          "reloaded with a crumb",
+			reloadStatus:  http.StatusFound,
+			unavailable:   2,
+			healthyStatus: http.StatusOK,
+			expectedPath:  "/reload",
+		},
+		{
+			name:          "configuration as code",
+			endpoint:      reloadEndpointCasC,
+			reloadStatus:  http.StatusOK,
+			healthyStatus: http.StatusOK,
+			expectedPath:  "/configuration-as-code/reload",
+		},
+		{
+			name:          "csrf protection disabled",
+			csrfDisabled:  true,
+			reloadStatus:  http.StatusFound,
+			healthyStatus: http.StatusOK,
+			expectedPath:  "/reload",
+		},
+		{
+			name:         "reload refused",
+			reloadStatus: http.StatusForbidden,
+			expectedPath: "/reload",
+			expectedErr:  "error requesting the reload: 403 Forbidden",
+		},
+		{
+			name:          "never comes back",
+			reloadStatus:  http.StatusFound,
+			unavailable:   1000,
+			healthyStatus: http.StatusOK,
+			expectedPath:  "/reload",
+			expectedErr:   "Jenkins did not come back within 50ms",
+		},
+		{
+			name:          "unhealthy after reload",
+			reloadStatus:  http.StatusFound,
+			healthyStatus: http.StatusInternalServerError,
+			expectedPath:  "/reload",
+			expectedErr:   "Jenkins is unhealthy after the reload: 500 Internal Server Error",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var reloaded []string
+			polls := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if user, token, ok := r.BasicAuth(); !ok || user != "updater" || token != "s3cret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				switch {
+				case r.URL.Path == "/crumbIssuer/api/json":
+					if tc.csrfDisabled {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "session", Path: "/"})
+					w.Write([]byte(`{"crumb":"abc","crumbRequestField":"Jenkins-Crumb"}`))
+				case r.Method == http.MethodPost:
+					if cookie, err := r.Cookie("JSESSIONID"); !tc.csrfDisabled && (err != nil || cookie.Value != "session" || r.Header.Get("Jenkins-Crumb") != "abc") {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+					reloaded = append(reloaded, r.URL.Path)
+					if tc.reloadStatus == http.StatusFound {
+						w.Header().Set("Location", "/")
+					}
+					w.WriteHeader(tc.reloadStatus)
+				case r.URL.Path == "/api/json":
+					polls++
+					if polls <= tc.unavailable {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					w.WriteHeader(tc.healthyStatus)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer ts.Close()
+
+			reloader := &httpJenkinsReloader{pollInterval: time.Millisecond}
+			err := reloader.Reload(context.Background(), JenkinsReload{URL: ts.URL + "/", Endpoint: tc.endpoint, CredentialsFile: credentials, Timeout: 50 * time.Millisecond})
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+			if expected := []string{tc.expectedPath}; tc.reloadStatus != http.StatusForbidden && !reflect.DeepEqual(reloaded, expected) {
+				t.Errorf("expected to reload %q, got %q", expected, reloaded)
+			}
+		})
+	}
+}
+
+// fakeReloader records the controllers reloaded, failing for failURL.
+type fakeReloader struct {
+	failURL  string
+	reloaded []string
+}
+
+func (f *fakeReloader) Reload(ctx context.Context, reload JenkinsReload) error {
+	f.reloaded = append(f.reloaded, reload.URL)
+	if reload.URL == f.failURL {
+		return errors.New("Jenkins did not come back within 5m0s")
+	}
+	return nil
+}
+
+func TestHandleEventJenkinsReload(t *testing.T) {
+	var testcases = []struct {
+		name             string
+		failures         map[string]bool
+		failURL          string
+		expectedReloaded []string
+		expectedComment  string
+	}{
+		{
+			name:             "reloaded after every task succeeded",
+			expectedReloaded: []string{"https://jenkins.example.com"},
+			expectedComment:  "The following Jenkins controllers were reloaded:\n<ul><li><code>https://jenkins.example.com</code> reloaded in 0s</li></ul>",
+		},
+		{
+			name:            "not reloaded when a task failed",
+			failures:        map[string]bool{"/usr/bin/make apply-prod": true},
+			expectedComment: "The following updates failed:",
+		},
+		{
+			name:             "failed reload",
+			failURL:          "https://jenkins.example.com",
+			expectedReloaded: []string{"https://jenkins.example.com"},
+			expectedComment:  "<li><code>https://jenkins.example.com</code> failed to reload: Jenkins did not come back within 5m0s</li>",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "jenkins/ci/jobs.yaml"},
+					{Filename: "jenkins/prod/jobs.yaml"},
+					{Filename: "docs/README.md"},
+				}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers: []Matcher{
+					{Glob: "jenkins/ci/*.yaml", Target: "apply-ci", JenkinsReload: &JenkinsReload{URL: "https://jenkins.example.com"}},
+					{Glob: "jenkins/prod/*.yaml", Target: "apply-prod", JenkinsReload: &JenkinsReload{URL: "https://jenkins.example.com"}},
+					{Glob: "docs/*.md", Target: "docs"},
+				},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.executor = &recordingExecutor{failures: tc.failures}
+			reloader := &fakeReloader{failURL: tc.failURL}
+			s.jenkins = reloader
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(reloader.reloaded, tc.expectedReloaded) {
+				t.Errorf("expected to reload %q, got %q", tc.expectedReloaded, reloader.reloaded)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+			if len(tc.expectedReloaded) == 0 && strings.Contains(ghc.IssueCommentsAdded[0], "Jenkins controllers") {
+				t.Errorf("expected no reload to be reported, got %q", ghc.IssueCommentsAdded[0])
+			}
+		})
+	}
+}
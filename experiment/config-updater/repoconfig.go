@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// inRepoConfigFile is the config a repo may keep at its root to add to
+// the config of the server.
+const inRepoConfigFile = ".jenkins-config-updater.yaml"
+
+// loadInRepoConfig reads the in-repo config from commitlike, which is the
+// merge commit, so that it is the config of the branch the PR was merged
+// into rather than the one the PR branch last had. It returns nil if the
+// commit does not have one.
+func loadInRepoConfig(ctx context.Context, r gitRepo, commitlike string) (*UpdateConfig, error) {
+	b, err := r.ReadFile(ctx, commitlike, inRepoConfigFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", inRepoConfigFile, err)
+	}
+	c := &UpdateConfig{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s: %v", inRepoConfigFile, err)
+	}
+	return c, nil
+}
+
+// withInRepo adds the in-repo config to c. The in-repo config may only
+// add Targets, Matchers and Excludes, and its matchers may only run what
+// c allows, so it cannot do more than the server config permits. As the
+// tasks run with the credentials of the server, its matchers may not set
+// their environment, input or any command besides their target either.
+func (c *UpdateConfig) withInRepo(inRepo *UpdateConfig) (*UpdateConfig, error) {
+	allowed := UpdateConfig{Targets: inRepo.Targets, Matchers: inRepo.Matchers, Excludes: inRepo.Excludes}
+	if !reflect.DeepEqual(*inRepo, allowed) {
+		return nil, fmt.Errorf("%s may only set targets, matchers and excludes", inRepoConfigFile)
+	}
+	for i, matcher := range inRepo.Matchers {
+		switch {
+		case matcher.Image != "":
+			return nil, fmt.Errorf("matcher %d for target %q in %s must not set an image", i, matcher.Target, inRepoConfigFile)
+		case matcher.Limits != nil:
+			return nil, fmt.Errorf("matcher %d for target %q in %s must not set limits", i, matcher.Target, inRepoConfigFile)
+		case matcher.TargetRepo != "":
+			return nil, fmt.Errorf("matcher %d for target %q in %s must not set a target repo", i, matcher.Target, inRepoConfigFile)
+		case matcher.JenkinsReload != nil:
+			return nil, fmt.Errorf("matcher %d for target %q in %s must not reload Jenkins", i, matcher.Target, inRepoConfigFile)
+		case matcher.ArgoCDSync != nil:
+			return nil, fmt.Errorf("matcher %d in %s must not sync ArgoCD applications", i, inRepoConfigFile)
+		case matcher.HelmBinary != "":
+			return nil, fmt.Errorf("matcher %d in %s must not set a helm binary", i, inRepoConfigFile)
+		case len(matcher.Env) > 0:
+			return nil, fmt.Errorf("matcher %d for target %q in %s must not set environment variables", i, matcher.Target, inRepoConfigFile)
+		case matcher.Rollback != nil:
+			return nil, fmt.Errorf("matcher %d for target %q in %s must not set a rollback", i, matcher.Target, inRepoConfigFile)
+		case matcher.Verify != nil:
+			return nil, fmt.Errorf("matcher %d for target %q in %s must not set a verification", i, matcher.Target, inRepoConfigFile)
+		case matcher.ProwJob != "":
+			return nil, fmt.Errorf("matcher %d for target %q in %s must not run a ProwJob", i, matcher.Target, inRepoConfigFile)
+		case matcher.Stdin != "":
+			return nil, fmt.Errorf("matcher %d for target %q in %s must not set stdin", i, matcher.Target, inRepoConfigFile)
+		}
+	}
+	merged := inherit(*c, *inRepo)
+	if err := merged.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", inRepoConfigFile, err)
+	}
+	return &merged, nil
+}
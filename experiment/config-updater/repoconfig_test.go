@@ -0,0 +1,243 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+const (
+	validInRepoConfig = `targets:
+- config/team.yaml
+matchers:
+- glob: dashboards/*.json
+  target: dashboards
+  after: [jobs]
+excludes:
+- glob: jobs/*.md
+`
+	invalidInRepoConfig = `matchers:
+- glob: dashboards/*.json
+  taget: dashboards
+`
+	privilegedInRepoConfig = `matchers:
+- glob: dashboards/*.json
+  target: dashboards
+allowed_executables:
+- /bin/rm
+`
+	rollbackInRepoConfig = `matchers:
+- glob: dashboards/*.json
+  target: dashboards
+  rollback:
+    command: [/usr/bin/make, dashboards-rollback]
+`
+)
+
+func TestWithInRepo(t *testing.T) {
+	server := &UpdateConfig{
+		Targets:    []string{"config/shared.yaml"},
+		Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Name: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	}
+	var testcases = []struct {
+		name             string
+		config           string
+		expectedTargets  []string
+		expectedMatchers []string
+		expectedErr      bool
+	}{
+		{
+			name:             "no in-repo config",
+			expectedTargets:  []string{"config/shared.yaml"},
+			expectedMatchers: []string{"jobs"},
+		},
+		{
+			name:             "valid in-repo config",
+			config:           validInRepoConfig,
+			expectedTargets:  []string{"config/shared.yaml", "config/team.yaml"},
+			expectedMatchers: []string{"jobs", "dashboards"},
+		},
+		{
+			name:        "invalid in-repo config",
+			config:      invalidInRepoConfig,
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config allowing executables",
+			config:      privilegedInRepoConfig,
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config setting a rollback",
+			config:      rollbackInRepoConfig,
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config setting a verification",
+			config:      "matchers:\n- glob: dashboards/*.json\n  target: dashboards\n  verify:\n    target: dashboards-verify\n",
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config setting environment variables",
+			config:      "matchers:\n- glob: dashboards/*.json\n  target: dashboards\n  env:\n    LD_PRELOAD: /tmp/evil.so\n",
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config running a ProwJob",
+			config:      "matchers:\n- glob: dashboards/*.json\n  target: dashboards\n  prowjob: deploy-dashboards\n",
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config setting stdin",
+			config:      "matchers:\n- glob: dashboards/*.json\n  target: dashboards\n  stdin: confirm\n",
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config running an image",
+			config:      "matchers:\n- glob: dashboards/*.json\n  target: dashboards\n  image: busybox\n",
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config reloading Jenkins",
+			config:      "matchers:\n- glob: dashboards/*.json\n  target: dashboards\n  jenkins_reload:\n    url: https://jenkins.example.com\n",
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config running helm",
+			config:      "matchers:\n- glob: charts/**\n  helm_binary: /bin/sh\n",
+			expectedErr: true,
+		},
+		{
+			name:        "in-repo config syncing ArgoCD",
+			config:      "matchers:\n- glob: apps/web/*\n  argocd_sync:\n    server: https://argocd.example.com\n    application: web\n",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string]string{}
+			if tc.config != "" {
+				files["abcdef:"+inRepoConfigFile] = tc.config
+			}
+			r := &fakeRepo{fakeGit: &fakeGit{files: files}}
+
+			config := server
+			inRepo, err := loadInRepoConfig(context.Background(), r, "abcdef")
+			if err == nil && inRepo != nil {
+				config, err = server.withInRepo(inRepo)
+			}
+			if tc.expectedErr {
+				if err == nil {
+					t.Errorf("expected an error, got config %+v", config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(config.Targets, tc.expectedTargets) {
+				t.Errorf("expected targets %v, got %v", tc.expectedTargets, config.Targets)
+			}
+			var matchers []string
+			for _, matcher := range config.Matchers {
+				matchers = append(matchers, matcher.Target)
+			}
+			if !reflect.DeepEqual(matchers, tc.expectedMatchers) {
+				t.Errorf("expected matchers for %v, got %v", tc.expectedMatchers, matchers)
+			}
+		})
+	}
+}
+
+func TestHandleEventInRepoConfig(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		files           map[string]string
+		expected        [][]string
+		expectedComment string
+	}{
+		{
+			name:     "in-repo matchers run after the server ones",
+			files:    map[string]string{"abcdef:" + inRepoConfigFile: validInRepoConfig},
+			expected: [][]string{{"/usr/bin/make", "jobs"}, {"/usr/bin/make", "dashboards"}},
+		},
+		{
+			name:            "invalid in-repo config runs nothing",
+			files:           map[string]string{"abcdef:" + inRepoConfigFile: invalidInRepoConfig},
+			expectedComment: "the in-repo config is invalid",
+		},
+		{
+			name:            "privileged in-repo config runs nothing",
+			files:           map[string]string{"abcdef:" + inRepoConfigFile: privilegedInRepoConfig},
+			expectedComment: inRepoConfigFile + " may only set targets, matchers and excludes",
+		},
+		{
+			name: "in-repo config is read from the merge commit",
+			files: map[string]string{
+				"abcdef:" + inRepoConfigFile: validInRepoConfig,
+				"123456:" + inRepoConfigFile: privilegedInRepoConfig,
+			},
+			expected: [][]string{{"/usr/bin/make", "jobs"}, {"/usr/bin/make", "dashboards"}},
+		},
+		{
+			name: "in-repo config of the head commit alone is ignored",
+			files: map[string]string{
+				"123456:" + inRepoConfigFile: validInRepoConfig,
+			},
+			expected: [][]string{{"/usr/bin/make", "jobs"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "jobs/a.yaml"},
+					{Filename: "dashboards/b.json"},
+				}},
+			}
+			s := newTestServer(&fakeGit{files: tc.files}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Name: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t))
+			if tc.expectedComment != "" {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				checkComment(t, ghc, tc.expectedComment)
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+		})
+	}
+}
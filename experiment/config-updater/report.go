@@ -0,0 +1,98 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// TaskRecord is the result of a task as written to the report, one JSON
+// object per line.
+type TaskRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Org       string    `json:"org"`
+	Repo      string    `json:"repo"`
+	PR        int       `json:"pr"`
+	Author    string    `json:"author"`
+	// File lists the files the task ran for, separated by commas.
+	File       string   `json:"file"`
+	Command    []string `json:"command"`
+	ExitCode   int      `json:"exit_code"`
+	DurationMS int64    `json:"duration_ms"`
+	// OutputTruncated is set when the task was killed for exceeding
+	// limits.max_output_bytes, so that only part of its output was kept.
+	OutputTruncated bool `json:"output_truncated"`
+}
+
+// newTaskRecord describes the result of a task run for files of pr.
+func newTaskRecord(pr github.PullRequest, files []string, r result) TaskRecord {
+	limitErr, limited := r.err.(*limitError)
+	return TaskRecord{
+		Timestamp:       time.Now(),
+		Org:             pr.Base.Repo.Owner.Login,
+		Repo:            pr.Base.Repo.Name,
+		PR:              pr.Number,
+		Author:          pr.User.Login,
+		File:            strings.Join(files, ","),
+		Command:         r.command,
+		ExitCode:        r.exitCode,
+		DurationMS:      int64(r.duration / time.Millisecond),
+		OutputTruncated: limited && limitErr.limit == "output",
+	}
+}
+
+// WriteReport writes each of tasks to w as a line of JSON.
+func WriteReport(w io.Writer, tasks []TaskRecord) error {
+	encoder := json.NewEncoder(w)
+	for _, task := range tasks {
+		if err := encoder.Encode(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Report is a file that the results of tasks are appended to, for a sidecar
+// to ship to wherever they are kept.
+type Report struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+// Write appends tasks to the report, creating it if need be. Records for a
+// PR are never interleaved with those for another.
+func (r *Report) Write(tasks []TaskRecord) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f, err := os.OpenFile(r.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := WriteReport(f, tasks); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestWriteReport(t *testing.T) {
+	timestamp := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	tasks := []TaskRecord{
+		{Timestamp: timestamp, Org: "org", Repo: "repo", PR: 1, Author: "author", File: "config/a.yaml", Command: []string{"/usr/bin/make", "apply", "WHAT=config/a.yaml"}, DurationMS: 1500},
+		{Timestamp: timestamp, Org: "org", Repo: "repo", PR: 1, Author: "author", File: "config/b.yaml", Command: []string{"/usr/bin/make", "apply", "WHAT=config/b.yaml"}, ExitCode: -1, OutputTruncated: true},
+	}
+	var b bytes.Buffer
+	if err := WriteReport(&b, tasks); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{"timestamp":"2019-05-01T12:00:00Z","org":"org","repo":"repo","pr":1,"author":"author","file":"config/a.yaml","command":["/usr/bin/make","apply","WHAT=config/a.yaml"],"exit_code":0,"duration_ms":1500,"output_truncated":false}
+{"timestamp":"2019-05-01T12:00:00Z","org":"org","repo":"repo","pr":1,"author":"author","file":"config/b.yaml","command":["/usr/bin/make","apply","WHAT=config/b.yaml"],"exit_code":-1,"duration_ms":0,"output_truncated":true}
+`
+	if b.String() != expected {
+		t.Errorf("expected report:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestNewTaskRecord(t *testing.T) {
+	var testcases = []struct {
+		name              string
+		err               error
+		expectedTruncated bool
+	}{
+		{
+			name: "succeeded",
+		},
+		{
+			name:              "output limit",
+			err:               &limitError{limit: "output", value: "10 bytes"},
+			expectedTruncated: true,
+		},
+		{
+			name: "memory limit",
+			err:  &limitError{limit: "memory", value: "10 bytes"},
+		},
+		{
+			name: "failed",
+			err:  errors.New("exit status 2"),
+		},
+	}
+
+	pr := github.PullRequest{
+		Number: 1,
+		Base:   github.PullRequestBranch{Repo: github.Repo{Owner: github.User{Login: "org"}, Name: "repo"}},
+		User:   github.User{Login: "author"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			record := newTaskRecord(pr, []string{"config/a.yaml", "config/b.yaml"}, result{command: []string{"make", "apply"}, duration: 2 * time.Second, err: tc.err})
+			if record.OutputTruncated != tc.expectedTruncated {
+				t.Errorf("expected output_truncated to be %v", tc.expectedTruncated)
+			}
+			if record.File != "config/a.yaml,config/b.yaml" || record.DurationMS != 2000 || record.Author != "author" || record.Org != "org" || record.Repo != "repo" || record.PR != 1 {
+				t.Errorf("unexpected record %+v", record)
+			}
+		})
+	}
+}
+
+func TestHandleEventWritesReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.jsonl")
+
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "jobs/a.yaml"},
+			{Filename: "charts/prow.yaml"},
+		}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers: []Matcher{
+			{Glob: "jobs/*.yaml", Target: "jobs"},
+			{Glob: "charts/*.yaml", Target: "helm"},
+		},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make helm": true}}
+	s.Report = &Report{Path: path}
+
+	// Every event appends to the report.
+	for i := 0; i < 2; i++ {
+		if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	var actual []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var record TaskRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		if record.Org != "org" || record.Repo != "repo" || record.PR != 1 || record.Author != "author" {
+			t.Errorf("unexpected record %+v", record)
+		}
+		actual = append(actual, strings.Join(record.Command, " ")+" for "+record.File)
+	}
+	expected := []string{"/usr/bin/make jobs for jobs/a.yaml", "/usr/bin/make helm for charts/prow.yaml"}
+	expected = append(expected, expected...)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected records %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultConfigSchema is the JSON Schema of UpdateConfig, used when no
+// other schema is given.
+const defaultConfigSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "targets": {"type": "array", "items": {"type": "string", "minLength": 1}},
+    "matchers": {"type": "array", "items": {"$ref": "#/definitions/matcher"}},
+    "excludes": {"type": "array", "items": {"$ref": "#/definitions/exclude"}},
+    "max_pr_files": {"type": "integer", "minimum": 0},
+    "cooldown_period": {"$ref": "#/definitions/duration"},
+    "make_binary": {"type": "string"},
+    "fail_fast": {"type": "boolean"},
+    "show_diff": {"type": "boolean"},
+    "slack_channel": {"type": "string"},
+    "email_recipients": {"type": "array", "items": {"type": "string"}},
+    "escalate_after": {"type": "integer", "minimum": 0},
+    "alert_threshold": {"type": "integer", "minimum": 0},
+    "escalate_window": {"$ref": "#/definitions/duration"},
+    "target_rollbacks": {"type": "object", "additionalProperties": {"$ref": "#/definitions/rollback"}},
+    "kind_verifications": {"type": "object", "additionalProperties": {"$ref": "#/definitions/verification"}},
+    "pre_task_script": {"type": "string"},
+    "post_task_script": {"type": "string"},
+    "limits": {"$ref": "#/definitions/limits"},
+    "allowed_executables": {"type": "array", "items": {"type": "string", "minLength": 1}},
+    "unsafe_filenames": {"type": "string", "enum": ["", "env", "file"]},
+    "batch_size": {"type": "integer", "minimum": 0},
+    "kind_env": {"type": "object", "additionalProperties": {"$ref": "#/definitions/env"}},
+    "targets_workdir": {"type": "string"},
+    "targets_statuses": {"$ref": "#/definitions/statuses"},
+    "clusters": {"type": "array", "items": {"$ref": "#/definitions/cluster"}},
+    "targets_clusters": {"type": "array", "items": {"type": "string", "minLength": 1}},
+    "targets_environment": {"type": "string"},
+    "promoted_environments": {"type": "array", "items": {"type": "string", "minLength": 1}},
+    "promotion_expiry": {"$ref": "#/definitions/duration"},
+    "kustomize_binary": {"type": "string", "minLength": 1},
+    "kustomize_target": {"type": "string", "minLength": 1},
+    "helm_target": {"type": "string", "minLength": 1},
+    "kind_backends": {"type": "object", "additionalProperties": {"type": "string", "enum": ["", "make", "native"]}},
+    "field_manager": {"type": "string", "minLength": 1},
+    "diff": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "command": {"type": "array", "items": {"type": "string", "minLength": 1}},
+        "target": {"type": "string", "minLength": 1}
+      }
+    },
+    "manifest_validation": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "schema_dir": {"type": "string", "minLength": 1},
+        "unknown_kinds": {"type": "string", "enum": ["", "warn", "fail"]}
+      }
+    },
+    "jjb_validation": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["paths"],
+      "properties": {
+        "paths": {"type": "array", "minItems": 1, "items": {"type": "string", "minLength": 1}},
+        "command": {"type": "array", "items": {"type": "string", "minLength": 1}}
+      }
+    },
+    "tracking_issues": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["repo"],
+      "properties": {
+        "repo": {"type": "string", "pattern": "^[^/]+/[^/]+$"},
+        "max_failures": {"type": "integer", "minimum": 0},
+        "window": {"$ref": "#/definitions/duration"},
+        "label": {"type": "string"}
+      }
+    },
+    "outcome_labels": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "applied": {"type": "string"},
+        "failed": {"type": "string"}
+      }
+    },
+    "acknowledge": {"type": "string", "enum": ["", "reaction", "comment"]},
+    "comment_on_success": {"type": "boolean"},
+    "notify_users": {"type": "array", "items": {"type": "string", "minLength": 1}},
+    "notify_teams": {"type": "array", "items": {"type": "string", "minLength": 1}},
+    "orgs": {"type": "object", "additionalProperties": {"$ref": "#"}},
+    "repos": {"type": "object", "additionalProperties": {"$ref": "#"}},
+    "disabled_matchers": {"type": "array", "items": {"type": "string", "minLength": 1}}
+  },
+  "definitions": {
+    "duration": {"type": ["string", "integer"]},
+    "env": {"type": "object", "additionalProperties": {"type": "string"}},
+    "statuses": {"type": "array", "items": {"type": "string", "enum": ["added", "modified", "removed"]}},
+    "matcher": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "regex": {"type": "string", "format": "regex"},
+        "glob": {"type": "string"},
+        "target": {"type": "string", "minLength": 1},
+        "name": {"type": "string"},
+        "after": {"type": "array", "items": {"type": "string", "minLength": 1}},
+        "patch_regex": {"type": "string", "format": "regex"},
+        "missing_patch": {"type": "string", "enum": ["", "match", "skip"]},
+        "statuses": {"$ref": "#/definitions/statuses"},
+        "workdir": {"type": "string"},
+        "env": {"$ref": "#/definitions/env"},
+        "continue_on_error": {"type": "boolean"},
+        "rollback": {"$ref": "#/definitions/rollback"},
+        "verify": {"$ref": "#/definitions/verification"},
+        "priority": {"type": "integer"},
+        "stop_on_match": {"type": "boolean"},
+        "target_repo": {"type": "string", "pattern": "^[^/]+/[^/]+$"},
+        "prowjob": {"type": "string", "minLength": 1},
+        "argocd_sync": {
+          "type": "object",
+          "additionalProperties": false,
+          "required": ["server", "token_file", "application"],
+          "properties": {
+            "server": {"type": "string", "pattern": "^https?://"},
+            "token_file": {"type": "string", "minLength": 1},
+            "application": {"type": "string", "minLength": 1},
+            "timeout": {"$ref": "#/definitions/duration"}
+          }
+        },
+        "required_labels": {"type": "array", "items": {"type": "string", "minLength": 1}},
+        "required_org_membership": {"type": "string"},
+        "stdin": {"type": "string"},
+        "image": {"type": "string"},
+        "limits": {"$ref": "#/definitions/limits"},
+        "output_mode": {"type": "string", "enum": ["", "split", "combined", "none"]},
+        "clusters": {"type": "array", "items": {"type": "string", "minLength": 1}},
+        "environment": {"type": "string"},
+        "batch_targets": {"type": "boolean"},
+        "batch_separator": {"type": "string", "minLength": 1},
+        "deployment": {"type": "boolean"},
+        "condition": {"type": "string", "minLength": 1},
+        "helm_binary": {"type": "string", "minLength": 1},
+        "helm_release_name": {"type": "string"},
+        "notify_users": {"type": "array", "items": {"type": "string", "minLength": 1}},
+        "notify_teams": {"type": "array", "items": {"type": "string", "minLength": 1}},
+        "jenkins_reload": {
+          "type": "object",
+          "additionalProperties": false,
+          "required": ["url"],
+          "properties": {
+            "url": {"type": "string", "pattern": "^https?://"},
+            "endpoint": {"type": "string", "enum": ["", "reload", "configuration-as-code"]},
+            "credentials_file": {"type": "string"},
+            "timeout": {"$ref": "#/definitions/duration"}
+          }
+        }
+      }
+    },
+    "cluster": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["name"],
+      "properties": {
+        "name": {"type": "string", "minLength": 1},
+        "kubeconfig": {"type": "string", "minLength": 1},
+        "context": {"type": "string", "minLength": 1}
+      }
+    },
+    "exclude": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "regex": {"type": "string", "format": "regex"},
+        "glob": {"type": "string"}
+      }
+    },
+    "rollback": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["command"],
+      "properties": {
+        "command": {"type": "array", "items": {"type": "string"}},
+        "timeout": {"$ref": "#/definitions/duration"}
+      }
+    },
+    "verification": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "command": {"type": "array", "items": {"type": "string"}},
+        "target": {"type": "string"},
+        "timeout": {"$ref": "#/definitions/duration"},
+        "retries": {"type": "integer", "minimum": 0}
+      }
+    },
+    "limits": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "max_rss_bytes": {"type": "integer", "minimum": 0},
+        "max_cpu_time": {"$ref": "#/definitions/duration"},
+        "max_output_bytes": {"type": "integer", "minimum": 0},
+        "max_address_space_bytes": {"type": "integer", "minimum": 0}
+      }
+    }
+  }
+}`
+
+// SchemaViolation is a way in which a config does not match its schema.
+type SchemaViolation struct {
+	// Path is the JSON pointer to the value in violation, such as
+	// /matchers/0/regex.
+	Path    string
+	Message string
+}
+
+// SchemaError lists every violation of the schema found in a config.
+type SchemaError struct {
+	Path       string
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	var violations []string
+	for _, v := range e.Violations {
+		violations = append(violations, fmt.Sprintf("%s: %s", v.Path, v.Message))
+	}
+	return fmt.Sprintf("%s does not match the schema: %s", e.Path, strings.Join(violations, "; "))
+}
+
+// bundledSchemaURL is the URL the bundled schema is known by to the
+// compiler, which reports it in the locations of violations.
+const bundledSchemaURL = "config-updater://schema.json"
+
+// ValidateSchema validates the YAML config at configPath against the JSON
+// Schema at schemaPath, or against the bundled schema if it is empty.
+// Violations are returned as a *SchemaError.
+func ValidateSchema(configPath, schemaPath string) error {
+	compiler := jsonschema.NewCompiler()
+	url := schemaPath
+	if schemaPath == "" {
+		url = bundledSchemaURL
+		if err := compiler.AddResource(url, strings.NewReader(defaultConfigSchema)); err != nil {
+			return fmt.Errorf("error parsing the bundled schema: %v", err)
+		}
+	}
+	schema, err := compiler.Compile(url)
+	if err != nil {
+		return fmt.Errorf("error compiling schema %s: %v", url, err)
+	}
+
+	b, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", configPath, err)
+	}
+	var config interface{}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("error unmarshaling %s: %v", configPath, err)
+	}
+
+	err = schema.Validate(config)
+	if validationErr, ok := err.(*jsonschema.ValidationError); ok {
+		var violations []SchemaViolation
+		collectViolations(validationErr, &violations)
+		return &SchemaError{Path: configPath, Violations: violations}
+	} else if err != nil {
+		return fmt.Errorf("error validating %s: %v", configPath, err)
+	}
+	return nil
+}
+
+// collectViolations adds the causes of err that have no causes of their
+// own, which are the keywords the value violates, to violations, sorted by
+// path.
+func collectViolations(err *jsonschema.ValidationError, violations *[]SchemaViolation) {
+	var collect func(err *jsonschema.ValidationError)
+	collect = func(err *jsonschema.ValidationError) {
+		if len(err.Causes) == 0 {
+			path := err.InstanceLocation
+			if path == "" {
+				path = "/"
+			}
+			*violations = append(*violations, SchemaViolation{Path: path, Message: err.Message})
+			return
+		}
+		for _, cause := range err.Causes {
+			collect(cause)
+		}
+	}
+	collect(err)
+	sort.SliceStable(*violations, func(i, j int) bool {
+		return (*violations)[i].Path < (*violations)[j].Path
+	})
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	var testcases = []struct {
+		name       string
+		config     string
+		schema     string
+		expected   []SchemaViolation
+		expectedOK bool
+	}{
+		{
+			name: "valid config",
+			config: `targets:
+- jobs/config.yaml
+matchers:
+- regex: ^jobs/
+  target: jobs
+  name: jobs
+  after: [libs]
+  verify:
+    target: verify-jobs
+    timeout: 5m
+    retries: 2
+  limits:
+    max_rss_bytes: 1073741824
+- glob: libs/*.yaml
+  target: libs
+  name: libs
+  env:
+    STAGE: prod
+excludes:
+- glob: jobs/*.md
+target_rollbacks:
+  jobs/config.yaml:
+    command: [git, checkout, HEAD^]
+max_pr_files: 50
+unsafe_filenames: env
+batch_size: 10
+kind_env:
+  Deployment:
+    APPLY: "true"
+`,
+			expectedOK: true,
+		},
+		{
+			name: "every violation is reported",
+			config: `targets: jobs/config.yaml
+matchers:
+- regex: ^jobs/(
+  taget: jobs
+max_pr_file: 50
+batch_size: -1
+unsafe_filenames: shell
+`,
+			expected: []SchemaViolation{
+				{Path: "/", Message: "additionalProperties 'max_pr_file' not allowed"},
+				{Path: "/batch_size", Message: "must be >= 0 but found -1"},
+				{Path: "/matchers/0", Message: "additionalProperties 'taget' not allowed"},
+				{Path: "/matchers/0/regex", Message: "'^jobs/(' is not valid 'regex'"},
+				{Path: "/targets", Message: "expected array, but got string"},
+				{Path: "/unsafe_filenames", Message: `value must be one of "", "env", "file"`},
+			},
+		},
+		{
+			name:   "user provided schema",
+			config: "targets: [jobs/config.yaml]\nfail_fast: true\n",
+			schema: `{"type": "object", "required": ["matchers"], "properties": {"fail_fast": {"enum": [false]}}}`,
+			expected: []SchemaViolation{
+				{Path: "/", Message: "missing properties: 'matchers'"},
+				{Path: "/fail_fast", Message: "value must be false"},
+			},
+		},
+		{
+			name:   "user provided schema with keywords the bundled one does not use",
+			config: "targets: [jobs/a.yaml, jobs/b.yaml]\nbatch_size: 3\n",
+			schema: `{"properties": {"targets": {"maxItems": 1}, "batch_size": {"oneOf": [{"const": 1}, {"multipleOf": 2}]}}}`,
+			expected: []SchemaViolation{
+				{Path: "/batch_size", Message: `value must be "1"`},
+				{Path: "/batch_size", Message: "3 not multipleOf 2"},
+				{Path: "/targets", Message: "maximum 1 items required, but found 2 items"},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "config-schema")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			configPath := filepath.Join(dir, "update.yaml")
+			if err := ioutil.WriteFile(configPath, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var schemaPath string
+			if tc.schema != "" {
+				schemaPath = filepath.Join(dir, "schema.json")
+				if err := ioutil.WriteFile(schemaPath, []byte(tc.schema), 0644); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			err = ValidateSchema(configPath, schemaPath)
+			if tc.expectedOK {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			schemaErr, ok := err.(*SchemaError)
+			if !ok {
+				t.Fatalf("expected a schema error, got %v", err)
+			}
+			if !reflect.DeepEqual(schemaErr.Violations, tc.expected) {
+				t.Errorf("expected violations %+v, got %+v", tc.expected, schemaErr.Violations)
+			}
+		})
+	}
+}
+
+func TestValidateSchemaLoadsConfig(t *testing.T) {
+	// Configs that match the bundled schema must also load.
+	dir, err := ioutil.TempDir("", "config-schema")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "update.yaml")
+	config := "matchers:\n- regex: ^jobs/\n  target: jobs\n  patch_regex: '(?m)^[-+]\\s*image:'\n  missing_patch: skip\n  verify:\n    target: verify\n    timeout: 5m\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ValidateSchema(path, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := Load(path); err != nil {
+		t.Errorf("unexpected error loading a config matching the schema: %v", err)
+	}
+}
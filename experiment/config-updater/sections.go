@@ -0,0 +1,266 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// ForRepo returns the config for org/repo. Without any Orgs or Repos, that
+// is c itself for every repo. Otherwise only repos with a section, or whose
+// org has one, are handled, and ok is false for the rest.
+func (c *UpdateConfig) ForRepo(org, repo string) (config *UpdateConfig, ok bool) {
+	if len(c.Orgs) == 0 && len(c.Repos) == 0 {
+		return c, true
+	}
+	orgSection, hasOrg := c.Orgs[org]
+	repoSection, hasRepo := c.Repos[org+"/"+repo]
+	if !hasOrg && !hasRepo {
+		return nil, false
+	}
+	merged := inherit(*c, orgSection)
+	if hasRepo {
+		merged = inherit(merged, repoSection)
+	}
+	return &merged, true
+}
+
+// inherit merges section into parent, the level above it. Targets, Matchers
+// and Excludes are added to those of the parent, less any DisabledMatchers.
+// Entries in maps are added as well, replacing those with the same key. The
+// other settings replace those of the parent if set. FailFast can only be
+// turned on.
+func inherit(parent, section UpdateConfig) UpdateConfig {
+	merged := section
+	merged.Orgs = nil
+	merged.Repos = nil
+	merged.DisabledMatchers = nil
+
+	merged.Targets = union(append([]string{}, parent.Targets...), section.Targets)
+	disabled := sets.NewString(section.DisabledMatchers...)
+	merged.Matchers = nil
+	for _, matcher := range parent.Matchers {
+		if matcher.Name == "" || !disabled.Has(matcher.Name) {
+			merged.Matchers = append(merged.Matchers, matcher)
+		}
+	}
+	merged.Matchers = append(merged.Matchers, section.Matchers...)
+	merged.Excludes = append(append([]Exclude{}, parent.Excludes...), section.Excludes...)
+
+	merged.TargetRollbacks = map[string]Rollback{}
+	for _, rollbacks := range []map[string]Rollback{parent.TargetRollbacks, section.TargetRollbacks} {
+		for target, rollback := range rollbacks {
+			merged.TargetRollbacks[target] = rollback
+		}
+	}
+	merged.KindVerifications = map[string]Verification{}
+	for _, verifications := range []map[string]Verification{parent.KindVerifications, section.KindVerifications} {
+		for kind, verification := range verifications {
+			merged.KindVerifications[kind] = verification
+		}
+	}
+	merged.KindEnv = map[string]map[string]string{}
+	for _, kindEnv := range []map[string]map[string]string{parent.KindEnv, section.KindEnv} {
+		for kind, env := range kindEnv {
+			if merged.KindEnv[kind] == nil {
+				merged.KindEnv[kind] = map[string]string{}
+			}
+			for name, value := range env {
+				merged.KindEnv[kind][name] = value
+			}
+		}
+	}
+	merged.KindBackends = map[string]string{}
+	for _, backends := range []map[string]string{parent.KindBackends, section.KindBackends} {
+		for kind, backend := range backends {
+			merged.KindBackends[kind] = backend
+		}
+	}
+
+	// These can only be set globally, as they concern the host.
+	merged.MakeBinary = parent.MakeBinary
+	merged.AllowedExecutables = parent.AllowedExecutables
+
+	merged.FailFast = parent.FailFast || section.FailFast
+	merged.ShowDiff = parent.ShowDiff || section.ShowDiff
+	if merged.MaxPRFiles == 0 {
+		merged.MaxPRFiles = parent.MaxPRFiles
+	}
+	if merged.PreTaskScript == "" {
+		merged.PreTaskScript = parent.PreTaskScript
+	}
+	if merged.PostTaskScript == "" {
+		merged.PostTaskScript = parent.PostTaskScript
+	}
+	if merged.SlackChannel == "" {
+		merged.SlackChannel = parent.SlackChannel
+	}
+	if len(merged.EmailRecipients) == 0 {
+		merged.EmailRecipients = parent.EmailRecipients
+	}
+	if merged.escalateAfter() == 0 {
+		merged.EscalateAfter = parent.escalateAfter()
+	}
+	if merged.EscalateWindow == 0 {
+		merged.EscalateWindow = parent.EscalateWindow
+	}
+	if merged.CooldownPeriod == 0 {
+		merged.CooldownPeriod = parent.CooldownPeriod
+	}
+	if merged.TrackingIssues == nil {
+		merged.TrackingIssues = parent.TrackingIssues
+	}
+	if merged.OutcomeLabels == nil {
+		merged.OutcomeLabels = parent.OutcomeLabels
+	}
+	if merged.CommentOnSuccess == nil {
+		merged.CommentOnSuccess = parent.CommentOnSuccess
+	}
+	if merged.Acknowledge == "" {
+		merged.Acknowledge = parent.Acknowledge
+	}
+	if len(merged.NotifyUsers) == 0 && len(merged.NotifyTeams) == 0 {
+		merged.NotifyUsers = parent.NotifyUsers
+		merged.NotifyTeams = parent.NotifyTeams
+	}
+	if merged.FieldManager == "" {
+		merged.FieldManager = parent.FieldManager
+	}
+	if merged.Diff == nil {
+		merged.Diff = parent.Diff
+	}
+	if merged.ManifestValidation == nil {
+		merged.ManifestValidation = parent.ManifestValidation
+	}
+	if merged.JJBValidation == nil {
+		merged.JJBValidation = parent.JJBValidation
+	}
+	if merged.Limits == nil {
+		merged.Limits = parent.Limits
+	}
+	if merged.UnsafeFilenames == "" {
+		merged.UnsafeFilenames = parent.UnsafeFilenames
+	}
+	if merged.BatchSize == 0 {
+		merged.BatchSize = parent.BatchSize
+	}
+	if merged.TargetsWorkdir == "" {
+		merged.TargetsWorkdir = parent.TargetsWorkdir
+	}
+	if merged.HelmTarget == "" {
+		merged.HelmTarget = parent.HelmTarget
+	}
+	if merged.KustomizeBinary == "" {
+		merged.KustomizeBinary = parent.KustomizeBinary
+	}
+	if merged.KustomizeTarget == "" {
+		merged.KustomizeTarget = parent.KustomizeTarget
+	}
+	if len(merged.TargetsStatuses) == 0 {
+		merged.TargetsStatuses = parent.TargetsStatuses
+	}
+	if len(merged.Clusters) == 0 {
+		merged.Clusters = parent.Clusters
+	}
+	if len(merged.TargetsClusters) == 0 {
+		merged.TargetsClusters = parent.TargetsClusters
+	}
+	if merged.TargetsEnvironment == "" {
+		merged.TargetsEnvironment = parent.TargetsEnvironment
+	}
+	if len(merged.PromotedEnvironments) == 0 {
+		merged.PromotedEnvironments = parent.PromotedEnvironments
+	}
+	if merged.PromotionExpiry == 0 {
+		merged.PromotionExpiry = parent.PromotionExpiry
+	}
+	return merged
+}
+
+// validateSections checks that the sections of c can be merged, and that
+// the config every one of them results in is valid.
+func (c *UpdateConfig) validateSections() error {
+	if len(c.DisabledMatchers) > 0 {
+		return fmt.Errorf("disabled_matchers can only be set in orgs and repos")
+	}
+	for _, org := range sortedKeys(c.Orgs) {
+		if strings.Contains(org, "/") {
+			return fmt.Errorf("org %q must not contain a slash", org)
+		}
+		section := c.Orgs[org]
+		if err := validateSection(*c, section); err != nil {
+			return fmt.Errorf("org %s: %v", org, err)
+		}
+		merged := inherit(*c, section)
+		if err := merged.Validate(); err != nil {
+			return fmt.Errorf("org %s: %v", org, err)
+		}
+	}
+	for _, name := range sortedKeys(c.Repos) {
+		parts := strings.Split(name, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("repo %q must be in the form org/repo", name)
+		}
+		parent := inherit(*c, c.Orgs[parts[0]])
+		section := c.Repos[name]
+		if err := validateSection(parent, section); err != nil {
+			return fmt.Errorf("repo %s: %v", name, err)
+		}
+		merged := inherit(parent, section)
+		if err := merged.Validate(); err != nil {
+			return fmt.Errorf("repo %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validateSection checks the settings of section that only make sense as
+// part of parent.
+func validateSection(parent, section UpdateConfig) error {
+	if len(section.Orgs) > 0 || len(section.Repos) > 0 {
+		return fmt.Errorf("orgs and repos can only be set globally")
+	}
+	if section.MakeBinary != "" {
+		return fmt.Errorf("make_binary can only be set globally")
+	}
+	if len(section.AllowedExecutables) > 0 {
+		return fmt.Errorf("allowed_executables can only be set globally")
+	}
+	inherited := sets.NewString()
+	for _, matcher := range parent.Matchers {
+		inherited.Insert(matcher.Name)
+	}
+	for _, name := range section.DisabledMatchers {
+		if name == "" || !inherited.Has(name) {
+			return fmt.Errorf("cannot disable %q, as no inherited matcher has that name", name)
+		}
+	}
+	return nil
+}
+
+func sortedKeys(sections map[string]UpdateConfig) []string {
+	var keys []string
+	for key := range sections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestForRepo(t *testing.T) {
+	jobs := Matcher{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Name: "jobs"}
+	lint := Matcher{Glob: "*.yaml", Target: "lint"}
+	prod := Matcher{Glob: "prod/*.yaml", Target: "prod", Name: "prod"}
+	global := UpdateConfig{
+		Targets:         []string{"config/shared.yaml"},
+		Matchers:        []Matcher{jobs, lint},
+		MaxPRFiles:      50,
+		MakeBinary:      "/usr/local/bin/make",
+		TargetRollbacks: map[string]Rollback{"config/shared.yaml": {Command: []string{"/usr/local/bin/make", "undo-shared"}}},
+		Orgs: map[string]UpdateConfig{
+			"org": {MaxPRFiles: 20, FailFast: true},
+		},
+		Repos: map[string]UpdateConfig{
+			"org/infra": {
+				Targets:         []string{"config/infra.yaml"},
+				Matchers:        []Matcher{prod},
+				TargetRollbacks: map[string]Rollback{"config/shared.yaml": {Command: []string{"/usr/local/bin/make", "undo-infra"}}},
+			},
+			"org/docs":     {DisabledMatchers: []string{"jobs"}, MaxPRFiles: 5},
+			"other/single": {Targets: []string{"config/single.yaml"}},
+		},
+	}
+
+	var testcases = []struct {
+		name   string
+		config UpdateConfig
+		repo   string
+
+		expectedOK         bool
+		expectedTargets    []string
+		expectedMatchers   []string
+		expectedMaxPRFiles int
+		expectedFailFast   bool
+		expectedRollback   string
+	}{
+		{
+			name:               "without sections every repo uses the global config",
+			config:             UpdateConfig{Targets: []string{"config/shared.yaml"}, Matchers: []Matcher{jobs}, MaxPRFiles: 50},
+			repo:               "anyone/anything",
+			expectedOK:         true,
+			expectedTargets:    []string{"config/shared.yaml"},
+			expectedMatchers:   []string{"jobs"},
+			expectedMaxPRFiles: 50,
+		},
+		{
+			name:               "global matchers plus repo targets",
+			config:             global,
+			repo:               "org/infra",
+			expectedOK:         true,
+			expectedTargets:    []string{"config/shared.yaml", "config/infra.yaml"},
+			expectedMatchers:   []string{"jobs", "lint", "prod"},
+			expectedMaxPRFiles: 20,
+			expectedFailFast:   true,
+			expectedRollback:   "undo-infra",
+		},
+		{
+			name:               "repo disables a global matcher",
+			config:             global,
+			repo:               "org/docs",
+			expectedOK:         true,
+			expectedTargets:    []string{"config/shared.yaml"},
+			expectedMatchers:   []string{"lint"},
+			expectedMaxPRFiles: 5,
+			expectedFailFast:   true,
+			expectedRollback:   "undo-shared",
+		},
+		{
+			name:               "repo without a section inherits from its org",
+			config:             global,
+			repo:               "org/other",
+			expectedOK:         true,
+			expectedTargets:    []string{"config/shared.yaml"},
+			expectedMatchers:   []string{"jobs", "lint"},
+			expectedMaxPRFiles: 20,
+			expectedFailFast:   true,
+			expectedRollback:   "undo-shared",
+		},
+		{
+			name:               "repo whose org has no section",
+			config:             global,
+			repo:               "other/single",
+			expectedOK:         true,
+			expectedTargets:    []string{"config/shared.yaml", "config/single.yaml"},
+			expectedMatchers:   []string{"jobs", "lint"},
+			expectedMaxPRFiles: 50,
+			expectedRollback:   "undo-shared",
+		},
+		{
+			name:   "unknown repo",
+			config: global,
+			repo:   "other/unknown",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			parts := strings.Split(tc.repo, "/")
+			config, ok := tc.config.ForRepo(parts[0], parts[1])
+			if ok != tc.expectedOK {
+				t.Fatalf("expected ok to be %t, got %t", tc.expectedOK, ok)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(config.Targets, tc.expectedTargets) {
+				t.Errorf("expected targets %v, got %v", tc.expectedTargets, config.Targets)
+			}
+			var matchers []string
+			for _, matcher := range config.Matchers {
+				matchers = append(matchers, matcher.Target)
+			}
+			if !reflect.DeepEqual(matchers, tc.expectedMatchers) {
+				t.Errorf("expected matchers for %v, got %v", tc.expectedMatchers, matchers)
+			}
+			if config.MaxPRFiles != tc.expectedMaxPRFiles {
+				t.Errorf("expected max_pr_files %d, got %d", tc.expectedMaxPRFiles, config.MaxPRFiles)
+			}
+			if config.FailFast != tc.expectedFailFast {
+				t.Errorf("expected fail_fast %t, got %t", tc.expectedFailFast, config.FailFast)
+			}
+			if rollback := config.TargetRollbacks["config/shared.yaml"].Command; tc.expectedRollback != "" && rollback[1] != tc.expectedRollback {
+				t.Errorf("expected rollback %s, got %v", tc.expectedRollback, rollback)
+			}
+			if config.MakeBinary != tc.config.MakeBinary || len(config.Orgs) != 0 && len(tc.config.Orgs) != 0 {
+				t.Errorf("expected global settings to be kept and sections to be dropped, got %+v", config)
+			}
+		})
+	}
+}
+
+func TestValidateSections(t *testing.T) {
+	named := []Matcher{{Glob: "jobs/*.yaml", Target: "jobs", Name: "jobs"}}
+	var testcases = []struct {
+		name        string
+		config      UpdateConfig
+		expectedErr string
+	}{
+		{
+			name: "valid sections",
+			config: UpdateConfig{
+				Matchers: named,
+				Orgs:     map[string]UpdateConfig{"org": {DisabledMatchers: []string{"jobs"}}},
+				Repos:    map[string]UpdateConfig{"org/repo": {Targets: []string{"config.yaml"}}},
+			},
+		},
+		{
+			name:        "disabled matchers at the top",
+			config:      UpdateConfig{Matchers: named, DisabledMatchers: []string{"jobs"}},
+			expectedErr: "disabled_matchers can only be set in orgs and repos",
+		},
+		{
+			name:        "disabling an unknown matcher",
+			config:      UpdateConfig{Matchers: named, Repos: map[string]UpdateConfig{"org/repo": {DisabledMatchers: []string{"lint"}}}},
+			expectedErr: `repo org/repo: cannot disable "lint", as no inherited matcher has that name`,
+		},
+		{
+			name: "disabling a matcher the org already disabled",
+			config: UpdateConfig{
+				Matchers: named,
+				Orgs:     map[string]UpdateConfig{"org": {DisabledMatchers: []string{"jobs"}}},
+				Repos:    map[string]UpdateConfig{"org/repo": {DisabledMatchers: []string{"jobs"}}},
+			},
+			expectedErr: `repo org/repo: cannot disable "jobs"`,
+		},
+		{
+			name:        "repo without an org",
+			config:      UpdateConfig{Repos: map[string]UpdateConfig{"repo": {}}},
+			expectedErr: `repo "repo" must be in the form org/repo`,
+		},
+		{
+			name:        "nested sections",
+			config:      UpdateConfig{Orgs: map[string]UpdateConfig{"org": {Repos: map[string]UpdateConfig{"org/repo": {}}}}},
+			expectedErr: "org org: orgs and repos can only be set globally",
+		},
+		{
+			name:        "host settings in a section",
+			config:      UpdateConfig{Repos: map[string]UpdateConfig{"org/repo": {AllowedExecutables: []string{"/bin/sh"}}}},
+			expectedErr: "repo org/repo: allowed_executables can only be set globally",
+		},
+		{
+			name: "invalid merged config",
+			config: UpdateConfig{
+				Matchers: named,
+				Repos:    map[string]UpdateConfig{"org/repo": {Matchers: []Matcher{{Glob: "other/*.yaml", Target: "other", Name: "jobs"}}}},
+			},
+			expectedErr: `repo org/repo: matcher 1 for target "other" reuses the name "jobs"`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestHandleEventSections(t *testing.T) {
+	config := &UpdateConfig{
+		Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Name: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+		Repos: map[string]UpdateConfig{
+			"org/repo":  {Matchers: []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^config/`)}, Target: "config"}}},
+			"org/quiet": {DisabledMatchers: []string{"jobs"}},
+		},
+	}
+	var testcases = []struct {
+		name     string
+		repo     string
+		expected [][]string
+	}{
+		{name: "configured repo", repo: "repo", expected: [][]string{{"/usr/bin/make", "jobs"}, {"/usr/bin/make", "config"}}},
+		{name: "repo disabling the global matcher", repo: "quiet"},
+		{name: "unknown repo is skipped", repo: "unknown"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &countingGitHub{FakeClient: &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "jobs/a.yaml"},
+					{Filename: "config/b.yaml"},
+				}},
+			}}
+			s := newTestServer(&fakeGit{}, ghc, config)
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			event := mergedPREvent(t, func(pr *github.PullRequest) { pr.Base.Repo.Name = tc.repo })
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", event); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+			if tc.repo == "unknown" && ghc.calls != 0 {
+				t.Errorf("expected the changes of a PR to an unknown repo not to be listed, got %d calls", ghc.calls)
+			}
+		})
+	}
+}
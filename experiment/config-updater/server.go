@@ -20,39 +20,758 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"os/exec"
+	"net/mail"
+	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apimachinery/pkg/util/sets"
 
 	"k8s.io/test-infra/prow/git"
 	"k8s.io/test-infra/prow/github"
 	"k8s.io/test-infra/prow/plugins"
 )
 
-const pluginName = "config-updater"
+const (
+	pluginName = "config-updater"
+
+	// commentSignature is added to every comment we post, hidden, to find
+	// them again.
+	commentSignature = "<!-- jenkins-config-updater -->"
+
+	// defaultMakeBinary is used when neither the config nor the server set
+	// the make binary.
+	defaultMakeBinary = "/usr/bin/make"
+
+	// defaultRollbackTimeout is used when a rollback does not set a timeout.
+	defaultRollbackTimeout = 10 * time.Minute
+
+	// defaultVerificationTimeout is used when a verification does not set a
+	// timeout.
+	defaultVerificationTimeout = 10 * time.Minute
+
+	// defaultContainerRuntime runs tasks that have an image.
+	defaultContainerRuntime = "docker"
+
+	// containerWorkDir is where the checkout is mounted when a task runs in
+	// a container.
+	containerWorkDir = "/workspace"
+
+	// defaultMaxPRFiles is used when the config does not set MaxPRFiles.
+	defaultMaxPRFiles = 50
+	// githubMaxListedFiles is the most changed files the API lists for a
+	// PR, past which the list is truncated.
+	githubMaxListedFiles = 3000
+
+	// maxSummaryLength is the most GitHub allows in the description of a
+	// commit status.
+	maxSummaryLength = 140
+
+	// defaultMaxRequestBodyBytes bounds the size of webhook payloads. GitHub
+	// caps them at 25MB, but ours are far smaller.
+	defaultMaxRequestBodyBytes = 1 << 20
+
+	// defaultMaxCacheEntries bounds how many PRs we remember the changes of.
+	defaultMaxCacheEntries = 1000
+
+	// changesCacheTTL is how long the changes of a PR are remembered, so
+	// that a replayed or retried event does not list them again.
+	changesCacheTTL = 5 * time.Minute
+
+	// defaultGitRetryBackoff is the initial wait between attempts to clone or
+	// check out, doubled after every failure.
+	defaultGitRetryBackoff = 2 * time.Second
+)
 
 type githubClient interface {
 	GetPullRequestChanges(org, repo string, number int) ([]github.PullRequestChange, error)
+	GetPullRequest(org, repo string, number int) (*github.PullRequest, error)
+	FindAllIssues(query, sort string, asc bool) ([]github.Issue, error)
 	CreateComment(org, repo string, number int, comment string) error
+	ListIssueComments(org, repo string, number int) ([]github.IssueComment, error)
+	IsMember(org, user string) (bool, error)
+	MinimizeComment(org, repo string, id int) error
+	BotName() (string, error)
+	GetRepo(owner, name string) (github.Repo, error)
+	CreateFork(owner, repo string) error
+	CreatePullRequest(org, repo, title, body, head, base string, canModify bool) (int, error)
+	CreateIssue(org, repo, title, body string, milestone int, labels, assignees []string) (int, error)
+	CreateCheckRun(org, repo string, opt github.CheckRunOptions) (int64, error)
+	UpdateCheckRun(org, repo string, checkRunID int64, opt github.CheckRunOptions) error
+	CreateDeployment(org, repo string, opt github.DeploymentOptions) (int64, error)
+	CreateDeploymentStatus(org, repo string, deploymentID int64, opt github.DeploymentStatusOptions) error
+	AddLabel(org, repo string, number int, label string) error
+	RemoveLabel(org, repo string, number int, label string) error
+	CreateIssueReaction(org, repo string, number int, reaction string) error
 }
 
 type UpdateConfig struct {
 	Targets  []string  `json:"targets"`
 	Matchers []Matcher `json:"matchers"`
+	// Excludes are checked first, and changed files they match are ignored
+	// even if they are in Targets or match one of the Matchers.
+	Excludes []Exclude `json:"excludes,omitempty" yaml:"excludes,omitempty"`
+	// MaxPRFiles is the largest number of changed files a PR may have
+	// before we refuse to run any updates for it. The API lists at most
+	// githubMaxListedFiles of them, so the rest are only diffed locally
+	// when it is set higher than that.
+	MaxPRFiles int `json:"max_pr_files,omitempty" yaml:"max_pr_files,omitempty"`
+	// CooldownPeriod, when set, skips the updates for a merged PR if they
+	// already ran within it, so that a webhook GitHub redelivers with a
+	// fresh GUID does not apply the PR again.
+	CooldownPeriod time.Duration `json:"cooldown_period,omitempty" yaml:"cooldown_period,omitempty"`
+	// MakeBinary is the make used to run tasks, /usr/bin/make by default.
+	MakeBinary string `json:"make_binary,omitempty" yaml:"make_binary,omitempty"`
+	// FailFast stops running tasks for a PR after the first one fails.
+	FailFast bool `json:"fail_fast,omitempty" yaml:"fail_fast,omitempty"`
+	// ShowDiff shows in the comment how the PR changed each file that the
+	// tasks update, before their results.
+	ShowDiff bool `json:"show_diff,omitempty" yaml:"show_diff,omitempty"`
+	// SlackChannel is where failed updates are notified, if the server has
+	// a Slack webhook.
+	SlackChannel string `json:"slack_channel,omitempty" yaml:"slack_channel,omitempty"`
+	// EmailRecipients are mailed failed updates, if the server has an SMTP
+	// server.
+	EmailRecipients []string `json:"email_recipients,omitempty" yaml:"email_recipients,omitempty"`
+	// EscalateAfter is how many times in a row a target may fail before
+	// the people on call are paged, if the server has a pager. Zero never
+	// pages.
+	EscalateAfter int `json:"escalate_after,omitempty" yaml:"escalate_after,omitempty"`
+	// AlertThreshold is another name for EscalateAfter. Setting both to
+	// different values is an error.
+	AlertThreshold int `json:"alert_threshold,omitempty" yaml:"alert_threshold,omitempty"`
+	// EscalateWindow, when set, only counts the failures within it towards
+	// EscalateAfter, so that a target failing rarely is not paged for.
+	EscalateWindow time.Duration `json:"escalate_window,omitempty" yaml:"escalate_window,omitempty"`
+	// TrackingIssues, when set, files an issue for each target that keeps
+	// failing.
+	TrackingIssues *TrackingIssues `json:"tracking_issues,omitempty" yaml:"tracking_issues,omitempty"`
+	// OutcomeLabels, when set, labels each PR with whether its updates
+	// were applied.
+	OutcomeLabels *OutcomeLabels `json:"outcome_labels,omitempty" yaml:"outcome_labels,omitempty"`
+	// Acknowledge, when set, tells authors as soon as updates start running
+	// for their PR, before the results are posted. With reaction, the PR
+	// gets an eyes reaction, followed by a rocket or confused reaction once
+	// the updates succeeded or failed. With comment, a short comment naming
+	// the run is posted instead of the eyes reaction.
+	Acknowledge string `json:"acknowledge,omitempty" yaml:"acknowledge,omitempty"`
+	// CommentOnSuccess, when false, posts no comment for PRs whose updates
+	// all succeeded, only for those with a failure or an internal error.
+	// Comments are posted for every PR by default.
+	CommentOnSuccess *bool `json:"comment_on_success,omitempty" yaml:"comment_on_success,omitempty"`
+	// NotifyUsers are the logins mentioned in the comment when an update
+	// fails, unless its matcher names its own.
+	NotifyUsers []string `json:"notify_users,omitempty" yaml:"notify_users,omitempty"`
+	// NotifyTeams are the org/team slugs of the teams mentioned in the
+	// comment when an update fails, unless its matcher names its own.
+	NotifyTeams []string `json:"notify_teams,omitempty" yaml:"notify_teams,omitempty"`
+	// TargetRollbacks maps entries in Targets to the rollback to run when
+	// applying them fails.
+	TargetRollbacks map[string]Rollback `json:"target_rollbacks,omitempty" yaml:"target_rollbacks,omitempty"`
+	// KindVerifications maps the kinds of objects in Targets to the
+	// verification to run after applying them.
+	KindVerifications map[string]Verification `json:"kind_verifications,omitempty" yaml:"kind_verifications,omitempty"`
+	// PreTaskScript is run with /bin/sh before the first task for a PR.
+	// If it fails, no tasks are run.
+	PreTaskScript string `json:"pre_task_script,omitempty" yaml:"pre_task_script,omitempty"`
+	// PostTaskScript is run with /bin/sh after the last task for a PR.
+	PostTaskScript string `json:"post_task_script,omitempty" yaml:"post_task_script,omitempty"`
+	// Limits applies to every task that does not set its own.
+	Limits *Limits `json:"limits,omitempty" yaml:"limits,omitempty"`
+	// AllowedExecutables are the absolute paths of the only executables
+	// tasks may run on the host. Only the make binary is allowed if unset.
+	AllowedExecutables []string `json:"allowed_executables,omitempty" yaml:"allowed_executables,omitempty"`
+	// UnsafeFilenames is how to pass configs in Targets whose names have
+	// whitespace or shell metacharacters to make, as Makefiles tend to
+	// interpolate WHAT into shell commands. With env, the default, the name
+	// is in $CONFIG_UPDATER_WHAT instead. With file, WHAT_FILE is the path,
+	// relative to the checkout, of a file holding the NUL-terminated name.
+	UnsafeFilenames string `json:"unsafe_filenames,omitempty" yaml:"unsafe_filenames,omitempty"`
+	// BatchSize, when more than one, opts in to applying up to that many
+	// configs in Targets with a single make run, passed in WHAT separated
+	// by spaces. Only configs with the same make target and verification
+	// and without a rollback are batched together.
+	BatchSize int `json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
+	// KindEnv maps the kinds of objects in Targets to the environment to
+	// apply them with, like Matcher.Env but without substitution.
+	KindEnv map[string]map[string]string `json:"kind_env,omitempty" yaml:"kind_env,omitempty"`
+	// TargetsWorkdir is the directory, relative to the root of the
+	// checkout, to apply Targets in. WHAT stays relative to the root.
+	TargetsWorkdir string `json:"targets_workdir,omitempty" yaml:"targets_workdir,omitempty"`
+	// TargetsStatuses, when set, limits Targets to the changes with one of
+	// these statuses, like Matcher.Statuses.
+	TargetsStatuses []string `json:"targets_statuses,omitempty" yaml:"targets_statuses,omitempty"`
+	// Clusters are the clusters that Targets and matchers can be applied
+	// to, by naming them in TargetsClusters and Matcher.Clusters.
+	Clusters []Cluster `json:"clusters,omitempty" yaml:"clusters,omitempty"`
+	// TargetsClusters, when set, applies Targets to each of these clusters
+	// in turn, with a task for each.
+	TargetsClusters []string `json:"targets_clusters,omitempty" yaml:"targets_clusters,omitempty"`
+	// TargetsEnvironment is the environment Targets are applied to, like
+	// Matcher.Environment.
+	TargetsEnvironment string `json:"targets_environment,omitempty" yaml:"targets_environment,omitempty"`
+	// PromotedEnvironments are the environments that updates are only
+	// applied to once promoted. Their tasks are held when the PR merges,
+	// until an org member comments /promote with the environment on it.
+	PromotedEnvironments []string `json:"promoted_environments,omitempty" yaml:"promoted_environments,omitempty"`
+	// PromotionExpiry is how long held updates can be promoted for, seven
+	// days by default.
+	PromotionExpiry time.Duration `json:"promotion_expiry,omitempty" yaml:"promotion_expiry,omitempty"`
+	// KustomizeBinary is the binary to apply kustomizations in Targets with,
+	// running apply -k on the directory of the kustomization. It is
+	// /usr/bin/kubectl by default, and may be oc, or a wrapper that builds
+	// with a standalone kustomize and applies the output. Each kustomization
+	// is applied for changes to any file in it or in the bases, resources
+	// and components it refers to.
+	KustomizeBinary string `json:"kustomize_binary,omitempty" yaml:"kustomize_binary,omitempty"`
+	// KustomizeTarget, when set, is the make target to apply kustomizations
+	// with instead, with WHAT the directory of the kustomization.
+	KustomizeTarget string `json:"kustomize_target,omitempty" yaml:"kustomize_target,omitempty"`
+	// HelmTarget is the make target to apply the charts that configs in
+	// Targets are part of with, applyHelm by default. CHART is the directory
+	// of the chart, which is applied once for changes to any file in it, and
+	// VALUES the values files at its root that changed, if any.
+	HelmTarget string `json:"helm_target,omitempty" yaml:"helm_target,omitempty"`
+	// KindBackends maps the kinds of objects in Targets to how configs of
+	// that kind are applied: with make, the default, or native, which
+	// applies every object in the config with server-side apply instead.
+	KindBackends map[string]string `json:"kind_backends,omitempty" yaml:"kind_backends,omitempty"`
+	// FieldManager is the field manager objects are applied natively as,
+	// config-updater by default.
+	FieldManager string `json:"field_manager,omitempty" yaml:"field_manager,omitempty"`
+	// Diff, when set, is run before each task applying configs in Targets,
+	// and its output is shown in the comment along with the task's. The
+	// task is not run if the diff fails.
+	Diff *Diff `json:"diff,omitempty" yaml:"diff,omitempty"`
+	// ManifestValidation, when set, validates the objects in the configs in
+	// Targets before any task runs, and fails the configs with invalid ones
+	// instead of applying them.
+	ManifestValidation *ManifestValidation `json:"manifest_validation,omitempty" yaml:"manifest_validation,omitempty"`
+	// JJBValidation, when set, tests the Jenkins Job Builder definitions
+	// that matchers apply before running them, and leaves the broken ones
+	// out of the update.
+	JJBValidation *JJBValidation `json:"jjb_validation,omitempty" yaml:"jjb_validation,omitempty"`
+	// Orgs and Repos are sections of the config for the repos of an org,
+	// and for a single org/repo. Sections inherit what they do not set from
+	// the org, then from the rest of this config. Once any are configured,
+	// repos without a section, or whose org has none, are not handled.
+	Orgs  map[string]UpdateConfig `json:"orgs,omitempty" yaml:"orgs,omitempty"`
+	Repos map[string]UpdateConfig `json:"repos,omitempty" yaml:"repos,omitempty"`
+	// DisabledMatchers names matchers that a section does not inherit.
+	DisabledMatchers []string `json:"disabled_matchers,omitempty" yaml:"disabled_matchers,omitempty"`
+}
+
+// Verification checks that a task had the intended effect. It is run right
+// after the task succeeds, and its failure fails the task.
+type Verification struct {
+	// Command is run as is. Either it or Target must be set.
+	Command []string `json:"command,omitempty"`
+	// Target is run with make, passing WHAT for objects in Targets.
+	Target string `json:"target,omitempty"`
+	// Timeout bounds each attempt at verification.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Retries is how many more times verification is attempted after it
+	// fails.
+	Retries int `json:"retries,omitempty"`
+}
+
+// command resolves the command to run for the verification, which is for
+// the config passed as what if the task came from a target.
+func (v *Verification) command(makeBinary string, what []string) []string {
+	if len(v.Command) > 0 {
+		return v.Command
+	}
+	return append([]string{makeBinary, v.Target}, what...)
+}
+
+// validate checks that exactly one of Command and Target is set, if the
+// verification is.
+func (v *Verification) validate() error {
+	switch {
+	case v == nil:
+		return nil
+	case len(v.Command) == 0 && v.Target == "":
+		return fmt.Errorf("sets neither command nor target")
+	case len(v.Command) > 0 && v.Target != "":
+		return fmt.Errorf("sets both command and target")
+	}
+	return nil
+}
+
+// Rollback is a command run in the same checkout when the task it belongs to
+// fails, to undo a partial update.
+type Rollback struct {
+	Command []string      `json:"command"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// RegexpWrapper is a regexp in the config. Unlike regexp.Regexp, it is
+// compiled while the config is unmarshaled, so that an invalid regex fails
+// loading the config rather than the first event it is matched against.
+type RegexpWrapper struct {
+	regexp.Regexp
+}
+
+// UnmarshalJSON compiles the regex from its source text.
+func (r *RegexpWrapper) UnmarshalJSON(b []byte) error {
+	var expr string
+	if err := json.Unmarshal(b, &expr); err != nil {
+		return err
+	}
+	return r.compile(expr)
+}
+
+// UnmarshalYAML compiles the regex from its source text.
+func (r *RegexpWrapper) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var expr string
+	if err := unmarshal(&expr); err != nil {
+		return err
+	}
+	return r.compile(expr)
+}
+
+func (r *RegexpWrapper) compile(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %v", expr, err)
+	}
+	r.Regexp = *re
+	return nil
+}
+
+// MarshalJSON renders the regex as its source text.
+func (r RegexpWrapper) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
 }
 
 type Matcher struct {
-	Regex  regexp.Regexp `json:"regex"`
-	Target string        `json:"target"`
+	Regex RegexpWrapper `json:"regex"`
+	// Glob is a simpler alternative to Regex, matched with filepath.Match.
+	// Like in a shell, * does not match across directories.
+	Glob string `json:"glob,omitempty" yaml:"glob,omitempty"`
+	// Target is the make target to run. Like the values of Env, it may
+	// refer to the capture groups of Regex in the changed file, as in
+	// apply-${team}, and files that expand to different targets are updated
+	// by separate tasks.
+	Target string `json:"target"`
+	// Name identifies the matcher in the After of other matchers.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// After names the matchers whose tasks must run before the tasks of
+	// this one, such as those applying configs it depends on.
+	After []string `json:"after,omitempty" yaml:"after,omitempty"`
+	// PatchRegex, when set, limits the matcher to changed files whose patch,
+	// the unified diff of the file, it matches. Use (?m)^[-+] to match the
+	// lines that changed.
+	PatchRegex RegexpWrapper `json:"patch_regex,omitempty" yaml:"patch_regex,omitempty"`
+	// MissingPatch is whether files without a patch, which GitHub omits
+	// for large and binary files, match PatchRegex: match, the default, or
+	// skip.
+	MissingPatch string `json:"missing_patch,omitempty" yaml:"missing_patch,omitempty"`
+	// Statuses, when set, limits the matcher to changed files that were
+	// added, modified or removed. A renamed file counts as removing the
+	// previous file and adding the new one. Without statuses, only the new
+	// name of a renamed file is matched.
+	Statuses []string `json:"statuses,omitempty" yaml:"statuses,omitempty"`
+	// Workdir is the directory, relative to the root of the checkout, to run
+	// the task in. It must stay inside the checkout.
+	Workdir string `json:"workdir,omitempty" yaml:"workdir,omitempty"`
+	// Env is set for the task, overriding the variables describing the PR.
+	// Values may refer to the capture groups of Regex in the changed file as
+	// $1 or ${name}, and $$ is a literal $. Files that expand to different
+	// values are updated by separate tasks.
+	Env map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	// ContinueOnError lets later tasks run when this one fails, even if
+	// FailFast is set.
+	ContinueOnError bool `json:"continue_on_error,omitempty" yaml:"continue_on_error,omitempty"`
+	// Rollback is run if the target fails.
+	Rollback *Rollback `json:"rollback,omitempty" yaml:"rollback,omitempty"`
+	// Verify is run after the target succeeds.
+	Verify *Verification `json:"verify,omitempty" yaml:"verify,omitempty"`
+	// Priority orders matchers, highest first. Matchers with the same
+	// priority keep the order in which they are configured.
+	Priority int `json:"priority,omitempty" yaml:"priority,omitempty"`
+	// StopOnMatch keeps the files this matcher matches from being matched
+	// by any matcher after it in priority order.
+	StopOnMatch bool `json:"stop_on_match,omitempty" yaml:"stop_on_match,omitempty"`
+	// TargetRepo is an org/repo that the matched files are copied to in a
+	// new PR, instead of running Target.
+	TargetRepo string `json:"target_repo,omitempty" yaml:"target_repo,omitempty"`
+	// ProwJob is a postsubmit of the repo in the Prow config that is run as
+	// a ProwJob at the merge commit, instead of running Target.
+	ProwJob string `json:"prowjob,omitempty" yaml:"prowjob,omitempty"`
+	// ArgoCDSync is an ArgoCD application that is synced, instead of
+	// running Target.
+	ArgoCDSync *ArgoCDSync `json:"argocd_sync,omitempty" yaml:"argocd_sync,omitempty"`
+	// RequiredLabels must all be on the PR for the matcher to run Target.
+	// Otherwise the update is skipped, which is noted in the comment.
+	RequiredLabels []string `json:"required_labels,omitempty" yaml:"required_labels,omitempty"`
+	// RequiredOrgMembership, when set, is the org the author of the PR must
+	// be a member of for the matcher to run Target. Otherwise the update is
+	// skipped, which is explained in a comment of its own.
+	RequiredOrgMembership string `json:"required_org_membership,omitempty" yaml:"required_org_membership,omitempty"`
+	// Stdin is written to the standard input of Target, for make targets
+	// that ask for confirmation.
+	Stdin string `json:"stdin,omitempty" yaml:"stdin,omitempty"`
+	// Image, when set, is the container image Target is run in.
+	Image string `json:"image,omitempty" yaml:"image,omitempty"`
+	// Limits overrides the Limits in the config for Target.
+	Limits *Limits `json:"limits,omitempty" yaml:"limits,omitempty"`
+	// Clusters, when set, runs Target for each of these clusters in turn,
+	// with the environment of the cluster.
+	Clusters []string `json:"clusters,omitempty" yaml:"clusters,omitempty"`
+	// Environment is the environment Target applies to. Tasks for one of
+	// PromotedEnvironments are held until promoted, the others run on merge.
+	Environment string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	// OutputMode is how the output of Target is captured: split, the
+	// default, keeps stdout and stderr apart, combined interleaves them as
+	// they are written, and none discards them so that only the exit code
+	// is reported.
+	OutputMode string `json:"output_mode,omitempty" yaml:"output_mode,omitempty"`
+	// BatchTargets passes all the files the matcher matched to Target in
+	// WHAT, joined by BatchSeparator, for Makefiles that apply what they are
+	// given rather than reading CHANGED_FILES.
+	BatchTargets bool `json:"batch_targets,omitempty" yaml:"batch_targets,omitempty"`
+	// BatchSeparator joins the files in WHAT, a space by default.
+	BatchSeparator string `json:"batch_separator,omitempty" yaml:"batch_separator,omitempty"`
+	// JenkinsReload, when set, reloads the configuration of a Jenkins
+	// controller once every task of the matcher succeeded.
+	JenkinsReload *JenkinsReload `json:"jenkins_reload,omitempty" yaml:"jenkins_reload,omitempty"`
+	// Deployment records each task of the matcher as a deployment of the
+	// merge commit, in an environment named after Environment or Target
+	// and the cluster, so that it shows in the environments of the repo.
+	// The token needs the repo_deployment scope.
+	Deployment bool `json:"deployment,omitempty" yaml:"deployment,omitempty"`
+	// NotifyUsers are the logins mentioned in the comment when a task of
+	// the matcher fails. With NotifyTeams, they replace those of the config.
+	NotifyUsers []string `json:"notify_users,omitempty" yaml:"notify_users,omitempty"`
+	// NotifyTeams are the org/team slugs of the teams mentioned in the
+	// comment when a task of the matcher fails.
+	NotifyTeams []string `json:"notify_teams,omitempty" yaml:"notify_teams,omitempty"`
+	// HelmBinary, when set, applies the charts whose Chart.yaml or values
+	// files the matcher matches with helm upgrade --install, instead of
+	// running a make target. Only files next to a Chart.yaml are applied.
+	// It may run without being in AllowedExecutables unless the config
+	// lists some.
+	HelmBinary string `json:"helm_binary,omitempty" yaml:"helm_binary,omitempty"`
+	// Condition, when set, only matches changed files with an object that
+	// it holds for. See Condition for the expressions it may be.
+	Condition *Condition `json:"condition,omitempty" yaml:"condition,omitempty"`
+	// HelmReleaseName names the release of each chart, which may refer to
+	// capture groups of Regex. The directory of the chart by default.
+	HelmReleaseName string `json:"helm_release_name,omitempty" yaml:"helm_release_name,omitempty"`
+}
+
+// describe names the update the matcher makes, for updates it skips.
+func (m *Matcher) describe(makeBinary string) string {
+	if m.TargetRepo != "" {
+		return "copy to " + m.TargetRepo
+	}
+	if m.ProwJob != "" {
+		return prowJobCommand + " " + m.ProwJob
+	}
+	if m.ArgoCDSync != nil {
+		return argoCDSyncCommand + " " + m.ArgoCDSync.Application
+	}
+	if m.HelmBinary != "" {
+		return m.HelmBinary + " upgrade --install"
+	}
+	return strings.Join([]string{makeBinary, m.Target}, " ")
+}
+
+// MarshalJSON renders the regex of the matcher as its source text.
+func (m Matcher) MarshalJSON() ([]byte, error) {
+	type matcher Matcher
+	return json.Marshal(struct {
+		Regex      string `json:"regex"`
+		PatchRegex string `json:"patch_regex,omitempty"`
+		matcher
+	}{
+		Regex:      m.Regex.String(),
+		PatchRegex: m.PatchRegex.String(),
+		matcher:    matcher(m),
+	})
+}
+
+// Exclude matches changed files to ignore, with either Regex or Glob.
+type Exclude struct {
+	Regex RegexpWrapper `json:"regex"`
+	Glob  string        `json:"glob,omitempty" yaml:"glob,omitempty"`
+}
+
+// MarshalJSON renders the regex of the exclude as its source text.
+func (e Exclude) MarshalJSON() ([]byte, error) {
+	type exclude Exclude
+	return json.Marshal(struct {
+		Regex string `json:"regex"`
+		exclude
+	}{
+		Regex:   e.Regex.String(),
+		exclude: exclude(e),
+	})
+}
+
+func (e *Exclude) matches(filename string) bool {
+	m := Matcher{Regex: e.Regex, Glob: e.Glob}
+	return m.matches(filename)
+}
+
+// matches determines whether the matcher applies to the changed filename.
+func (m *Matcher) matches(filename string) bool {
+	if m.Glob != "" {
+		matched, _ := filepath.Match(m.Glob, filename)
+		return matched
+	}
+	return m.Regex.MatchString(filename)
+}
+
+const (
+	missingPatchMatch = "match"
+	missingPatchSkip  = "skip"
+)
+
+const (
+	outputModeSplit    = "split"
+	outputModeCombined = "combined"
+	outputModeNone     = "none"
+)
+
+// matchesPatch determines whether the patch of change matches PatchRegex,
+// if the matcher has one.
+func (m *Matcher) matchesPatch(change github.PullRequestChange) bool {
+	if m.PatchRegex.String() == "" {
+		return true
+	}
+	if change.Patch == "" {
+		return m.MissingPatch != missingPatchSkip
+	}
+	return m.PatchRegex.MatchString(change.Patch)
+}
+
+// Validate checks the config for mistakes that would otherwise only show
+// when handling a PR.
+func (c *UpdateConfig) Validate() error {
+	switch c.UnsafeFilenames {
+	case "", unsafeFilenamesEnv, unsafeFilenamesFile:
+	default:
+		return fmt.Errorf("unsafe_filenames must be %s or %s, not %q", unsafeFilenamesEnv, unsafeFilenamesFile, c.UnsafeFilenames)
+	}
+	switch c.Acknowledge {
+	case "", acknowledgeReaction, acknowledgeComment:
+	default:
+		return fmt.Errorf("acknowledge must be %s or %s, not %q", acknowledgeReaction, acknowledgeComment, c.Acknowledge)
+	}
+	if c.EscalateAfter < 0 {
+		return fmt.Errorf("escalate_after must not be negative, not %d", c.EscalateAfter)
+	}
+	if c.AlertThreshold < 0 {
+		return fmt.Errorf("alert_threshold must not be negative, not %d", c.AlertThreshold)
+	}
+	if c.EscalateAfter != 0 && c.AlertThreshold != 0 && c.EscalateAfter != c.AlertThreshold {
+		return fmt.Errorf("alert_threshold is another name for escalate_after, so they cannot be %d and %d", c.AlertThreshold, c.EscalateAfter)
+	}
+	if c.EscalateWindow < 0 {
+		return fmt.Errorf("escalate_window must not be negative, not %v", c.EscalateWindow)
+	}
+	if c.CooldownPeriod < 0 {
+		return fmt.Errorf("cooldown_period must not be negative, not %v", c.CooldownPeriod)
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch_size must not be negative, not %d", c.BatchSize)
+	}
+	if err := validateWorkdir(c.TargetsWorkdir); err != nil {
+		return fmt.Errorf("invalid targets_workdir: %v", err)
+	}
+	for i, matcher := range c.Matchers {
+		switch {
+		case matcher.Target == "" && matcher.TargetRepo == "" && matcher.ProwJob == "" && matcher.ArgoCDSync == nil && matcher.HelmBinary == "":
+			return fmt.Errorf("matcher %d sets none of target, target_repo, prowjob, argocd_sync and helm_binary", i)
+		case matcher.Target != "" && matcher.TargetRepo != "":
+			return fmt.Errorf("matcher %d for target %q sets both target and target_repo", i, matcher.Target)
+		case matcher.ProwJob != "" && (matcher.Target != "" || matcher.TargetRepo != ""):
+			return fmt.Errorf("matcher %d for prowjob %q also sets target or target_repo", i, matcher.ProwJob)
+		case matcher.ArgoCDSync != nil && (matcher.Target != "" || matcher.TargetRepo != "" || matcher.ProwJob != ""):
+			return fmt.Errorf("matcher %d for argocd_sync %q also sets target, target_repo or prowjob", i, matcher.ArgoCDSync.Application)
+		case matcher.HelmBinary != "" && (matcher.Target != "" || matcher.TargetRepo != "" || matcher.ProwJob != "" || matcher.ArgoCDSync != nil):
+			return fmt.Errorf("matcher %d for helm_binary %q also sets target, target_repo, prowjob or argocd_sync", i, matcher.HelmBinary)
+		case matcher.Glob != "" && strings.Contains(matcher.Target, "$"):
+			return fmt.Errorf("matcher %d for target %q refers to capture groups, which a glob does not have", i, matcher.Target)
+		}
+		if err := matcher.Verify.validate(); err != nil {
+			return fmt.Errorf("matcher %d for target %q has invalid verify: %v", i, matcher.Target, err)
+		}
+		if matcher.Rollback != nil && len(matcher.Rollback.Command) == 0 {
+			return fmt.Errorf("matcher %d for target %q has a rollback without a command", i, matcher.Target)
+		}
+	}
+	for kind, backend := range c.KindBackends {
+		switch backend {
+		case "", backendMake, backendNative:
+		default:
+			return fmt.Errorf("kind_backends for %s is %q, must be %s or %s", kind, backend, backendMake, backendNative)
+		}
+	}
+	if err := c.Diff.validate(); err != nil {
+		return fmt.Errorf("diff %v", err)
+	}
+	for kind, verification := range c.KindVerifications {
+		if err := verification.validate(); err != nil {
+			return fmt.Errorf("kind_verifications for %s: %v", kind, err)
+		}
+	}
+	for target, rollback := range c.TargetRollbacks {
+		if len(rollback.Command) == 0 {
+			return fmt.Errorf("target_rollbacks for %s has no command", target)
+		}
+	}
+	for i, matcher := range c.Matchers {
+		if err := validateWorkdir(matcher.Workdir); err != nil {
+			return fmt.Errorf("matcher %d for target %q has invalid workdir: %v", i, matcher.Target, err)
+		}
+	}
+	for i, matcher := range c.Matchers {
+		switch matcher.MissingPatch {
+		case "", missingPatchMatch, missingPatchSkip:
+		default:
+			return fmt.Errorf("matcher %d for target %q has missing_patch %q, must be %s or %s", i, matcher.Target, matcher.MissingPatch, missingPatchMatch, missingPatchSkip)
+		}
+		switch matcher.OutputMode {
+		case "", outputModeSplit, outputModeCombined, outputModeNone:
+		default:
+			return fmt.Errorf("matcher %d for target %q has output_mode %q, must be %s, %s or %s", i, matcher.Target, matcher.OutputMode, outputModeSplit, outputModeCombined, outputModeNone)
+		}
+		if matcher.BatchSeparator != "" && !matcher.BatchTargets {
+			return fmt.Errorf("matcher %d for target %q sets batch_separator without batch_targets", i, matcher.Target)
+		}
+		if matcher.BatchTargets && matcher.Target == "" {
+			return fmt.Errorf("matcher %d sets batch_targets without a target", i)
+		}
+		if matcher.Deployment && matcher.TargetRepo != "" {
+			return fmt.Errorf("matcher %d sets deployment with target_repo, which opens a PR rather than deploying", i)
+		}
+		if matcher.HelmReleaseName != "" && matcher.HelmBinary == "" {
+			return fmt.Errorf("matcher %d sets helm_release_name without helm_binary", i)
+		}
+		if err := validateNotify(matcher.NotifyUsers, matcher.NotifyTeams); err != nil {
+			return fmt.Errorf("matcher %d %v", i, err)
+		}
+		if matcher.ArgoCDSync != nil {
+			if err := matcher.ArgoCDSync.validate(); err != nil {
+				return fmt.Errorf("matcher %d has invalid argocd_sync: %v", i, err)
+			}
+		}
+		if matcher.JenkinsReload != nil {
+			if err := matcher.JenkinsReload.validate(); err != nil {
+				return fmt.Errorf("matcher %d for target %q has invalid jenkins_reload: %v", i, matcher.Target, err)
+			}
+		}
+	}
+	selected := map[string][]string{"targets_clusters": c.TargetsClusters}
+	for i, matcher := range c.Matchers {
+		selected[fmt.Sprintf("matcher %d for target %q", i, matcher.Target)] = matcher.Clusters
+	}
+	if err := validateClusters(c.Clusters, selected); err != nil {
+		return err
+	}
+	if c.PromotionExpiry < 0 {
+		return fmt.Errorf("promotion_expiry must not be negative, got %v", c.PromotionExpiry)
+	}
+	if err := validateStatuses(c.TargetsStatuses); err != nil {
+		return fmt.Errorf("invalid targets_statuses: %v", err)
+	}
+	for i, matcher := range c.Matchers {
+		if err := validateStatuses(matcher.Statuses); err != nil {
+			return fmt.Errorf("matcher %d for target %q has invalid statuses: %v", i, matcher.Target, err)
+		}
+	}
+	names := sets.NewString()
+	for i, matcher := range c.Matchers {
+		if matcher.Name == "" {
+			continue
+		}
+		if names.Has(matcher.Name) {
+			return fmt.Errorf("matcher %d for target %q reuses the name %q", i, matcher.Target, matcher.Name)
+		}
+		names.Insert(matcher.Name)
+	}
+	for i, matcher := range c.Matchers {
+		for _, after := range matcher.After {
+			if after == matcher.Name {
+				return fmt.Errorf("matcher %d for target %q runs after itself", i, matcher.Target)
+			}
+			if !names.Has(after) {
+				return fmt.Errorf("matcher %d for target %q runs after unknown matcher %q", i, matcher.Target, after)
+			}
+		}
+	}
+	for i, exclude := range c.Excludes {
+		if exclude.Glob == "" {
+			continue
+		}
+		if exclude.Regex.String() != "" {
+			return fmt.Errorf("exclude %d sets both regex and glob", i)
+		}
+		if _, err := filepath.Match(exclude.Glob, ""); err != nil {
+			return fmt.Errorf("exclude %d has invalid glob %q: %v", i, exclude.Glob, err)
+		}
+	}
+	for i, matcher := range c.Matchers {
+		if matcher.Glob == "" {
+			continue
+		}
+		if matcher.Regex.String() != "" {
+			return fmt.Errorf("matcher %d for target %q sets both regex and glob", i, matcher.Target)
+		}
+		if _, err := filepath.Match(matcher.Glob, ""); err != nil {
+			return fmt.Errorf("matcher %d for target %q has invalid glob %q: %v", i, matcher.Target, matcher.Glob, err)
+		}
+	}
+	if err := c.ManifestValidation.validate(); err != nil {
+		return fmt.Errorf("invalid manifest_validation: %v", err)
+	}
+	if err := c.JJBValidation.validate(); err != nil {
+		return fmt.Errorf("jjb_validation %v", err)
+	}
+	if err := c.TrackingIssues.validate(); err != nil {
+		return fmt.Errorf("invalid tracking_issues: %v", err)
+	}
+	if err := c.OutcomeLabels.validate(); err != nil {
+		return fmt.Errorf("invalid outcome_labels: %v", err)
+	}
+	if err := validateNotify(c.NotifyUsers, c.NotifyTeams); err != nil {
+		return err
+	}
+	for _, recipient := range c.EmailRecipients {
+		if _, err := mail.ParseAddress(recipient); err != nil {
+			return fmt.Errorf("invalid email_recipients %q: %v", recipient, err)
+		}
+	}
+	if err := validateExecutables(c); err != nil {
+		return err
+	}
+	return c.validateSections()
 }
 
 // Load loads and parses the config at path.
@@ -61,211 +780,1958 @@ func Load(path string) (*UpdateConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading %s: %v", path, err)
 	}
-	nc := &UpdateConfig{}
-	if err := yaml.Unmarshal(b, nc); err != nil {
-		return nil, fmt.Errorf("error unmarshaling %s: %v", path, err)
+	nc := &UpdateConfig{}
+	if err := yaml.Unmarshal(b, nc); err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s: %v", path, err)
+	}
+	if nc.MaxPRFiles == 0 {
+		nc.MaxPRFiles = defaultMaxPRFiles
+	}
+	if err := nc.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	return nc, nil
+}
+
+// task is a command to run for a PR, along with the config file it applies
+// if it came from a target.
+type task struct {
+	command []string
+	target  string
+	config  string
+	// files are the changed files that caused the task to run.
+	files []string
+	// env holds extra KEY=value pairs to set for the command.
+	env []string
+	// names are the names of the matchers the task is for, and after the
+	// names of the matchers whose tasks must run before it.
+	names []string
+	after []string
+	// continueOnError exempts the task from the FailFast policy.
+	continueOnError bool
+	// folded is set when identical tasks were merged into this one.
+	folded bool
+	// batch names the batch of configs in files the task applies, if it
+	// applies more than one.
+	batch string
+	// rollback is run if the task fails.
+	rollback *Rollback
+	// verify is run after the task succeeds, with verifyCommand.
+	verify        *Verification
+	verifyCommand []string
+	// diff is run before the task.
+	diff *Diff
+	// clusters are the clusters the task is applied to, each with a task of
+	// its own, which is for cluster.
+	clusters []string
+	cluster  string
+	// environment is the environment the task applies to.
+	environment string
+	// reload is the Jenkins controller to reload once every task with it
+	// succeeded.
+	reload *JenkinsReload
+	// prowJob is the postsubmit the task is run as, if it is run as a
+	// ProwJob.
+	prowJob string
+	// argoCD is the ArgoCD application the task syncs, if it syncs one.
+	argoCD *ArgoCDSync
+	// native is set when the configs of the task are applied natively,
+	// rather than by running its command.
+	native bool
+	// stdin is written to the standard input of the command.
+	stdin string
+	// outputMode is how the output of the command is captured.
+	outputMode string
+	// image is the container image to run the task in, if any.
+	image string
+	// workdir is the directory to run the task in, relative to the root of
+	// the checkout.
+	workdir string
+	// limits bound the resources of the task when it runs locally.
+	limits *Limits
+	// kustomize is set on tasks running the binary that applies
+	// kustomizations, which may run without being in AllowedExecutables
+	// unless the config lists some.
+	kustomize bool
+	// helm is set on tasks running the HelmBinary of their matcher, which
+	// may likewise run without being in AllowedExecutables.
+	helm bool
+	// deployment is set when the task is recorded as a deployment.
+	deployment bool
+	// notify are the users and org/team slugs to mention if it fails.
+	notify []string
+}
+
+// configs lists the configs in Targets the task applies.
+func (t task) configs() []string {
+	if t.batch != "" {
+		return t.files
+	}
+	if t.config != "" {
+		return []string{t.config}
+	}
+	return nil
+}
+
+// usesImages determines whether any task is configured to run in a
+// container.
+func (c *UpdateConfig) usesImages() bool {
+	for _, matcher := range c.Matchers {
+		if matcher.Image != "" {
+			return true
+		}
+	}
+	for _, sections := range []map[string]UpdateConfig{c.Orgs, c.Repos} {
+		for _, section := range sections {
+			if section.usesImages() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key identifies tasks that would do exactly the same thing.
+func (t task) key() string {
+	return t.image + "\x00\x00" + t.workdir + "\x00\x00" + strings.Join(t.command, "\x00") + "\x00\x00" + strings.Join(t.env, "\x00") + "\x00\x00" + t.stdin + "\x00\x00" + t.environment
+}
+
+// dedupeTasks drops tasks identical to an earlier one, folding the files
+// that caused them into the task that is kept.
+func dedupeTasks(tasks []task) []task {
+	var deduped []task
+	seen := map[string]int{}
+	for _, t := range tasks {
+		i, ok := seen[t.key()]
+		if !ok {
+			seen[t.key()] = len(deduped)
+			deduped = append(deduped, t)
+			continue
+		}
+		deduped[i].folded = true
+		deduped[i].files = union(deduped[i].files, t.files)
+		deduped[i].names = union(deduped[i].names, t.names)
+		deduped[i].after = union(deduped[i].after, t.after)
+		deduped[i].deployment = deduped[i].deployment || t.deployment
+		deduped[i].notify = union(deduped[i].notify, t.notify)
+	}
+	return deduped
+}
+
+// union appends the values in b that are not in a to a.
+func union(a, b []string) []string {
+	values := sets.NewString(a...)
+	for _, value := range b {
+		if !values.Has(value) {
+			values.Insert(value)
+			a = append(a, value)
+		}
+	}
+	return a
+}
+
+type result struct {
+	command []string
+	// image is the container image the command ran in, if any.
+	image string
+	// workdir is the directory the command ran in, relative to the root of
+	// the checkout.
+	workdir string
+	// cluster is the cluster the command was applied to, if any.
+	cluster string
+	// diff is the result of diffing the cluster before the task ran, if it
+	// was diffed.
+	diff *result
+	// verification is the result of the last attempt to verify the task,
+	// if it was verified.
+	verification *result
+	// objects are the results of applying each object, if they were
+	// applied natively.
+	objects []objectResult
+	// url links to the ProwJob the task ran as, if it did.
+	url string
+	// attempts is the number of times the command was run.
+	attempts int
+	// files are listed in the comment if several tasks were folded into
+	// this one.
+	files []string
+	// batch names the batch of configs in files the command applied.
+	batch string
+	// duration is how long the task took to run.
+	duration time.Duration
+	stdout   string
+	stderr   string
+	// outputMode is how the output was captured. When it is combined, all
+	// of it is in stdout.
+	outputMode string
+	exitCode   int
+	err        error
+	// forced is set when the task ran for a PR that is not merged, with
+	// --force-pr.
+	forced bool
+	// notify are who to mention if the task failed.
+	notify []string
+}
+
+// failed determines whether the command, or its verification, failed.
+func (r *result) failed() bool {
+	return r.err != nil || (r.verification != nil && r.verification.failed())
+}
+
+// exitCoder is implemented by errors from commands that ran to completion,
+// such as *exec.ExitError.
+type exitCoder interface {
+	ExitCode() int
+}
+
+// exitCode returns the exit code of a command that returned err, or -1 if
+// the command did not run to completion.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(exitCoder); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// Server implements http.Handler. It validates incoming GitHub webhooks and
+// then dispatches them to the appropriate plugins.
+type Server struct {
+	// inflight counts the events being handled. It is accessed atomically
+	// and so must stay first in the struct to be 64-bit aligned.
+	inflight int64
+	// unsuccessful counts the runs whose results were not a success, for
+	// the exit status of the modes that run once. It is accessed atomically.
+	unsuccessful int32
+
+	hmacSecret func() []byte
+
+	gc  gitClient
+	ghc githubClient
+	log *logrus.Entry
+
+	configAgent *Agent
+	executor    Executor
+
+	// gitRetryDeadline bounds how long we keep retrying a failed clone or
+	// checkout before giving up on the event.
+	gitRetryDeadline time.Duration
+	gitRetryBackoff  time.Duration
+
+	// JenkinsURL, when set, is the Jenkins controller on which to build the
+	// job named by every config that is applied successfully. JenkinsToken
+	// is called for every build, so that a rotated token is picked up.
+	JenkinsURL   string
+	JenkinsToken func() []byte
+
+	// MakeBinary, when set, overrides the make binary in the config.
+	MakeBinary string
+
+	// ContainerRuntime is the docker compatible binary used to run tasks
+	// that have an image.
+	ContainerRuntime string
+
+	// CommentTemplate, when set, is the text/template used to render
+	// comments instead of the default format. See commentData.
+	CommentTemplate string
+
+	// lifetimeCtx is cancelled by Shutdown.
+	lifetimeCtx    context.Context
+	cancelLifetime context.CancelFunc
+	initLifetime   sync.Once
+
+	// TracerProvider traces the events, with a span for the webhook, the
+	// event, each task and each GitHub call. None are when it is unset.
+	TracerProvider trace.TracerProvider
+
+	// MaxRequestBodyBytes bounds the size of a webhook payload, so that a
+	// huge one cannot exhaust our memory. Zero means unlimited.
+	MaxRequestBodyBytes int64
+
+	// RequireSHA256Signature refuses webhooks without an HMAC-SHA256
+	// signature in X-Hub-Signature-256, rather than accepting the SHA-1 one
+	// older installations send.
+	RequireSHA256Signature bool
+
+	// MaxCacheEntries bounds how many PRs the changes are cached for, the
+	// least recently used being evicted first. Zero disables the cache.
+	MaxCacheEntries int
+	changesCache    *cache.LRUExpireCache
+	initCache       sync.Once
+
+	// MaxConcurrentClones bounds how many PRs may be cloned at once, so that
+	// a burst of events cannot exhaust the disk or file descriptors. A clone
+	// is counted until it is cleaned up. Zero means unlimited.
+	MaxConcurrentClones int
+	// CloneWaitTimeout bounds each attempt at waiting for another clone to
+	// finish. Attempts that time out are retried like failed clones.
+	CloneWaitTimeout time.Duration
+	clones           chan struct{}
+	initClones       sync.Once
+
+	// StatusEntries is how many of the most recent task results are kept
+	// for /status.
+	StatusEntries int
+	status        *statusBuffer
+	initStatus    sync.Once
+
+	// UseChecksAPI reports the progress and results of the updates for a
+	// PR in a check run on its merge commit, as well as in a comment. This
+	// requires authenticating as a GitHub App.
+	UseChecksAPI bool
+
+	// StatsDAddr, when set, is the host:port of a StatsD server to send
+	// the duration and outcome of every task to over UDP.
+	StatsDAddr string
+	statsd     *statsdSender
+	initStatsD sync.Once
+
+	// Report, when set, is where the result of every task is written once
+	// the comment with the results is posted.
+	Report *Report
+
+	// DeadLetters, when set, keeps the events that failed, so that they
+	// can be replayed.
+	DeadLetters DeadLetterQueue
+
+	// jenkins reloads Jenkins controllers for Matcher.JenkinsReload. It is
+	// the HTTP API unless set.
+	jenkins jenkinsReloader
+
+	// cluster, when set, is where objects of the kinds in KindBackends
+	// are applied natively.
+	cluster cluster
+
+	// ProwJobs, when set, runs the tasks of matchers with a ProwJob.
+	ProwJobs *ProwJobRunner
+
+	// argoCDSyncer syncs applications for Matcher.ArgoCDSync. It is the
+	// HTTP API unless set.
+	argoCDSyncer argoCDSyncer
+
+	// Promotions keeps the updates held until they are promoted. They are
+	// kept in memory if it is not set.
+	Promotions     *PromotionStore
+	initPromotions sync.Once
+
+	// MinimizeOldComments hides the comments we posted earlier on a PR as
+	// outdated once we post a new one, so that only the latest results
+	// stand out.
+	MinimizeOldComments bool
+
+	// Notifiers tell the SlackChannel or EmailRecipients of the repo when
+	// updates fail. The same PR is notified at most once per
+	// NotifyInterval.
+	Notifiers      []Notifier
+	NotifyInterval time.Duration
+	notified       map[string]time.Time
+	notifiedLock   sync.Mutex
+
+	// Pager, when set, pages when a target fails EscalateAfter times in a
+	// row, counting in Escalations, as are the failures counted towards
+	// TrackingIssues. They are counted in memory if it is not set.
+	Pager           Pager
+	Escalations     *EscalationStore
+	initEscalations sync.Once
+
+	// ranAt is when the updates for each PR last ran, for
+	// UpdateConfig.CooldownPeriod.
+	ranAt     map[string]time.Time
+	ranAtLock sync.Mutex
+
+	// APITimeouts bound the GitHub API calls named by the methods of
+	// githubClient, such as CreateComment. Calls missing from it time out
+	// after defaultAPITimeout.
+	APITimeouts map[string]time.Duration
+}
+
+// commentData is passed to CommentTemplate.
+type commentData struct {
+	// Results is the rendered body of the comment.
+	Results string
+	PR      github.PullRequest
+	Org     string
+}
+
+func parseCommentTemplate(text string) (*template.Template, error) {
+	return template.New("comment").Parse(text)
+}
+
+// NewServer returns new server
+func NewServer(hmac func() []byte, gc *git.Client, ghc *github.Client, configAgent *Agent, gitRetryDeadline time.Duration) *Server {
+	return &Server{
+		hmacSecret: hmac,
+
+		gc:  &clientWrapper{gc},
+		ghc: ghc,
+		log: logrus.StandardLogger().WithField("plugin", pluginName),
+
+		configAgent: configAgent,
+		executor:    &execExecutor{},
+
+		gitRetryDeadline: gitRetryDeadline,
+		gitRetryBackoff:  defaultGitRetryBackoff,
+
+		ContainerRuntime:    defaultContainerRuntime,
+		MaxRequestBodyBytes: defaultMaxRequestBodyBytes,
+		MaxCacheEntries:     defaultMaxCacheEntries,
+		StatusEntries:       defaultStatusEntries,
+		CloneWaitTimeout:    defaultCloneWaitTimeout,
+		NotifyInterval:      defaultNotifyInterval,
+	}
+}
+
+// ServeHTTP validates an incoming webhook and puts it into the event channel.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	validatorWriter := w
+	var body *limitedBody
+	if s.MaxRequestBodyBytes > 0 {
+		body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, s.MaxRequestBodyBytes), limit: s.MaxRequestBodyBytes}
+		r.Body = body
+		validatorWriter = &bodyLimitWriter{ResponseWriter: w, body: body}
+	}
+	// ValidateWebhook validates X-Hub-Signature-256 whenever it is set, so
+	// this is the algorithm of the signature it validates.
+	if s.RequireSHA256Signature && r.Method == http.MethodPost && !strings.HasPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=") {
+		s.log.WithField("remote-addr", r.RemoteAddr).Error("Refused payload without a SHA-256 signature.")
+		http.Error(w, "403 Forbidden: Missing X-Hub-Signature-256", http.StatusForbidden)
+		return
+	}
+	eventType, eventGUID, payload, ok, _ := github.ValidateWebhook(validatorWriter, r, s.hmacSecret())
+	if body != nil && body.exceeded {
+		s.log.WithFields(logrus.Fields{"remote-addr": r.RemoteAddr, "limit": s.MaxRequestBodyBytes}).Error("Refused payload larger than the limit.")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, `{"error": "request body is larger than the limit of %d bytes"}`, s.MaxRequestBodyBytes)
+		return
+	}
+	if !ok {
+		s.log.Error("Failed to validate payload")
+		return
+	}
+	fmt.Fprint(w, "Event received. Have a nice day.")
+	// GitHub gives up on a delivery after 10 seconds, so it is acknowledged
+	// before the event is handled.
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	// The event is handled within the request, so that the server waits for
+	// it when shutting down. Cancelling the request, or shutting down once the
+	// grace period is over, stops handling it.
+	handleCtx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.lifetime().Done():
+			cancel()
+		case <-handleCtx.Done():
+		}
+	}()
+	spanCtx, span := s.startRemoteSpan(handleCtx, "config-updater/webhook", r)
+	span.SetAttributes(attribute.String("event-type", eventType), attribute.String("event-guid", eventGUID))
+	err := s.handleEvent(spanCtx, eventType, eventGUID, payload)
+	if err != nil {
+		logrus.WithError(err).Error("Error handling event.")
+	}
+	endSpan(span, err)
+}
+
+// lifetime is cancelled by Shutdown, stopping the events being handled.
+func (s *Server) lifetime() context.Context {
+	s.initLifetime.Do(func() {
+		s.lifetimeCtx, s.cancelLifetime = context.WithCancel(context.Background())
+	})
+	return s.lifetimeCtx
+}
+
+// Shutdown stops handling the events in progress, skipping their remaining
+// tasks. It is called once they were given the time to finish.
+func (s *Server) Shutdown() {
+	s.lifetime()
+	s.cancelLifetime()
+}
+
+// limitedBody notes whether reading a request body failed because it was
+// cut off by http.MaxBytesReader, which must be the ReadCloser it wraps.
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// bodyLimitWriter drops the response the validator writes when it fails to
+// read a body that was too large, so that we can respond in its place.
+type bodyLimitWriter struct {
+	http.ResponseWriter
+	body *limitedBody
+}
+
+func (w *bodyLimitWriter) WriteHeader(statusCode int) {
+	if !w.body.exceeded {
+		w.ResponseWriter.WriteHeader(statusCode)
+	}
+}
+
+func (w *bodyLimitWriter) Write(b []byte) (int, error) {
+	if w.body.exceeded {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// getPullRequestChanges lists the changes of a PR, which are cached for a
+// while if MaxCacheEntries is set.
+func (s *Server) getPullRequestChanges(ctx context.Context, org, repo string, num int) ([]github.PullRequestChange, error) {
+	if s.MaxCacheEntries <= 0 {
+		return s.github(ctx).GetPullRequestChanges(org, repo, num)
+	}
+	s.initCache.Do(func() {
+		if s.changesCache == nil {
+			s.changesCache = cache.NewLRUExpireCache(s.MaxCacheEntries)
+		}
+	})
+	key := fmt.Sprintf("%s/%s#%d", org, repo, num)
+	if cached, ok := s.changesCache.Get(key); ok {
+		s.log.WithField("key", key).Debug("Using cached pull request changes.")
+		return append([]github.PullRequestChange{}, cached.([]github.PullRequestChange)...), nil
+	}
+	changes, err := s.github(ctx).GetPullRequestChanges(org, repo, num)
+	if err != nil {
+		return nil, err
+	}
+	s.changesCache.Add(key, append([]github.PullRequestChange{}, changes...), changesCacheTTL)
+	return changes, nil
+}
+
+// ServeHealth reports how many events are being handled.
+func (s *Server) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"inflight": %d}`, atomic.LoadInt64(&s.inflight))
+}
+
+// handleEvent runs the updates for a merged PR. Cancelling ctx stops the
+// git operations and tasks in progress, and skips the remaining tasks.
+func (s *Server) handleEvent(ctx context.Context, eventType, eventGUID string, payload []byte) (err error) {
+	atomic.AddInt64(&s.inflight, 1)
+	inflightRequests.Inc()
+	defer func() {
+		atomic.AddInt64(&s.inflight, -1)
+		inflightRequests.Dec()
+	}()
+	ctx, span := s.startSpan(ctx, "config-updater/event", trace.WithSpanKind(trace.SpanKindServer))
+	span.SetAttributes(attribute.String("event-type", eventType), attribute.String("event-guid", eventGUID))
+	defer func() { endSpan(span, err) }()
+	// Anything that fails here has already been retried as far as it can
+	// be, so the event is kept to be replayed rather than lost. Unless a
+	// call that changes something on GitHub timed out, as it may still take
+	// effect, and replaying the event would make it twice.
+	ctx, mutationTimedOut := trackMutationTimeouts(ctx)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if mutationTimedOut() {
+			s.log.WithError(err).WithField("eventGUID", eventGUID).Error("Not keeping the failed event to be replayed, as a GitHub call that may still take effect timed out.")
+			return
+		}
+		s.deadLetter(eventType, eventGUID, payload, err)
+	}()
+
+	s.log.WithField("eventType", eventType).WithField("eventGUID", eventGUID).Info("Received webhook")
+	if eventType == "issue_comment" {
+		return s.handleComment(ctx, eventGUID, payload)
+	}
+	if eventType != "pull_request" {
+		s.log.Debugf("received an event of type %q but didn't ask for it", eventType)
+		return nil
+	}
+
+	var pre github.PullRequestEvent
+	if err := json.Unmarshal(payload, &pre); err != nil {
+		return err
+	}
+	s.log = s.log.WithFields(map[string]interface{}{
+		"org":    pre.Repo.Owner.Login,
+		"repo":   pre.Repo.Name,
+		"pr":     pre.Number,
+		"author": pre.PullRequest.User.Login,
+		"url":    pre.PullRequest.HTMLURL,
+	})
+
+	if pre.Action != github.PullRequestActionClosed {
+		return nil
+	}
+
+	if !pre.PullRequest.Merged || pre.PullRequest.MergeSHA == nil {
+		return nil
+	}
+	return s.update(ctx, eventGUID, pre, nil, false)
+}
+
+// update runs the updates for the merged PR of pre and posts the results.
+// Updates for PromotedEnvironments are held, unless promoting, when only
+// those for the environment being promoted are run. forced is set when the
+// PR is not merged, but was run with --force-pr.
+func (s *Server) update(ctx context.Context, eventGUID string, pre github.PullRequestEvent, promoting *promotionRequest, forced bool) error {
+	pr := pre.PullRequest
+	org := pr.Base.Repo.Owner.Login
+	repo := pr.Base.Repo.Name
+	num := pr.Number
+	run := newRunInfo(eventGUID)
+
+	// Every span of the update says which PR it is for.
+	prAttributes := []attribute.KeyValue{attribute.String("org", org), attribute.String("repo", repo), attribute.Int("pr", num)}
+	trace.SpanFromContext(ctx).SetAttributes(prAttributes...)
+	ctx = withTraceAttributes(ctx, prAttributes...)
+
+	updateConfig, ok := s.configAgent.Config().ForRepo(org, repo)
+	if !ok {
+		s.log.Debug("No config for the repo, skipping.")
+		return nil
+	}
+	// Promotions and forced runs are asked for, so they are not redundant.
+	if promoting == nil && !forced && s.coolingDown(fmt.Sprintf("%s/%s#%d", org, repo, num), updateConfig.CooldownPeriod) {
+		s.log.WithFields(logrus.Fields{"eventGUID": eventGUID, "cooldown": updateConfig.CooldownPeriod}).Info("The updates for the PR ran within the cooldown period, skipping.")
+		return nil
+	}
+
+	changes, err := s.getPullRequestChanges(ctx, org, repo, num)
+	if err != nil {
+		return fmt.Errorf("error getting pull request changes: %v", err)
+	}
+
+	// The API truncates the list of changes for very large PRs, so trust
+	// the count on the PR itself when it is higher.
+	changedFiles := len(changes)
+	if pr.ChangedFiles > changedFiles {
+		changedFiles = pr.ChangedFiles
+	}
+
+	if changedFiles > updateConfig.MaxPRFiles {
+		s.log.WithField("files", changedFiles).Info("Too many files changed, skipping updates.")
+		message := fmt.Sprintf(
+			"This PR changes %d files, which is more than the limit of %d, so no updates were run. Please apply the changes manually.",
+			changedFiles, updateConfig.MaxPRFiles,
+		)
+		return s.comment(ctx, pre, run, message, message)
+	}
+
+	startClone := time.Now()
+	release, err := s.acquireClone(ctx)
+	if err != nil {
+		return s.reportInternalError(ctx, pre, run, fmt.Errorf("error waiting for other clones to finish: %v", err))
+	}
+	defer release()
+	s.log.Info("cloning " + org + "/" + repo)
+	var r gitRepo
+	if err := s.retry(ctx, "clone", func() error {
+		var err error
+		r, err = s.gc.Clone(ctx, org+"/"+repo)
+		return err
+	}); err != nil {
+		err = fmt.Errorf("error cloning: %v", err)
+		return s.reportInternalError(ctx, pre, run, err)
+	}
+	defer func() {
+		if err := r.Clean(); err != nil {
+			s.log.WithError(err).Error("Error cleaning up repo.")
+		}
+	}()
+
+	s.log.Info("checking out " + pr.Head.SHA)
+	attempted := false
+	if err := s.retry(ctx, "checkout", func() error {
+		// The SHA may not have been fetchable yet when we cloned, so ask
+		// for it explicitly before trying again.
+		if attempted {
+			if err := r.Fetch(ctx, pr.Head.SHA); err != nil {
+				s.log.WithError(err).Warn("Error fetching commit.")
+			}
+		}
+		attempted = true
+		return r.Checkout(ctx, pr.Head.SHA)
+	}); err != nil {
+		err = fmt.Errorf("error checking out %s: %v", pr.Head.SHA, err)
+		return s.reportInternalError(ctx, pre, run, err)
+	}
+	s.log.WithField("duration", time.Since(startClone)).Info("Cloned and checked out target branch.")
+
+	inRepo, err := loadInRepoConfig(ctx, r, *pr.MergeSHA)
+	if err == nil && inRepo != nil {
+		updateConfig, err = updateConfig.withInRepo(inRepo)
+	}
+	if err != nil {
+		// Running only the updates of the server config would silently drop
+		// those the repo asked for, so run none.
+		s.log.WithError(err).Warn("Invalid in-repo config.")
+		return s.reportInternalError(ctx, pre, run, fmt.Errorf("not running any updates, as the in-repo config is invalid: %v", err))
+	}
+
+	results := results{run: run, promotion: promoting, forced: forced}
+	for _, cluster := range updateConfig.Clusters {
+		results.clusters = append(results.clusters, cluster.Name)
+	}
+	tasks := []task{}
+
+	// The API only truncates the list past githubMaxListedFiles, so PRs are
+	// only diffed locally when MaxPRFiles is set higher than that; with a
+	// lower limit they were refused above. The merge commit is diffed with
+	// its first parent, the base branch it was merged into, as the base SHA
+	// of the event may be older and diffing with it would take in the
+	// changes of PRs merged since.
+	if changedFiles > len(changes) {
+		s.log.WithFields(logrus.Fields{"api": len(changes), "total": changedFiles}).Info("Change list was truncated, diffing locally.")
+		if diffChanges, err := r.Changes(*pr.MergeSHA+"^1", *pr.MergeSHA); err != nil {
+			results.internal = append(results.internal, fmt.Errorf("error listing all %d changed files, only the first %d were considered: %v", changedFiles, len(changes), err))
+		} else {
+			changes = diffChanges
+		}
+	}
+
+	changes = splitRenames(changes)
+
+	// Every path below is handed to make or a command, so none of them may
+	// point outside of the checkout.
+	var contained []github.PullRequestChange
+	for _, change := range changes {
+		if _, err := checkoutPath(r.Directory(), change.Filename); err != nil {
+			if _, escaped := err.(*pathEscapeError); escaped {
+				s.log.WithField("filename", change.Filename).Error("Changed file resolves to outside of the checkout, refusing to handle it.")
+				pathEscapes.WithLabelValues(org, repo).Inc()
+			}
+			results.internal = append(results.internal, err)
+			continue
+		}
+		contained = append(contained, change)
+	}
+	changes = contained
+
+	var included []github.PullRequestChange
+	for _, change := range changes {
+		if excluded(updateConfig.Excludes, change.Filename) {
+			s.log.WithField("filename", change.Filename).Debug("Ignoring excluded file.")
+			excludedFiles.WithLabelValues(org, repo).Inc()
+			continue
+		}
+		included = append(included, change)
+	}
+	changes = included
+
+	makeBinary := s.makeBinary(updateConfig)
+	// Kustomizations are applied for changes to anything they are built from,
+	// and charts for changes to any file in them, including other configs in
+	// Targets, which are not applied on their own.
+	rolledUp := sets.NewString()
+	for _, target := range updateConfig.Targets {
+		if !isKustomization(r.Directory(), target) {
+			continue
+		}
+		t, warning, err := updateConfig.kustomizeTask(makeBinary, r.Directory(), target, changes)
+		if err != nil {
+			results.internal = append(results.internal, err)
+			continue
+		}
+		if warning != "" {
+			results.warnings = append(results.warnings, warning)
+		}
+		if t != nil {
+			rolledUp.Insert(t.files...)
+			tasks = append(tasks, *t)
+		}
+	}
+	charts := sets.NewString()
+	for _, target := range updateConfig.Targets {
+		chart := chartFor(r.Directory(), target)
+		if chart == "" || charts.Has(chart) {
+			continue
+		}
+		charts.Insert(chart)
+		t, err := updateConfig.helmTask(makeBinary, chart, target, changes)
+		if err != nil {
+			results.internal = append(results.internal, err)
+			continue
+		}
+		if t != nil {
+			rolledUp.Insert(t.files...)
+			tasks = append(tasks, *t)
+		}
+	}
+	for _, target := range updateConfig.Targets {
+		if rolledUp.Has(target) || isKustomization(r.Directory(), target) || chartFor(r.Directory(), target) != "" {
+			continue
+		}
+		for _, change := range changes {
+			if change.Filename == target && hasStatus(updateConfig.TargetsStatuses, change) {
+				commands, errs := determineTargetForConfig(makeBinary, updateConfig.kustomizeBinary(), r.Directory(), change.Filename)
+				results.internal = append(results.internal, errs...)
+				if len(commands) == 0 {
+					continue
+				}
+				what, env, warning, err := updateConfig.whatFor(r.Directory(), change.Filename)
+				if err != nil {
+					results.internal = append(results.internal, err)
+					continue
+				}
+				if warning != "" {
+					results.warnings = append(results.warnings, warning)
+				}
+				if validation := updateConfig.ManifestValidation; validation != nil {
+					warnings, err := validation.validateManifest(r.Directory(), change.Filename)
+					results.warnings = append(results.warnings, warnings...)
+					if err != nil {
+						// The config is not applied, but the others are.
+						for _, args := range commands {
+							results.failed = append(results.failed, result{command: append(args[:2], what...), workdir: updateConfig.TargetsWorkdir, exitCode: -1, err: err})
+						}
+						continue
+					}
+				}
+				var kind string
+				if len(updateConfig.KindVerifications) > 0 || len(updateConfig.KindEnv) > 0 || len(updateConfig.KindBackends) > 0 {
+					kind, _ = determineKindForConfig(r.Directory(), change.Filename)
+				}
+				if updateConfig.KindBackends[kind] == backendNative {
+					t := task{command: []string{"apply", change.Filename}, target: nativeApplyTarget, config: change.Filename, files: []string{change.Filename}, native: true}
+					if rollback, ok := updateConfig.TargetRollbacks[target]; ok {
+						t.rollback = &rollback
+					}
+					if verify, ok := updateConfig.KindVerifications[kind]; ok {
+						t.verify = &verify
+						t.verifyCommand = verify.command(makeBinary, what)
+					}
+					tasks = append(tasks, t)
+					continue
+				}
+				for _, args := range commands {
+					args = append(args[:2], what...)
+					t := task{command: args, target: args[1], config: change.Filename, files: []string{change.Filename}, env: env, workdir: updateConfig.TargetsWorkdir, limits: updateConfig.Limits}
+					if rollback, ok := updateConfig.TargetRollbacks[target]; ok {
+						t.rollback = &rollback
+					}
+					t.diff = updateConfig.Diff
+					if kind != "" {
+						if verify, ok := updateConfig.KindVerifications[kind]; ok {
+							t.verify = &verify
+							t.verifyCommand = verify.command(makeBinary, what)
+						}
+						t.env = append(t.env, environment(updateConfig.KindEnv[kind], func(value string) string { return value })...)
+					}
+					tasks = append(tasks, t)
+				}
+			}
+		}
+	}
+	for i := range tasks {
+		tasks[i].clusters = updateConfig.TargetsClusters
+		tasks[i].environment = updateConfig.TargetsEnvironment
+		tasks[i].notify = updateConfig.mentions(nil)
+	}
+	tasks = batchTasks(tasks, updateConfig.BatchSize)
+	matchers := append([]Matcher{}, updateConfig.Matchers...)
+	sort.SliceStable(matchers, func(i, j int) bool {
+		return matchers[i].Priority > matchers[j].Priority
+	})
+	claimed := sets.NewString()
+	var labels sets.String
+	prLabels := func() sets.String {
+		if labels != nil {
+			return labels
+		}
+		labels = sets.NewString()
+		for _, label := range pr.Labels {
+			labels.Insert(label.Name)
+		}
+		// The payload may not list the labels, so ask for them in case.
+		if labels.Len() == 0 {
+			fresh, err := s.github(ctx).GetPullRequest(org, repo, num)
+			if err != nil {
+				results.internal = append(results.internal, fmt.Errorf("error getting the labels of the PR: %v", err))
+				return labels
+			}
+			for _, label := range fresh.Labels {
+				labels.Insert(label.Name)
+			}
+		}
+		return labels
+	}
+	// Membership is checked once per org, however many matchers need it.
+	var restricted []restrictedUpdate
+	memberships := map[string]bool{}
+	isMember := func(requiredOrg string) (bool, error) {
+		if member, ok := memberships[requiredOrg]; ok {
+			return member, nil
+		}
+		member, err := s.github(ctx).IsMember(requiredOrg, pr.User.Login)
+		if err != nil {
+			return false, err
+		}
+		memberships[requiredOrg] = member
+		return member, nil
+	}
+	// Job definitions are only tested once, however many matchers apply them.
+	validatedJobs := map[string]*result{}
+	var syncRepos []string
+	syncFiles := map[string][]string{}
+	for _, matcher := range matchers {
+		var files []string
+		for _, change := range changes {
+			if !claimed.Has(change.Filename) && hasStatus(matcher.Statuses, change) && matcher.matches(change.Filename) && matcher.matchesPatch(change) && (matcher.Condition == nil || matcher.Condition.holds(r.Directory(), change.Filename)) {
+				files = append(files, change.Filename)
+			}
+		}
+		if matcher.StopOnMatch {
+			claimed.Insert(files...)
+		}
+		if len(files) > 0 && len(matcher.RequiredLabels) > 0 {
+			if missing := sets.NewString(matcher.RequiredLabels...).Difference(prLabels()); missing.Len() > 0 {
+				s.log.WithFields(logrus.Fields{"target": matcher.Target, "missing": missing.List()}).Info("Skipping update for missing labels.")
+				results.unlabeled = append(results.unlabeled, unlabeledUpdate{update: matcher.describe(makeBinary), missing: missing.List()})
+				continue
+			}
+		}
+		if len(files) > 0 && matcher.RequiredOrgMembership != "" {
+			member, err := isMember(matcher.RequiredOrgMembership)
+			if err != nil {
+				results.internal = append(results.internal, fmt.Errorf("not running %s, as the membership of %s in %s could not be checked: %v", matcher.describe(makeBinary), pr.User.Login, matcher.RequiredOrgMembership, err))
+				continue
+			}
+			if !member {
+				s.log.WithFields(logrus.Fields{"target": matcher.Target, "org": matcher.RequiredOrgMembership}).Info("Skipping update, as the author is not a member of the required org.")
+				restricted = append(restricted, restrictedUpdate{update: matcher.describe(makeBinary), org: matcher.RequiredOrgMembership})
+				continue
+			}
+		}
+		if len(files) > 0 && matcher.TargetRepo == "" && updateConfig.JJBValidation != nil {
+			var failed []result
+			files, failed = s.validateJobs(ctx, eventGUID, r.Directory(), updateConfig.JJBValidation, files, validatedJobs)
+			results.failed = append(results.failed, failed...)
+		}
+		if len(files) > 0 && matcher.TargetRepo != "" {
+			if _, ok := syncFiles[matcher.TargetRepo]; !ok {
+				syncRepos = append(syncRepos, matcher.TargetRepo)
+			}
+			syncFiles[matcher.TargetRepo] = append(syncFiles[matcher.TargetRepo], files...)
+		} else if len(files) > 0 && matcher.ProwJob != "" {
+			t := task{command: []string{prowJobCommand, matcher.ProwJob}, target: matcher.ProwJob, files: files, prowJob: matcher.ProwJob, continueOnError: matcher.ContinueOnError}
+			if matcher.Name != "" {
+				t.names = []string{matcher.Name}
+			}
+			t.after = matcher.After
+			t.environment = matcher.Environment
+			t.reload = matcher.JenkinsReload
+			t.deployment = matcher.Deployment
+			t.notify = updateConfig.mentions(&matcher)
+			tasks = append(tasks, t)
+		} else if len(files) > 0 && matcher.ArgoCDSync != nil {
+			t := task{command: []string{argoCDSyncCommand, matcher.ArgoCDSync.Application}, target: argoCDSyncCommand, files: files, argoCD: matcher.ArgoCDSync, continueOnError: matcher.ContinueOnError}
+			if matcher.Name != "" {
+				t.names = []string{matcher.Name}
+			}
+			t.after = matcher.After
+			t.environment = matcher.Environment
+			t.reload = matcher.JenkinsReload
+			t.deployment = matcher.Deployment
+			t.notify = updateConfig.mentions(&matcher)
+			tasks = append(tasks, t)
+		} else if len(files) > 0 && matcher.HelmBinary != "" {
+			helmTasks, skipped, err := matcher.helmUpgradeTasks(r.Directory(), files)
+			if err != nil {
+				results.internal = append(results.internal, err)
+			}
+			if len(skipped) > 0 {
+				results.warnings = append(results.warnings, fmt.Sprintf("%s are not the Chart.yaml or values files of a chart, so helm did not apply them.", strings.Join(skipped, ", ")))
+			}
+			for _, t := range helmTasks {
+				t.continueOnError = matcher.ContinueOnError
+				t.rollback = matcher.Rollback
+				t.limits = updateConfig.Limits
+				if matcher.Limits != nil {
+					t.limits = matcher.Limits
+				}
+				t.env = environment(matcher.Env, func(value string) string { return matcher.expand(t.files[0], value) })
+				if matcher.Name != "" {
+					t.names = []string{matcher.Name}
+				}
+				t.after = matcher.After
+				t.clusters = matcher.Clusters
+				t.environment = matcher.Environment
+				t.reload = matcher.JenkinsReload
+				t.deployment = matcher.Deployment
+				t.notify = updateConfig.mentions(&matcher)
+				tasks = append(tasks, t)
+			}
+		} else if len(files) > 0 {
+			// Files whose target or environment differs need a task each.
+			var groups []string
+			filesByGroup := map[string][]string{}
+			for _, file := range files {
+				target := matcher.expand(file, matcher.Target)
+				if target == "" {
+					results.internal = append(results.internal, fmt.Errorf("target %q expands to nothing for %s, so it was not updated", matcher.Target, file))
+					continue
+				}
+				env := strings.Join(environment(matcher.Env, func(value string) string { return matcher.expand(file, value) }), "\x00")
+				group := target + "\x00\x00" + env
+				if _, ok := filesByGroup[group]; !ok {
+					groups = append(groups, group)
+				}
+				filesByGroup[group] = append(filesByGroup[group], file)
+			}
+			for _, group := range groups {
+				parts := strings.SplitN(group, "\x00\x00", 2)
+				target, env := parts[0], parts[1]
+				t := task{command: []string{makeBinary, target}, target: target, files: filesByGroup[group], continueOnError: matcher.ContinueOnError, rollback: matcher.Rollback, stdin: matcher.Stdin, outputMode: matcher.OutputMode, image: matcher.Image, workdir: matcher.Workdir, limits: updateConfig.Limits}
+				if env != "" {
+					t.env = strings.Split(env, "\x00")
+				}
+				if matcher.Name != "" {
+					t.names = []string{matcher.Name}
+				}
+				t.after = matcher.After
+				t.clusters = matcher.Clusters
+				t.environment = matcher.Environment
+				t.reload = matcher.JenkinsReload
+				t.deployment = matcher.Deployment
+				t.notify = updateConfig.mentions(&matcher)
+				if matcher.Limits != nil {
+					t.limits = matcher.Limits
+				}
+				var what []string
+				if matcher.BatchTargets {
+					var unsafe string
+					if what, unsafe = matcher.batchWhat(filesByGroup[group]); unsafe != "" {
+						results.warnings = append(results.warnings, fmt.Sprintf("%q cannot be told apart from the other files in WHAT, so the files of target %s were only passed to make in CHANGED_FILES.", unsafe, target))
+					}
+					t.command = append(t.command, what...)
+				}
+				if matcher.Verify != nil {
+					t.verify = matcher.Verify
+					t.verifyCommand = matcher.Verify.command(makeBinary, what)
+				}
+				tasks = append(tasks, t)
+			}
+		}
+	}
+
+	tasks = dedupeTasks(fanOutClusters(tasks, updateConfig.Clusters))
+	var runnable []task
+	for _, t := range tasks {
+		if err := checkWorkdir(r.Directory(), t.workdir); err != nil {
+			if _, escaped := err.(*pathEscapeError); escaped {
+				s.log.WithField("workdir", t.workdir).Error("Workdir resolves to outside of the checkout, refusing to run in it.")
+				pathEscapes.WithLabelValues(org, repo).Inc()
+			}
+			results.internal = append(results.internal, fmt.Errorf("not running %q: %v", strings.Join(t.command, " "), err))
+			continue
+		}
+		runnable = append(runnable, t)
+	}
+	tasks = runnable
+	if ordered, err := orderTasks(tasks); err != nil {
+		s.log.WithError(err).Error("Error ordering tasks.")
+		results.internal = append(results.internal, fmt.Errorf("%v, so no updates were run", err))
+		tasks = nil
+	} else {
+		tasks = ordered
+	}
+	var held []task
+	tasks, held = holdForPromotion(updateConfig, tasks, promoting)
+	if len(held) > 0 {
+		pending, err := s.holdPromotions(pr, updateConfig, held)
+		if err != nil {
+			s.log.WithError(err).Error("Error saving pending promotions.")
+			results.internal = append(results.internal, err)
+		}
+		results.pending = pending
+	}
+	if promoting != nil {
+		// Only the held updates are run, the rest already were on merge.
+		syncRepos = nil
+		results.unlabeled = nil
+		restricted = nil
+	}
+	if updateConfig.ShowDiff {
+		diffs, errs := diffFiles(r, pr.Base.SHA, tasks)
+		results.fileDiffs = diffs
+		results.internal = append(results.internal, errs...)
+	}
+	var checkRunID int64
+	if s.UseChecksAPI && (len(tasks) > 0 || len(syncRepos) > 0) {
+		checkRunID = s.startCheckRun(ctx, pr)
+	}
+	var changedNames []string
+	for _, change := range changes {
+		changedNames = append(changedNames, change.Filename)
+	}
+	scriptEnv := prEnvironment(pr, changedNames)
+	// The scripts bracket the tasks, so they are not run if there are none.
+	runScripts := len(tasks) > 0
+	stopped := false
+	var native *nativeApplier
+	// A controller is only reloaded once every task for it succeeded, and
+	// only once however many matchers reload it.
+	var reloads []JenkinsReload
+	unreloaded := map[JenkinsReload]int{}
+	for _, t := range tasks {
+		if t.reload == nil {
+			continue
+		}
+		if _, ok := unreloaded[*t.reload]; !ok {
+			reloads = append(reloads, *t.reload)
+		}
+		unreloaded[*t.reload]++
+	}
+	acknowledged := len(tasks) > 0 && s.acknowledge(ctx, run, pr, updateConfig.Acknowledge)
+	if runScripts && updateConfig.PreTaskScript != "" {
+		if err := s.runScript(ctx, eventGUID, r.Directory(), "pre-task", updateConfig.PreTaskScript, scriptEnv); err != nil {
+			results.internal = append(results.internal, fmt.Errorf("%v, so no updates were run", err))
+			tasks = nil
+		}
+	}
+	for _, t := range tasks {
+		if !stopped && ctx.Err() != nil {
+			results.internal = append(results.internal, fmt.Errorf("stopped running updates: %v", ctx.Err()))
+			stopped = true
+		}
+		if stopped {
+			results.skipped = append(results.skipped, t.command)
+			continue
+		}
+		t.env = mergeEnvironment(s.log.WithField("target", t.target), t.env, prEnvironment(pr, t.files))
+		taskCtx, span := s.startSpan(ctx, "config-updater/task")
+		span.SetAttributes(attribute.String("target", t.target), attribute.String("command", strings.Join(t.command, " ")))
+		var diffResult *result
+		if t.diff != nil {
+			diff := s.diff(taskCtx, eventGUID, r.Directory(), makeBinary, t)
+			if _, notAllowed := diff.err.(*notAllowedError); notAllowed {
+				results.internal = append(results.internal, diff.err)
+				endSpan(span, diff.err)
+				continue
+			}
+			diffResult = &diff
+		}
+		var deploymentID int64
+		if t.deployment {
+			deploymentID = s.startDeployment(taskCtx, pr, t)
+		}
+		var taskResult result
+		started := time.Now()
+		if diffResult != nil && diffResult.err != nil {
+			taskResult = result{command: t.command, workdir: t.workdir, exitCode: -1, err: fmt.Errorf("not run, as the diff failed: %v", diffResult.err)}
+		} else if t.native {
+			if native == nil {
+				native = newNativeApplier(s.cluster, updateConfig.fieldManager())
+			}
+			taskResult = s.applyNatively(taskCtx, native, r.Directory(), t)
+		} else if t.prowJob != "" {
+			taskResult = s.runProwJob(taskCtx, eventGUID, pr, t)
+		} else if t.argoCD != nil {
+			taskResult = s.syncArgoCD(taskCtx, eventGUID, t)
+		} else {
+			taskResult = s.runTask(taskCtx, eventGUID, r.Directory(), t)
+		}
+		if _, notAllowed := taskResult.err.(*notAllowedError); notAllowed {
+			results.internal = append(results.internal, taskResult.err)
+			if deploymentID != 0 {
+				s.finishDeployment(taskCtx, pr, deploymentID, taskResult)
+			}
+			endSpan(span, taskResult.err)
+			continue
+		}
+		taskResult.duration = time.Since(started)
+		taskResult.cluster = t.cluster
+		taskResult.diff = diffResult
+		if t.folded || t.batch != "" {
+			taskResult.files = t.files
+		}
+		taskResult.batch = t.batch
+		taskResult.notify = t.notify
+		s.recordStatus(pr, taskResult)
+		results.records = append(results.records, newTaskRecord(pr, t.files, taskResult))
+		taskExitCodes.WithLabelValues(t.target, strconv.Itoa(taskResult.exitCode)).Inc()
+		s.sendTaskStats(pr, t, taskResult)
+		if taskResult.err == nil && t.verify != nil {
+			verification := s.verify(taskCtx, eventGUID, r.Directory(), t)
+			taskResult.verification = &verification
+		}
+		if deploymentID != 0 {
+			s.finishDeployment(taskCtx, pr, deploymentID, taskResult)
+		}
+		spanErr := taskResult.err
+		if spanErr == nil && taskResult.verification != nil {
+			spanErr = taskResult.verification.err
+		}
+		endSpan(span, spanErr)
+		s.escalate(updateConfig, pr, t, taskResult)
+		s.trackFailure(ctx, updateConfig, pr, t, taskResult)
+
+		if taskResult.failed() {
+			results.failed = append(results.failed, taskResult)
+			stopped = updateConfig.FailFast && !t.continueOnError
+			if t.rollback != nil {
+				rollbackResult := s.rollback(eventGUID, r.Directory(), t)
+				rollbackResult.cluster = t.cluster
+				s.recordStatus(pr, rollbackResult)
+				results.rollbacks = append(results.rollbacks, rollbackResult)
+			}
+			continue
+		}
+		results.succeeded = append(results.succeeded, taskResult)
+		if t.reload != nil {
+			unreloaded[*t.reload]--
+		}
+
+		if s.JenkinsURL != "" {
+			for _, config := range t.configs() {
+				if err := s.triggerJenkins(r.Directory(), config); err != nil {
+					results.internal = append(results.internal, err)
+				}
+			}
+		}
+	}
+
+	for _, reload := range reloads {
+		if unreloaded[reload] > 0 {
+			s.log.WithField("jenkins", reload.URL).Info("Not reloading Jenkins, as not every task for it succeeded.")
+			continue
+		}
+		results.reloads = append(results.reloads, s.reloadJenkins(ctx, reload))
+	}
+
+	if runScripts && updateConfig.PostTaskScript != "" {
+		if err := s.runScript(ctx, eventGUID, r.Directory(), "post-task", updateConfig.PostTaskScript, scriptEnv); err != nil {
+			results.internal = append(results.internal, err)
+		}
+	}
+
+	for _, targetRepo := range syncRepos {
+		url, err := s.syncToRepo(ctx, pr, r.Directory(), targetRepo, sets.NewString(syncFiles[targetRepo]...).List())
+		if err != nil {
+			results.internal = append(results.internal, fmt.Errorf("error opening a PR against %s: %v", targetRepo, err))
+			continue
+		}
+		results.pullRequests = append(results.pullRequests, url)
+	}
+
+	if checkRunID != 0 {
+		s.finishCheckRun(ctx, pr, checkRunID, results)
+	}
+	if acknowledged {
+		s.reactToOutcome(ctx, pr, results)
+	}
+
+	if len(restricted) > 0 {
+		if err := s.commentRestricted(ctx, pr, restricted); err != nil {
+			s.log.WithError(err).Error("Error commenting on the updates skipped for membership.")
+		}
+	}
+
+	if len(results.succeeded) == 0 && len(results.failed) == 0 && len(results.pullRequests) == 0 && len(results.unlabeled) == 0 && len(results.pending) == 0 && len(results.internal) == 0 {
+		s.log.WithField("eventGUID", eventGUID).Info("No updates were run, so no results are posted.")
+		return nil
+	}
+
+	return s.postResults(ctx, pre, updateConfig, results)
+}
+
+// runTask runs t in dir and records how it went.
+func (s *Server) runTask(ctx context.Context, eventGUID, dir string, t task) result {
+	startAction := time.Now()
+	command := t.command
+	taskLog := s.log.WithFields(logrus.Fields{"eventGUID": eventGUID, "task": strings.Join(command, " ")})
+	if t.image == "" {
+		updateConfig := s.configAgent.Config()
+		allowed := allowedExecutables(updateConfig, s.makeBinary(updateConfig))
+		if t.kustomize && len(updateConfig.AllowedExecutables) == 0 {
+			allowed = append(allowed, command[0])
+		}
+		// The helm binary of a task may come from an in-repo matcher, so
+		// only those in the server config are allowed without being listed.
+		if t.helm && len(updateConfig.AllowedExecutables) == 0 {
+			allowed = append(allowed, updateConfig.helmBinaries()...)
+		}
+		if err := checkExecutable(command, filepath.Join(dir, t.workdir), allowed); err != nil {
+			taskLog.WithError(err).Warn("Refusing to run command.")
+			return result{command: command, workdir: t.workdir, exitCode: -1, err: err}
+		}
+	}
+	if t.image != "" {
+		taskLog = taskLog.WithField("image", t.image)
+		if runner, ok := s.executor.(imageRunner); !ok || !runner.runsImages() {
+			t.command = containerCommand(s.ContainerRuntime, t.image, dir, t)
+		}
+	}
+	stdout, stderr, err := s.executor.Run(ctx, taskLog, dir, t)
+	if t.outputMode == outputModeNone {
+		stdout, stderr = nil, nil
 	}
-	return nc, nil
+	taskResult := result{
+		command:    command,
+		image:      t.image,
+		workdir:    t.workdir,
+		stdout:     string(stdout),
+		stderr:     string(stderr),
+		outputMode: t.outputMode,
+		exitCode:   exitCode(err),
+		err:        err,
+	}
+	s.log.WithFields(map[string]interface{}{
+		"duration":  time.Since(startAction),
+		"args":      command,
+		"image":     t.image,
+		"exitCode":  taskResult.exitCode,
+		"succeeded": err == nil,
+	}).Info("Ran command")
+	return taskResult
 }
 
-type result struct {
-	command []string
-	output  string
-	err     error
+// runScript runs an operator provided script in dir. Its output is only
+// logged, as it may well contain credentials.
+func (s *Server) runScript(ctx context.Context, eventGUID, dir, name, script string, env []string) error {
+	scriptResult := s.runTask(ctx, eventGUID, dir, task{command: []string{"/bin/sh", "-c", script}, target: name, env: env})
+	if scriptResult.err != nil {
+		return fmt.Errorf("the %s script failed: %v", name, scriptResult.err)
+	}
+	return nil
 }
 
-// Server implements http.Handler. It validates incoming GitHub webhooks and
-// then dispatches them to the appropriate plugins.
-type Server struct {
-	hmacSecret func() []byte
-
-	gc  *git.Client
-	ghc githubClient
-	log *logrus.Entry
-
-	configAgent *Agent
+// verify runs the verification of the successful task t, retrying it as
+// configured with every attempt bound by the timeout.
+func (s *Server) verify(ctx context.Context, eventGUID, dir string, t task) result {
+	timeout := t.verify.Timeout
+	if timeout == 0 {
+		timeout = defaultVerificationTimeout
+	}
+	var verification result
+	for attempt := 1; attempt <= t.verify.Retries+1 && (attempt == 1 || ctx.Err() == nil); attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		verification = s.runTask(attemptCtx, eventGUID, dir, task{command: t.verifyCommand, target: t.target, env: t.env, image: t.image, workdir: t.workdir})
+		cancel()
+		verification.attempts = attempt
+		if verification.err == nil {
+			break
+		}
+	}
+	return verification
 }
 
-// NewServer returns new server
-func NewServer(hmac func() []byte, gc *git.Client, ghc *github.Client, configAgent *Agent) *Server {
-	return &Server{
-		hmacSecret: hmac,
-
-		gc:  gc,
-		ghc: ghc,
-		log: logrus.StandardLogger().WithField("plugin", pluginName),
+// rollback runs the rollback of the failed task t, within its timeout. It
+// is not cancelled along with the event, as the task may have been stopped
+// halfway through an update that is better undone.
+func (s *Server) rollback(eventGUID, dir string, t task) result {
+	timeout := t.rollback.Timeout
+	if timeout == 0 {
+		timeout = defaultRollbackTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	rollbackResult := s.runTask(ctx, eventGUID, dir, task{command: t.rollback.Command, target: t.target, env: t.env, image: t.image, workdir: t.workdir})
+	if rollbackResult.err != nil {
+		s.log.WithError(rollbackResult.err).WithField("target", t.target).Error("Rollback failed.")
+		failedRollbacks.WithLabelValues(t.target).Inc()
+	}
+	return rollbackResult
+}
 
-		configAgent: configAgent,
+// containerCommand wraps the command of t so that it runs in image with the
+// checkout in dir mounted as its working directory. The task environment is
+// passed through by name, as it is also set for the runtime itself.
+func containerCommand(runtime, image, dir string, t task) []string {
+	command := []string{runtime, "run", "--rm", "--volume", dir + ":" + containerWorkDir, "--workdir", path.Join(containerWorkDir, t.workdir)}
+	if t.stdin != "" {
+		command = append(command, "--interactive")
+	}
+	for _, env := range t.env {
+		command = append(command, "--env", strings.SplitN(env, "=", 2)[0])
 	}
+	command = append(command, image)
+	return append(command, t.command...)
 }
 
-// ServeHTTP validates an incoming webhook and puts it into the event channel.
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	eventType, eventGUID, payload, ok, _ := github.ValidateWebhook(w, r, s.hmacSecret())
-	if !ok {
-		s.log.Error("Failed to validate payload")
-		return
+// prEnvironment describes the merged PR and the files that caused a task to
+// run, for use by the task. These variables are set last so they take
+// precedence over any of the same name in the server's environment.
+func prEnvironment(pr github.PullRequest, files []string) []string {
+	return []string{
+		fmt.Sprintf("PULL_NUMBER=%d", pr.Number),
+		fmt.Sprintf("PULL_BASE_REF=%s", pr.Base.Ref),
+		fmt.Sprintf("PULL_MERGE_SHA=%s", *pr.MergeSHA),
+		fmt.Sprintf("REPO_OWNER=%s", pr.Base.Repo.Owner.Login),
+		fmt.Sprintf("REPO_NAME=%s", pr.Base.Repo.Name),
+		fmt.Sprintf("PULL_AUTHOR=%s", pr.User.Login),
+		fmt.Sprintf("CHANGED_FILES=%s", strings.Join(files, "\n")),
 	}
-	fmt.Fprint(w, "Event received. Have a nice day.")
+}
 
-	if err := s.handleEvent(eventType, eventGUID, payload); err != nil {
-		logrus.WithError(err).Error("Error handling event.")
+// retry calls fn until it succeeds, backing off exponentially between
+// attempts, and gives up once the next attempt would start after the
+// configured deadline or ctx is cancelled.
+func (s *Server) retry(ctx context.Context, action string, fn func() error) error {
+	deadline := time.Now().Add(s.gitRetryDeadline)
+	backoff := s.gitRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("%s failed after %d attempt(s): %v", action, attempt, err)
+		}
+		s.log.WithError(err).Warnf("Attempt %d to %s failed, retrying in %v.", attempt, action, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%s failed after %d attempt(s): %v, then %v", action, attempt, err, ctx.Err())
+		}
+		backoff *= 2
 	}
 }
 
-func (s *Server) handleEvent(eventType, eventGUID string, payload []byte) error {
-	s.log.WithField("eventType", eventType).WithField("eventGUID", eventGUID).Info("Received webhook")
-	if eventType != "pull_request" {
-		s.log.Debugf("received an event of type %q but didn't ask for it", eventType)
-		return nil
+// reportInternalError lets the PR author know that no updates were applied
+// because of err, and returns err for logging.
+func (s *Server) reportInternalError(ctx context.Context, pre github.PullRequestEvent, run runInfo, err error) error {
+	if cerr := s.postResults(ctx, pre, nil, results{run: run, internal: []error{err}}); cerr != nil {
+		s.log.WithError(cerr).Error("Error commenting on internal error.")
 	}
+	return err
+}
 
-	var pre github.PullRequestEvent
-	if err := json.Unmarshal(payload, &pre); err != nil {
+// postResults reports results on the PR, as the effective updateConfig of
+// the run asks for. updateConfig may be nil if the run failed before it was
+// known.
+func (s *Server) postResults(ctx context.Context, pre github.PullRequestEvent, updateConfig *UpdateConfig, results results) error {
+	s.log.WithFields(logrus.Fields{"eventGUID": results.run.eventGUID, "run": results.run.id, "summary": results.Summary()}).Info("Posting results.")
+	if !results.IsSuccess() {
+		atomic.AddInt32(&s.unsuccessful, 1)
+	}
+	s.notifyFailure(pre.PullRequest, results)
+	s.labelOutcome(ctx, pre.PullRequest, results)
+	if silentOnSuccess(updateConfig, results) {
+		s.log.Info("Every update succeeded, not commenting as comment_on_success is off.")
+	} else if err := s.comment(ctx, pre, results.run, results.formatResults(), results.fingerprint()); err != nil {
 		return err
 	}
-	s.log = s.log.WithFields(map[string]interface{}{
-		"org":    pre.Repo.Owner.Login,
-		"repo":   pre.Repo.Name,
-		"pr":     pre.Number,
-		"author": pre.PullRequest.User.Login,
-		"url":    pre.PullRequest.HTMLURL,
-	})
+	if s.Report != nil && len(results.records) > 0 {
+		// The results were posted, so failing to report them is only
+		// logged.
+		if err := s.Report.Write(results.records); err != nil {
+			s.log.WithError(err).WithField("path", s.Report.Path).Error("Error writing the report.")
+		}
+	}
+	return nil
+}
 
-	if pre.Action != github.PullRequestActionClosed {
-		return nil
+// silentOnSuccess determines whether no comment is posted for results, as
+// they have no failure and updateConfig only comments on failures.
+func silentOnSuccess(updateConfig *UpdateConfig, results results) bool {
+	if updateConfig == nil || updateConfig.CommentOnSuccess == nil || *updateConfig.CommentOnSuccess {
+		return false
 	}
+	return results.IsSuccess() && !results.failedRollback()
+}
 
+// comment posts message on the PR, unless the last comment we posted there
+// has the same fingerprint, which identifies what the message reports.
+func (s *Server) comment(ctx context.Context, pre github.PullRequestEvent, run runInfo, message, fingerprint string) error {
 	pr := pre.PullRequest
-	if !pr.Merged || pr.MergeSHA == nil {
+	body := plugins.FormatResponseRaw(pr.Body, pr.HTMLURL, pr.User.Login, message)
+	if s.CommentTemplate != "" {
+		tmpl, err := parseCommentTemplate(s.CommentTemplate)
+		if err != nil {
+			return fmt.Errorf("error parsing comment template: %v", err)
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, commentData{Results: message, PR: pr, Org: pr.Base.Repo.Owner.Login}); err != nil {
+			return fmt.Errorf("error rendering comment template: %v", err)
+		}
+		body = b.String()
+	}
+	org, repo := pr.Base.Repo.Owner.Login, pr.Base.Repo.Name
+	marker := resultsMarker(fingerprint)
+	if s.postedLast(ctx, org, repo, pr.Number, marker) {
+		s.log.WithFields(logrus.Fields{"eventGUID": run.eventGUID, "run": run.id, "pr": pr.Number}).Info("Not commenting, as the last comment posted the same results.")
 		return nil
 	}
+	if err := s.github(ctx).CreateComment(org, repo, pr.Number, body+"\n\n"+marker+"\n"+commentFooter(run)+"\n"+commentSignature); err != nil {
+		return err
+	}
+	if s.MinimizeOldComments {
+		s.minimizeOldComments(ctx, org, repo, pr.Number)
+	}
+	return nil
+}
 
-	org := pr.Base.Repo.Owner.Login
-	repo := pr.Base.Repo.Name
-	num := pr.Number
-
-	changes, err := s.ghc.GetPullRequestChanges(org, repo, num)
+// minimizeOldComments hides every comment with our signature on the PR but
+// the latest. Failing to is only logged, as the new comment was posted.
+func (s *Server) minimizeOldComments(ctx context.Context, org, repo string, number int) {
+	log := s.log.WithFields(logrus.Fields{"org": org, "repo": repo, "pr": number})
+	comments, err := s.github(ctx).ListIssueComments(org, repo, number)
 	if err != nil {
-		return fmt.Errorf("error getting pull request changes: %v", err)
+		log.WithError(err).Warn("Failed to list comments to minimize.")
+		return
+	}
+	var ours []github.IssueComment
+	for _, comment := range comments {
+		if strings.Contains(comment.Body, commentSignature) {
+			ours = append(ours, comment)
+		}
 	}
+	for i := 0; i < len(ours)-1; i++ {
+		if err := s.github(ctx).MinimizeComment(org, repo, ours[i].ID); err != nil {
+			log.WithError(err).WithField("comment", ours[i].ID).Warn("Failed to minimize an old comment.")
+		}
+	}
+}
 
-	startClone := time.Now()
-	s.log.Info("cloning " + org + "/" + repo)
-	r, err := s.gc.Clone(org + "/" + repo)
+// resultsMarker is a hidden hash of the fingerprint of a comment, as the
+// footer differs between runs and GitHub normalizes the whitespace of the
+// body.
+func resultsMarker(fingerprint string) string {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return fmt.Sprintf("<!-- config-updater results=%s -->", hex.EncodeToString(sum[:8]))
+}
+
+// postedLast determines whether the last comment with our signature on the
+// PR has marker, so that redeliveries and retries that produce the same
+// results do not post them again. If the comments cannot be listed, the
+// results are posted regardless.
+func (s *Server) postedLast(ctx context.Context, org, repo string, number int, marker string) bool {
+	comments, err := s.github(ctx).ListIssueComments(org, repo, number)
 	if err != nil {
-		return fmt.Errorf("error cloning: %v", err)
+		s.log.WithError(err).WithFields(logrus.Fields{"org": org, "repo": repo, "pr": number}).Warn("Failed to list comments to compare the results with.")
+		return false
 	}
-	defer func() {
-		if err := r.Clean(); err != nil {
-			s.log.WithError(err).Error("Error cleaning up repo.")
+	for i := len(comments) - 1; i >= 0; i-- {
+		if strings.Contains(comments[i].Body, commentSignature) {
+			return strings.Contains(comments[i].Body, marker)
 		}
-	}()
-
-	s.log.Info("checking out " + pr.Head.SHA)
-	if err = r.Checkout(pr.Head.SHA); err != nil {
-		return err
 	}
-	s.log.WithField("duration", time.Since(startClone)).Info("Cloned and checked out target branch.")
+	return false
+}
 
-	results := results{}
-	tasks := [][]string{}
+// makeBinary returns the make to run tasks with.
+func (s *Server) makeBinary(c *UpdateConfig) string {
+	switch {
+	case s.MakeBinary != "":
+		return s.MakeBinary
+	case c.MakeBinary != "":
+		return c.MakeBinary
+	default:
+		return defaultMakeBinary
+	}
+}
 
-	updateConfig := s.configAgent.Config()
-	for _, target := range updateConfig.Targets {
-		for _, change := range changes {
-			if change.Filename == target {
-				args, err := determineTargetForConfig(r.Dir, change.Filename)
-				if err != nil {
-					results.internal = append(results.internal, err)
-				} else {
-					tasks = append(tasks, args)
-				}
-			}
+// validateStatuses checks that the statuses are ones that changes are
+// matched with.
+func validateStatuses(statuses []string) error {
+	for _, status := range statuses {
+		switch status {
+		case github.PullRequestFileAdded, string(github.PullRequestFileModified), github.PullRequestFileRemoved:
+		default:
+			return fmt.Errorf("unknown status %q, must be %s, %s or %s", status, github.PullRequestFileAdded, github.PullRequestFileModified, github.PullRequestFileRemoved)
 		}
 	}
-	for _, matcher := range updateConfig.Matchers {
-		for _, change := range changes {
-			if matcher.Regex.MatchString(change.Filename) {
-				tasks = append(tasks, []string{"/usr/bin/make", matcher.Target})
-				break
-			}
+	return nil
+}
+
+// hasStatus determines whether the status of change is one of statuses,
+// which are all allowed if there are none. Without statuses a renamed file
+// is only matched by its new name, as it was before statuses were
+// matched, rather than also running what matches its previous one.
+func hasStatus(statuses []string, change github.PullRequestChange) bool {
+	if len(statuses) == 0 {
+		return !renamedAway(change)
+	}
+	for _, status := range statuses {
+		if status == change.Status {
+			return true
 		}
 	}
+	return false
+}
 
-	for _, task := range tasks {
-		startAction := time.Now()
-		cmd := exec.Command(task[0], task[1:]...)
-		cmd.Dir = r.Dir
-		out, err := cmd.CombinedOutput()
-		s.log.WithFields(map[string]interface{}{
-			"duration":  time.Since(startAction),
-			"args":      task,
-			"output":    out,
-			"succeeded": err == nil,
-		}).Info("Ran command")
-		taskResult := result{task, string(out), err}
+// excluded determines whether any of the excludes matches filename.
+func excluded(excludes []Exclude, filename string) bool {
+	for _, exclude := range excludes {
+		if exclude.matches(filename) {
+			return true
+		}
+	}
+	return false
+}
 
+// determineTargetForConfig returns the commands applying config: one per
+// make target the objects in it need, in the order they first appear. Each
+// document that cannot be parsed, or has no kind, adds an error instead,
+// without stopping the others from being applied.
+func determineTargetForConfig(makeBinary, kustomizeBinary, dir, config string) ([][]string, []error) {
+	// Older kustomizations have no kind, and kustomize builds the directory
+	// they are in rather than the file.
+	if isKustomization(dir, config) {
+		return [][]string{{kustomizeBinary, "apply", "-k", path.Dir(config)}}, nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, config))
+	if err != nil {
+		return nil, []error{fmt.Errorf("cannot read object YAML/JSON from %v", config)}
+	}
+	documents := splitDocuments(config, content)
+	var commands [][]string
+	var errs []error
+	seen := sets.NewString()
+	for i, document := range documents {
+		source := config
+		if len(documents) > 1 {
+			source = fmt.Sprintf("document %d of %v", i+1, config)
+		}
+		object, err := parseObject(config, document)
 		if err != nil {
-			results.failed = append(results.failed, taskResult)
-		} else {
-			results.succeeded = append(results.succeeded, taskResult)
+			errs = append(errs, fmt.Errorf("cannot parse object YAML/JSON from %v", source))
+			continue
+		}
+		objectType, ok := object["kind"].(string)
+		if !ok {
+			errs = append(errs, fmt.Errorf("cannot access object kind from %v", source))
+			continue
 		}
-	}
 
-	if len(results.succeeded) == 0 && len(results.failed) == 0 && len(results.internal) == 0 {
-		return nil
+		var makeTarget string
+		switch objectType {
+		case "Template":
+			makeTarget = "applyTemplate"
+		default:
+			makeTarget = "apply"
+		}
+		if seen.Has(makeTarget) {
+			continue
+		}
+		seen.Insert(makeTarget)
+		commands = append(commands, []string{makeBinary, makeTarget, fmt.Sprintf("WHAT=%s", config)})
 	}
+	return commands, errs
+}
+
+// documentSeparator starts each document after the first in a YAML file.
+var documentSeparator = regexp.MustCompile(`(?m)^---([ \t].*)?$`)
 
-	return s.ghc.CreateComment(
-		org, repo, num,
-		plugins.FormatResponseRaw(
-			pre.PullRequest.Body,
-			pre.PullRequest.HTMLURL,
-			pre.PullRequest.User.Login,
-			results.formatResults(),
-		),
-	)
+// splitDocuments splits the YAML in content into its documents, leaving out
+// those with nothing but comments in them. JSON, and YAML with a single
+// document, is returned whole.
+func splitDocuments(config string, content []byte) [][]byte {
+	if filepath.Ext(config) == ".json" {
+		return [][]byte{content}
+	}
+	var documents [][]byte
+	for _, document := range documentSeparator.Split(string(content), -1) {
+		for _, line := range strings.Split(document, "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				documents = append(documents, []byte(document))
+				break
+			}
+		}
+	}
+	if len(documents) < 2 {
+		return [][]byte{content}
+	}
+	return documents
 }
 
-func determineTargetForConfig(dir, config string) ([]string, error) {
+func determineKindForConfig(dir, config string) (string, error) {
 	configFile := filepath.Join(dir, config)
 	content, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read object YAML/JSON from %v", config)
+		return "", fmt.Errorf("cannot read object YAML/JSON from %v", config)
 	}
-	object := map[interface{}]interface{}{}
-	err = yaml.Unmarshal(content, &object)
+	object, err := parseObject(config, content)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse object YAML/JSON from %v", config)
+		return "", fmt.Errorf("cannot parse object YAML/JSON from %v", config)
 	}
-	objectType, ok := object["kind"]
+	kind, ok := object["kind"].(string)
 	if !ok {
-		return nil, fmt.Errorf("cannot access object kind from %v", config)
+		return "", fmt.Errorf("cannot access object kind from %v", config)
 	}
+	return kind, nil
+}
 
-	var makeTarget string
-	switch objectType {
-	case "Template":
-		makeTarget = "applyTemplate"
-	default:
-		makeTarget = "apply"
+// triggerJenkins builds the Jenkins job named after the object in config.
+func (s *Server) triggerJenkins(dir, config string) error {
+	if info, err := os.Stat(filepath.Join(dir, config)); err == nil && info.IsDir() {
+		// Kustomizations are applied by directory, which is not a single
+		// object to name a job after.
+		return nil
+	}
+	name, err := determineNameForConfig(dir, config)
+	if err != nil {
+		return err
+	}
+	trigger := &JenkinsTrigger{URL: s.JenkinsURL, Token: string(s.JenkinsToken())}
+	if err := trigger.Trigger(name); err != nil {
+		return fmt.Errorf("error triggering Jenkins job for %v: %v", config, err)
+	}
+	return nil
+}
+
+func determineNameForConfig(dir, config string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, config))
+	if err != nil {
+		return "", fmt.Errorf("cannot read object YAML/JSON from %v", config)
+	}
+	object, err := parseObject(config, content)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse object YAML/JSON from %v", config)
+	}
+	metadata, ok := object["metadata"]
+	if !ok {
+		return "", fmt.Errorf("cannot access object metadata from %v", config)
+	}
+	var name interface{}
+	switch metadata := metadata.(type) {
+	case map[string]interface{}:
+		name = metadata["name"]
+	case map[interface{}]interface{}:
+		name = metadata["name"]
+	}
+	if name, ok := name.(string); ok && name != "" {
+		return name, nil
+	}
+	return "", fmt.Errorf("cannot access object name from %v", config)
+}
+
+// parseObject decodes content according to the extension of config. Files
+// with an unknown extension are tried as JSON first and then as YAML.
+func parseObject(config string, content []byte) (map[string]interface{}, error) {
+	object := map[string]interface{}{}
+	switch filepath.Ext(config) {
+	case ".json":
+		return object, json.Unmarshal(content, &object)
+	case ".yaml", ".yml":
+		return object, yaml.Unmarshal(content, &object)
 	}
-	return []string{"/usr/bin/make", makeTarget, fmt.Sprintf("WHAT=%s", config)}, nil
+	if err := json.Unmarshal(content, &object); err == nil {
+		return object, nil
+	}
+	object = map[string]interface{}{}
+	return object, yaml.Unmarshal(content, &object)
 }
 
 type results struct {
+	// run is the run the results are posted for.
+	run runInfo
+	// fileDiffs are how the PR changed the files the tasks update, if they
+	// are shown.
+	fileDiffs []fileDiff
 	succeeded []result
 	failed    []result
-	internal  []error
+	// skipped are the commands not run because an earlier task failed.
+	skipped [][]string
+	// unlabeled are the updates not run because the PR lacks labels that
+	// their matcher requires.
+	unlabeled []unlabeledUpdate
+	// rollbacks are the results of rolling back failed tasks.
+	rollbacks []result
+	// pullRequests links the PRs opened to copy files to other repos.
+	pullRequests []string
+	// warnings explain anything unusual about how the tasks were run.
+	warnings []string
+	internal []error
+	// records are written to the report once the results are posted.
+	records []TaskRecord
+	// clusters name the configured clusters, in order.
+	clusters []string
+	// reloads are the results of reloading Jenkins controllers.
+	reloads []reloadResult
+	// pending are the updates held until they are promoted.
+	pending []pendingPromotion
+	// promotion is set when the results are of promoting held updates.
+	promotion *promotionRequest
+	// forced is set when the updates ran for a PR that is not merged, with
+	// --force-pr.
+	forced bool
+}
+
+// restrictedUpdate describes an update that was skipped because the author
+// of the PR is not a member of the org its matcher requires.
+type restrictedUpdate struct {
+	update string
+	org    string
+}
+
+// commentRestricted explains the updates skipped for membership in a comment
+// of their own. It is not signed, so that it is not hidden as outdated when
+// the results are posted.
+func (s *Server) commentRestricted(ctx context.Context, pr github.PullRequest, restricted []restrictedUpdate) error {
+	var b bytes.Buffer
+	b.WriteString("The following updates were skipped, as only members of the orgs they require may trigger them:\n")
+	b.WriteString("<ul>")
+	for _, update := range restricted {
+		b.WriteString(fmt.Sprintf(`<li><code>%s</code> requires membership of <code>%s</code></li>`, html.EscapeString(update.update), html.EscapeString(update.org)))
+	}
+	b.WriteString("</ul>\n")
+	b.WriteString("Please ask a member to apply them.")
+	body := plugins.FormatResponseRaw(pr.Body, pr.HTMLURL, pr.User.Login, b.String())
+	return s.github(ctx).CreateComment(pr.Base.Repo.Owner.Login, pr.Base.Repo.Name, pr.Number, body)
+}
+
+// unlabeledUpdate describes an update that was skipped for missing labels.
+type unlabeledUpdate struct {
+	update  string
+	missing []string
+}
+
+// runOnceExitCode is the exit status of a mode that runs once, such as
+// --force-pr: 1 if it failed, or if the results of any of its runs were not
+// a success, and 0 otherwise.
+func (s *Server) runOnceExitCode(failed bool) int {
+	if failed || atomic.LoadInt32(&s.unsuccessful) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// IsSuccess determines whether every update succeeded, without any
+// internal errors.
+func (r *results) IsSuccess() bool {
+	return len(r.failed) == 0 && len(r.internal) == 0 && r.failedReloads() == 0
+}
+
+// failedRollback determines whether any rollback failed, leaving a
+// half-applied update behind.
+func (r *results) failedRollback() bool {
+	for _, rollback := range r.rollbacks {
+		if rollback.err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary describes the results in one line, short enough to be used as
+// the description of a commit status.
+func (r *results) Summary() string {
+	summary := fmt.Sprintf("%d succeeded, %d failed, %d internal errors", len(r.succeeded), len(r.failed), len(r.internal))
+	if skipped := len(r.skipped) + len(r.unlabeled); skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", skipped)
+	}
+	if len(r.pullRequests) > 0 {
+		summary += fmt.Sprintf(", %d pull requests opened", len(r.pullRequests))
+	}
+	if failed := r.failedReloads(); failed > 0 {
+		summary += fmt.Sprintf(", %d Jenkins reloads failed", failed)
+	}
+	if pending := r.pendingCount(); pending > 0 {
+		summary += fmt.Sprintf(", %d pending promotion", pending)
+	}
+	if applied, failed := r.clusterOutcome(); len(failed) > 0 {
+		summary += fmt.Sprintf(", applied to %d of %d clusters", len(applied)-len(failed), len(applied))
+	}
+	if r.failedRollback() {
+		summary += ", a rollback failed and manual intervention is required"
+	}
+	if len(summary) > maxSummaryLength {
+		summary = summary[:maxSummaryLength-3] + "..."
+	}
+	return summary
+}
+
+// formatSummary counts the results and tabulates how each task went, so
+// that failures show without scrolling through the details.
+func (r *results) formatSummary() string {
+	var total time.Duration
+	for _, task := range append(append([]result{}, r.succeeded...), r.failed...) {
+		total += task.duration
+	}
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("**%d succeeded, %d failed, %d internal errors — total %s**\n\n", len(r.succeeded), len(r.failed), len(r.internal), formatTaskDuration(total)))
+	if len(r.succeeded) == 0 && len(r.failed) == 0 {
+		return b.String()
+	}
+	b.WriteString("| Task | Status | Duration |\n| --- | --- | --- |\n")
+	for _, outcome := range []struct {
+		status string
+		tasks  []result
+	}{{"succeeded", r.succeeded}, {"failed", r.failed}} {
+		for _, task := range r.byCluster(outcome.tasks) {
+			name := strings.Join(task.command, " ")
+			if task.cluster != "" {
+				name += " on " + task.cluster
+			}
+			// Pipes would end the cell.
+			name = strings.Replace(html.EscapeString(name), "|", "&#124;", -1)
+			b.WriteString(fmt.Sprintf("| <code>%s</code> | %s | %s |\n", name, outcome.status, formatTaskDuration(task.duration)))
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// fingerprint renders the results without how long anything took, so that
+// rerunning the same updates with the same outcome has the same fingerprint.
+func (r *results) fingerprint() string {
+	copied := *r
+	copied.succeeded = untimed(r.succeeded)
+	copied.failed = untimed(r.failed)
+	copied.reloads = make([]reloadResult, len(r.reloads))
+	for i, reload := range r.reloads {
+		reload.duration = 0
+		copied.reloads[i] = reload
+	}
+	return copied.formatResults()
+}
+
+// untimed copies tasks without their durations.
+func untimed(tasks []result) []result {
+	copied := make([]result, len(tasks))
+	for i, task := range tasks {
+		task.duration = 0
+		copied[i] = task
+	}
+	return copied
+}
+
+// formatTaskDuration rounds d to the second, as tasks that take less are
+// not worth timing more precisely.
+func formatTaskDuration(d time.Duration) string {
+	if d < time.Second {
+		return "<1s"
+	}
+	return d.Round(time.Second).String()
 }
 
 func (r *results) formatResults() string {
 	var commentBuffer bytes.Buffer
+	commentBuffer.WriteString(r.formatSummary())
+	if r.failedRollback() {
+		commentBuffer.WriteString("**:rotating_light: A rollback failed, so some updates may be half-applied. Manual intervention is required. :rotating_light:**\n\n")
+	}
+	if r.forced {
+		commentBuffer.WriteString(fmt.Sprintf("**%s** These updates were run with <code>--force-pr</code> before the PR was merged.\n\n", forceRunMarker))
+	}
+	if r.promotion != nil {
+		commentBuffer.WriteString(fmt.Sprintf("Promoted to <code>%s</code> by %s.\n\n", html.EscapeString(r.promotion.environment), r.promotion.by))
+	}
+	if applied, failed := r.clusterOutcome(); len(failed) > 0 {
+		commentBuffer.WriteString(fmt.Sprintf("**:warning: Applied to %d of %d clusters, failed on <code>%s</code>.**\n\n", len(applied)-len(failed), len(applied), formatCodeList(failed)))
+	}
+	if len(r.fileDiffs) > 0 {
+		commentBuffer.WriteString(formatFileDiffs(r.fileDiffs))
+	}
 	if len(r.succeeded) > 0 {
 		commentBuffer.WriteString("The following updates succeeded:\n")
 		commentBuffer.WriteString("<ul>")
-		for _, task := range r.succeeded {
+		for _, task := range r.byCluster(r.succeeded) {
+			task.forced = r.forced
 			commentBuffer.WriteString(formatDetails(task))
 		}
 		commentBuffer.WriteString("</ul>\n")
@@ -274,17 +2740,77 @@ func (r *results) formatResults() string {
 	if len(r.failed) > 0 {
 		commentBuffer.WriteString("The following updates failed:\n")
 		commentBuffer.WriteString("<ul>")
-		for _, task := range r.failed {
+		for _, task := range r.byCluster(r.failed) {
+			task.forced = r.forced
 			commentBuffer.WriteString(formatDetails(task))
 		}
 		commentBuffer.WriteString("</ul>\n")
+		commentBuffer.WriteString(r.formatMentions())
+	}
+
+	if len(r.rollbacks) > 0 {
+		commentBuffer.WriteString("The following rollbacks were run for failed updates:\n")
+		commentBuffer.WriteString("<ul>")
+		for _, rollback := range r.rollbacks {
+			rollback.forced = r.forced
+			commentBuffer.WriteString(formatDetails(rollback))
+		}
+		commentBuffer.WriteString("</ul>\n")
+	}
+
+	if len(r.skipped) > 0 {
+		commentBuffer.WriteString("The following updates were skipped because an earlier update failed:\n")
+		commentBuffer.WriteString("<ul>")
+		for _, command := range r.skipped {
+			var marker string
+			if r.forced {
+				marker = forceRunMarker + " "
+			}
+			commentBuffer.WriteString(fmt.Sprintf(`<li>%s<code>%s</code></li>`, marker, html.EscapeString(strings.Join(command, " "))))
+		}
+		commentBuffer.WriteString("</ul>\n")
+	}
+
+	if len(r.unlabeled) > 0 {
+		commentBuffer.WriteString("The following updates were skipped because the PR is missing labels they require:\n")
+		commentBuffer.WriteString("<ul>")
+		for _, update := range r.unlabeled {
+			commentBuffer.WriteString(fmt.Sprintf(`<li><code>%s</code> requires <code>%s</code></li>`, html.EscapeString(update.update), formatCodeList(update.missing)))
+		}
+		commentBuffer.WriteString("</ul>\n")
+	}
+
+	if len(r.reloads) > 0 {
+		commentBuffer.WriteString(formatReloads(r.reloads))
+	}
+
+	for _, pending := range r.pending {
+		commentBuffer.WriteString(formatPending(pending))
+	}
+
+	if len(r.pullRequests) > 0 {
+		commentBuffer.WriteString("The following pull requests were opened to update other repositories:\n")
+		commentBuffer.WriteString("<ul>")
+		for _, url := range r.pullRequests {
+			commentBuffer.WriteString(fmt.Sprintf(`<li>%s</li>`, html.EscapeString(url)))
+		}
+		commentBuffer.WriteString("</ul>\n")
+	}
+
+	if len(r.warnings) > 0 {
+		commentBuffer.WriteString("The following warnings were raised:\n")
+		commentBuffer.WriteString("<ul>")
+		for _, warning := range r.warnings {
+			commentBuffer.WriteString(fmt.Sprintf(`<li>%s</li>`, html.EscapeString(warning)))
+		}
+		commentBuffer.WriteString("</ul>\n")
 	}
 
 	if len(r.internal) > 0 {
 		commentBuffer.WriteString("The following internal errors occurred:\n")
 		commentBuffer.WriteString("<ul>")
 		for _, err := range r.internal {
-			commentBuffer.WriteString(fmt.Sprintf(`<li>%v</li>`, err))
+			commentBuffer.WriteString(fmt.Sprintf(`<li>%s</li>`, html.EscapeString(err.Error())))
 		}
 		commentBuffer.WriteString("</ul>\n")
 	}
@@ -293,15 +2819,119 @@ func (r *results) formatResults() string {
 }
 
 func formatDetails(taskResult result) string {
-	output := taskResult.output
-	if taskResult.err != nil {
-		output = fmt.Sprintf("%s\n%v", taskResult.output, taskResult.err)
+	var details bytes.Buffer
+	args := html.EscapeString(strings.Join(taskResult.command, " "))
+	var workdir string
+	if taskResult.workdir != "" {
+		workdir = fmt.Sprintf(" in <code>%s</code>", html.EscapeString(taskResult.workdir))
+	}
+	if taskResult.cluster != "" {
+		workdir += fmt.Sprintf(" on cluster <code>%s</code>", html.EscapeString(taskResult.cluster))
+	}
+	var marker string
+	if taskResult.forced {
+		marker = forceRunMarker + " "
+	}
+	details.WriteString(fmt.Sprintf("<li><details><summary>%s<code>%s</code>%s%s</summary>\n", marker, args, workdir, html.EscapeString(formatStatus(taskResult))))
+	if taskResult.image != "" {
+		details.WriteString(fmt.Sprintf("Ran in <code>%s</code>\n", html.EscapeString(taskResult.image)))
+	}
+	if taskResult.url != "" {
+		details.WriteString(fmt.Sprintf("Ran as <a href=\"%s\">a ProwJob</a>\n", html.EscapeString(taskResult.url)))
+	}
+	if taskResult.batch != "" {
+		details.WriteString(fmt.Sprintf("Applied %s: <code>%s</code>\n", html.EscapeString(taskResult.batch), formatCodeList(taskResult.files)))
+	} else if len(taskResult.files) > 0 {
+		details.WriteString(fmt.Sprintf("Ran once for <code>%s</code>\n", formatCodeList(taskResult.files)))
+	}
+	if len(taskResult.objects) > 0 {
+		details.WriteString("<ul>")
+		for _, object := range taskResult.objects {
+			details.WriteString(fmt.Sprintf("<li>%s</li>", object))
+		}
+		details.WriteString("</ul>\n")
+	}
+	if d := taskResult.diff; d != nil {
+		status := formatStatus(*d)
+		switch d.exitCode {
+		case 0:
+			status = " found no differences"
+		case diffExitCodeChanged:
+			status = " found differences"
+		}
+		details.WriteString(fmt.Sprintf("<details><summary>Cluster diff <code>%s</code>%s</summary>\n", html.EscapeString(strings.Join(d.command, " ")), html.EscapeString(status)))
+		details.WriteString(formatStreams(*d))
+		details.WriteString("</details>\n")
 	}
+	details.WriteString(formatStreams(taskResult))
+	if v := taskResult.verification; v != nil {
+		details.WriteString(fmt.Sprintf("<details><summary>Verification <code>%s</code>%s</summary>\n", html.EscapeString(strings.Join(v.command, " ")), html.EscapeString(formatStatus(*v))))
+		details.WriteString(formatStreams(*v))
+		details.WriteString("</details>\n")
+	}
+	details.WriteString("</details></li>")
+	return details.String()
+}
+
+// formatCodeList escapes values and joins them into a list of code spans
+// inside of an enclosing <code> element.
+func formatCodeList(values []string) string {
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = html.EscapeString(value)
+	}
+	return strings.Join(escaped, "</code>, <code>")
+}
+
+// formatStatus describes how the command ended.
+func formatStatus(r result) string {
+	var status string
+	if r.exitCode >= 0 {
+		status = fmt.Sprintf(" exited with code %d", r.exitCode)
+	} else {
+		status = fmt.Sprintf(" failed: %v", r.err)
+	}
+	if r.attempts > 1 {
+		status += fmt.Sprintf(" after %d attempts", r.attempts)
+	}
+	return status
+}
 
-	args := strings.Join(taskResult.command, " ")
+// formatStreams renders the output of r, in a single section when its
+// streams were combined.
+func formatStreams(r result) string {
+	if r.outputMode == outputModeCombined {
+		return formatOutput("output", r.stdout)
+	}
+	return formatOutput("stdout", r.stdout) + formatOutput("stderr", r.stderr)
+}
 
-	return fmt.Sprintf(`<li><details><summary><code>%s</code></summary><pre><code>
-$ %s
+// formatOutput renders output as a collapsible section, or nothing if it is
+// empty. The output is escaped, so that it cannot close the section.
+func formatOutput(name, output string) string {
+	output = sanitize(output)
+	if output == "" {
+		return ""
+	}
+	return fmt.Sprintf(`<details><summary>%s</summary><pre><code>
 %s
-</pre></code></details></li>`, args, args, output)
+</code></pre></details>
+`, name, html.EscapeString(output))
+}
+
+// ansiEscape matches CSI sequences (colors, cursor movement), OSC sequences
+// (window titles, hyperlinks) and the remaining two-byte escapes.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// sanitize removes terminal escape sequences and control characters other
+// than newlines and tabs from output, so that it renders cleanly in a
+// comment.
+func sanitize(output string) string {
+	output = ansiEscape.ReplaceAllString(output, "")
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, output)
 }
@@ -0,0 +1,3278 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	yamlv2 "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"sigs.k8s.io/yaml"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// fakeGit fails the first cloneFailures clones and the first
+// checkoutFailures checkouts before succeeding.
+type fakeGit struct {
+	cloneFailures    int
+	checkoutFailures int
+
+	clones    int
+	checkouts int
+	fetches   []string
+	dir       string
+
+	// diffChanges is returned from Changes, unless diffErr is set.
+	diffChanges []github.PullRequestChange
+	diffErr     error
+	// diffs are the ranges Changes was called with.
+	diffs []string
+	// fileDiffs are returned from FileDiff, by file.
+	fileDiffs map[string]string
+	// files are returned from ReadFile, by commit and file as
+	// "commit:file".
+	files map[string]string
+
+	// repoDirs overrides dir for the clones of specific repos.
+	repoDirs map[string]string
+	branches []string
+	commits  []string
+	pushes   []string
+}
+
+func (f *fakeGit) Clone(ctx context.Context, repo string) (gitRepo, error) {
+	f.clones++
+	if f.clones <= f.cloneFailures {
+		return nil, errors.New("connection reset by peer")
+	}
+	return &fakeRepo{fakeGit: f, repo: repo}, nil
+}
+
+type fakeRepo struct {
+	*fakeGit
+	repo string
+}
+
+func (r *fakeRepo) Directory() string {
+	if dir, ok := r.repoDirs[r.repo]; ok {
+		return dir
+	}
+	return r.dir
+}
+
+func (r *fakeRepo) Checkout(ctx context.Context, commitlike string) error {
+	r.checkouts++
+	if r.checkouts <= r.checkoutFailures {
+		return errors.New("reference is not a tree: " + commitlike)
+	}
+	return nil
+}
+
+func (r *fakeRepo) Fetch(ctx context.Context, commitlike string) error {
+	r.fetches = append(r.fetches, commitlike)
+	return nil
+}
+
+func (r *fakeRepo) ReadFile(ctx context.Context, commitlike, file string) ([]byte, error) {
+	content, ok := r.files[commitlike+":"+file]
+	if !ok {
+		return nil, &os.PathError{Op: "read", Path: commitlike + ":" + file, Err: os.ErrNotExist}
+	}
+	return []byte(content), nil
+}
+
+func (r *fakeRepo) Changes(base, head string) ([]github.PullRequestChange, error) {
+	r.diffs = append(r.diffs, base+".."+head)
+	return r.diffChanges, r.diffErr
+}
+
+func (r *fakeRepo) FileDiff(base, file string) (string, error) {
+	diff, ok := r.fileDiffs[file]
+	if !ok {
+		return "", fmt.Errorf("error diffing %s against %s: unknown file", file, base)
+	}
+	return diff, nil
+}
+
+func (r *fakeRepo) CheckoutNewBranch(branch string) error {
+	r.branches = append(r.branches, r.repo+":"+branch)
+	return nil
+}
+
+func (r *fakeRepo) Commit(name, email, message string) error {
+	r.commits = append(r.commits, fmt.Sprintf("%s <%s>: %s", name, email, message))
+	return nil
+}
+
+func (r *fakeRepo) Push(repo, branch string) error {
+	r.pushes = append(r.pushes, repo+":"+branch)
+	return nil
+}
+
+func (r *fakeRepo) Clean() error {
+	return nil
+}
+
+// recordingExecutor records the tasks it is asked to run and fails those
+// listed in failures.
+type recordingExecutor struct {
+	failures map[string]bool
+	ran      [][]string
+	env      [][]string
+	workdirs []string
+	stdins   []string
+}
+
+func (e *recordingExecutor) Run(ctx context.Context, log *logrus.Entry, dir string, t task) ([]byte, []byte, error) {
+	e.ran = append(e.ran, t.command)
+	e.env = append(e.env, t.env)
+	e.workdirs = append(e.workdirs, t.workdir)
+	e.stdins = append(e.stdins, t.stdin)
+	command := strings.Join(t.command, " ")
+	if e.failures[command] {
+		return []byte("running " + command), []byte("it broke"), fakeExitError(2)
+	}
+	return []byte("running " + command), nil, nil
+}
+
+// fakeExitError is the error returned by a command that exited with the
+// given code.
+type fakeExitError int
+
+func (e fakeExitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func (e fakeExitError) ExitCode() int {
+	return int(e)
+}
+
+func mergedPREvent(t *testing.T, mutators ...func(*github.PullRequest)) []byte {
+	mergeSHA := "abcdef"
+	pr := github.PullRequest{
+		Number:   1,
+		Merged:   true,
+		MergeSHA: &mergeSHA,
+		Head:     github.PullRequestBranch{SHA: "123456"},
+		Base: github.PullRequestBranch{
+			Ref:  "master",
+			Repo: github.Repo{Owner: github.User{Login: "org"}, Name: "repo"},
+		},
+		User: github.User{Login: "author"},
+	}
+	for _, mutate := range mutators {
+		mutate(&pr)
+	}
+	payload, err := json.Marshal(github.PullRequestEvent{
+		Action:      github.PullRequestActionClosed,
+		Number:      pr.Number,
+		PullRequest: pr,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	return payload
+}
+
+func newTestServer(gc gitClient, ghc githubClient, config *UpdateConfig) *Server {
+	return &Server{
+		gc:               gc,
+		ghc:              ghc,
+		log:              logrus.WithField("plugin", pluginName),
+		configAgent:      &Agent{c: config},
+		executor:         &recordingExecutor{},
+		gitRetryDeadline: time.Second,
+		gitRetryBackoff:  time.Millisecond,
+	}
+}
+
+// checkComment verifies that exactly one comment containing expected was
+// posted, or none at all if expected is empty.
+func checkComment(t *testing.T, ghc *fakegithub.FakeClient, expected string) {
+	switch {
+	case expected == "" && len(ghc.IssueCommentsAdded) != 0:
+		t.Errorf("expected no comment, got %v", ghc.IssueCommentsAdded)
+	case expected != "" && len(ghc.IssueCommentsAdded) != 1:
+		t.Errorf("expected one comment, got %v", ghc.IssueCommentsAdded)
+	case expected != "" && !strings.Contains(ghc.IssueCommentsAdded[0], expected):
+		t.Errorf("expected comment to contain %q, got %q", expected, ghc.IssueCommentsAdded[0])
+	}
+}
+
+func TestHandleEventGitRetries(t *testing.T) {
+	var testcases = []struct {
+		name             string
+		cloneFailures    int
+		checkoutFailures int
+		deadline         time.Duration
+
+		expectedErr     bool
+		expectedClones  int
+		expectedFetches int
+		expectedComment string
+	}{
+		{
+			name:     "clone and checkout succeed first time",
+			deadline: time.Second,
+
+			expectedClones: 1,
+		},
+		{
+			name:          "transient clone failures are retried",
+			cloneFailures: 2,
+			deadline:      time.Second,
+
+			expectedClones: 3,
+		},
+		{
+			name:             "checkout failures fetch the commit before retrying",
+			checkoutFailures: 2,
+			deadline:         time.Second,
+
+			expectedClones:  1,
+			expectedFetches: 2,
+		},
+		{
+			name:          "clone failures past the deadline are reported",
+			cloneFailures: 2,
+
+			expectedErr:     true,
+			expectedClones:  1,
+			expectedComment: "error cloning",
+		},
+		{
+			name:             "checkout failures past the deadline are reported",
+			checkoutFailures: 2,
+
+			expectedErr:     true,
+			expectedClones:  1,
+			expectedComment: "error checking out 123456",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			gc := &fakeGit{cloneFailures: tc.cloneFailures, checkoutFailures: tc.checkoutFailures}
+			ghc := &fakegithub.FakeClient{IssueComments: map[int][]github.IssueComment{}}
+			s := newTestServer(gc, ghc, &UpdateConfig{MaxPRFiles: defaultMaxPRFiles})
+			s.gitRetryDeadline = tc.deadline
+
+			err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t))
+			if tc.expectedErr && err == nil {
+				t.Error("expected an error but got none")
+			}
+			if !tc.expectedErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if gc.clones != tc.expectedClones {
+				t.Errorf("expected %d clones, got %d", tc.expectedClones, gc.clones)
+			}
+			if len(gc.fetches) != tc.expectedFetches {
+				t.Errorf("expected %d fetches, got %d", tc.expectedFetches, len(gc.fetches))
+			}
+			checkComment(t, ghc, tc.expectedComment)
+		})
+	}
+}
+
+// cancelingExecutor cancels the event it runs tasks for after the first.
+type cancelingExecutor struct {
+	recordingExecutor
+	cancel func()
+}
+
+func (e *cancelingExecutor) Run(ctx context.Context, log *logrus.Entry, dir string, t task) ([]byte, []byte, error) {
+	e.cancel()
+	return e.recordingExecutor.Run(ctx, log, dir, t)
+}
+
+func TestHandleEventCancelled(t *testing.T) {
+	t.Run("cancelling stops retrying the clone", func(t *testing.T) {
+		gc := &fakeGit{cloneFailures: 2}
+		ghc := &fakegithub.FakeClient{IssueComments: map[int][]github.IssueComment{}}
+		s := newTestServer(gc, ghc, &UpdateConfig{MaxPRFiles: defaultMaxPRFiles})
+		s.gitRetryDeadline = time.Minute
+		s.gitRetryBackoff = time.Second
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := s.handleEvent(ctx, "pull_request", "guid", mergedPREvent(t)); err == nil {
+			t.Error("expected an error but got none")
+		}
+		if gc.clones != 1 {
+			t.Errorf("expected 1 clone, got %d", gc.clones)
+		}
+		checkComment(t, ghc, "context canceled")
+	})
+
+	t.Run("cancelling skips the remaining tasks", func(t *testing.T) {
+		ghc := &fakegithub.FakeClient{
+			IssueComments: map[int][]github.IssueComment{},
+			PullRequestChanges: map[int][]github.PullRequestChange{1: {
+				{Filename: "jobs/a.yaml"},
+				{Filename: "config/b.yaml"},
+			}},
+		}
+		s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+			Matchers: []Matcher{
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"},
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^config/`)}, Target: "config"},
+			},
+			MaxPRFiles: defaultMaxPRFiles,
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		executor := &cancelingExecutor{cancel: cancel}
+		s.executor = executor
+
+		if err := s.handleEvent(ctx, "pull_request", "guid", mergedPREvent(t)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := [][]string{{"/usr/bin/make", "jobs"}}; !reflect.DeepEqual(executor.ran, expected) {
+			t.Errorf("expected to run %q, got %q", expected, executor.ran)
+		}
+		checkComment(t, ghc, "stopped running updates: context canceled")
+	})
+}
+
+func TestHandleEventMaxPRFiles(t *testing.T) {
+	var testcases = []struct {
+		name       string
+		files      int
+		maxPRFiles int
+
+		expectedClones  int
+		expectedComment string
+	}{
+		{
+			name:       "PR under the limit is processed",
+			files:      2,
+			maxPRFiles: 2,
+
+			expectedClones: 1,
+		},
+		{
+			name:       "PR over the limit is skipped",
+			files:      3,
+			maxPRFiles: 2,
+
+			expectedComment: "This PR changes 3 files, which is more than the limit of 2",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var changes []github.PullRequestChange
+			for i := 0; i < tc.files; i++ {
+				changes = append(changes, github.PullRequestChange{Filename: fmt.Sprintf("file-%d", i)})
+			}
+			gc := &fakeGit{}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+			}
+			s := newTestServer(gc, ghc, &UpdateConfig{MaxPRFiles: tc.maxPRFiles})
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gc.clones != tc.expectedClones {
+				t.Errorf("expected %d clones, got %d", tc.expectedClones, gc.clones)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+		})
+	}
+}
+
+func TestHandleEventTruncatedChanges(t *testing.T) {
+	var testcases = []struct {
+		name         string
+		maxPRFiles   int
+		changedFiles int
+		diffErr      error
+
+		expectedDiffs   []string
+		expectedComment string
+	}{
+		{
+			name:         "complete change list is used as is",
+			maxPRFiles:   5000,
+			changedFiles: githubMaxListedFiles,
+		},
+		{
+			name:         "truncated change list is diffed locally",
+			maxPRFiles:   5000,
+			changedFiles: 3500,
+
+			expectedDiffs: []string{"abcdef^1..abcdef"},
+		},
+		{
+			name:         "failure to diff locally is reported",
+			maxPRFiles:   5000,
+			changedFiles: 3500,
+			diffErr:      errors.New("bad object"),
+
+			expectedDiffs:   []string{"abcdef^1..abcdef"},
+			expectedComment: "error listing all 3500 changed files, only the first 3000 were considered",
+		},
+		{
+			name:         "truncated change list is refused by the default limit",
+			maxPRFiles:   defaultMaxPRFiles,
+			changedFiles: 3500,
+
+			expectedComment: "This PR changes 3500 files, which is more than the limit of 50",
+		},
+	}
+
+	// The API lists as many changes as it does for the largest PRs.
+	var listed []github.PullRequestChange
+	for i := 0; i < githubMaxListedFiles; i++ {
+		listed = append(listed, github.PullRequestChange{Filename: fmt.Sprintf("docs/%d.md", i)})
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			gc := &fakeGit{diffErr: tc.diffErr}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: listed},
+			}
+			s := newTestServer(gc, ghc, &UpdateConfig{MaxPRFiles: tc.maxPRFiles})
+
+			event := mergedPREvent(t, func(pr *github.PullRequest) { pr.ChangedFiles = tc.changedFiles })
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", event); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(gc.diffs, tc.expectedDiffs) {
+				t.Errorf("expected diffs %v, got %v", tc.expectedDiffs, gc.diffs)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+		})
+	}
+}
+
+// makeRepoDir creates a temporary directory holding files, which the caller
+// must remove.
+func makeRepoDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "config-updater")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestHandleEventTasks(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		changes  []string
+		config   UpdateConfig
+		failures map[string]bool
+
+		expectedTasks   [][]string
+		expectedComment []string
+	}{
+		{
+			name:    "no tasks means no comment",
+			changes: []string{"README.md"},
+			config: UpdateConfig{
+				Targets:  []string{"config/service.yaml"},
+				Matchers: []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+			},
+		},
+		{
+			name:    "target matches apply the config",
+			changes: []string{"config/service.yaml", "config/template.yaml"},
+			config: UpdateConfig{
+				Targets: []string{"config/service.yaml", "config/template.yaml"},
+			},
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "applyTemplate", "WHAT=config/template.yaml"},
+			},
+			expectedComment: []string{"The following updates succeeded"},
+		},
+		{
+			name:    "matchers run their target once",
+			changes: []string{"jobs/a.yaml", "jobs/b.yaml", "README.md"},
+			config: UpdateConfig{
+				Matchers: []Matcher{
+					{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"},
+					{Regex: RegexpWrapper{*regexp.MustCompile(`^images/`)}, Target: "images"},
+				},
+			},
+			expectedTasks:   [][]string{{"/usr/bin/make", "jobs"}},
+			expectedComment: []string{"The following updates succeeded"},
+		},
+		{
+			name:    "mixed success and failure are both reported",
+			changes: []string{"config/service.yaml", "jobs/a.yaml"},
+			config: UpdateConfig{
+				Targets:  []string{"config/service.yaml"},
+				Matchers: []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+			},
+			failures: map[string]bool{"/usr/bin/make jobs": true},
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "jobs"},
+			},
+			expectedComment: []string{
+				"The following updates succeeded:\n<ul><li><details><summary><code>/usr/bin/make apply WHAT=config/service.yaml</code>",
+				"The following updates failed:\n<ul><li><details><summary><code>/usr/bin/make jobs</code>",
+				"<code>/usr/bin/make jobs</code> exited with code 2</summary>\n<details><summary>stdout</summary><pre><code>\nrunning /usr/bin/make jobs\n</code></pre></details>\n<details><summary>stderr</summary><pre><code>\nit broke\n</code></pre></details>\n</details></li>",
+			},
+		},
+		{
+			name:    "unparseable targets are internal errors",
+			changes: []string{"config/broken.yaml"},
+			config: UpdateConfig{
+				Targets: []string{"config/broken.yaml"},
+			},
+			expectedComment: []string{"The following internal errors occurred", "cannot access object kind from config/broken.yaml"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := makeRepoDir(t, map[string]string{
+				"config/service.yaml":  "kind: Service\n",
+				"config/template.yaml": "kind: Template\n",
+				"config/broken.yaml":   "metadata: {}\n",
+			})
+			defer os.RemoveAll(dir)
+
+			var changes []github.PullRequestChange
+			for _, change := range tc.changes {
+				changes = append(changes, github.PullRequestChange{Filename: change})
+			}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+			}
+			tc.config.MaxPRFiles = defaultMaxPRFiles
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &tc.config)
+			executor := &recordingExecutor{failures: tc.failures}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedTasks) {
+				t.Errorf("expected tasks %v, got %v", tc.expectedTasks, executor.ran)
+			}
+			if len(tc.expectedComment) == 0 {
+				checkComment(t, ghc, "")
+			}
+			for _, expected := range tc.expectedComment {
+				checkComment(t, ghc, expected)
+			}
+		})
+	}
+}
+
+func TestDetermineTargetForConfig(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		file     string
+		content  string
+		expected [][]string
+		errs     []string
+	}{
+		{
+			name:     "YAML template",
+			file:     "template.yaml",
+			content:  "apiVersion: v1\nkind: Template\n",
+			expected: [][]string{{"/usr/bin/make", "applyTemplate", "WHAT=template.yaml"}},
+		},
+		{
+			name:     "YAML object with .yml extension",
+			file:     "service.yml",
+			content:  "apiVersion: v1\nkind: Service\n",
+			expected: [][]string{{"/usr/bin/make", "apply", "WHAT=service.yml"}},
+		},
+		{
+			name:     "JSON template",
+			file:     "template.json",
+			content:  `{"apiVersion": "v1", "kind": "Template"}`,
+			expected: [][]string{{"/usr/bin/make", "applyTemplate", "WHAT=template.json"}},
+		},
+		{
+			name:     "JSON object",
+			file:     "service.json",
+			content:  `{"apiVersion": "v1", "kind": "Service"}`,
+			expected: [][]string{{"/usr/bin/make", "apply", "WHAT=service.json"}},
+		},
+		{
+			name:     "unknown extension containing JSON",
+			file:     "template",
+			content:  `{"apiVersion": "v1", "kind": "Template"}`,
+			expected: [][]string{{"/usr/bin/make", "applyTemplate", "WHAT=template"}},
+		},
+		{
+			name:     "unknown extension containing YAML",
+			file:     "service.conf",
+			content:  "apiVersion: v1\nkind: Service\n",
+			expected: [][]string{{"/usr/bin/make", "apply", "WHAT=service.conf"}},
+		},
+		{
+			name:    "YAML in a .json file",
+			file:    "service.json",
+			content: "apiVersion: v1\nkind: Service\n",
+			errs:    []string{"cannot parse object YAML/JSON from service.json"},
+		},
+		{
+			name:     "kustomization without a kind",
+			file:     "kustomization.yaml",
+			content:  "resources:\n- service.yaml\n",
+			expected: [][]string{{"/usr/bin/kubectl", "apply", "-k", "."}},
+		},
+		{
+			name:     "kustomization by kind",
+			file:     "overlay.yaml",
+			content:  "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\n",
+			expected: [][]string{{"/usr/bin/kubectl", "apply", "-k", "."}},
+		},
+		{
+			name:     "two documents with the same target",
+			file:     "services.yaml",
+			content:  "apiVersion: v1\nkind: Service\n---\napiVersion: v1\nkind: Route\n",
+			expected: [][]string{{"/usr/bin/make", "apply", "WHAT=services.yaml"}},
+		},
+		{
+			name:    "three documents with different targets",
+			file:    "app.yaml",
+			content: "# The app.\n---\napiVersion: v1\nkind: Template\n--- # its service\napiVersion: v1\nkind: Service\n---\napiVersion: v1\nkind: Template\n",
+			expected: [][]string{
+				{"/usr/bin/make", "applyTemplate", "WHAT=app.yaml"},
+				{"/usr/bin/make", "apply", "WHAT=app.yaml"},
+			},
+		},
+		{
+			name:     "three documents, two of which are broken",
+			file:     "app.yml",
+			content:  "apiVersion: v1\nmetadata: {}\n---\nkind: [Service\n---\napiVersion: v1\nkind: Template\n",
+			expected: [][]string{{"/usr/bin/make", "applyTemplate", "WHAT=app.yml"}},
+			errs: []string{
+				"cannot access object kind from document 1 of app.yml",
+				"cannot parse object YAML/JSON from document 2 of app.yml",
+			},
+		},
+		{
+			name:    "two broken documents",
+			file:    "app.yaml",
+			content: "apiVersion: v1\n---\napiVersion: v1\n",
+			errs: []string{
+				"cannot access object kind from document 1 of app.yaml",
+				"cannot access object kind from document 2 of app.yaml",
+			},
+		},
+		{
+			name:    "missing kind",
+			file:    "service.json",
+			content: `{"apiVersion": "v1"}`,
+			errs:    []string{"cannot access object kind from service.json"},
+		},
+		{
+			name: "missing file",
+			file: "missing.yaml",
+			errs: []string{"cannot read object YAML/JSON from missing.yaml"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "config-updater")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			if tc.content != "" {
+				if err := ioutil.WriteFile(filepath.Join(dir, tc.file), []byte(tc.content), 0644); err != nil {
+					t.Fatalf("failed to write file: %v", err)
+				}
+			}
+
+			commands, errs := determineTargetForConfig("/usr/bin/make", defaultKustomizeBinary, dir, tc.file)
+			var messages []string
+			for _, err := range errs {
+				messages = append(messages, err.Error())
+			}
+			if !reflect.DeepEqual(messages, tc.errs) {
+				t.Errorf("expected errors %q, got %q", tc.errs, messages)
+			}
+			if !reflect.DeepEqual(commands, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, commands)
+			}
+		})
+	}
+}
+
+func TestHandleEventMultipleDocuments(t *testing.T) {
+	dir := makeRepoDir(t, map[string]string{
+		"config/app.yaml": "kind: Template\n---\nkind: [Service\n---\nkind: Service\n",
+	})
+	defer os.RemoveAll(dir)
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "config/app.yaml"}}},
+	}
+	s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+		Targets:    []string{"config/app.yaml"},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := [][]string{
+		{"/usr/bin/make", "applyTemplate", "WHAT=config/app.yaml"},
+		{"/usr/bin/make", "apply", "WHAT=config/app.yaml"},
+	}
+	if !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected to run %q, got %q", expected, executor.ran)
+	}
+	checkComment(t, ghc, "cannot parse object YAML/JSON from document 2 of config/app.yaml")
+}
+
+func TestHandleEventTriggersJenkins(t *testing.T) {
+	var builds, tokens []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		builds = append(builds, r.URL.Path)
+		tokens = append(tokens, r.URL.Query().Get("token"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	dir := makeRepoDir(t, map[string]string{
+		"jobs/applied.yaml":   "kind: BuildConfig\nmetadata:\n  name: applied\n",
+		"jobs/failed.yaml":    "kind: BuildConfig\nmetadata:\n  name: failed\n",
+		"jobs/unnamed.json":   `{"kind": "BuildConfig", "metadata": {}}`,
+		"jobs/templated.json": `{"kind": "Template", "metadata": {"name": "templated"}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	var changes []github.PullRequestChange
+	for _, change := range []string{"jobs/applied.yaml", "jobs/failed.yaml", "jobs/unnamed.json", "jobs/templated.json"} {
+		changes = append(changes, github.PullRequestChange{Filename: change})
+	}
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+	}
+	s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+		Targets:    []string{"jobs/applied.yaml", "jobs/failed.yaml", "jobs/unnamed.json", "jobs/templated.json"},
+		Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make apply WHAT=jobs/failed.yaml": true}}
+	s.JenkinsURL = ts.URL
+	// The token is rotated after the first build.
+	s.JenkinsToken = func() []byte {
+		if len(tokens) == 0 {
+			return []byte("old")
+		}
+		return []byte("new")
+	}
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"/job/applied/build", "/job/templated/build"}; !reflect.DeepEqual(builds, expected) {
+		t.Errorf("expected builds %v, got %v", expected, builds)
+	}
+	if expected := []string{"old", "new"}; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("expected builds with tokens %v, got %v", expected, tokens)
+	}
+	checkComment(t, ghc, "cannot access object name from jobs/unnamed.json")
+}
+
+func TestFormatDetails(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		result   result
+		expected string
+	}{
+		{
+			name:   "successful command with only stdout",
+			result: result{command: []string{"make", "apply"}, stdout: "applied"},
+			expected: `<li><details><summary><code>make apply</code> exited with code 0</summary>
+<details><summary>stdout</summary><pre><code>
+applied
+</code></pre></details>
+</details></li>`,
+		},
+		{
+			name:   "failed command with stdout and stderr",
+			result: result{command: []string{"make", "apply"}, stdout: "applying", stderr: "oops", exitCode: 2, err: fakeExitError(2)},
+			expected: `<li><details><summary><code>make apply</code> exited with code 2</summary>
+<details><summary>stdout</summary><pre><code>
+applying
+</code></pre></details>
+<details><summary>stderr</summary><pre><code>
+oops
+</code></pre></details>
+</details></li>`,
+		},
+		{
+			name:   "command run in a workdir",
+			result: result{command: []string{"make", "apply"}, workdir: "cluster/ci", stdout: "applied"},
+			expected: `<li><details><summary><code>make apply</code> in <code>cluster/ci</code> exited with code 0</summary>
+<details><summary>stdout</summary><pre><code>
+applied
+</code></pre></details>
+</details></li>`,
+		},
+		{
+			name:   "command killed for exceeding a limit",
+			result: result{command: []string{"make", "apply"}, stdout: "applying", exitCode: -1, err: &limitError{limit: "memory", value: "1024 bytes"}},
+			expected: `<li><details><summary><code>make apply</code> failed: killed for exceeding the memory limit of 1024 bytes</summary>
+<details><summary>stdout</summary><pre><code>
+applying
+</code></pre></details>
+</details></li>`,
+		},
+		{
+			name:   "command that could not run",
+			result: result{command: []string{"make", "apply"}, exitCode: -1, err: errors.New("executable file not found")},
+			expected: `<li><details><summary><code>make apply</code> failed: executable file not found</summary>
+</details></li>`,
+		},
+		{
+			name:   "output cannot close its section",
+			result: result{command: []string{"make", "apply"}, stdout: "\x1b[31mdone</code></pre></details><img src=x> & more"},
+			expected: `<li><details><summary><code>make apply</code> exited with code 0</summary>
+<details><summary>stdout</summary><pre><code>
+done&lt;/code&gt;&lt;/pre&gt;&lt;/details&gt;&lt;img src=x&gt; &amp; more
+</code></pre></details>
+</details></li>`,
+		},
+		{
+			name: "markup in the values is escaped",
+			result: result{
+				command:  []string{"make", "apply", "WHAT=</code><b>a.yaml"},
+				workdir:  "<i>dir",
+				cluster:  "<cluster>",
+				image:    "image<br>",
+				files:    []string{"a</code>.yaml", "<b>.yaml"},
+				exitCode: -1,
+				err:      errors.New("<script>"),
+			},
+			expected: `<li><details><summary><code>make apply WHAT=&lt;/code&gt;&lt;b&gt;a.yaml</code> in <code>&lt;i&gt;dir</code> on cluster <code>&lt;cluster&gt;</code> failed: &lt;script&gt;</summary>
+Ran in <code>image&lt;br&gt;</code>
+Ran once for <code>a&lt;/code&gt;.yaml</code>, <code>&lt;b&gt;.yaml</code>
+</details></li>`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := formatDetails(tc.result); actual != tc.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	_, _, err := (&execExecutor{}).Run(context.Background(), logrus.NewEntry(logrus.New()), "", task{command: []string{"sh", "-c", "exit 3"}})
+	if code := exitCode(err); code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+	if code := exitCode(nil); code != 0 {
+		t.Errorf("expected exit code 0 without an error, got %d", code)
+	}
+	if code := exitCode(errors.New("not found")); code != -1 {
+		t.Errorf("expected exit code -1 for a command that did not run, got %d", code)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		results  results
+		expected string
+	}{
+		{
+			name:     "no results",
+			expected: "0 succeeded, 0 failed, 0 internal errors",
+		},
+		{
+			name:     "some of everything",
+			results:  results{succeeded: make([]result, 3), failed: make([]result, 1), skipped: make([][]string, 2), rollbacks: []result{{err: errors.New("oops")}}},
+			expected: "3 succeeded, 1 failed, 0 internal errors, 2 skipped, a rollback failed and manual intervention is required",
+		},
+		{
+			name: "long summary is truncated",
+			results: results{
+				succeeded:    make([]result, 100000),
+				failed:       make([]result, 100000),
+				internal:     make([]error, 100000),
+				skipped:      make([][]string, 100000),
+				pullRequests: make([]string, 100000),
+				rollbacks:    []result{{err: errors.New("oops")}},
+			},
+			expected: "100000 succeeded, 100000 failed, 100000 internal errors, 100000 skipped, 100000 pull requests opened, a rollback failed and manual interv...",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			summary := tc.results.Summary()
+			if summary != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, summary)
+			}
+			if len(summary) > maxSummaryLength {
+				t.Errorf("expected at most %d characters, got %d", maxSummaryLength, len(summary))
+			}
+		})
+	}
+}
+
+func TestFormatSummary(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		results  results
+		expected string
+	}{
+		{
+			name: "all succeeded",
+			results: results{succeeded: []result{
+				{command: []string{"/usr/bin/make", "jobs"}, duration: 1500 * time.Millisecond},
+				{command: []string{"/usr/bin/make", "apply", "WHAT=config/a.yaml"}, duration: 4*time.Minute + 30*time.Second},
+			}},
+			expected: "**2 succeeded, 0 failed, 0 internal errors — total 4m32s**\n\n" +
+				"| Task | Status | Duration |\n" +
+				"| --- | --- | --- |\n" +
+				"| <code>/usr/bin/make jobs</code> | succeeded | 2s |\n" +
+				"| <code>/usr/bin/make apply WHAT=config/a.yaml</code> | succeeded | 4m30s |\n\n",
+		},
+		{
+			name: "mixed",
+			results: results{
+				succeeded: []result{{command: []string{"/usr/bin/make", "jobs"}, cluster: "ci", duration: 200 * time.Millisecond}},
+				failed:    []result{{command: []string{"/usr/bin/make", "apply", "WHAT=a|b <c>"}, duration: 3 * time.Second, err: errors.New("oops")}},
+				internal:  []error{errors.New("oops")},
+			},
+			expected: "**1 succeeded, 1 failed, 1 internal errors — total 3s**\n\n" +
+				"| Task | Status | Duration |\n" +
+				"| --- | --- | --- |\n" +
+				"| <code>/usr/bin/make jobs on ci</code> | succeeded | <1s |\n" +
+				"| <code>/usr/bin/make apply WHAT=a&#124;b &lt;c&gt;</code> | failed | 3s |\n\n",
+		},
+		{
+			name:     "only internal errors",
+			results:  results{internal: []error{errors.New("oops")}},
+			expected: "**0 succeeded, 0 failed, 1 internal errors — total <1s**\n\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if summary := tc.results.formatSummary(); summary != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, summary)
+			}
+			if comment := tc.results.formatResults(); !strings.HasPrefix(comment, tc.expected) {
+				t.Errorf("expected the comment to start with the summary, got %q", comment)
+			}
+		})
+	}
+
+	internalOnly := results{internal: []error{errors.New("oops")}}
+	expected := "**0 succeeded, 0 failed, 1 internal errors — total <1s**\n\n" +
+		"The following internal errors occurred:\n<ul><li>oops</li></ul>\n"
+	if comment := internalOnly.formatResults(); comment != expected {
+		t.Errorf("expected %q, got %q", expected, comment)
+	}
+}
+
+func TestIsSuccess(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		results  results
+		expected bool
+	}{
+		{
+			name:     "no failures or internal errors",
+			results:  results{succeeded: make([]result, 2), skipped: make([][]string, 1)},
+			expected: true,
+		},
+		{
+			name:    "failures",
+			results: results{succeeded: make([]result, 2), failed: make([]result, 1)},
+		},
+		{
+			name:    "internal errors",
+			results: results{internal: []error{errors.New("oops")}},
+		},
+		{
+			name:    "failures and internal errors",
+			results: results{failed: make([]result, 1), internal: []error{errors.New("oops")}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if success := tc.results.IsSuccess(); success != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, success)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		output   string
+		expected string
+	}{
+		{
+			name:     "plain output is untouched",
+			output:   "deployment.apps/web configured\n\tdone\n",
+			expected: "deployment.apps/web configured\n\tdone\n",
+		},
+		{
+			name:     "kubectl diff colors",
+			output:   "\x1b[1mdiff -u -N /tmp/LIVE/apps.v1.Deployment.web\x1b[0m\n\x1b[31m-  replicas: 1\x1b[0m\n\x1b[32m+  replicas: 3\x1b[0m\n",
+			expected: "diff -u -N /tmp/LIVE/apps.v1.Deployment.web\n-  replicas: 1\n+  replicas: 3\n",
+		},
+		{
+			name:     "terraform plan with bold and 256 colors",
+			output:   "\x1b[0m\x1b[1m\x1b[32mApply complete! Resources: 1 added, 0 changed, 0 destroyed.\x1b[0m\n\x1b[38;5;208mwarning\x1b[39m\r\n",
+			expected: "Apply complete! Resources: 1 added, 0 changed, 0 destroyed.\nwarning\n",
+		},
+		{
+			name:     "progress bars with cursor movement",
+			output:   "pulling\x1b[2K\x1b[1Gpulled\x1b[?25h\x08\n",
+			expected: "pullingpulled\n",
+		},
+		{
+			name:     "hyperlinks and window titles",
+			output:   "\x1b]0;make apply\x07see \x1b]8;;https://example.com\x1b\\docs\x1b]8;;\x1b\\\n",
+			expected: "see docs\n",
+		},
+		{
+			name:     "other control characters",
+			output:   "bell\x07 null\x00 escape\x1bM\n",
+			expected: "bell null escape\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := sanitize(tc.output); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandleEventTaskEnvironment(t *testing.T) {
+	dir := makeRepoDir(t, map[string]string{"config/service.yaml": "kind: Service\n"})
+	defer os.RemoveAll(dir)
+
+	var changes []github.PullRequestChange
+	for _, change := range []string{"config/service.yaml", "jobs/a.yaml", "README.md", "jobs/b.yaml"} {
+		changes = append(changes, github.PullRequestChange{Filename: change})
+	}
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+	}
+	s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+		Targets:    []string{"config/service.yaml"},
+		Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	common := []string{
+		"PULL_NUMBER=1",
+		"PULL_BASE_REF=master",
+		"PULL_MERGE_SHA=abcdef",
+		"REPO_OWNER=org",
+		"REPO_NAME=repo",
+		"PULL_AUTHOR=author",
+	}
+	expected := [][]string{
+		append(append([]string{}, common...), "CHANGED_FILES=config/service.yaml"),
+		append(append([]string{}, common...), "CHANGED_FILES=jobs/a.yaml\njobs/b.yaml"),
+	}
+	if !reflect.DeepEqual(executor.env, expected) {
+		t.Errorf("expected environments %v, got %v", expected, executor.env)
+	}
+}
+
+func TestHandleEventFailFast(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		failFast        bool
+		continueOnError bool
+
+		expectedTasks      [][]string
+		expectedComment    string
+		notExpectedComment string
+	}{
+		{
+			name: "all tasks run by default",
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "generate"},
+				{"/usr/bin/make", "apply"},
+				{"/usr/bin/make", "verify"},
+			},
+			notExpectedComment: "skipped",
+		},
+		{
+			name:     "fail-fast skips tasks after a failure",
+			failFast: true,
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "generate"},
+			},
+			expectedComment: "The following updates failed:\n<ul><li><details><summary><code>/usr/bin/make generate</code> exited with code 2</summary>\n<details><summary>stdout</summary><pre><code>\nrunning /usr/bin/make generate\n</code></pre></details>\n<details><summary>stderr</summary><pre><code>\nit broke\n</code></pre></details>\n</details></li></ul>\nThe following updates were skipped because an earlier update failed:\n<ul><li><code>/usr/bin/make apply</code></li><li><code>/usr/bin/make verify</code></li></ul>\n",
+		},
+		{
+			name:            "failing task may continue on error",
+			failFast:        true,
+			continueOnError: true,
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "generate"},
+				{"/usr/bin/make", "apply"},
+				{"/usr/bin/make", "verify"},
+			},
+			notExpectedComment: "skipped",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers: []Matcher{
+					{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "generate", ContinueOnError: tc.continueOnError},
+					{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "apply"},
+					{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "verify"},
+				},
+				MaxPRFiles: defaultMaxPRFiles,
+				FailFast:   tc.failFast,
+			})
+			executor := &recordingExecutor{failures: map[string]bool{"/usr/bin/make generate": true}}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedTasks) {
+				t.Errorf("expected tasks %v, got %v", tc.expectedTasks, executor.ran)
+			}
+			if tc.expectedComment != "" {
+				checkComment(t, ghc, tc.expectedComment)
+			}
+			if tc.notExpectedComment != "" && strings.Contains(ghc.IssueCommentsAdded[0], tc.notExpectedComment) {
+				t.Errorf("expected comment not to contain %q, got %q", tc.notExpectedComment, ghc.IssueCommentsAdded[0])
+			}
+		})
+	}
+}
+
+func TestInflightRequests(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{})
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	s.executor = &blockingExecutor{started: started, block: block}
+
+	health := func() string {
+		w := httptest.NewRecorder()
+		s.ServeHealth(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return w.Body.String()
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t))
+	}()
+	<-started
+	if body := health(); body != `{"inflight": 1}` {
+		t.Errorf("expected one event in flight, got %s", body)
+	}
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if body := health(); body != `{"inflight": 0}` {
+		t.Errorf("expected no events in flight, got %s", body)
+	}
+}
+
+// blockingExecutor signals started when a task runs and then waits for
+// block to be closed.
+type blockingExecutor struct {
+	started chan struct{}
+	block   chan struct{}
+}
+
+func (e *blockingExecutor) Run(ctx context.Context, log *logrus.Entry, dir string, t task) ([]byte, []byte, error) {
+	close(e.started)
+	select {
+	case <-e.block:
+		return nil, nil, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+func TestServeHTTPCancelsEvent(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		shutdown        bool
+		expectedComment string
+	}{
+		{
+			name:            "client disconnecting stops the updates",
+			expectedComment: "context canceled",
+		},
+		{
+			name:            "shutting down stops the updates",
+			shutdown:        true,
+			expectedComment: "context canceled",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			secret := []byte("secret")
+			block := make(chan struct{})
+			started := make(chan struct{})
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.hmacSecret = func() []byte { return secret }
+			s.executor = &blockingExecutor{started: started, block: block}
+			server := httptest.NewServer(s)
+
+			payload := mergedPREvent(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(payload))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			req = req.WithContext(ctx)
+			req.Header.Set("X-GitHub-Event", "pull_request")
+			req.Header.Set("X-GitHub-Delivery", "guid")
+			req.Header.Set("X-Hub-Signature", github.PayloadSignature(payload, secret))
+			req.Header.Set("content-type", "application/json")
+			// The response is flushed before the task runs, so it arrives
+			// while the task is blocked.
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			<-started
+			if tc.shutdown {
+				s.Shutdown()
+			} else {
+				cancel()
+			}
+			defer resp.Body.Close()
+			// Closing waits for the event to be handled.
+			server.Close()
+			checkComment(t, ghc, tc.expectedComment)
+		})
+	}
+}
+
+func TestHandleEventDeduplicatesTasks(t *testing.T) {
+	dir := makeRepoDir(t, map[string]string{"config/service.yaml": "kind: Service\n"})
+	defer os.RemoveAll(dir)
+
+	var changes []github.PullRequestChange
+	for _, change := range []string{"config/service.yaml", "jobs/a.yaml", "images/b.yaml", "jobs/c.yaml"} {
+		changes = append(changes, github.PullRequestChange{Filename: change})
+	}
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+	}
+	s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+		Targets: []string{"config/service.yaml", "config/service.yaml"},
+		Matchers: []Matcher{
+			{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"},
+			{Regex: RegexpWrapper{*regexp.MustCompile(`^images/`)}, Target: "images"},
+			{Regex: RegexpWrapper{*regexp.MustCompile(`\.yaml$`)}, Target: "jobs"},
+		},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedTasks := [][]string{
+		{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+		{"/usr/bin/make", "jobs"},
+		{"/usr/bin/make", "images"},
+	}
+	if !reflect.DeepEqual(executor.ran, expectedTasks) {
+		t.Errorf("expected tasks %v, got %v", expectedTasks, executor.ran)
+	}
+	if changed := executor.env[1][len(executor.env[1])-1]; changed != "CHANGED_FILES=jobs/a.yaml\njobs/c.yaml\nconfig/service.yaml\nimages/b.yaml" {
+		t.Errorf("expected folded task to run for every file, got %q", changed)
+	}
+	for _, expected := range []string{
+		"<code>/usr/bin/make apply WHAT=config/service.yaml</code> exited with code 0</summary>\nRan once for <code>config/service.yaml</code>\n",
+		"<code>/usr/bin/make jobs</code> exited with code 0</summary>\nRan once for <code>jobs/a.yaml</code>, <code>jobs/c.yaml</code>, <code>config/service.yaml</code>, <code>images/b.yaml</code>\n",
+		"<code>/usr/bin/make images</code> exited with code 0</summary>\n<details>",
+	} {
+		checkComment(t, ghc, expected)
+	}
+}
+
+func TestCommentTemplate(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		template string
+
+		expectedErr     bool
+		expectedComment string
+	}{
+		{
+			name:            "default format",
+			expectedComment: "org/repo#1:@author: This PR changes 2 files",
+		},
+		{
+			name:            "custom template",
+			template:        "{{ .Org }} PR #{{ .PR.Number }} by {{ .PR.User.Login }}: {{ .Results }}",
+			expectedComment: "org/repo#1:org PR #1 by author: This PR changes 2 files",
+		},
+		{
+			name:        "broken template",
+			template:    "{{ .Results",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "a"}, {Filename: "b"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{MaxPRFiles: 1})
+			s.CommentTemplate = tc.template
+
+			err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t))
+			if tc.expectedErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if tc.expectedComment != "" && !strings.HasPrefix(ghc.IssueCommentsAdded[0], tc.expectedComment) {
+				t.Errorf("expected comment to start with %q, got %q", tc.expectedComment, ghc.IssueCommentsAdded[0])
+			}
+		})
+	}
+}
+
+func TestMakeBinary(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		server   string
+		config   string
+		expected []string
+	}{
+		{
+			name:     "default make",
+			expected: []string{"/usr/bin/make", "/usr/bin/make"},
+		},
+		{
+			name:     "make from config",
+			config:   "/usr/local/bin/make",
+			expected: []string{"/usr/local/bin/make", "/usr/local/bin/make"},
+		},
+		{
+			name:     "make from flag overrides config",
+			server:   "gmake",
+			config:   "/usr/local/bin/make",
+			expected: []string{"gmake", "gmake"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := makeRepoDir(t, map[string]string{"config/service.yaml": "kind: Service\n"})
+			defer os.RemoveAll(dir)
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "config/service.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:    []string{"config/service.yaml"},
+				Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^config/`)}, Target: "config"}},
+				MakeBinary: tc.config,
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.MakeBinary = tc.server
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var binaries []string
+			for _, command := range executor.ran {
+				binaries = append(binaries, command[0])
+			}
+			if !reflect.DeepEqual(binaries, tc.expected) {
+				t.Errorf("expected make binaries %v, got %v", tc.expected, binaries)
+			}
+		})
+	}
+}
+
+func TestHandleEventRollback(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		failures map[string]bool
+
+		expectedTasks      [][]string
+		expectedComment    []string
+		notExpectedComment string
+	}{
+		{
+			name: "successful tasks are not rolled back",
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "jobs"},
+			},
+			notExpectedComment: "rollback",
+		},
+		{
+			name: "failed apply is rolled back even when failing fast",
+			failures: map[string]bool{
+				"/usr/bin/make apply WHAT=config/service.yaml": true,
+			},
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+				{"/usr/bin/git", "checkout", "HEAD^", "--", "config/service.yaml"},
+			},
+			expectedComment: []string{
+				"The following rollbacks were run for failed updates:\n<ul><li><details><summary><code>/usr/bin/git checkout HEAD^ -- config/service.yaml</code> exited with code 0</summary>",
+				"The following updates were skipped because an earlier update failed:\n<ul><li><code>/usr/bin/make jobs</code></li></ul>",
+			},
+			notExpectedComment: "Manual intervention is required",
+		},
+		{
+			name: "failed rollback escalates",
+			failures: map[string]bool{
+				"/usr/bin/make jobs":          true,
+				"/usr/bin/make jobs-rollback": true,
+			},
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "jobs"},
+				{"/usr/bin/make", "jobs-rollback"},
+			},
+			expectedComment: []string{
+				"**:rotating_light: A rollback failed, so some updates may be half-applied. Manual intervention is required. :rotating_light:**",
+				"The following rollbacks were run for failed updates:\n<ul><li><details><summary><code>/usr/bin/make jobs-rollback</code> exited with code 2</summary>",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := makeRepoDir(t, map[string]string{"config/service.yaml": "kind: Service\n"})
+			defer os.RemoveAll(dir)
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "config/service.yaml"}, {Filename: "jobs/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:            []string{"config/service.yaml"},
+				AllowedExecutables: []string{"/usr/bin/make", "/usr/bin/git"},
+				TargetRollbacks: map[string]Rollback{
+					"config/service.yaml": {Command: []string{"/usr/bin/git", "checkout", "HEAD^", "--", "config/service.yaml"}},
+				},
+				Matchers: []Matcher{{
+					Regex:    RegexpWrapper{*regexp.MustCompile(`^jobs/`)},
+					Target:   "jobs",
+					Rollback: &Rollback{Command: []string{"/usr/bin/make", "jobs-rollback"}, Timeout: time.Minute},
+				}},
+				MaxPRFiles: defaultMaxPRFiles,
+				FailFast:   true,
+			})
+			executor := &recordingExecutor{failures: tc.failures}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedTasks) {
+				t.Errorf("expected tasks %v, got %v", tc.expectedTasks, executor.ran)
+			}
+			for _, expected := range tc.expectedComment {
+				checkComment(t, ghc, expected)
+			}
+			if tc.notExpectedComment != "" && strings.Contains(ghc.IssueCommentsAdded[0], tc.notExpectedComment) {
+				t.Errorf("expected comment not to contain %q, got %q", tc.notExpectedComment, ghc.IssueCommentsAdded[0])
+			}
+		})
+	}
+}
+
+func TestHandleEventMatcherPriority(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		matchers []Matcher
+		changes  []string
+
+		expectedTasks [][]string
+		expectedEnv   []string
+	}{
+		{
+			name: "matchers run in descending priority",
+			matchers: []Matcher{
+				{Regex: RegexpWrapper{*regexp.MustCompile(`.*`)}, Target: "all"},
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Priority: 10},
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^images/`)}, Target: "images", Priority: 10},
+			},
+			changes: []string{"jobs/a.yaml"},
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "jobs"},
+				{"/usr/bin/make", "all"},
+			},
+			expectedEnv: []string{"CHANGED_FILES=jobs/a.yaml", "CHANGED_FILES=jobs/a.yaml"},
+		},
+		{
+			name: "specific matcher stops catch-all from firing",
+			matchers: []Matcher{
+				{Regex: RegexpWrapper{*regexp.MustCompile(`.*`)}, Target: "all"},
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Priority: 10, StopOnMatch: true},
+			},
+			changes: []string{"jobs/a.yaml"},
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "jobs"},
+			},
+			expectedEnv: []string{"CHANGED_FILES=jobs/a.yaml"},
+		},
+		{
+			name: "catch-all still fires for files that were not claimed",
+			matchers: []Matcher{
+				{Regex: RegexpWrapper{*regexp.MustCompile(`.*`)}, Target: "all"},
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Priority: 10, StopOnMatch: true},
+			},
+			changes: []string{"jobs/a.yaml", "README.md"},
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "jobs"},
+				{"/usr/bin/make", "all"},
+			},
+			expectedEnv: []string{"CHANGED_FILES=jobs/a.yaml", "CHANGED_FILES=README.md"},
+		},
+		{
+			name: "stop on match does not affect higher priority matchers",
+			matchers: []Matcher{
+				{Regex: RegexpWrapper{*regexp.MustCompile(`.*`)}, Target: "all", StopOnMatch: true},
+				{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Priority: 10},
+			},
+			changes: []string{"jobs/a.yaml"},
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "jobs"},
+				{"/usr/bin/make", "all"},
+			},
+			expectedEnv: []string{"CHANGED_FILES=jobs/a.yaml", "CHANGED_FILES=jobs/a.yaml"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var changes []github.PullRequestChange
+			for _, change := range tc.changes {
+				changes = append(changes, github.PullRequestChange{Filename: change})
+			}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+			}
+			config := &UpdateConfig{Matchers: tc.matchers, MaxPRFiles: defaultMaxPRFiles}
+			s := newTestServer(&fakeGit{}, ghc, config)
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedTasks) {
+				t.Errorf("expected tasks %v, got %v", tc.expectedTasks, executor.ran)
+			}
+			var env []string
+			for _, taskEnv := range executor.env {
+				env = append(env, taskEnv[len(taskEnv)-1])
+			}
+			if !reflect.DeepEqual(env, tc.expectedEnv) {
+				t.Errorf("expected changed files %v, got %v", tc.expectedEnv, env)
+			}
+			if !reflect.DeepEqual(config.Matchers, tc.matchers) {
+				t.Errorf("expected config to be left alone, got %v", config.Matchers)
+			}
+		})
+	}
+}
+
+func TestHandleEventVerification(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		failures map[string]bool
+		retries  int
+
+		expectedTasks   [][]string
+		expectedFailed  bool
+		expectedComment []string
+	}{
+		{
+			name: "apply and verify succeed",
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "verify", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "jobs"},
+				{"/usr/local/bin/smoke"},
+			},
+			expectedComment: []string{
+				"<code>/usr/bin/make apply WHAT=config/service.yaml</code> exited with code 0</summary>\n<details><summary>stdout</summary><pre><code>\nrunning /usr/bin/make apply WHAT=config/service.yaml\n</code></pre></details>\n<details><summary>Verification <code>/usr/bin/make verify WHAT=config/service.yaml</code> exited with code 0</summary>\n",
+			},
+		},
+		{
+			name:     "apply succeeds but verification fails",
+			failures: map[string]bool{"/usr/bin/make verify WHAT=config/service.yaml": true},
+			retries:  2,
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "verify", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "verify", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "verify", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "jobs"},
+				{"/usr/local/bin/smoke"},
+			},
+			expectedComment: []string{
+				"The following updates failed:\n<ul><li><details><summary><code>/usr/bin/make apply WHAT=config/service.yaml</code> exited with code 0</summary>",
+				"<details><summary>Verification <code>/usr/bin/make verify WHAT=config/service.yaml</code> exited with code 2 after 3 attempts</summary>\n<details><summary>stdout</summary><pre><code>\nrunning /usr/bin/make verify WHAT=config/service.yaml\n</code></pre></details>\n<details><summary>stderr</summary><pre><code>\nit broke\n</code></pre></details>\n</details>\n</details></li></ul>",
+			},
+		},
+		{
+			name:     "failed apply is not verified",
+			failures: map[string]bool{"/usr/bin/make jobs": true},
+			expectedTasks: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "verify", "WHAT=config/service.yaml"},
+				{"/usr/bin/make", "jobs"},
+			},
+			expectedComment: []string{"The following updates failed:\n<ul><li><details><summary><code>/usr/bin/make jobs</code> exited with code 2</summary>"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := makeRepoDir(t, map[string]string{"config/service.yaml": "kind: Service\n"})
+			defer os.RemoveAll(dir)
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "config/service.yaml"}, {Filename: "jobs/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:            []string{"config/service.yaml"},
+				AllowedExecutables: []string{"/usr/bin/make", "/usr/local/bin/smoke"},
+				KindVerifications: map[string]Verification{
+					"Service":  {Target: "verify", Retries: tc.retries},
+					"Template": {Target: "verifyTemplate"},
+				},
+				Matchers: []Matcher{
+					{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Verify: &Verification{Command: []string{"/usr/local/bin/smoke"}}},
+				},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{failures: tc.failures}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedTasks) {
+				t.Errorf("expected tasks %v, got %v", tc.expectedTasks, executor.ran)
+			}
+			for _, expected := range tc.expectedComment {
+				checkComment(t, ghc, expected)
+			}
+		})
+	}
+}
+
+func TestHandleEventTargetRepo(t *testing.T) {
+	source := makeRepoDir(t, map[string]string{"config/a.yaml": "a: new\n", "jobs/b.yaml": "b\n"})
+	defer os.RemoveAll(source)
+	target := makeRepoDir(t, map[string]string{"config/a.yaml": "a: old\n", "config/gone.yaml": "gone\n"})
+	defer os.RemoveAll(target)
+
+	gc := &fakeGit{dir: source, repoDirs: map[string]string{"other/configs": target}}
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "config/a.yaml"},
+			{Filename: "config/gone.yaml", Status: "removed"},
+			{Filename: "jobs/b.yaml"},
+		}},
+	}
+	s := newTestServer(gc, ghc, &UpdateConfig{
+		Matchers: []Matcher{
+			{Regex: RegexpWrapper{*regexp.MustCompile(`^config/`)}, TargetRepo: "other/configs"},
+			{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"},
+		},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := [][]string{{"/usr/bin/make", "jobs"}}; !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected tasks %v, got %v", expected, executor.ran)
+	}
+	if expected := []string{"other/configs"}; !reflect.DeepEqual(ghc.ReposForked, expected) {
+		t.Errorf("expected forks %v, got %v", expected, ghc.ReposForked)
+	}
+	if expected := []string{"other/configs:config-updater-org-repo-1"}; !reflect.DeepEqual(gc.branches, expected) {
+		t.Errorf("expected branches %v, got %v", expected, gc.branches)
+	}
+	if expected := []string{"configs:config-updater-org-repo-1"}; !reflect.DeepEqual(gc.pushes, expected) {
+		t.Errorf("expected pushes %v, got %v", expected, gc.pushes)
+	}
+	if expected := []string{"k8s-ci-robot <k8s-ci-robot@users.noreply.github.com>: Update from org/repo#1"}; !reflect.DeepEqual(gc.commits, expected) {
+		t.Errorf("expected commits %v, got %v", expected, gc.commits)
+	}
+	if expected := []string{"other/configs#1:k8s-ci-robot:config-updater-org-repo-1->master"}; !reflect.DeepEqual(ghc.PullRequestsCreated, expected) {
+		t.Errorf("expected pull requests %v, got %v", expected, ghc.PullRequestsCreated)
+	}
+	if body := ghc.PullRequests[1].Body; !strings.Contains(body, "- `config/a.yaml`\n- `config/gone.yaml`\n") {
+		t.Errorf("expected the PR body to list the copied files, got %q", body)
+	}
+
+	if content, err := ioutil.ReadFile(filepath.Join(target, "config/a.yaml")); err != nil || string(content) != "a: new\n" {
+		t.Errorf("expected config/a.yaml to be copied, got %q (err: %v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "config/gone.yaml")); !os.IsNotExist(err) {
+		t.Errorf("expected config/gone.yaml to be removed, got err: %v", err)
+	}
+	checkComment(t, ghc, "The following pull requests were opened to update other repositories:\n<ul><li>other/configs#1</li></ul>")
+}
+
+func TestHandleEventContainerImage(t *testing.T) {
+	dir := makeRepoDir(t, nil)
+	defer os.RemoveAll(dir)
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}, {Filename: "docs/b.md"}}},
+	}
+	s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+		Matchers: []Matcher{
+			{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs", Image: "quay.io/org/tools:v1", Verify: &Verification{Target: "verify-jobs"}},
+			{Regex: RegexpWrapper{*regexp.MustCompile(`^docs/`)}, Target: "docs"},
+		},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	s.ContainerRuntime = "podman"
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	container := []string{"podman", "run", "--rm", "--volume", dir + ":/workspace", "--workdir", "/workspace",
+		"--env", "PULL_NUMBER", "--env", "PULL_BASE_REF", "--env", "PULL_MERGE_SHA", "--env", "REPO_OWNER",
+		"--env", "REPO_NAME", "--env", "PULL_AUTHOR", "--env", "CHANGED_FILES", "quay.io/org/tools:v1"}
+	expected := [][]string{
+		append(append([]string{}, container...), "/usr/bin/make", "jobs"),
+		append(append([]string{}, container...), "/usr/bin/make", "verify-jobs"),
+		{"/usr/bin/make", "docs"},
+	}
+	if !reflect.DeepEqual(executor.ran, expected) {
+		t.Errorf("expected tasks %v, got %v", expected, executor.ran)
+	}
+	if env := executor.env[0]; len(env) == 0 || env[0] != "PULL_NUMBER=1" {
+		t.Errorf("expected the environment to be set for the container runtime, got %v", env)
+	}
+	checkComment(t, ghc, "<li><details><summary><code>/usr/bin/make jobs</code> exited with code 0</summary>\nRan in <code>quay.io/org/tools:v1</code>\n")
+}
+
+func TestHandleEventTaskScripts(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		changes  []string
+		failures map[string]bool
+
+		expectedTasks   [][]string
+		expectedComment string
+	}{
+		{
+			name:    "scripts bracket the tasks",
+			changes: []string{"jobs/a.yaml"},
+			expectedTasks: [][]string{
+				{"/bin/sh", "-c", "vault login"},
+				{"/usr/bin/make", "jobs"},
+				{"/bin/sh", "-c", "vault revoke"},
+			},
+			expectedComment: "The following updates succeeded:\n<ul><li><details><summary><code>/usr/bin/make jobs</code> exited with code 0</summary>\n<details><summary>stdout</summary><pre><code>\nrunning /usr/bin/make jobs\n</code></pre></details>\n</details></li></ul>\n",
+		},
+		{
+			name:     "failed pre-task script aborts the tasks",
+			changes:  []string{"jobs/a.yaml"},
+			failures: map[string]bool{"/bin/sh -c vault login": true},
+			expectedTasks: [][]string{
+				{"/bin/sh", "-c", "vault login"},
+				{"/bin/sh", "-c", "vault revoke"},
+			},
+			expectedComment: "The following internal errors occurred:\n<ul><li>the pre-task script failed: exit status 2, so no updates were run</li></ul>\n",
+		},
+		{
+			name:     "failed post-task script is reported",
+			changes:  []string{"jobs/a.yaml"},
+			failures: map[string]bool{"/bin/sh -c vault revoke": true},
+			expectedTasks: [][]string{
+				{"/bin/sh", "-c", "vault login"},
+				{"/usr/bin/make", "jobs"},
+				{"/bin/sh", "-c", "vault revoke"},
+			},
+			expectedComment: "<li>the post-task script failed: exit status 2</li>",
+		},
+		{
+			name:    "scripts are not run without tasks",
+			changes: []string{"docs/a.md"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var changes []github.PullRequestChange
+			for _, change := range tc.changes {
+				changes = append(changes, github.PullRequestChange{Filename: change})
+			}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:           []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+				MaxPRFiles:         defaultMaxPRFiles,
+				AllowedExecutables: []string{"/usr/bin/make", "/bin/sh"},
+				PreTaskScript:      "vault login",
+				PostTaskScript:     "vault revoke",
+			})
+			executor := &recordingExecutor{failures: tc.failures}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expectedTasks) {
+				t.Errorf("expected tasks %v, got %v", tc.expectedTasks, executor.ran)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+			if len(ghc.IssueCommentsAdded) > 0 && strings.Contains(ghc.IssueCommentsAdded[0], "vault") {
+				t.Errorf("expected script output to be left out of the comment, got %q", ghc.IssueCommentsAdded[0])
+			}
+		})
+	}
+}
+
+func TestMatcherGlob(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		glob     string
+		filename string
+		expected bool
+	}{
+		{name: "exact path", glob: "config/jobs.yaml", filename: "config/jobs.yaml", expected: true},
+		{name: "star matches a file name", glob: "config/*.yaml", filename: "config/jobs.yaml", expected: true},
+		{name: "star does not match across directories", glob: "config/*.yaml", filename: "config/jobs/a.yaml"},
+		{name: "star per directory", glob: "config/*/*.yaml", filename: "config/jobs/a.yaml", expected: true},
+		{name: "extension must match", glob: "config/*.yaml", filename: "config/jobs.json"},
+		{name: "question mark matches one character", glob: "config/job?.yaml", filename: "config/jobs.yaml", expected: true},
+		{name: "question mark does not match a slash", glob: "config?jobs.yaml", filename: "config/jobs.yaml"},
+		{name: "character class", glob: "config/[a-j]*.yaml", filename: "config/jobs.yaml", expected: true},
+		{name: "negated character class", glob: "config/[^a-j]*.yaml", filename: "config/jobs.yaml"},
+		{name: "escaped star is literal", glob: `config/\*.yaml`, filename: "config/*.yaml", expected: true},
+		{name: "escaped star does not match others", glob: `config/\*.yaml`, filename: "config/jobs.yaml"},
+		{name: "glob is anchored", glob: "*.yaml", filename: "config/jobs.yaml"},
+		{name: "invalid glob matches nothing", glob: "config/[", filename: "config/["},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			matcher := Matcher{Glob: tc.glob}
+			if matched := matcher.matches(tc.filename); matched != tc.expected {
+				t.Errorf("expected %q matching %q to be %t, got %t", tc.glob, tc.filename, tc.expected, matched)
+			}
+		})
+	}
+}
+
+// imagePatch bumps the image of a Deployment.
+const imagePatch = `@@ -14,7 +14,7 @@ spec:
+       serviceAccountName: deck
+       containers:
+       - name: deck
+-        image: gcr.io/k8s-prow/deck:v20190501-1a2b3c4
++        image: gcr.io/k8s-prow/deck:v20190508-5d6e7f8
+         args:
+         - --tide-url=http://tide/
+         - --hook-url=http://hook:8888/plugin-help`
+
+// commentPatch only changes a comment next to an image.
+const commentPatch = `@@ -1,6 +1,6 @@
+-# Deck serves the front end of Prow.
++# Deck serves the front end of Prow, see https://prow.k8s.io.
+ apiVersion: extensions/v1beta1
+ kind: Deployment
+ metadata:
+   name: deck
+ spec:
+@@ -16,3 +16,3 @@ spec:
+       - name: deck
+         image: gcr.io/k8s-prow/deck:v20190501-1a2b3c4
+         args:`
+
+func TestMatcherPatch(t *testing.T) {
+	var testcases = []struct {
+		name         string
+		patchRegex   string
+		missingPatch string
+		patch        string
+		expected     bool
+	}{
+		{name: "no patch regex", patch: commentPatch, expected: true},
+		{name: "changed line matches", patchRegex: `(?m)^[-+]\s*image:`, patch: imagePatch, expected: true},
+		{name: "context line does not match", patchRegex: `(?m)^[-+]\s*image:`, patch: commentPatch},
+		{name: "unanchored regex matches context", patchRegex: `image:`, patch: commentPatch, expected: true},
+		{name: "missing patch matches by default", patchRegex: `(?m)^[-+]\s*image:`, expected: true},
+		{name: "missing patch matches", patchRegex: `(?m)^[-+]\s*image:`, missingPatch: "match", expected: true},
+		{name: "missing patch is skipped", patchRegex: `(?m)^[-+]\s*image:`, missingPatch: "skip"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			matcher := Matcher{PatchRegex: RegexpWrapper{*regexp.MustCompile(tc.patchRegex)}, MissingPatch: tc.missingPatch}
+			if matched := matcher.matchesPatch(github.PullRequestChange{Filename: "deck.yaml", Patch: tc.patch}); matched != tc.expected {
+				t.Errorf("expected matching the patch to be %t, got %t", tc.expected, matched)
+			}
+		})
+	}
+}
+
+func TestHandleEventPatch(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "prow/deck.yaml", Status: "modified", Patch: imagePatch},
+			{Filename: "prow/hook.yaml", Status: "modified", Patch: commentPatch},
+			{Filename: "prow/huge.yaml", Status: "modified"},
+		}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers: []Matcher{
+			{Glob: "prow/*.yaml", PatchRegex: RegexpWrapper{*regexp.MustCompile(`(?m)^[-+]\s*image:`)}, Target: "images"},
+			{Glob: "prow/*.yaml", PatchRegex: RegexpWrapper{*regexp.MustCompile(`(?m)^[-+]\s*image:`)}, MissingPatch: "skip", Target: "strict-images"},
+		},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := [][]string{{"/usr/bin/make", "images"}, {"/usr/bin/make", "strict-images"}}; !reflect.DeepEqual(executor.ran, expected) {
+		t.Fatalf("expected to run %q, got %q", expected, executor.ran)
+	}
+	expectedFiles := []string{"CHANGED_FILES=prow/deck.yaml\nprow/huge.yaml", "CHANGED_FILES=prow/deck.yaml"}
+	for i, expected := range expectedFiles {
+		found := false
+		for _, variable := range executor.env[i] {
+			found = found || variable == expected
+		}
+		if !found {
+			t.Errorf("expected task %d to have %q, got %q", i, expected, executor.env[i])
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		matchers    []Matcher
+		excludes    []Exclude
+		expectedErr string
+	}{
+		{
+			name:     "regex",
+			matchers: []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+		},
+		{
+			name:     "glob",
+			matchers: []Matcher{{Glob: "jobs/*.yaml", Target: "jobs"}},
+		},
+		{
+			name:        "regex and glob",
+			matchers:    []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Glob: "jobs/*.yaml", Target: "jobs"}},
+			expectedErr: `matcher 0 for target "jobs" sets both regex and glob`,
+		},
+		{
+			name:        "invalid glob",
+			matchers:    []Matcher{{Glob: "jobs/*.yaml", Target: "jobs"}, {Glob: "config/[", Target: "config"}},
+			expectedErr: `matcher 1 for target "config" has invalid glob "config/["`,
+		},
+		{
+			name:        "exclude with regex and glob",
+			excludes:    []Exclude{{Glob: "jobs/*.yaml"}, {Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Glob: "jobs/*.yaml"}},
+			expectedErr: `exclude 1 sets both regex and glob`,
+		},
+		{
+			name:        "exclude with invalid glob",
+			excludes:    []Exclude{{Glob: "jobs/["}},
+			expectedErr: `exclude 0 has invalid glob "jobs/["`,
+		},
+		{
+			name:        "matcher with unknown missing patch",
+			matchers:    []Matcher{{Glob: "jobs/*.yaml", Target: "jobs", MissingPatch: "fail"}},
+			expectedErr: `matcher 0 for target "jobs" has missing_patch "fail", must be match or skip`,
+		},
+		{
+			name:        "glob matcher with capture groups in target",
+			matchers:    []Matcher{{Glob: "config/*/jobs.yaml", Target: "apply-$1"}},
+			expectedErr: `matcher 0 for target "apply-$1" refers to capture groups, which a glob does not have`,
+		},
+		{
+			name:        "matcher with unknown output mode",
+			matchers:    []Matcher{{Glob: "jobs/*.yaml", Target: "jobs", OutputMode: "stdout"}},
+			expectedErr: `matcher 0 for target "jobs" has output_mode "stdout", must be split, combined or none`,
+		},
+		{
+			name:        "matcher with unknown status",
+			matchers:    []Matcher{{Glob: "jobs/*.yaml", Target: "jobs", Statuses: []string{"added", "renamed"}}},
+			expectedErr: `matcher 0 for target "jobs" has invalid statuses: unknown status "renamed", must be added, modified or removed`,
+		},
+		{
+			name:     "matchers ordered by name",
+			matchers: []Matcher{{Glob: "lib/*.yaml", Target: "lib", Name: "lib"}, {Glob: "jobs/*.yaml", Target: "jobs", After: []string{"lib"}}},
+		},
+		{
+			name:        "duplicate matcher names",
+			matchers:    []Matcher{{Glob: "lib/*.yaml", Target: "lib", Name: "lib"}, {Glob: "jobs/*.yaml", Target: "jobs", Name: "lib"}},
+			expectedErr: `matcher 1 for target "jobs" reuses the name "lib"`,
+		},
+		{
+			name:        "matcher after an unknown matcher",
+			matchers:    []Matcher{{Glob: "jobs/*.yaml", Target: "jobs", After: []string{"lib"}}},
+			expectedErr: `matcher 0 for target "jobs" runs after unknown matcher "lib"`,
+		},
+		{
+			name:        "matcher after itself",
+			matchers:    []Matcher{{Glob: "jobs/*.yaml", Target: "jobs", Name: "jobs", After: []string{"jobs"}}},
+			expectedErr: `matcher 0 for target "jobs" runs after itself`,
+		},
+		{
+			name:        "workdir escaping the checkout",
+			matchers:    []Matcher{{Glob: "jobs/*.yaml", Target: "jobs", Workdir: "../other"}},
+			expectedErr: `matcher 0 for target "jobs" has invalid workdir: "../other" must stay inside the checkout`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := UpdateConfig{Matchers: tc.matchers, Excludes: tc.excludes}
+			err := config.Validate()
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestHandleEventGlob(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "jobs/a.yaml"},
+			{Filename: "jobs/nested/b.yaml"},
+		}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers:   []Matcher{{Glob: "jobs/*.yaml", Target: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(executor.ran) != 1 {
+		t.Fatalf("expected one task to run, got %v", executor.ran)
+	}
+}
+
+func TestServeHTTPBodyLimit(t *testing.T) {
+	var testcases = []struct {
+		name           string
+		limit          int64
+		size           int
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "small payload", limit: 1024, size: 100, expectedStatus: http.StatusOK, expectedBody: "Event received. Have a nice day."},
+		{name: "payload at the limit", limit: 1024, size: 1024, expectedStatus: http.StatusOK, expectedBody: "Event received. Have a nice day."},
+		{name: "payload over the limit", limit: 1024, size: 1025, expectedStatus: http.StatusRequestEntityTooLarge, expectedBody: `{"error": "request body is larger than the limit of 1024 bytes"}`},
+		{name: "huge payload", limit: 1024, size: 10 << 20, expectedStatus: http.StatusRequestEntityTooLarge, expectedBody: `{"error": "request body is larger than the limit of 1024 bytes"}`},
+		{name: "unlimited", size: 10 << 20, expectedStatus: http.StatusOK, expectedBody: "Event received. Have a nice day."},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			secret := []byte("hmac")
+			s := newTestServer(&fakeGit{}, &fakegithub.FakeClient{}, &UpdateConfig{})
+			s.hmacSecret = func() []byte { return secret }
+			s.MaxRequestBodyBytes = tc.limit
+
+			payload := []byte(`{"padding": "` + strings.Repeat("x", tc.size-len(`{"padding": ""}`)) + `"}`)
+			mac := hmac.New(sha1.New, secret)
+			mac.Write(payload)
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+			req.Header.Set("X-GitHub-Event", "ping")
+			req.Header.Set("X-GitHub-Delivery", "guid")
+			req.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+			req.Header.Set("content-type", "application/json")
+			w := httptest.NewRecorder()
+
+			s.ServeHTTP(w, req)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if body := w.Body.String(); body != tc.expectedBody {
+				t.Errorf("expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestServeHTTPValidation(t *testing.T) {
+	secret := []byte("hmac")
+	sign := func(payload []byte) string {
+		mac := hmac.New(sha1.New, secret)
+		mac.Write(payload)
+		return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	sign256 := func(payload []byte) string {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(payload)
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	var testcases = []struct {
+		name      string
+		eventType string
+		payload   []byte
+		signature func(payload []byte) string
+		// signature256 is sent in X-Hub-Signature-256, if set.
+		signature256   func(payload []byte) string
+		requireSHA256  bool
+		contentType    string
+		expectedStatus int
+		expectedBody   string
+		expectedLog    string
+		expectedTasks  int
+	}{
+		{
+			name:           "missing signature",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      func([]byte) string { return "" },
+			contentType:    "application/json",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "403 Forbidden: Missing X-Hub-Signature\n",
+		},
+		{
+			name:           "wrong signature",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      func(payload []byte) string { return sign(append(payload, ' ')) },
+			contentType:    "application/json",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "403 Forbidden: Invalid X-Hub-Signature\n",
+		},
+		{
+			name:           "unexpected content type",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      sign,
+			contentType:    "application/x-www-form-urlencoded",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "400 Bad Request: Hook only accepts content-type: application/json - please reconfigure this hook on GitHub\n",
+		},
+		{
+			name:           "unknown event type",
+			eventType:      "deployment",
+			payload:        []byte(`{}`),
+			signature:      sign,
+			contentType:    "application/json",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Event received. Have a nice day.",
+			expectedLog:    `received an event of type \"deployment\" but didn't ask for it`,
+		},
+		{
+			name:           "pull request",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      sign,
+			contentType:    "application/json",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Event received. Have a nice day.",
+			expectedTasks:  1,
+		},
+		{
+			name:           "sha-256 signature",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      func([]byte) string { return "" },
+			signature256:   sign256,
+			contentType:    "application/json",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Event received. Have a nice day.",
+			expectedTasks:  1,
+		},
+		{
+			name:           "sha-256 signature is preferred",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      sign,
+			signature256:   func(payload []byte) string { return sign256(append(payload, ' ')) },
+			contentType:    "application/json",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "403 Forbidden: Invalid X-Hub-Signature\n",
+		},
+		{
+			name:           "sha-1 signature when sha-256 is required",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      sign,
+			requireSHA256:  true,
+			contentType:    "application/json",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "403 Forbidden: Missing X-Hub-Signature-256\n",
+			expectedLog:    "Refused payload without a SHA-256 signature.",
+		},
+		{
+			name:           "sha-1 signature in the sha-256 header",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      func([]byte) string { return "" },
+			signature256:   sign,
+			contentType:    "application/json",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "403 Forbidden: Invalid X-Hub-Signature\n",
+		},
+		{
+			name:           "sha-1 signature in the sha-256 header when sha-256 is required",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      func([]byte) string { return "" },
+			signature256:   sign,
+			requireSHA256:  true,
+			contentType:    "application/json",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "403 Forbidden: Missing X-Hub-Signature-256\n",
+			expectedLog:    "Refused payload without a SHA-256 signature.",
+		},
+		{
+			name:           "sha-256 signature in the sha-1 header",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      sign256,
+			contentType:    "application/json",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "403 Forbidden: Invalid X-Hub-Signature\n",
+		},
+		{
+			name:           "both signatures when sha-256 is required",
+			eventType:      "pull_request",
+			payload:        mergedPREvent(t),
+			signature:      sign,
+			signature256:   sign256,
+			requireSHA256:  true,
+			contentType:    "application/json",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Event received. Have a nice day.",
+			expectedTasks:  1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.hmacSecret = func() []byte { return secret }
+			s.RequireSHA256Signature = tc.requireSHA256
+			executor := &recordingExecutor{}
+			s.executor = executor
+			var logs bytes.Buffer
+			logger := logrus.New()
+			logger.Out = &logs
+			logger.Level = logrus.DebugLevel
+			s.log = logrus.NewEntry(logger)
+
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tc.payload))
+			req.Header.Set("X-GitHub-Event", tc.eventType)
+			req.Header.Set("X-GitHub-Delivery", "guid")
+			if signature := tc.signature(tc.payload); signature != "" {
+				req.Header.Set("X-Hub-Signature", signature)
+			}
+			if tc.signature256 != nil {
+				req.Header.Set("X-Hub-Signature-256", tc.signature256(tc.payload))
+			}
+			req.Header.Set("content-type", tc.contentType)
+			w := httptest.NewRecorder()
+
+			s.ServeHTTP(w, req)
+			if w.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if body := w.Body.String(); body != tc.expectedBody {
+				t.Errorf("expected body %q, got %q", tc.expectedBody, body)
+			}
+			if !strings.Contains(logs.String(), tc.expectedLog) {
+				t.Errorf("expected logs to contain %q, got %q", tc.expectedLog, logs.String())
+			}
+			if len(executor.ran) != tc.expectedTasks {
+				t.Errorf("expected %d tasks to run, got %v", tc.expectedTasks, executor.ran)
+			}
+		})
+	}
+}
+
+// countingGitHub counts the calls to list the changes of PRs.
+func TestHandleEventMinimizesOldComments(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		minimize bool
+		expected []string
+	}{
+		{
+			name: "old comments are kept by default",
+		},
+		{
+			name:     "only our old comments are minimized",
+			minimize: true,
+			expected: []string{"org/repo#1", "org/repo#3"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{1: {
+					{ID: 1, Body: "The following updates succeeded:\n" + commentSignature},
+					{ID: 2, Body: "Looks like the update failed, rerunning."},
+					{ID: 3, Body: "The following updates failed:\n" + commentSignature},
+				}},
+				IssueCommentID:     4,
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.MinimizeOldComments = tc.minimize
+			s.executor = &recordingExecutor{}
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkComment(t, ghc, commentSignature)
+			if !reflect.DeepEqual(ghc.IssueCommentsMinimized, tc.expected) {
+				t.Errorf("expected to minimize %v, got %v", tc.expected, ghc.IssueCommentsMinimized)
+			}
+		})
+	}
+}
+
+type countingGitHub struct {
+	*fakegithub.FakeClient
+	calls int
+	err   error
+}
+
+func (c *countingGitHub) GetPullRequestChanges(org, repo string, number int) ([]github.PullRequestChange, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.FakeClient.GetPullRequestChanges(org, repo, number)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestGetPullRequestChangesCache(t *testing.T) {
+	var testcases = []struct {
+		name          string
+		maxEntries    int
+		err           error
+		requests      []int
+		wait          time.Duration
+		expectedCalls int
+	}{
+		{
+			name:          "cache is disabled",
+			requests:      []int{1, 1},
+			expectedCalls: 2,
+		},
+		{
+			name:          "repeated request is cached",
+			maxEntries:    10,
+			requests:      []int{1, 1, 1},
+			expectedCalls: 1,
+		},
+		{
+			name:          "PRs are cached separately",
+			maxEntries:    10,
+			requests:      []int{1, 2, 1, 2},
+			expectedCalls: 2,
+		},
+		{
+			name:          "cached changes expire",
+			maxEntries:    10,
+			requests:      []int{1, 1},
+			wait:          changesCacheTTL + time.Second,
+			expectedCalls: 2,
+		},
+		{
+			name:          "cached changes are kept until they expire",
+			maxEntries:    10,
+			requests:      []int{1, 1},
+			wait:          changesCacheTTL - time.Second,
+			expectedCalls: 1,
+		},
+		{
+			name:          "least recently used PR is evicted",
+			maxEntries:    2,
+			requests:      []int{1, 2, 1, 3, 1, 2},
+			expectedCalls: 4,
+		},
+		{
+			name:          "errors are not cached",
+			maxEntries:    10,
+			err:           errors.New("rate limited"),
+			requests:      []int{1, 1},
+			expectedCalls: 2,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &countingGitHub{
+				FakeClient: &fakegithub.FakeClient{PullRequestChanges: map[int][]github.PullRequestChange{
+					1: {{Filename: "a.yaml"}},
+					2: {{Filename: "b.yaml"}},
+					3: {{Filename: "c.yaml"}},
+				}},
+				err: tc.err,
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{})
+			s.MaxCacheEntries = tc.maxEntries
+			clock := &fakeClock{now: time.Now()}
+			if tc.maxEntries > 0 {
+				s.changesCache = cache.NewLRUExpireCacheWithClock(tc.maxEntries, clock)
+			}
+
+			for _, number := range tc.requests {
+				changes, err := s.getPullRequestChanges(context.Background(), "org", "repo", number)
+				if tc.err == nil && (err != nil || !reflect.DeepEqual(changes, ghc.PullRequestChanges[number])) {
+					t.Errorf("expected changes %v for PR %d, got %v and %v", ghc.PullRequestChanges[number], number, changes, err)
+				}
+				clock.now = clock.now.Add(tc.wait)
+			}
+			if ghc.calls != tc.expectedCalls {
+				t.Errorf("expected %d calls, got %d", tc.expectedCalls, ghc.calls)
+			}
+		})
+	}
+}
+
+func TestHandleEventExcludes(t *testing.T) {
+	dir := makeRepoDir(t, map[string]string{
+		"jenkins/jobs.yaml":              "kind: Service\n",
+		"jenkins/experimental/jobs.yaml": "kind: Service\n",
+	})
+	defer os.RemoveAll(dir)
+
+	var testcases = []struct {
+		name     string
+		excludes []Exclude
+		expected [][]string
+	}{
+		{
+			name: "nothing excluded",
+			expected: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=jenkins/jobs.yaml"},
+				{"/usr/bin/make", "apply", "WHAT=jenkins/experimental/jobs.yaml"},
+				{"/usr/bin/make", "jenkins"},
+			},
+		},
+		{
+			name:     "exclusion wins over targets and matchers",
+			excludes: []Exclude{{Regex: RegexpWrapper{*regexp.MustCompile(`^jenkins/experimental/`)}}},
+			expected: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=jenkins/jobs.yaml"},
+				{"/usr/bin/make", "jenkins"},
+			},
+		},
+		{
+			name:     "exclude by glob",
+			excludes: []Exclude{{Glob: "jenkins/*/*.yaml"}},
+			expected: [][]string{
+				{"/usr/bin/make", "apply", "WHAT=jenkins/jobs.yaml"},
+				{"/usr/bin/make", "jenkins"},
+			},
+		},
+		{
+			name:     "everything excluded",
+			excludes: []Exclude{{Glob: "jenkins/*.yaml"}, {Regex: RegexpWrapper{*regexp.MustCompile(`experimental`)}}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "jenkins/jobs.yaml"},
+					{Filename: "jenkins/experimental/jobs.yaml"},
+				}},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:    []string{"jenkins/jobs.yaml", "jenkins/experimental/jobs.yaml"},
+				Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jenkins/.*\.yaml$`)}, Target: "jenkins"}},
+				Excludes:   tc.excludes,
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+			if len(tc.expected) == 0 && len(ghc.IssueCommentsAdded) != 0 {
+				t.Errorf("expected no comment, got %v", ghc.IssueCommentsAdded)
+			}
+		})
+	}
+}
+
+func TestHandleEventStatuses(t *testing.T) {
+	dir := makeRepoDir(t, map[string]string{
+		"jobs/added.yaml":    "kind: Service\n",
+		"jobs/modified.yaml": "kind: Service\n",
+		"jobs/new.yaml":      "kind: Service\n",
+	})
+	defer os.RemoveAll(dir)
+	changes := []github.PullRequestChange{
+		{Filename: "jobs/added.yaml", Status: "added"},
+		{Filename: "jobs/modified.yaml", Status: "modified"},
+		{Filename: "jobs/removed.yaml", Status: "removed"},
+		{Filename: "jobs/new.yaml", Status: "renamed", PreviousFilename: "jobs/old.yaml"},
+	}
+
+	var testcases = []struct {
+		name            string
+		targets         []string
+		targetsStatuses []string
+		matchers        []Matcher
+		expected        [][]string
+		expectedFiles   [][]string
+	}{
+		{
+			name:     "matchers without statuses see every change but the previous names of renames",
+			matchers: []Matcher{{Glob: "jobs/*.yaml", Target: "apply"}},
+			expected: [][]string{{"/usr/bin/make", "apply"}},
+			expectedFiles: [][]string{
+				{"jobs/added.yaml", "jobs/modified.yaml", "jobs/removed.yaml", "jobs/new.yaml"},
+			},
+		},
+		{
+			name: "matcher without statuses of the previous name of a rename runs nothing",
+			matchers: []Matcher{
+				{Glob: "jobs/old.yaml", Target: "teardown"},
+				{Glob: "jobs/new.yaml", Target: "apply"},
+			},
+			expected:      [][]string{{"/usr/bin/make", "apply"}},
+			expectedFiles: [][]string{{"jobs/new.yaml"}},
+		},
+		{
+			name: "matchers by status",
+			matchers: []Matcher{
+				{Glob: "jobs/*.yaml", Target: "create", Statuses: []string{"added"}},
+				{Glob: "jobs/*.yaml", Target: "apply", Statuses: []string{"modified"}},
+				{Glob: "jobs/*.yaml", Target: "teardown", Statuses: []string{"removed"}},
+			},
+			expected: [][]string{{"/usr/bin/make", "create"}, {"/usr/bin/make", "apply"}, {"/usr/bin/make", "teardown"}},
+			expectedFiles: [][]string{
+				{"jobs/added.yaml", "jobs/new.yaml"},
+				{"jobs/modified.yaml"},
+				{"jobs/removed.yaml", "jobs/old.yaml"},
+			},
+		},
+		{
+			name:     "matcher with several statuses",
+			matchers: []Matcher{{Glob: "jobs/*.yaml", Target: "apply", Statuses: []string{"added", "modified"}}},
+			expected: [][]string{{"/usr/bin/make", "apply"}},
+			expectedFiles: [][]string{
+				{"jobs/added.yaml", "jobs/modified.yaml", "jobs/new.yaml"},
+			},
+		},
+		{
+			name:            "targets by status",
+			targets:         []string{"jobs/added.yaml", "jobs/modified.yaml", "jobs/new.yaml"},
+			targetsStatuses: []string{"added"},
+			expected:        [][]string{{"/usr/bin/make", "apply", "WHAT=jobs/added.yaml"}, {"/usr/bin/make", "apply", "WHAT=jobs/new.yaml"}},
+			expectedFiles:   [][]string{{"jobs/added.yaml"}, {"jobs/new.yaml"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: changes},
+			}
+			s := newTestServer(&fakeGit{dir: dir}, ghc, &UpdateConfig{
+				Targets:         tc.targets,
+				TargetsStatuses: tc.targetsStatuses,
+				Matchers:        tc.matchers,
+				MaxPRFiles:      defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+			var files [][]string
+			for _, env := range executor.env {
+				for _, variable := range env {
+					if strings.HasPrefix(variable, "CHANGED_FILES=") {
+						files = append(files, strings.Split(strings.TrimPrefix(variable, "CHANGED_FILES="), "\n"))
+					}
+				}
+			}
+			if !reflect.DeepEqual(files, tc.expectedFiles) {
+				t.Errorf("expected tasks for files %q, got %q", tc.expectedFiles, files)
+			}
+		})
+	}
+}
+
+func TestHandleEventStdin(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "charts/prow.yaml"},
+		}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers: []Matcher{
+			{Glob: "charts/*.yaml", Target: "helm", Stdin: "y\n"},
+			{Glob: "charts/*.yaml", Target: "helm", Stdin: "n\n"},
+			{Glob: "charts/*.yaml", Target: "lint"},
+		},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	executor := &recordingExecutor{}
+	s.executor = executor
+
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"y\n", "n\n", ""}; !reflect.DeepEqual(executor.stdins, expected) {
+		t.Errorf("expected tasks with stdin %q, got %q", expected, executor.stdins)
+	}
+
+	command := containerCommand("docker", "tools", "/checkout", task{command: []string{"make", "helm"}, stdin: "y\n"})
+	if command[7] != "--interactive" {
+		t.Errorf("expected the container to keep stdin open, got %q", command)
+	}
+}
+
+func TestHandleEventOutputMode(t *testing.T) {
+	var testcases = []struct {
+		name            string
+		outputMode      string
+		expectedComment string
+	}{
+		{
+			name:            "split",
+			outputMode:      outputModeSplit,
+			expectedComment: "<code>/usr/bin/make jobs</code> exited with code 2</summary>\n<details><summary>stdout</summary><pre><code>\nrunning /usr/bin/make jobs\n</code></pre></details>\n<details><summary>stderr</summary><pre><code>\nit broke\n</code></pre></details>\n</details></li>",
+		},
+		{
+			name:            "combined",
+			outputMode:      outputModeCombined,
+			expectedComment: "<code>/usr/bin/make jobs</code> exited with code 2</summary>\n<details><summary>output</summary><pre><code>\nrunning /usr/bin/make jobs\n</code></pre></details>\n</details></li>",
+		},
+		{
+			name:            "none",
+			outputMode:      outputModeNone,
+			expectedComment: "<code>/usr/bin/make jobs</code> exited with code 2</summary>\n</details></li>",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/ci.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "jobs/*.yaml", Target: "jobs", OutputMode: tc.outputMode}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": true}}
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkComment(t, ghc, tc.expectedComment)
+		})
+	}
+}
+
+func TestHandleEventRequiredLabels(t *testing.T) {
+	approved := []github.Label{{Name: "deploy-approved"}, {Name: "lgtm"}}
+	var testcases = []struct {
+		name            string
+		payloadLabels   []github.Label
+		apiLabels       []github.Label
+		expected        [][]string
+		expectedComment string
+	}{
+		{
+			name:          "labels present in the payload",
+			payloadLabels: approved,
+			expected:      [][]string{{"/usr/bin/make", "jobs"}, {"/usr/bin/make", "jenkins-prod"}},
+		},
+		{
+			name:            "labels missing",
+			payloadLabels:   []github.Label{{Name: "lgtm"}},
+			apiLabels:       approved,
+			expected:        [][]string{{"/usr/bin/make", "jobs"}},
+			expectedComment: "The following updates were skipped because the PR is missing labels they require:\n<ul><li><code>/usr/bin/make jenkins-prod</code> requires <code>deploy-approved</code></li></ul>",
+		},
+		{
+			name:            "no labels anywhere",
+			expected:        [][]string{{"/usr/bin/make", "jobs"}},
+			expectedComment: "<li><code>/usr/bin/make jenkins-prod</code> requires <code>deploy-approved</code></li>",
+		},
+		{
+			name:      "stale payload but fresh API",
+			apiLabels: approved,
+			expected:  [][]string{{"/usr/bin/make", "jobs"}, {"/usr/bin/make", "jenkins-prod"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "jobs/a.yaml"},
+					{Filename: "jenkins/prod.yaml"},
+				}},
+				PullRequests: map[int]*github.PullRequest{1: {Number: 1, Labels: tc.apiLabels}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers: []Matcher{
+					{Glob: "jobs/*.yaml", Target: "jobs"},
+					{Glob: "jenkins/*.yaml", Target: "jenkins-prod", RequiredLabels: []string{"deploy-approved"}},
+				},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			event := mergedPREvent(t, func(pr *github.PullRequest) { pr.Labels = tc.payloadLabels })
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", event); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+			comments := strings.Join(ghc.IssueCommentsAdded, "\n")
+			if tc.expectedComment != "" && !strings.Contains(comments, tc.expectedComment) {
+				t.Errorf("expected a comment containing %q, got %q", tc.expectedComment, comments)
+			}
+			if tc.expectedComment == "" && strings.Contains(comments, "missing labels") {
+				t.Errorf("expected no update to be skipped, got %q", comments)
+			}
+		})
+	}
+}
+
+func TestHandleEventRequiredOrgMembership(t *testing.T) {
+	var testcases = []struct {
+		name               string
+		members            []string
+		expected           [][]string
+		expectedRestricted string
+	}{
+		{
+			name:     "author is a member",
+			members:  []string{"author"},
+			expected: [][]string{{"/usr/bin/make", "jobs"}, {"/usr/bin/make", "jenkins-prod"}},
+		},
+		{
+			name:               "author is not a member",
+			members:            []string{"someone-else"},
+			expected:           [][]string{{"/usr/bin/make", "jobs"}},
+			expectedRestricted: "The following updates were skipped, as only members of the orgs they require may trigger them:\n<ul><li><code>/usr/bin/make jenkins-prod</code> requires membership of <code>prod-admins</code></li></ul>",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments: map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {
+					{Filename: "jobs/a.yaml"},
+					{Filename: "jenkins/prod.yaml"},
+				}},
+				OrgMembers: map[string][]string{"prod-admins": tc.members},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers: []Matcher{
+					{Glob: "jobs/*.yaml", Target: "jobs"},
+					{Glob: "jenkins/*.yaml", Target: "jenkins-prod", RequiredOrgMembership: "prod-admins"},
+				},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			executor := &recordingExecutor{}
+			s.executor = executor
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(executor.ran, tc.expected) {
+				t.Errorf("expected to run %q, got %q", tc.expected, executor.ran)
+			}
+			// The restriction is explained apart from the results.
+			expectedComments := 1
+			if tc.expectedRestricted != "" {
+				expectedComments = 2
+			}
+			if len(ghc.IssueCommentsAdded) != expectedComments {
+				t.Fatalf("expected %d comments, got %q", expectedComments, ghc.IssueCommentsAdded)
+			}
+			if tc.expectedRestricted != "" && !strings.Contains(ghc.IssueCommentsAdded[0], tc.expectedRestricted) {
+				t.Errorf("expected a comment containing %q, got %q", tc.expectedRestricted, ghc.IssueCommentsAdded[0])
+			}
+			if results := ghc.IssueCommentsAdded[len(ghc.IssueCommentsAdded)-1]; strings.Contains(results, "membership") {
+				t.Errorf("expected the results not to mention membership, got %q", results)
+			}
+		})
+	}
+}
+
+func TestRegexpWrapper(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		unmarshal   func(b []byte, v interface{}) error
+		config      string
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:      "json",
+			unmarshal: json.Unmarshal,
+			config:    `{"regex": "^jobs/(?P<team>\\w+)/"}`,
+			expected:  `^jobs/(?P<team>\w+)/`,
+		},
+		{
+			name:        "invalid json",
+			unmarshal:   json.Unmarshal,
+			config:      `{"regex": "^jobs/("}`,
+			expectedErr: "invalid regex \"^jobs/(\": error parsing regexp: missing closing )",
+		},
+		{
+			name:        "not a string",
+			unmarshal:   json.Unmarshal,
+			config:      `{"regex": 1}`,
+			expectedErr: "cannot unmarshal number",
+		},
+		{
+			name:      "yaml",
+			unmarshal: func(b []byte, v interface{}) error { return yaml.Unmarshal(b, v) },
+			config:    "regex: ^jobs/\n",
+			expected:  "^jobs/",
+		},
+		{
+			name:      "yaml.v2",
+			unmarshal: yamlv2.Unmarshal,
+			config:    "regex: ^jobs/\n",
+			expected:  "^jobs/",
+		},
+		{
+			name:        "invalid yaml.v2",
+			unmarshal:   yamlv2.Unmarshal,
+			config:      "regex: ^jobs/(\n",
+			expectedErr: "invalid regex \"^jobs/(\": error parsing regexp: missing closing )",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var e Exclude
+			err := tc.unmarshal([]byte(tc.config), &e)
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if e.Regex.String() != tc.expected {
+				t.Errorf("expected regex %q, got %q", tc.expected, e.Regex.String())
+			}
+			if !e.Regex.MatchString("jobs/team/config.yaml") {
+				t.Errorf("expected %q to match", e.Regex.String())
+			}
+			b, err := json.Marshal(e.Regex)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected, _ := json.Marshal(tc.expected); string(b) != string(expected) {
+				t.Errorf("expected %s, got %s", expected, b)
+			}
+		})
+	}
+}
+
+func TestCommentOnSuccess(t *testing.T) {
+	yes, no := true, false
+	var testcases = []struct {
+		name             string
+		commentOnSuccess *bool
+		repo             string
+		changes          []github.PullRequestChange
+		failed           bool
+		expectedComments int
+		expectedLog      string
+	}{
+		{
+			name:             "success is commented on by default",
+			repo:             "quiet",
+			changes:          []github.PullRequestChange{{Filename: "jobs/config.yaml"}},
+			expectedComments: 1,
+		},
+		{
+			name:             "silent on success",
+			commentOnSuccess: &no,
+			repo:             "quiet",
+			changes:          []github.PullRequestChange{{Filename: "jobs/config.yaml"}},
+			expectedLog:      "Every update succeeded, not commenting as comment_on_success is off.",
+		},
+		{
+			name:             "failure is commented on",
+			commentOnSuccess: &no,
+			repo:             "quiet",
+			changes:          []github.PullRequestChange{{Filename: "jobs/config.yaml"}},
+			failed:           true,
+			expectedComments: 1,
+		},
+		{
+			name:             "repo overriding the global option",
+			commentOnSuccess: &no,
+			repo:             "repo",
+			changes:          []github.PullRequestChange{{Filename: "jobs/config.yaml"}},
+			expectedComments: 1,
+		},
+		{
+			name:             "nothing matched",
+			commentOnSuccess: &no,
+			repo:             "quiet",
+			changes:          []github.PullRequestChange{{Filename: "README.md"}},
+			expectedLog:      "No updates were run, so no results are posted.",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: tc.changes},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:         []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+				MaxPRFiles:       defaultMaxPRFiles,
+				CommentOnSuccess: tc.commentOnSuccess,
+				Repos: map[string]UpdateConfig{
+					"org/repo":  {CommentOnSuccess: &yes},
+					"org/quiet": {},
+				},
+			})
+			s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": tc.failed}}
+			var logs bytes.Buffer
+			logger := logrus.New()
+			logger.Out = &logs
+			s.log = logrus.NewEntry(logger)
+
+			event := mergedPREvent(t, func(pr *github.PullRequest) { pr.Base.Repo.Name = tc.repo })
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", event); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(ghc.IssueCommentsAdded) != tc.expectedComments {
+				t.Errorf("expected %d comments, got %v", tc.expectedComments, ghc.IssueCommentsAdded)
+			}
+			if !strings.Contains(logs.String(), tc.expectedLog) {
+				t.Errorf("expected logs to contain %q, got %q", tc.expectedLog, logs.String())
+			}
+		})
+	}
+}
+
+func TestSilentOnSuccess(t *testing.T) {
+	yes, no := true, false
+	succeeded := results{succeeded: make([]result, 1)}
+	var testcases = []struct {
+		name     string
+		config   *UpdateConfig
+		results  results
+		expected bool
+	}{
+		{
+			name:    "no config",
+			results: succeeded,
+		},
+		{
+			name:    "commenting on success by default",
+			config:  &UpdateConfig{},
+			results: succeeded,
+		},
+		{
+			name:    "commenting on success",
+			config:  &UpdateConfig{CommentOnSuccess: &yes},
+			results: succeeded,
+		},
+		{
+			name:     "silent on success",
+			config:   &UpdateConfig{CommentOnSuccess: &no},
+			results:  succeeded,
+			expected: true,
+		},
+		{
+			name:    "failure",
+			config:  &UpdateConfig{CommentOnSuccess: &no},
+			results: results{failed: make([]result, 1)},
+		},
+		{
+			name:    "failed rollback",
+			config:  &UpdateConfig{CommentOnSuccess: &no},
+			results: results{succeeded: make([]result, 1), rollbacks: []result{{err: errors.New("oops")}}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if silent := silentOnSuccess(tc.config, tc.results); silent != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, silent)
+			}
+		})
+	}
+}
+
+func TestSkipsIdenticalComment(t *testing.T) {
+	yes, no := true, false
+	var testcases = []struct {
+		name             string
+		previousFailed   *bool
+		failed           bool
+		expectedComments int
+		expectedLog      string
+	}{
+		{
+			name:             "no previous comment",
+			failed:           true,
+			expectedComments: 1,
+		},
+		{
+			name:             "identical results",
+			previousFailed:   &yes,
+			failed:           true,
+			expectedComments: 1,
+			expectedLog:      "Not commenting, as the last comment posted the same results.",
+		},
+		{
+			name:             "identical successes",
+			previousFailed:   &no,
+			expectedComments: 1,
+			expectedLog:      "Not commenting, as the last comment posted the same results.",
+		},
+		{
+			name:             "different results",
+			previousFailed:   &yes,
+			expectedComments: 2,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			if tc.previousFailed != nil {
+				s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": *tc.previousFailed}}
+				if err := s.handleEvent(context.Background(), "pull_request", "first", mergedPREvent(t)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				// A comment of someone else in between is not compared with.
+				ghc.IssueComments[1] = append(ghc.IssueComments[1], github.IssueComment{Body: "Retrying."})
+			}
+			s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": tc.failed}}
+			var logs bytes.Buffer
+			logger := logrus.New()
+			logger.Out = &logs
+			s.log = logrus.NewEntry(logger)
+
+			if err := s.handleEvent(context.Background(), "pull_request", "second", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(ghc.IssueCommentsAdded) != tc.expectedComments {
+				t.Errorf("expected %d comments, got %v", tc.expectedComments, ghc.IssueCommentsAdded)
+			}
+			if !strings.Contains(logs.String(), tc.expectedLog) {
+				t.Errorf("expected logs to contain %q, got %q", tc.expectedLog, logs.String())
+			}
+		})
+	}
+}
+
+func TestFingerprintIgnoresDurations(t *testing.T) {
+	run := func(duration time.Duration, failed bool) results {
+		r := results{
+			succeeded: []result{{command: []string{"/usr/bin/make", "jobs"}, stdout: "applied", duration: duration}},
+			reloads:   []reloadResult{{url: "https://jenkins", duration: duration}},
+		}
+		if failed {
+			r.failed = []result{{command: []string{"/usr/bin/make", "apply"}, exitCode: 2, stderr: "oops", duration: duration}}
+		}
+		return r
+	}
+
+	first, second := run(2*time.Second, true), run(5*time.Minute, true)
+	if first.formatResults() == second.formatResults() {
+		t.Fatalf("expected the comments to differ in durations, got %q for both", first.formatResults())
+	}
+	if first.fingerprint() != second.fingerprint() {
+		t.Errorf("expected runs that only differ in duration to have the same fingerprint, got %q and %q", first.fingerprint(), second.fingerprint())
+	}
+	if first.succeeded[0].duration != 2*time.Second || first.reloads[0].duration != 2*time.Second {
+		t.Errorf("expected fingerprinting to leave the durations of the results alone")
+	}
+	if succeeded := run(2*time.Second, false); succeeded.fingerprint() == first.fingerprint() {
+		t.Errorf("expected runs with different outcomes to have different fingerprints")
+	}
+}
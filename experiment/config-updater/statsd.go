@@ -0,0 +1,92 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// statsdBufferSize bounds how many metrics wait to be sent to StatsD, past
+// which they are dropped rather than holding up the updates.
+const statsdBufferSize = 1000
+
+// statsdSender sends metrics to StatsD over UDP in the background.
+type statsdSender struct {
+	conn    net.Conn
+	metrics chan string
+}
+
+func newStatsDSender(addr string) (*statsdSender, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to StatsD at %s: %v", addr, err)
+	}
+	s := &statsdSender{conn: conn, metrics: make(chan string, statsdBufferSize)}
+	go s.run()
+	return s, nil
+}
+
+func (s *statsdSender) run() {
+	for metric := range s.metrics {
+		// Metrics are best effort, so a StatsD that is down is not worth
+		// reporting for every one of them.
+		s.conn.Write([]byte(metric))
+	}
+}
+
+// send queues metric, dropping it if the buffer is full.
+func (s *statsdSender) send(metric string) {
+	select {
+	case s.metrics <- metric:
+	default:
+	}
+}
+
+// statsdTagReplacer replaces the characters that delimit tags and values.
+var statsdTagReplacer = strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_", "\n", "_")
+
+// sendTaskStats sends the duration and outcome of t to StatsDAddr, if set,
+// tagged in the DogStatsD format that Telegraf also accepts.
+func (s *Server) sendTaskStats(pr github.PullRequest, t task, r result) {
+	if s.StatsDAddr == "" {
+		return
+	}
+	s.initStatsD.Do(func() {
+		sender, err := newStatsDSender(s.StatsDAddr)
+		if err != nil {
+			s.log.WithError(err).Warn("Not sending task metrics to StatsD.")
+			return
+		}
+		s.statsd = sender
+	})
+	if s.statsd == nil {
+		return
+	}
+	status := "success"
+	if r.failed() {
+		status = "failure"
+	}
+	tags := fmt.Sprintf("|#target:%s,org:%s,repo:%s,status:%s",
+		statsdTagReplacer.Replace(t.target), statsdTagReplacer.Replace(pr.Base.Repo.Owner.Login), statsdTagReplacer.Replace(pr.Base.Repo.Name), status)
+	s.statsd.send(fmt.Sprintf("jenkins_updater.task.duration:%d|ms%s", r.duration/time.Millisecond, tags))
+	s.statsd.send("jenkins_updater.task.result:1|c" + tags)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestSendTaskStats(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		target   string
+		failed   bool
+		expected []string
+	}{
+		{
+			name:   "success",
+			target: "jobs",
+			expected: []string{
+				`^jenkins_updater\.task\.duration:\d+\|ms\|#target:jobs,org:org,repo:repo,status:success$`,
+				`^jenkins_updater\.task\.result:1\|c\|#target:jobs,org:org,repo:repo,status:success$`,
+			},
+		},
+		{
+			name:   "failure",
+			target: "jobs",
+			failed: true,
+			expected: []string{
+				`^jenkins_updater\.task\.duration:\d+\|ms\|#target:jobs,org:org,repo:repo,status:failure$`,
+				`^jenkins_updater\.task\.result:1\|c\|#target:jobs,org:org,repo:repo,status:failure$`,
+			},
+		},
+		{
+			name:   "delimiters in tags are replaced",
+			target: "jobs:a,b",
+			expected: []string{
+				`^jenkins_updater\.task\.duration:\d+\|ms\|#target:jobs_a_b,org:org,repo:repo,status:success$`,
+				`^jenkins_updater\.task\.result:1\|c\|#target:jobs_a_b,org:org,repo:repo,status:success$`,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer listener.Close()
+
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Glob: "jobs/*", Target: tc.target}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make " + tc.target: tc.failed}}
+			s.StatsDAddr = listener.LocalAddr().String()
+
+			if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			buf := make([]byte, 1024)
+			for _, expected := range tc.expected {
+				listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+				n, _, err := listener.ReadFrom(buf)
+				if err != nil {
+					t.Fatalf("expected a metric matching %s, got error: %v", expected, err)
+				}
+				if metric := string(buf[:n]); !regexp.MustCompile(expected).MatchString(metric) {
+					t.Errorf("expected a metric matching %s, got %q", expected, metric)
+				}
+			}
+		})
+	}
+}
+
+func TestStatsDSenderDropsWhenFull(t *testing.T) {
+	// Nothing drains the metrics, so sending must not block once the buffer
+	// is full.
+	s := &statsdSender{metrics: make(chan string, 1)}
+	s.send("first:1|c")
+	s.send("second:1|c")
+	if metric := <-s.metrics; metric != "first:1|c" {
+		t.Errorf("expected the first metric to be kept, got %q", metric)
+	}
+	if len(s.metrics) != 0 {
+		t.Errorf("expected the second metric to be dropped, got %d queued", len(s.metrics))
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+const (
+	defaultStatusEntries = 20
+	// maxStatusOutputBytes is how much of the end of the output of a task
+	// is kept for /status.
+	maxStatusOutputBytes = 4096
+)
+
+// statusEntry is the result of a task as reported by /status.
+type statusEntry struct {
+	Time     time.Time `json:"time"`
+	Org      string    `json:"org"`
+	Repo     string    `json:"repo"`
+	PR       int       `json:"pr"`
+	Command  []string  `json:"command"`
+	ExitCode int       `json:"exit_code"`
+	Stdout   string    `json:"stdout,omitempty"`
+	Stderr   string    `json:"stderr,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// newStatusEntry describes the result of a task run for pr.
+func newStatusEntry(pr github.PullRequest, r result) statusEntry {
+	entry := statusEntry{
+		Time:     time.Now(),
+		Org:      pr.Base.Repo.Owner.Login,
+		Repo:     pr.Base.Repo.Name,
+		PR:       pr.Number,
+		Command:  r.command,
+		ExitCode: r.exitCode,
+		Stdout:   lastBytes(sanitize(r.stdout), maxStatusOutputBytes),
+		Stderr:   lastBytes(sanitize(r.stderr), maxStatusOutputBytes),
+	}
+	if r.err != nil {
+		entry.Error = r.err.Error()
+	}
+	return entry
+}
+
+// lastBytes keeps the last limit bytes of output, where errors tend to be.
+func lastBytes(output string, limit int) string {
+	if len(output) <= limit {
+		return output
+	}
+	return "..." + output[len(output)-limit:]
+}
+
+// statusBuffer is a ring buffer of the most recent task results.
+type statusBuffer struct {
+	sync.Mutex
+	entries []statusEntry
+	next    int
+	full    bool
+}
+
+func newStatusBuffer(size int) *statusBuffer {
+	if size < 0 {
+		size = 0
+	}
+	return &statusBuffer{entries: make([]statusEntry, size)}
+}
+
+// add records entry, replacing the oldest one if the buffer is full.
+func (b *statusBuffer) add(entry statusEntry) {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.entries) == 0 {
+		return
+	}
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// list returns the entries in the buffer, most recent first.
+func (b *statusBuffer) list() []statusEntry {
+	b.Lock()
+	defer b.Unlock()
+	count := b.next
+	if b.full {
+		count = len(b.entries)
+	}
+	entries := make([]statusEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		entries = append(entries, b.entries[(b.next-i+len(b.entries))%len(b.entries)])
+	}
+	return entries
+}
+
+// recentResults is the buffer of results for /status, which is created
+// with room for StatusEntries on first use.
+func (s *Server) recentResults() *statusBuffer {
+	s.initStatus.Do(func() {
+		if s.status == nil {
+			s.status = newStatusBuffer(s.StatusEntries)
+		}
+	})
+	return s.status
+}
+
+// recordStatus keeps the result of a task run for pr for /status.
+func (s *Server) recordStatus(pr github.PullRequest, r result) {
+	s.recentResults().add(newStatusEntry(pr, r))
+}
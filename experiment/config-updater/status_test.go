@@ -0,0 +1,122 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestStatusBuffer(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		size     int
+		added    int
+		expected []int
+	}{
+		{name: "empty", size: 3, expected: []int{}},
+		{name: "partly full", size: 3, added: 2, expected: []int{2, 1}},
+		{name: "full", size: 3, added: 3, expected: []int{3, 2, 1}},
+		{name: "wrapped around", size: 3, added: 7, expected: []int{7, 6, 5}},
+		{name: "no room", size: 0, added: 2, expected: []int{}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newStatusBuffer(tc.size)
+			for i := 1; i <= tc.added; i++ {
+				b.add(statusEntry{PR: i})
+			}
+			prs := []int{}
+			for _, entry := range b.list() {
+				prs = append(prs, entry.PR)
+			}
+			if !reflect.DeepEqual(prs, tc.expected) {
+				t.Errorf("expected entries for PRs %v, got %v", tc.expected, prs)
+			}
+		})
+	}
+}
+
+func TestLastBytes(t *testing.T) {
+	if output := lastBytes("short", 10); output != "short" {
+		t.Errorf("expected short output to be kept, got %q", output)
+	}
+	if output := lastBytes("a long line\nerror: it broke", 15); output != "...error: it broke" {
+		t.Errorf("expected the end of long output to be kept, got %q", output)
+	}
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	ghc := &fakegithub.FakeClient{
+		IssueComments: map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {
+			{Filename: "jobs/a.yaml"},
+			{Filename: "config/b.yaml"},
+		}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers: []Matcher{
+			{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"},
+			{Regex: RegexpWrapper{*regexp.MustCompile(`^config/`)}, Target: "config"},
+		},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	s.StatusEntries = defaultStatusEntries
+	s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make config": true}}
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler := requireToken(func() []byte { return []byte("s3cret") }, statusHandler(s))
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a request without a token to be refused, got status %d", w.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var entries []statusEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected two entries, got %v", entries)
+	}
+	latest := entries[0]
+	if strings.Join(latest.Command, " ") != "/usr/bin/make config" || latest.Error == "" || latest.Org != "org" || latest.Repo != "repo" || latest.PR != 1 || latest.Time.IsZero() {
+		t.Errorf("expected the failed config task to be first, got %+v", latest)
+	}
+	if strings.Join(entries[1].Command, " ") != "/usr/bin/make jobs" || entries[1].Error != "" {
+		t.Errorf("expected the jobs task to succeed, got %+v", entries[1])
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// syncToRepo copies files from the checkout of pr in dir to targetRepo by
+// pushing them to a fork of it and opening a PR, which it returns a link to.
+// Files that no longer exist in dir are deleted from targetRepo.
+func (s *Server) syncToRepo(ctx context.Context, pr github.PullRequest, dir, targetRepo string, files []string) (string, error) {
+	parts := strings.Split(targetRepo, "/")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("target repo %q is not of the form org/repo", targetRepo)
+	}
+	org, repo := parts[0], parts[1]
+	log := s.log.WithField("targetRepo", targetRepo)
+
+	botName, err := s.github(ctx).BotName()
+	if err != nil {
+		return "", err
+	}
+	target, err := s.github(ctx).GetRepo(org, repo)
+	if err != nil {
+		return "", fmt.Errorf("error getting repo: %v", err)
+	}
+	if err := s.github(ctx).CreateFork(org, repo); err != nil {
+		return "", fmt.Errorf("error forking: %v", err)
+	}
+
+	log.Info("cloning " + targetRepo)
+	var r gitRepo
+	if err := s.retry(ctx, "clone", func() error {
+		var err error
+		r, err = s.gc.Clone(ctx, targetRepo)
+		return err
+	}); err != nil {
+		return "", fmt.Errorf("error cloning: %v", err)
+	}
+	defer func() {
+		if err := r.Clean(); err != nil {
+			log.WithError(err).Error("Error cleaning up repo.")
+		}
+	}()
+	if err := r.Checkout(ctx, target.DefaultBranch); err != nil {
+		return "", err
+	}
+
+	source := pr.Base.Repo.Owner.Login + "/" + pr.Base.Repo.Name
+	branch := fmt.Sprintf("config-updater-%s-%d", strings.Replace(source, "/", "-", -1), pr.Number)
+	if err := r.CheckoutNewBranch(branch); err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if err := copyFile(filepath.Join(dir, file), filepath.Join(r.Directory(), file)); err != nil {
+			return "", err
+		}
+	}
+	title := fmt.Sprintf("Update from %s#%d", source, pr.Number)
+	if err := r.Commit(botName, botName+"@users.noreply.github.com", title); err != nil {
+		return "", err
+	}
+	// The fork is created asynchronously, so it may take a while before we
+	// can push to it.
+	if err := s.retry(ctx, "push", func() error {
+		return r.Push(repo, branch)
+	}); err != nil {
+		return "", fmt.Errorf("error pushing: %v", err)
+	}
+
+	body := fmt.Sprintf("This copies the changes to the following files from %s:\n", pr.HTMLURL)
+	for _, file := range files {
+		body += fmt.Sprintf("- `%s`\n", file)
+	}
+	number, err := s.github(ctx).CreatePullRequest(org, repo, title, body, botName+":"+branch, target.DefaultBranch, true)
+	if err != nil {
+		return "", fmt.Errorf("error creating pull request: %v", err)
+	}
+	log.WithField("targetPR", number).Info("Opened pull request.")
+	return fmt.Sprintf("%s#%d", targetRepo, number), nil
+}
+
+// copyFile replaces dst with src, or deletes dst if src does not exist.
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, content, info.Mode())
+}
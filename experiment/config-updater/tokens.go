@@ -0,0 +1,256 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+// RotatingTokenSource hands out one of a pool of GitHub tokens at a time,
+// moving on to the next when the current one exhausts its rate limit.
+type RotatingTokenSource struct {
+	// tokens return each token, so that they are reloaded like any other
+	// secret.
+	tokens []func() []byte
+
+	lock    sync.Mutex
+	current int
+}
+
+// NewRotatingTokenSource creates a source starting with the first of tokens.
+func NewRotatingTokenSource(tokens []func() []byte) *RotatingTokenSource {
+	return &RotatingTokenSource{tokens: tokens}
+}
+
+// Token returns the current token.
+func (r *RotatingTokenSource) Token() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return strings.TrimSpace(string(r.tokens[r.current]()))
+}
+
+// Generator returns the current token, for the GitHub and git clients.
+func (r *RotatingTokenSource) Generator() []byte {
+	return []byte(r.Token())
+}
+
+// Rotate moves on to the next token if exhausted, as returned by Current, is
+// still in use. That way, calls failing at once for the same token only
+// rotate once.
+func (r *RotatingTokenSource) Rotate(exhausted int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.current == exhausted {
+		r.current = (r.current + 1) % len(r.tokens)
+	}
+}
+
+// Current returns which token is in use.
+func (r *RotatingTokenSource) Current() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.current
+}
+
+// Len returns how many tokens are in the pool.
+func (r *RotatingTokenSource) Len() int {
+	return len(r.tokens)
+}
+
+// isRateLimited determines whether err is GitHub refusing a call because the
+// token exhausted its rate limit, for longer than the client waits for.
+func isRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	for _, limited := range []string{
+		"status code 429",
+		"API rate limit exceeded",
+		"sleep time for token reset exceeds max sleep time",
+		"sleep time for abuse rate limit exceeds max sleep time",
+	} {
+		if strings.Contains(message, limited) {
+			return true
+		}
+	}
+	return false
+}
+
+// rotatingGitHubClient retries the calls that exhaust the rate limit of a
+// token with the next token of the pool, until every token was tried. Calls
+// refused for the rate limit had no effect, so retrying them is safe.
+type rotatingGitHubClient struct {
+	githubClient
+	tokens *RotatingTokenSource
+	log    *logrus.Entry
+}
+
+// do calls fn until it is not rate limited or every token was tried.
+func (r *rotatingGitHubClient) do(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < r.tokens.Len(); attempt++ {
+		current := r.tokens.Current()
+		if err = fn(); !isRateLimited(err) {
+			return err
+		}
+		r.log.WithError(err).WithField("token", current).Warn("GitHub token exhausted its rate limit, rotating to the next one.")
+		r.tokens.Rotate(current)
+	}
+	return err
+}
+
+func (r *rotatingGitHubClient) GetPullRequestChanges(org, repo string, number int) (changes []github.PullRequestChange, err error) {
+	err = r.do(func() error {
+		changes, err = r.githubClient.GetPullRequestChanges(org, repo, number)
+		return err
+	})
+	return changes, err
+}
+
+func (r *rotatingGitHubClient) GetPullRequest(org, repo string, number int) (pr *github.PullRequest, err error) {
+	err = r.do(func() error {
+		pr, err = r.githubClient.GetPullRequest(org, repo, number)
+		return err
+	})
+	return pr, err
+}
+
+func (r *rotatingGitHubClient) FindAllIssues(query, sort string, asc bool) (issues []github.Issue, err error) {
+	err = r.do(func() error {
+		issues, err = r.githubClient.FindAllIssues(query, sort, asc)
+		return err
+	})
+	return issues, err
+}
+
+func (r *rotatingGitHubClient) CreateComment(org, repo string, number int, comment string) error {
+	return r.do(func() error {
+		return r.githubClient.CreateComment(org, repo, number, comment)
+	})
+}
+
+func (r *rotatingGitHubClient) ListIssueComments(org, repo string, number int) (comments []github.IssueComment, err error) {
+	err = r.do(func() error {
+		comments, err = r.githubClient.ListIssueComments(org, repo, number)
+		return err
+	})
+	return comments, err
+}
+
+func (r *rotatingGitHubClient) IsMember(org, user string) (member bool, err error) {
+	err = r.do(func() error {
+		member, err = r.githubClient.IsMember(org, user)
+		return err
+	})
+	return member, err
+}
+
+func (r *rotatingGitHubClient) MinimizeComment(org, repo string, id int) error {
+	return r.do(func() error {
+		return r.githubClient.MinimizeComment(org, repo, id)
+	})
+}
+
+func (r *rotatingGitHubClient) BotName() (name string, err error) {
+	err = r.do(func() error {
+		name, err = r.githubClient.BotName()
+		return err
+	})
+	return name, err
+}
+
+func (r *rotatingGitHubClient) GetRepo(owner, name string) (repo github.Repo, err error) {
+	err = r.do(func() error {
+		repo, err = r.githubClient.GetRepo(owner, name)
+		return err
+	})
+	return repo, err
+}
+
+func (r *rotatingGitHubClient) CreateFork(owner, repo string) error {
+	return r.do(func() error {
+		return r.githubClient.CreateFork(owner, repo)
+	})
+}
+
+func (r *rotatingGitHubClient) CreatePullRequest(org, repo, title, body, head, base string, canModify bool) (number int, err error) {
+	err = r.do(func() error {
+		number, err = r.githubClient.CreatePullRequest(org, repo, title, body, head, base, canModify)
+		return err
+	})
+	return number, err
+}
+
+func (r *rotatingGitHubClient) CreateIssue(org, repo, title, body string, milestone int, labels, assignees []string) (number int, err error) {
+	err = r.do(func() error {
+		number, err = r.githubClient.CreateIssue(org, repo, title, body, milestone, labels, assignees)
+		return err
+	})
+	return number, err
+}
+
+func (r *rotatingGitHubClient) CreateCheckRun(org, repo string, opt github.CheckRunOptions) (id int64, err error) {
+	err = r.do(func() error {
+		id, err = r.githubClient.CreateCheckRun(org, repo, opt)
+		return err
+	})
+	return id, err
+}
+
+func (r *rotatingGitHubClient) UpdateCheckRun(org, repo string, checkRunID int64, opt github.CheckRunOptions) error {
+	return r.do(func() error {
+		return r.githubClient.UpdateCheckRun(org, repo, checkRunID, opt)
+	})
+}
+
+func (r *rotatingGitHubClient) CreateDeployment(org, repo string, opt github.DeploymentOptions) (id int64, err error) {
+	err = r.do(func() error {
+		id, err = r.githubClient.CreateDeployment(org, repo, opt)
+		return err
+	})
+	return id, err
+}
+
+func (r *rotatingGitHubClient) CreateDeploymentStatus(org, repo string, deploymentID int64, opt github.DeploymentStatusOptions) error {
+	return r.do(func() error {
+		return r.githubClient.CreateDeploymentStatus(org, repo, deploymentID, opt)
+	})
+}
+
+func (r *rotatingGitHubClient) AddLabel(org, repo string, number int, label string) error {
+	return r.do(func() error {
+		return r.githubClient.AddLabel(org, repo, number, label)
+	})
+}
+
+func (r *rotatingGitHubClient) RemoveLabel(org, repo string, number int, label string) error {
+	return r.do(func() error {
+		return r.githubClient.RemoveLabel(org, repo, number, label)
+	})
+}
+
+func (r *rotatingGitHubClient) CreateIssueReaction(org, repo string, number int, reaction string) error {
+	return r.do(func() error {
+		return r.githubClient.CreateIssueReaction(org, repo, number, reaction)
+	})
+}
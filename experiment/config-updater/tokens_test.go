@@ -0,0 +1,173 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func staticTokens(tokens ...string) []func() []byte {
+	var generators []func() []byte
+	for _, token := range tokens {
+		token := token
+		generators = append(generators, func() []byte { return []byte(token + "\n") })
+	}
+	return generators
+}
+
+func TestRotatingTokenSource(t *testing.T) {
+	r := NewRotatingTokenSource(staticTokens("a", "b", "c"))
+	if token := r.Token(); token != "a" {
+		t.Fatalf("expected token a, got %q", token)
+	}
+
+	// Calls that failed at once with the same token only rotate once.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Rotate(0)
+		}()
+	}
+	wg.Wait()
+	if token := r.Token(); token != "b" {
+		t.Errorf("expected token b, got %q", token)
+	}
+
+	r.Rotate(1)
+	r.Rotate(2)
+	if token := r.Token(); token != "a" {
+		t.Errorf("expected to wrap around to token a, got %q", token)
+	}
+}
+
+func TestIsRateLimited(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name: "no error",
+		},
+		{
+			name:     "secondary rate limit",
+			err:      errors.New("status code 429 not one of [200], body: {}"),
+			expected: true,
+		},
+		{
+			name:     "rate limit exhausted",
+			err:      errors.New(`status code 403 not one of [201], body: {"message":"API rate limit exceeded for user ID 1."}`),
+			expected: true,
+		},
+		{
+			name:     "reset too far away",
+			err:      errors.New("sleep time for token reset exceeds max sleep time (1h0m0s > 2m0s)"),
+			expected: true,
+		},
+		{
+			name: "forbidden",
+			err:  errors.New(`status code 403 not one of [201], body: {"message":"Resource not accessible by integration"}`),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := isRateLimited(tc.err); actual != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+// rateLimitedGitHub refuses to comment with the exhausted tokens.
+type rateLimitedGitHub struct {
+	*fakegithub.FakeClient
+	tokens    *RotatingTokenSource
+	exhausted map[string]bool
+	used      []string
+}
+
+func (r *rateLimitedGitHub) CreateComment(org, repo string, number int, comment string) error {
+	token := r.tokens.Token()
+	r.used = append(r.used, token)
+	if r.exhausted[token] {
+		return fmt.Errorf(`status code 403 not one of [201], body: {"message":"API rate limit exceeded for %s."}`, token)
+	}
+	return r.FakeClient.CreateComment(org, repo, number, comment)
+}
+
+func TestRotatingGitHubClient(t *testing.T) {
+	var testcases = []struct {
+		name         string
+		exhausted    []string
+		expectedUsed []string
+		expectedErr  bool
+	}{
+		{
+			name:         "token with quota left",
+			expectedUsed: []string{"a"},
+		},
+		{
+			name:         "rotates past exhausted tokens",
+			exhausted:    []string{"a", "b"},
+			expectedUsed: []string{"a", "b", "c"},
+		},
+		{
+			name:         "every token exhausted",
+			exhausted:    []string{"a", "b", "c"},
+			expectedUsed: []string{"a", "b", "c"},
+			expectedErr:  true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens := NewRotatingTokenSource(staticTokens("a", "b", "c"))
+			ghc := &rateLimitedGitHub{
+				FakeClient: &fakegithub.FakeClient{IssueComments: map[int][]github.IssueComment{}},
+				tokens:     tokens,
+				exhausted:  map[string]bool{},
+			}
+			for _, token := range tc.exhausted {
+				ghc.exhausted[token] = true
+			}
+			client := &rotatingGitHubClient{githubClient: ghc, tokens: tokens, log: logrus.WithField("test", tc.name)}
+
+			err := client.CreateComment("org", "repo", 1, "hello")
+			if tc.expectedErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if !reflect.DeepEqual(ghc.used, tc.expectedUsed) {
+				t.Errorf("expected tokens %v to be used, got %v", tc.expectedUsed, ghc.used)
+			}
+			if expected := len(tc.exhausted) < 3; expected != (len(ghc.IssueCommentsAdded) == 1) {
+				t.Errorf("expected a comment %v, got %v", expected, ghc.IssueCommentsAdded)
+			}
+		})
+	}
+}
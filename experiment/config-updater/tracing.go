@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceAttributesKey holds the attributes added to every span started with
+// the context, such as the PR being updated.
+type traceAttributesKey struct{}
+
+// withTraceAttributes adds attributes to every span started with ctx.
+func withTraceAttributes(ctx context.Context, attributes ...attribute.KeyValue) context.Context {
+	inherited, _ := ctx.Value(traceAttributesKey{}).([]attribute.KeyValue)
+	return context.WithValue(ctx, traceAttributesKey{}, append(append([]attribute.KeyValue{}, inherited...), attributes...))
+}
+
+// tracer starts the spans of TracerProvider, which start none when it is
+// unset.
+func (s *Server) tracer() trace.Tracer {
+	provider := s.TracerProvider
+	if provider == nil {
+		provider = trace.NewNoopTracerProvider()
+	}
+	return provider.Tracer(pluginName, trace.WithInstrumentationVersion(version))
+}
+
+// startSpan starts a span as the child of the one in ctx, or as the root of
+// a new trace.
+func (s *Server) startSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if attributes, ok := ctx.Value(traceAttributesKey{}).([]attribute.KeyValue); ok {
+		options = append(options, trace.WithAttributes(attributes...))
+	}
+	return s.tracer().Start(ctx, name, options...)
+}
+
+// startRemoteSpan starts the span of a webhook, as the child of the span
+// that sent it if the request says which. GitHub does not, but a proxy in
+// front of us may.
+func (s *Server) startRemoteSpan(ctx context.Context, name string, r *http.Request) (context.Context, trace.Span) {
+	if parent, ok := spanContextFromRequest(r); ok {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, parent)
+	}
+	return s.tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// spanContextFromRequest reads the span that sent r from its W3C traceparent
+// header, or else from its B3 headers.
+func spanContextFromRequest(r *http.Request) (trace.SpanContext, bool) {
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+	if parent := trace.SpanContextFromContext(ctx); parent.IsValid() {
+		return parent, true
+	}
+	return parseB3(r.Header)
+}
+
+// parseB3 parses the multiple B3 headers, X-B3-TraceId, X-B3-SpanId and
+// X-B3-Sampled, which OpenTelemetry has no propagator for here.
+func parseB3(header http.Header) (trace.SpanContext, bool) {
+	traceIDHex := header.Get("X-B3-TraceId")
+	// 64-bit trace IDs are the lower half of a 128-bit one.
+	if len(traceIDHex) == 16 {
+		traceIDHex = strings.Repeat("0", 16) + traceIDHex
+	}
+	traceID, err := trace.TraceIDFromHex(traceIDHex)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	spanID, err := trace.SpanIDFromHex(header.Get("X-B3-SpanId"))
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	config := trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, Remote: true}
+	switch sampled := header.Get("X-B3-Sampled"); {
+	case sampled == "1" || sampled == "true" || header.Get("X-B3-Flags") == "1":
+		config.TraceFlags = trace.FlagsSampled
+	case sampled == "" || sampled == "0" || sampled == "false":
+	default:
+		return trace.SpanContext{}, false
+	}
+	return trace.NewSpanContext(config), true
+}
+
+// endSpan ends span, marking it as failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
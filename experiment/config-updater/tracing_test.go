@@ -0,0 +1,398 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+// recordingExporter keeps the spans that end.
+type recordingExporter struct {
+	lock  sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (e *recordingExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// named returns the first span named name, if any.
+func (e *recordingExporter) named(name string) sdktrace.ReadOnlySpan {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, span := range e.spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+// attributesOf returns the attributes of span by key.
+func attributesOf(span sdktrace.ReadOnlySpan) map[string]interface{} {
+	attributes := map[string]interface{}{}
+	for _, kv := range span.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	return attributes
+}
+
+func TestTraceWebhook(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		traced      bool
+		traceparent string
+		failures    map[string]bool
+
+		expectedSpans  bool
+		expectedTrace  string
+		expectedParent string
+		expectedFailed bool
+	}{
+		{
+			name: "nothing is traced without a tracer provider",
+		},
+		{
+			name:          "event is traced",
+			traced:        true,
+			expectedSpans: true,
+		},
+		{
+			name:           "trace of the sender is continued",
+			traced:         true,
+			traceparent:    "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			expectedSpans:  true,
+			expectedTrace:  "0af7651916cd43dd8448eb211c80319c",
+			expectedParent: "b7ad6b7169203331",
+		},
+		{
+			name:           "failed task marks its span",
+			traced:         true,
+			failures:       map[string]bool{"/usr/bin/make jobs": true},
+			expectedSpans:  true,
+			expectedFailed: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			exporter := &recordingExporter{}
+
+			secret := []byte("secret")
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/a.yaml"}}},
+			}
+			s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+				Matchers:   []Matcher{{Regex: RegexpWrapper{*regexp.MustCompile(`^jobs/`)}, Target: "jobs"}},
+				MaxPRFiles: defaultMaxPRFiles,
+			})
+			s.hmacSecret = func() []byte { return secret }
+			s.executor = &recordingExecutor{failures: tc.failures}
+			if tc.traced {
+				s.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			}
+
+			payload := mergedPREvent(t)
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+			req.Header.Set("X-GitHub-Event", "pull_request")
+			req.Header.Set("X-GitHub-Delivery", "guid")
+			req.Header.Set("X-Hub-Signature", github.PayloadSignature(payload, secret))
+			req.Header.Set("content-type", "application/json")
+			if tc.traceparent != "" {
+				req.Header.Set("traceparent", tc.traceparent)
+			}
+			s.ServeHTTP(httptest.NewRecorder(), req)
+
+			webhook := exporter.named("config-updater/webhook")
+			if !tc.expectedSpans {
+				if len(exporter.spans) != 0 {
+					t.Errorf("expected no spans, got %d", len(exporter.spans))
+				}
+				return
+			}
+			event := exporter.named("config-updater/event")
+			task := exporter.named("config-updater/task")
+			changes := exporter.named("github/GetPullRequestChanges")
+			comment := exporter.named("github/CreateComment")
+			for name, span := range map[string]sdktrace.ReadOnlySpan{"webhook": webhook, "event": event, "task": task, "changes": changes, "comment": comment} {
+				if span == nil {
+					t.Fatalf("expected a span for the %s", name)
+				}
+			}
+
+			traceID := webhook.SpanContext().TraceID()
+			if tc.expectedTrace != "" && traceID.String() != tc.expectedTrace {
+				t.Errorf("expected the trace %s, got %s", tc.expectedTrace, traceID)
+			}
+			if tc.expectedParent != "" && webhook.Parent().SpanID().String() != tc.expectedParent {
+				t.Errorf("expected the webhook span to be a child of %s, got %s", tc.expectedParent, webhook.Parent().SpanID())
+			}
+			if webhook.SpanKind() != trace.SpanKindServer {
+				t.Errorf("expected the webhook span to be a server span, got kind %s", webhook.SpanKind())
+			}
+			parents := []struct {
+				name          string
+				child, parent sdktrace.ReadOnlySpan
+			}{
+				{name: "event", child: event, parent: webhook},
+				{name: "task", child: task, parent: event},
+				{name: "changes", child: changes, parent: event},
+				{name: "comment", child: comment, parent: event},
+			}
+			for _, p := range parents {
+				if p.child.SpanContext().TraceID() != traceID {
+					t.Errorf("expected the %s span to be in trace %s, got %s", p.name, traceID, p.child.SpanContext().TraceID())
+				}
+				if p.child.Parent().SpanID() != p.parent.SpanContext().SpanID() {
+					t.Errorf("expected the %s span to be a child of %s, got %s", p.name, p.parent.SpanContext().SpanID(), p.child.Parent().SpanID())
+				}
+			}
+			if changes.SpanKind() != trace.SpanKindClient {
+				t.Errorf("expected the GitHub span to be a client span, got kind %s", changes.SpanKind())
+			}
+
+			expectedAttributes := map[string]interface{}{"org": "org", "repo": "repo", "pr": int64(1), "target": "jobs"}
+			for key, value := range expectedAttributes {
+				if actual := attributesOf(task)[key]; actual != value {
+					t.Errorf("expected the task span to have %s=%v, got %v", key, value, actual)
+				}
+			}
+			if actual := attributesOf(comment)["pr"]; actual != int64(1) {
+				t.Errorf("expected the GitHub span to have pr=1, got %v", actual)
+			}
+
+			if failed := task.Status().Code == codes.Error; failed != tc.expectedFailed {
+				t.Errorf("expected the task span to have failed: %v, got status %+v", tc.expectedFailed, task.Status())
+			}
+			if event.Status().Code == codes.Error {
+				t.Errorf("expected the event span to succeed, got status %+v", event.Status())
+			}
+		})
+	}
+}
+
+func TestSpanContextFromRequest(t *testing.T) {
+	var testcases = []struct {
+		name    string
+		headers map[string]string
+
+		expectedOK      bool
+		expectedTrace   string
+		expectedSampled bool
+	}{
+		{
+			name:            "sampled traceparent",
+			headers:         map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+			expectedOK:      true,
+			expectedSampled: true,
+		},
+		{
+			name:       "traceparent not sampled",
+			headers:    map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"},
+			expectedOK: true,
+		},
+		{
+			name: "no headers",
+		},
+		{
+			name:    "invalid version",
+			headers: map[string]string{"traceparent": "ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		},
+		{
+			name:    "short trace ID",
+			headers: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c8031-b7ad6b7169203331-01"},
+		},
+		{
+			name:    "not hex",
+			headers: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01"},
+		},
+		{
+			name:    "zero span ID",
+			headers: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01"},
+		},
+		{
+			name:            "sampled B3",
+			headers:         map[string]string{"X-B3-TraceId": "0af7651916cd43dd8448eb211c80319c", "X-B3-SpanId": "b7ad6b7169203331", "X-B3-Sampled": "1"},
+			expectedOK:      true,
+			expectedSampled: true,
+		},
+		{
+			name:          "B3 not sampled with a 64-bit trace ID",
+			headers:       map[string]string{"X-B3-TraceId": "8448eb211c80319c", "X-B3-SpanId": "b7ad6b7169203331", "X-B3-Sampled": "0"},
+			expectedOK:    true,
+			expectedTrace: "00000000000000008448eb211c80319c",
+		},
+		{
+			name:    "B3 with an invalid sampling decision",
+			headers: map[string]string{"X-B3-TraceId": "0af7651916cd43dd8448eb211c80319c", "X-B3-SpanId": "b7ad6b7169203331", "X-B3-Sampled": "maybe"},
+		},
+		{
+			name: "traceparent is preferred over B3",
+			headers: map[string]string{
+				"traceparent":  "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				"X-B3-TraceId": "11111111111111111111111111111111",
+				"X-B3-SpanId":  "b7ad6b7169203331",
+			},
+			expectedOK:      true,
+			expectedSampled: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+			sc, ok := spanContextFromRequest(req)
+			if ok != tc.expectedOK {
+				t.Fatalf("expected ok: %v, got %v", tc.expectedOK, ok)
+			}
+			if !ok {
+				return
+			}
+			expectedTrace := tc.expectedTrace
+			if expectedTrace == "" {
+				expectedTrace = "0af7651916cd43dd8448eb211c80319c"
+			}
+			if sc.TraceID().String() != expectedTrace || sc.SpanID().String() != "b7ad6b7169203331" {
+				t.Errorf("unexpected span context %+v", sc)
+			}
+			if !sc.IsRemote() {
+				t.Error("expected a remote span context")
+			}
+			if sc.IsSampled() != tc.expectedSampled {
+				t.Errorf("expected sampled: %v, got %v", tc.expectedSampled, sc.IsSampled())
+			}
+		})
+	}
+}
+
+func TestOTLPExporterExport(t *testing.T) {
+	var received otlpTraceRequest
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Errorf("failed to unmarshal spans: %v", err)
+		}
+	}))
+	defer collector.Close()
+
+	start := time.Unix(100, 0)
+	spans := &recordingExporter{}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(spans),
+		sdktrace.WithIDGenerator(fixedIDs{spanID: trace.SpanID{0xb7, 0xad}}),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", pluginName))),
+	)
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x0a, 0xf7},
+		SpanID:     trace.SpanID{0x01},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+	_, span := provider.Tracer(pluginName, trace.WithInstrumentationVersion("v1.2.3")).Start(ctx, "github/CreateComment",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(attribute.String("repo", "repo"), attribute.Int("pr", 1)),
+	)
+	span.SetStatus(codes.Error, "it broke")
+	span.End(trace.WithTimestamp(start.Add(time.Second)))
+
+	e := &OTLPExporter{Endpoint: collector.URL, client: http.DefaultClient, log: logrus.WithField("plugin", pluginName)}
+	if err := e.export(context.Background(), spans.spans); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if path != "/v1/traces" {
+		t.Errorf("expected the spans to be sent to /v1/traces, got %s", path)
+	}
+	if len(received.ResourceSpans) != 1 || len(received.ResourceSpans[0].ScopeSpans) != 1 || len(received.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("expected a single span, got %+v", received)
+	}
+	if scope := received.ResourceSpans[0].ScopeSpans[0].Scope; scope.Name != pluginName || scope.Version != "v1.2.3" {
+		t.Errorf("expected the scope %s v1.2.3, got %+v", pluginName, scope)
+	}
+	if service := received.ResourceSpans[0].Resource.Attributes; len(service) != 1 || service[0].Key != "service.name" || *service[0].Value.StringValue != pluginName {
+		t.Errorf("expected the resource to be the service %s, got %+v", pluginName, service)
+	}
+	actual := received.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	one, repo := "1", "repo"
+	expected := otlpSpan{
+		TraceID:           "0af70000000000000000000000000000",
+		SpanID:            "b7ad000000000000",
+		ParentSpanID:      "0100000000000000",
+		Name:              "github/CreateComment",
+		Kind:              otlpKindClient,
+		StartTimeUnixNano: "100000000000",
+		EndTimeUnixNano:   "101000000000",
+		Attributes: []otlpAttribute{
+			{Key: "pr", Value: otlpValue{IntValue: &one}},
+			{Key: "repo", Value: otlpValue{StringValue: &repo}},
+		},
+		Status: otlpStatus{Code: otlpStatusError, Message: "it broke"},
+	}
+	expectedJSON, _ := json.Marshal(expected)
+	actualJSON, _ := json.Marshal(actual)
+	if !bytes.Equal(expectedJSON, actualJSON) {
+		t.Errorf("expected span %s, got %s", expectedJSON, actualJSON)
+	}
+}
+
+// fixedIDs generates the same span ID every time.
+type fixedIDs struct {
+	traceID trace.TraceID
+	spanID  trace.SpanID
+}
+
+func (g fixedIDs) NewIDs(context.Context) (trace.TraceID, trace.SpanID) {
+	return g.traceID, g.spanID
+}
+
+func (g fixedIDs) NewSpanID(context.Context, trace.TraceID) trace.SpanID {
+	return g.spanID
+}
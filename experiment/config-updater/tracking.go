@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+)
+
+const (
+	// defaultTrackingWindow is used when tracking issues set no window.
+	defaultTrackingWindow = 24 * time.Hour
+	// defaultTrackingLabel is used when tracking issues set no label.
+	defaultTrackingLabel = "config-apply-failure"
+)
+
+// TrackingIssues files an issue for each target that keeps failing, so that
+// the failures are not lost in the comments on merged PRs.
+type TrackingIssues struct {
+	// Repo is the org/repo to file the issues in.
+	Repo string `json:"repo"`
+	// MaxFailures is how many times a target may fail within Window before
+	// an issue is filed. Every failure after that is added to the issue.
+	MaxFailures int `json:"max_failures,omitempty" yaml:"max_failures,omitempty"`
+	// Window is how far back failures are counted, a day by default.
+	Window time.Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	// Label is applied to the issues, config-apply-failure by default.
+	Label string `json:"label,omitempty" yaml:"label,omitempty"`
+}
+
+// validate checks that the issues are filed in a repo, if they are.
+func (i *TrackingIssues) validate() error {
+	if i == nil {
+		return nil
+	}
+	if parts := strings.Split(i.Repo, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("repo %q must be in the form org/repo", i.Repo)
+	}
+	if i.MaxFailures < 0 {
+		return fmt.Errorf("max_failures must not be negative, not %d", i.MaxFailures)
+	}
+	if i.Window < 0 {
+		return fmt.Errorf("window must not be negative, not %v", i.Window)
+	}
+	return nil
+}
+
+func (i *TrackingIssues) window() time.Duration {
+	if i.Window == 0 {
+		return defaultTrackingWindow
+	}
+	return i.Window
+}
+
+func (i *TrackingIssues) label() string {
+	if i.Label == "" {
+		return defaultTrackingLabel
+	}
+	return i.Label
+}
+
+// trackFailure counts the failure of the target of t, and once it failed
+// more than MaxFailures times within the window, files an issue for it or
+// comments on the one already open. The failures are counted in the
+// escalation store, so that they survive restarts like those paged for.
+// Failing to do so is only logged, as the results are reported on the PR
+// regardless.
+func (s *Server) trackFailure(ctx context.Context, c *UpdateConfig, pr github.PullRequest, t task, r result) {
+	if c.TrackingIssues == nil || !r.failed() {
+		return
+	}
+	repo := pr.Base.Repo.Owner.Login + "/" + pr.Base.Repo.Name
+	target := t.escalationTarget()
+	// Successes reset the escalation of a target, but not its tracking, so
+	// they are counted apart.
+	key := "tracking/" + repo + "/" + target
+	title := fmt.Sprintf("Applying %s keeps failing for %s", target, repo)
+	log := s.log.WithField("title", title)
+
+	var failedIn []string
+	var trimmed bool
+	err := s.escalations().update(key, func(escalation *Escalation) {
+		now := time.Now()
+		var recent []time.Time
+		var recentIn []string
+		for i, failedAt := range escalation.FailedAt {
+			if now.Sub(failedAt) < c.TrackingIssues.window() && i < len(escalation.FailedIn) {
+				recent = append(recent, failedAt)
+				recentIn = append(recentIn, escalation.FailedIn[i])
+			}
+		}
+		recent = append(recent, now)
+		recentIn = append(recentIn, pr.HTMLURL)
+		// Only those needed to file the issue are kept, so that a target
+		// failing in a loop cannot grow the store without bound.
+		if keep := c.TrackingIssues.MaxFailures + 1; len(recent) > keep {
+			recent, recentIn = recent[len(recent)-keep:], recentIn[len(recentIn)-keep:]
+			trimmed = true
+		}
+		escalation.FailedAt, escalation.FailedIn = recent, recentIn
+		escalation.Failures = len(recent)
+		failedIn = recentIn
+	})
+	if err != nil {
+		log.WithError(err).Error("Error saving escalations.")
+	}
+	if len(failedIn) <= c.TrackingIssues.MaxFailures {
+		return
+	}
+
+	excerpt := fmt.Sprintf("The latest error, from `%s`:\n```\n%s\n```\n", strings.Join(r.command, " "), firstLines(failureMessage(r)))
+	if err := s.fileTrackingIssue(ctx, c.TrackingIssues, title, pr, failedIn, trimmed, excerpt); err != nil {
+		log.WithError(err).Error("Error filing tracking issue.")
+	}
+}
+
+// fileTrackingIssue comments on the open issue with title, or files it if
+// there is none, listing the PRs failedIn. trimmed is set when earlier
+// failures within the window are not listed.
+func (s *Server) fileTrackingIssue(ctx context.Context, tracking *TrackingIssues, title string, pr github.PullRequest, failedIn []string, trimmed bool, excerpt string) error {
+	parts := strings.SplitN(tracking.Repo, "/", 2)
+	org, repo := parts[0], parts[1]
+	query := fmt.Sprintf("repo:%s is:issue is:open in:title %q", tracking.Repo, title)
+	issues, err := s.github(ctx).FindAllIssues(query, "created", true)
+	if err != nil {
+		return fmt.Errorf("error searching for the issue: %v", err)
+	}
+	for _, issue := range issues {
+		// The search matches words, so it may find other issues too.
+		if issue.Title == title && issue.State == "open" && issue.PullRequest == nil {
+			return s.github(ctx).CreateComment(org, repo, issue.Number, fmt.Sprintf("Failed again in %s.\n\n%s", pr.HTMLURL, excerpt))
+		}
+	}
+
+	var b strings.Builder
+	times := fmt.Sprintf("%d times", len(failedIn))
+	if trimmed {
+		times = "at least " + times
+	}
+	fmt.Fprintf(&b, "This target failed %s within %v, in:\n", times, tracking.window())
+	for _, url := range failedIn {
+		fmt.Fprintf(&b, "- %s\n", url)
+	}
+	b.WriteString("\n")
+	b.WriteString(excerpt)
+	b.WriteString("\nFurther failures are added as comments. Please close this issue once the target is fixed.\n")
+	_, err = s.github(ctx).CreateIssue(org, repo, title, b.String(), 0, []string{tracking.label()}, nil)
+	return err
+}
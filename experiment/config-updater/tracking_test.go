@@ -0,0 +1,152 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestTrackFailure(t *testing.T) {
+	const title = "Applying jobs keeps failing for org/repo"
+	var testcases = []struct {
+		name     string
+		tracking TrackingIssues
+		existing []github.Issue
+		// failures are whether the target fails for each PR in turn.
+		failures         []bool
+		expectedCreated  []string
+		expectedBody     []string
+		expectedComments []string
+	}{
+		{
+			name:            "filed once the target failed too often, then commented on",
+			tracking:        TrackingIssues{Repo: "org/infra", MaxFailures: 2},
+			failures:        []bool{true, true, true, true},
+			expectedCreated: []string{"org/infra#1:" + title},
+			expectedBody: []string{
+				"This target failed 3 times within 24h0m0s, in:\n- https://github.com/org/repo/pull/1\n- https://github.com/org/repo/pull/2\n- https://github.com/org/repo/pull/3\n",
+				"The latest error, from `/usr/bin/make jobs`:\n```\nit broke\n```\n",
+			},
+			expectedComments: []string{"org/infra#1:Failed again in https://github.com/org/repo/pull/4.\n\nThe latest error, from `/usr/bin/make jobs`:\n```\nit broke\n```\n"},
+		},
+		{
+			name:     "successes do not count",
+			tracking: TrackingIssues{Repo: "org/infra", MaxFailures: 2},
+			failures: []bool{true, false, true, false},
+		},
+		{
+			name:     "open issue is commented on",
+			tracking: TrackingIssues{Repo: "org/infra"},
+			existing: []github.Issue{
+				{Number: 7, Title: title + " again", State: "open"},
+				{Number: 8, Title: title, State: "closed"},
+				{Number: 9, Title: title, State: "open"},
+			},
+			failures:         []bool{true},
+			expectedComments: []string{"org/infra#9:Failed again in https://github.com/org/repo/pull/1.\n\nThe latest error, from `/usr/bin/make jobs`:\n```\nit broke\n```\n"},
+		},
+		{
+			name:     "failures outside the window do not count",
+			tracking: TrackingIssues{Repo: "org/infra", MaxFailures: 1, Window: time.Nanosecond},
+			failures: []bool{true, true, true},
+		},
+		{
+			name:            "custom label",
+			tracking:        TrackingIssues{Repo: "org/infra", Label: "oncall"},
+			failures:        []bool{true},
+			expectedCreated: []string{"org/infra#1:" + title},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			changes := map[int][]github.PullRequestChange{}
+			for i := range tc.failures {
+				changes[i+1] = []github.PullRequestChange{{Filename: "jobs/config.yaml"}}
+			}
+			ghc := &fakegithub.FakeClient{
+				IssueComments:      map[int][]github.IssueComment{},
+				PullRequestChanges: changes,
+				Issues:             tc.existing,
+			}
+			dir, err := ioutil.TempDir("", "escalations")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "escalations.json")
+
+			tracking := tc.tracking
+			for i, failed := range tc.failures {
+				// Each event is handled by a new server, loading the
+				// failures saved by the last, as after a restart.
+				escalations, err := LoadEscalationStore(path)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+					Matchers:       []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+					MaxPRFiles:     defaultMaxPRFiles,
+					TrackingIssues: &tracking,
+				})
+				s.Escalations = escalations
+				s.executor = &recordingExecutor{failures: map[string]bool{"/usr/bin/make jobs": failed}}
+				event := mergedPREvent(t, func(pr *github.PullRequest) {
+					pr.Number = i + 1
+					pr.HTMLURL = fmt.Sprintf("https://github.com/org/repo/pull/%d", i+1)
+				})
+				if err := s.handleEvent(context.Background(), "pull_request", "guid", event); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			if !reflect.DeepEqual(ghc.IssuesCreated, tc.expectedCreated) {
+				t.Errorf("expected issues %v to be created, got %v", tc.expectedCreated, ghc.IssuesCreated)
+			}
+			for _, expected := range tc.expectedBody {
+				if len(ghc.IssuesCreated) == 0 || !strings.Contains(ghc.Issues[len(tc.existing)].Body, expected) {
+					t.Errorf("expected issue body to contain %q, got %v", expected, ghc.Issues)
+				}
+			}
+			for _, issue := range ghc.Issues[len(tc.existing):] {
+				if expected := []github.Label{{Name: tracking.label()}}; !reflect.DeepEqual(issue.Labels, expected) {
+					t.Errorf("expected labels %v, got %v", expected, issue.Labels)
+				}
+			}
+			var comments []string
+			for _, comment := range ghc.IssueCommentsAdded {
+				if strings.HasPrefix(comment, "org/infra#") {
+					comments = append(comments, comment)
+				}
+			}
+			if !reflect.DeepEqual(comments, tc.expectedComments) {
+				t.Errorf("expected comments %q on issues, got %q", tc.expectedComments, comments)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// configCheck is what checkConfig needs to know about how the server runs
+// tasks, which is given by its flags.
+type configCheck struct {
+	// SchemaPath is the JSON Schema to check the config against, if any,
+	// with builtin for the bundled one.
+	SchemaPath string
+	// MakeBinary overrides the make binary in the config.
+	MakeBinary string
+	// ContainerRuntime runs the tasks that have an image.
+	ContainerRuntime string
+	// Local is set when tasks run on this host, which must then have every
+	// executable the config refers to.
+	Local bool
+}
+
+// checkConfig loads the config at path and checks it for every mistake that
+// can be found before handling a PR, both at startup and for
+// --validate-config.
+func checkConfig(path string, check configCheck) (*UpdateConfig, error) {
+	if check.SchemaPath != "" {
+		schemaPath := check.SchemaPath
+		if schemaPath == "builtin" {
+			schemaPath = ""
+		}
+		if err := ValidateSchema(path, schemaPath); err != nil {
+			return nil, err
+		}
+	}
+	c, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if check.Local {
+		if err := checkHostExecutables(c, check.MakeBinary, check.ContainerRuntime); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// checkHostExecutables checks that the executables the config runs on this
+// host exist, in every section of the config.
+func checkHostExecutables(c *UpdateConfig, makeBinary, containerRuntime string) error {
+	if c.usesImages() {
+		if _, err := exec.LookPath(containerRuntime); err != nil {
+			return fmt.Errorf("container runtime %q is needed to run tasks in images: %v", containerRuntime, err)
+		}
+	}
+	configs := []*UpdateConfig{c}
+	for _, org := range sortedKeys(c.Orgs) {
+		section, _ := c.ForRepo(org, "")
+		configs = append(configs, section)
+	}
+	for _, name := range sortedKeys(c.Repos) {
+		parts := strings.SplitN(name, "/", 2)
+		section, _ := c.ForRepo(parts[0], parts[1])
+		configs = append(configs, section)
+	}
+	for _, config := range configs {
+		binary := makeBinary
+		if binary == "" {
+			binary = config.MakeBinary
+		}
+		if binary == "" {
+			binary = defaultMakeBinary
+		}
+		commands := hostCommands(config, binary)
+		if config.KustomizeBinary != "" && config.KustomizeTarget == "" {
+			commands = append(commands, []string{config.KustomizeBinary})
+		}
+		for _, command := range commands {
+			if _, err := exec.LookPath(command[0]); err != nil {
+				return fmt.Errorf("command %q cannot be run: %v", strings.Join(command, " "), err)
+			}
+		}
+	}
+	return nil
+}
+
+// configSummary describes what the config updates, for --validate-config.
+func configSummary(c *UpdateConfig) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d target(s):\n", len(c.Targets))
+	for _, target := range c.Targets {
+		fmt.Fprintf(&b, "  %s\n", target)
+	}
+	fmt.Fprintf(&b, "%d matcher(s):\n", len(c.Matchers))
+	for _, matcher := range c.Matchers {
+		pattern := matcher.Regex.String()
+		if matcher.Glob != "" {
+			pattern = matcher.Glob
+		}
+		update := "make " + matcher.Target
+		if matcher.TargetRepo != "" {
+			update = "copy to " + matcher.TargetRepo
+		}
+		fmt.Fprintf(&b, "  %s: %s\n", pattern, update)
+	}
+	if len(c.Orgs) > 0 || len(c.Repos) > 0 {
+		fmt.Fprintf(&b, "%d org section(s) and %d repo section(s)\n", len(c.Orgs), len(c.Repos))
+	}
+	fmt.Fprintf(&b, "PRs changing more than %d files are refused", c.MaxPRFiles)
+	if c.MaxPRFiles > githubMaxListedFiles {
+		fmt.Fprintf(&b, ", and those changing more than the %d files the API lists are diffed locally", githubMaxListedFiles)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
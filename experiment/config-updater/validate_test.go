@@ -0,0 +1,222 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	var testcases = []struct {
+		name        string
+		config      string
+		check       configCheck
+		expectedErr string
+	}{
+		{
+			name:   "valid config",
+			config: "targets: [jobs/config.yaml]\nmatchers:\n- regex: ^jobs/\n  target: jobs\n",
+			check:  configCheck{MakeBinary: "/bin/sh", Local: true},
+		},
+		{
+			name:        "invalid regex",
+			config:      "matchers:\n- regex: ^jobs/(\n  target: jobs\n",
+			expectedErr: "error parsing regexp",
+		},
+		{
+			name:        "missing target",
+			config:      "matchers:\n- regex: ^jobs/\n",
+			expectedErr: "matcher 0 sets none of target, target_repo, prowjob, argocd_sync and helm_binary",
+		},
+		{
+			name:        "target and target repo",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\n  target_repo: org/repo\n",
+			expectedErr: `matcher 0 for target "jobs" sets both target and target_repo`,
+		},
+		{
+			name:        "batch separator without batch targets",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\n  batch_separator: \",\"\n",
+			expectedErr: `matcher 0 for target "jobs" sets batch_separator without batch_targets`,
+		},
+		{
+			name:        "same outcome labels",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\noutcome_labels:\n  failed: config-applied\n",
+			expectedErr: `invalid outcome_labels: applied and failed must be different labels, not both "config-applied"`,
+		},
+		{
+			name:        "unknown acknowledgement",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\nacknowledge: emoji\n",
+			expectedErr: `acknowledge must be reaction or comment, not "emoji"`,
+		},
+		{
+			name:        "team without an org",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\n  notify_teams:\n  - config-owners\n",
+			expectedErr: `matcher 0 notify_teams must be org/team slugs without @, not "config-owners"`,
+		},
+		{
+			name:        "user mentioned with @",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\nnotify_users:\n- '@alice'\n",
+			expectedErr: `notify_users must be GitHub logins without @, not "@alice"`,
+		},
+		{
+			name:        "helm binary and target",
+			config:      "matchers:\n- regex: ^charts/\n  target: jobs\n  helm_binary: /usr/local/bin/helm\n",
+			expectedErr: `matcher 0 for helm_binary "/usr/local/bin/helm" also sets target, target_repo, prowjob or argocd_sync`,
+		},
+		{
+			name:        "helm release name without helm binary",
+			config:      "matchers:\n- regex: ^charts/\n  target: jobs\n  helm_release_name: agents\n",
+			expectedErr: "matcher 0 sets helm_release_name without helm_binary",
+		},
+		{
+			name:        "relative helm binary",
+			config:      "matchers:\n- regex: ^charts/\n  helm_binary: bin/helm\n",
+			expectedErr: `matcher 0 has helm_binary "bin/helm", which must be an absolute path`,
+		},
+		{
+			name:        "negative cooldown",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\ncooldown_period: -1m\n",
+			expectedErr: "cooldown_period must not be negative, not -1m0s",
+		},
+		{
+			name:        "alert_threshold differing from escalate_after",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\nescalate_after: 3\nalert_threshold: 2\n",
+			expectedErr: "alert_threshold is another name for escalate_after, so they cannot be 2 and 3",
+		},
+		{
+			name:        "deployment of a target repo",
+			config:      "matchers:\n- regex: ^jobs/\n  target_repo: org/repo\n  deployment: true\n",
+			expectedErr: "matcher 0 sets deployment with target_repo, which opens a PR rather than deploying",
+		},
+		{
+			name:        "prowjob and target",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\n  prowjob: apply-jobs\n",
+			expectedErr: `matcher 0 for prowjob "apply-jobs" also sets target or target_repo`,
+		},
+		{
+			name:        "invalid email recipient",
+			config:      "email_recipients: [oncall]\nrepos:\n  org/repo:\n    matchers:\n    - regex: ^jobs/\n      target: jobs\n",
+			expectedErr: `invalid email_recipients "oncall"`,
+		},
+		{
+			name:        "tracking issues without a repo",
+			config:      "tracking_issues:\n  repo: infra\nmatchers:\n- regex: ^jobs/\n  target: jobs\n",
+			expectedErr: `invalid tracking_issues: repo "infra" must be in the form org/repo`,
+		},
+		{
+			name:        "verification with command and target",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\n  verify:\n    target: verify\n    command: [/usr/bin/make, verify]\n",
+			expectedErr: `matcher 0 for target "jobs" has invalid verify: sets both command and target`,
+		},
+		{
+			name:        "kind verification without command or target",
+			config:      "kind_verifications:\n  Service:\n    retries: 1\n",
+			expectedErr: "kind_verifications for Service: sets neither command nor target",
+		},
+		{
+			name:        "rollback without command",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\n  rollback:\n    timeout: 1m\n",
+			expectedErr: `matcher 0 for target "jobs" has a rollback without a command`,
+		},
+		{
+			name:        "missing make binary",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\n",
+			check:       configCheck{MakeBinary: "/nonexistent/make", Local: true},
+			expectedErr: `command "/nonexistent/make" cannot be run`,
+		},
+		{
+			name:        "missing executable in a repo section",
+			config:      "make_binary: /bin/sh\nallowed_executables: [/bin/sh, /nonexistent/smoke]\nrepos:\n  org/repo:\n    matchers:\n    - regex: ^jobs/\n      target: jobs\n      verify:\n        command: [/nonexistent/smoke]\n",
+			check:       configCheck{MakeBinary: "/bin/sh", Local: true},
+			expectedErr: `command "/nonexistent/smoke" cannot be run`,
+		},
+		{
+			name:   "executables are not checked for jobs",
+			config: "matchers:\n- regex: ^jobs/\n  target: jobs\n",
+			check:  configCheck{MakeBinary: "/nonexistent/make"},
+		},
+		{
+			name:        "missing container runtime",
+			config:      "matchers:\n- regex: ^jobs/\n  target: jobs\n  image: tools\n",
+			check:       configCheck{MakeBinary: "/bin/sh", ContainerRuntime: "nonexistent-docker", Local: true},
+			expectedErr: `container runtime "nonexistent-docker" is needed`,
+		},
+		{
+			name:        "schema violation",
+			config:      "matchers:\n- regex: ^jobs/\n  taget: jobs\n",
+			check:       configCheck{SchemaPath: "builtin"},
+			expectedErr: "does not match",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "check-config")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "update.yaml")
+			if err := ioutil.WriteFile(path, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, err = checkConfig(path, tc.check)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestConfigSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check-config")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "update.yaml")
+	config := "targets: [jobs/config.yaml]\nmatchers:\n- regex: ^jobs/\n  target: jobs\n- glob: docs/*.md\n  target_repo: org/docs\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c, err := checkConfig(path, configCheck{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `1 target(s):
+  jobs/config.yaml
+2 matcher(s):
+  ^jobs/: make jobs
+  docs/*.md: copy to org/docs
+PRs changing more than 50 files are refused
+`
+	if summary := configSummary(c); summary != expected {
+		t.Errorf("expected summary %q, got %q", expected, summary)
+	}
+
+	c.MaxPRFiles = 5000
+	if summary := configSummary(c); !strings.HasSuffix(summary, "PRs changing more than 5000 files are refused, and those changing more than the 3000 files the API lists are diffed locally\n") {
+		t.Errorf("expected the summary to say that truncated PRs are diffed locally, got %q", summary)
+	}
+}
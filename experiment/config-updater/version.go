@@ -0,0 +1,108 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The build metadata is embedded when building, with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// and is unknown otherwise.
+var (
+	version   = "unknown"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+var buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "config_updater_build_info",
+	Help: "Always 1, labeled with the version, commit and build date of the binary.",
+}, []string{"version", "commit", "build_date"})
+
+func init() {
+	prometheus.MustRegister(buildInfo)
+	buildInfo.WithLabelValues(version, commit, buildDate).Set(1)
+}
+
+// VersionInfo describes the build of the binary.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+func currentVersion() VersionInfo {
+	return VersionInfo{Version: version, Commit: commit, BuildDate: buildDate}
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("config-updater %s, commit %s, built %s", v.Version, v.Commit, v.BuildDate)
+}
+
+// versionHandler serves the build of the binary as JSON.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.Marshal(currentVersion())
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// runInfo identifies the run of the updates of a PR that posted a comment.
+type runInfo struct {
+	// eventGUID is the delivery GUID of the webhook that started the run.
+	eventGUID string
+	// id tells apart the runs of the same event, such as redeliveries.
+	id string
+}
+
+func newRunInfo(eventGUID string) runInfo {
+	b := make([]byte, 4)
+	// A run without an ID is still traced by its event, so a failure to
+	// read random bytes is not worth failing the updates for.
+	if _, err := rand.Read(b); err != nil {
+		return runInfo{eventGUID: eventGUID, id: "unknown"}
+	}
+	return runInfo{eventGUID: eventGUID, id: hex.EncodeToString(b)}
+}
+
+// commentFooter names the run and the binary that posted a comment, so that
+// operators can trace a comment back to the logs and the build that posted
+// it. The HTML comment repeats them as key=value pairs to be grepped for.
+func commentFooter(run runInfo) string {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return fmt.Sprintf(
+		"<sub>Posted by config-updater %s (%s) for event `%s`, run `%s`, at %s.</sub>\n<!-- config-updater event=%s run=%s version=%s commit=%s time=%s -->",
+		version, commit, run.eventGUID, run.id, now, run.eventGUID, run.id, version, commit, now,
+	)
+}
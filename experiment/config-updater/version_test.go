@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/test-infra/prow/github"
+	"k8s.io/test-infra/prow/github/fakegithub"
+)
+
+func TestVersionHandler(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "v1.2.3", "abcdef", "2019-05-01T12:00:00Z"
+
+	var testcases = []struct {
+		name         string
+		method       string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "get",
+			method:       http.MethodGet,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"version":"v1.2.3","commit":"abcdef","build_date":"2019-05-01T12:00:00Z"}`,
+		},
+		{
+			name:         "post",
+			method:       http.MethodPost,
+			expectedCode: http.StatusMethodNotAllowed,
+			expectedBody: "405 Method Not Allowed\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			versionHandler(w, httptest.NewRequest(tc.method, "/version", nil))
+			if w.Code != tc.expectedCode {
+				t.Errorf("expected code %d, got %d", tc.expectedCode, w.Code)
+			}
+			if w.Body.String() != tc.expectedBody {
+				t.Errorf("expected body %q, got %q", tc.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCommentFooter(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "v1.2.3", "abcdef"
+
+	ghc := &fakegithub.FakeClient{
+		IssueComments:      map[int][]github.IssueComment{},
+		PullRequestChanges: map[int][]github.PullRequestChange{1: {{Filename: "jobs/config.yaml"}}},
+	}
+	s := newTestServer(&fakeGit{}, ghc, &UpdateConfig{
+		Matchers:   []Matcher{{Glob: "jobs/*", Target: "jobs"}},
+		MaxPRFiles: defaultMaxPRFiles,
+	})
+	if err := s.handleEvent(context.Background(), "pull_request", "guid", mergedPREvent(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ghc.IssueCommentsAdded) != 1 {
+		t.Fatalf("expected one comment, got %v", ghc.IssueCommentsAdded)
+	}
+	footer := regexp.MustCompile("<!-- config-updater event=(\\S+) run=([0-9a-f]{8}) version=(\\S+) commit=(\\S+) time=(\\S+) -->\n" + regexp.QuoteMeta(commentSignature) + "$")
+	match := footer.FindStringSubmatch(ghc.IssueCommentsAdded[0])
+	if match == nil {
+		t.Fatalf("expected comment to end with a footer, got %q", ghc.IssueCommentsAdded[0])
+	}
+	if event, version, commit := match[1], match[3], match[4]; event != "guid" || version != "v1.2.3" || commit != "abcdef" {
+		t.Errorf("expected footer for event guid of v1.2.3 (abcdef), got event %s of %s (%s)", event, version, commit)
+	}
+	if _, err := time.Parse(time.RFC3339, match[5]); err != nil {
+		t.Errorf("expected footer time to parse: %v", err)
+	}
+	if visible := fmt.Sprintf("<sub>Posted by config-updater v1.2.3 (abcdef) for event `guid`, run `%s`, at %s.</sub>", match[2], match[5]); !strings.Contains(ghc.IssueCommentsAdded[0], visible) {
+		t.Errorf("expected comment to contain %q, got %q", visible, ghc.IssueCommentsAdded[0])
+	}
+}
+
+func TestNewRunInfo(t *testing.T) {
+	first, second := newRunInfo("guid"), newRunInfo("guid")
+	if first.eventGUID != "guid" {
+		t.Errorf("expected event guid, got %s", first.eventGUID)
+	}
+	if first.id == second.id {
+		t.Errorf("expected runs of the same event to have different IDs, both got %s", first.id)
+	}
+}
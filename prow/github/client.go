@@ -106,6 +106,7 @@ type httpClient interface {
 // Interface for how prow interacts with the graphql client, which we may throttle.
 type gqlClient interface {
 	Query(ctx context.Context, q interface{}, vars map[string]interface{}) error
+	Mutate(ctx context.Context, m interface{}, input githubql.Input, vars map[string]interface{}) error
 }
 
 // throttler sets a ceiling on the rate of GitHub requests.
@@ -156,6 +157,11 @@ func (t *throttler) Query(ctx context.Context, q interface{}, vars map[string]in
 	return t.graph.Query(ctx, q, vars)
 }
 
+func (t *throttler) Mutate(ctx context.Context, m interface{}, input githubql.Input, vars map[string]interface{}) error {
+	t.Wait()
+	return t.graph.Mutate(ctx, m, input, vars)
+}
+
 // Throttle client to a rate of at most hourlyTokens requests per hour,
 // allowing burst tokens.
 func (c *Client) Throttle(hourlyTokens, burst int) {
@@ -862,6 +868,40 @@ func (c *Client) DeleteComment(org, repo string, id int) error {
 	return err
 }
 
+// MinimizeCommentInput is the input of the minimizeComment mutation.
+type MinimizeCommentInput struct {
+	SubjectID  githubql.ID     `json:"subjectId"`
+	Classifier githubql.String `json:"classifier"`
+}
+
+// MinimizeComment hides comment id in org/repo as outdated.
+//
+// See https://developer.github.com/v4/mutation/minimizecomment/
+func (c *Client) MinimizeComment(org, repo string, id int) error {
+	c.log("MinimizeComment", org, repo, id)
+	if c.fake || c.dry {
+		return nil
+	}
+	// The mutation needs the GraphQL ID of the comment.
+	var comment struct {
+		NodeID string `json:"node_id"`
+	}
+	if _, err := c.request(&request{
+		method:    http.MethodGet,
+		path:      fmt.Sprintf("/repos/%s/%s/issues/comments/%d", org, repo, id),
+		exitCodes: []int{200},
+	}, &comment); err != nil {
+		return err
+	}
+	var m struct {
+		MinimizeComment struct {
+			ClientMutationID githubql.String
+		} `graphql:"minimizeComment(input: $input)"`
+	}
+	input := MinimizeCommentInput{SubjectID: githubql.ID(comment.NodeID), Classifier: githubql.String("OUTDATED")}
+	return c.gqlc.Mutate(context.Background(), &m, input, nil)
+}
+
 // EditComment changes the body of comment id in org/repo.
 //
 // See https://developer.github.com/v3/issues/comments/#edit-a-comment
@@ -1104,6 +1144,40 @@ func (c *Client) CreatePullRequest(org, repo, title, body, head, base string, ca
 	return resp.Num, nil
 }
 
+// CreateIssue creates a new issue and returns its number if the creation
+// is successful, otherwise any error that is encountered.
+//
+// See https://developer.github.com/v3/issues/#create-an-issue
+func (c *Client) CreateIssue(org, repo, title, body string, milestone int, labels, assignees []string) (int, error) {
+	c.log("CreateIssue", org, repo, title)
+	data := struct {
+		Title     string   `json:"title"`
+		Body      string   `json:"body,omitempty"`
+		Milestone int      `json:"milestone,omitempty"`
+		Labels    []string `json:"labels,omitempty"`
+		Assignees []string `json:"assignees,omitempty"`
+	}{
+		Title:     title,
+		Body:      body,
+		Milestone: milestone,
+		Labels:    labels,
+		Assignees: assignees,
+	}
+	var resp struct {
+		Num int `json:"number"`
+	}
+	_, err := c.request(&request{
+		method:      http.MethodPost,
+		path:        fmt.Sprintf("/repos/%s/%s/issues", org, repo),
+		requestBody: &data,
+		exitCodes:   []int{201},
+	}, &resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Num, nil
+}
+
 // UpdatePullRequest modifies the title, body, open state
 func (c *Client) UpdatePullRequest(org, repo string, number int, title, body *string, open *bool, branch *string, canModify *bool) error {
 	c.log("UpdatePullRequest", org, repo, title)
@@ -1233,6 +1307,84 @@ func (c *Client) CreateStatus(org, repo, SHA string, s Status) error {
 	return err
 }
 
+// CreateCheckRun creates a check run for a commit and returns its ID. Only
+// GitHub Apps may create check runs.
+//
+// See https://developer.github.com/v3/checks/runs/#create-a-check-run
+func (c *Client) CreateCheckRun(org, repo string, opt CheckRunOptions) (int64, error) {
+	c.log("CreateCheckRun", org, repo, opt)
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	_, err := c.request(&request{
+		method:      http.MethodPost,
+		path:        fmt.Sprintf("/repos/%s/%s/check-runs", org, repo),
+		accept:      "application/vnd.github.antiope-preview+json",
+		requestBody: &opt,
+		exitCodes:   []int{201},
+	}, &resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+// UpdateCheckRun updates a check run created by CreateCheckRun.
+//
+// See https://developer.github.com/v3/checks/runs/#update-a-check-run
+func (c *Client) UpdateCheckRun(org, repo string, checkRunID int64, opt CheckRunOptions) error {
+	c.log("UpdateCheckRun", org, repo, checkRunID, opt)
+	_, err := c.request(&request{
+		method:      http.MethodPatch,
+		path:        fmt.Sprintf("/repos/%s/%s/check-runs/%d", org, repo, checkRunID),
+		accept:      "application/vnd.github.antiope-preview+json",
+		requestBody: &opt,
+		exitCodes:   []int{200},
+	}, nil)
+	return err
+}
+
+// CreateDeployment creates a deployment of a ref and returns its ID.
+//
+// See https://developer.github.com/v3/repos/deployments/#create-a-deployment
+func (c *Client) CreateDeployment(org, repo string, opt DeploymentOptions) (int64, error) {
+	c.log("CreateDeployment", org, repo, opt)
+	if opt.RequiredContexts == nil {
+		opt.RequiredContexts = []string{}
+	}
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	_, err := c.request(&request{
+		method:      http.MethodPost,
+		path:        fmt.Sprintf("/repos/%s/%s/deployments", org, repo),
+		accept:      "application/vnd.github.ant-man-preview+json",
+		requestBody: &opt,
+		exitCodes:   []int{201},
+	}, &resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+// CreateDeploymentStatus adds a status to a deployment created by
+// CreateDeployment. The in_progress and queued states require the flash
+// preview, and LogURL the ant-man one.
+//
+// See https://developer.github.com/v3/repos/deployments/#create-a-deployment-status
+func (c *Client) CreateDeploymentStatus(org, repo string, deploymentID int64, opt DeploymentStatusOptions) error {
+	c.log("CreateDeploymentStatus", org, repo, deploymentID, opt)
+	_, err := c.request(&request{
+		method:      http.MethodPost,
+		path:        fmt.Sprintf("/repos/%s/%s/deployments/%d/statuses", org, repo, deploymentID),
+		accept:      "application/vnd.github.ant-man-preview+json, application/vnd.github.flash-preview+json",
+		requestBody: &opt,
+		exitCodes:   []int{201},
+	}, nil)
+	return err
+}
+
 // ListStatuses gets commit statuses for a given ref.
 //
 // See https://developer.github.com/v3/repos/statuses/#list-statuses-for-a-specific-ref
@@ -1898,6 +2050,45 @@ func (c *Client) FindIssues(query, sort string, asc bool) ([]Issue, error) {
 	return issSearchResult.Issues, err
 }
 
+// FindAllIssues is like FindIssues, but reads every page of the results
+// rather than only the first. The search API returns at most 1000 results.
+//
+// Each page of results consumes one API token.
+//
+// See https://help.github.com/articles/searching-issues-and-pull-requests/ for details.
+func (c *Client) FindAllIssues(query, sort string, asc bool) ([]Issue, error) {
+	c.log("FindAllIssues", query)
+	if c.fake {
+		return nil, nil
+	}
+	values := url.Values{
+		"q":        []string{query},
+		"per_page": []string{"100"},
+	}
+	if sort != "" {
+		values.Set("sort", sort)
+		if asc {
+			values.Set("order", "asc")
+		}
+	}
+	var issues []Issue
+	err := c.readPaginatedResultsWithValues(
+		"/search/issues",
+		values,
+		acceptNone,
+		func() interface{} {
+			return &IssuesSearchResult{}
+		},
+		func(obj interface{}) {
+			issues = append(issues, obj.(*IssuesSearchResult).Issues...)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return issues, nil
+}
+
 // FileNotFound happens when github cannot find the file requested by GetFile().
 type FileNotFound struct {
 	org, repo, path, commit string
@@ -32,6 +32,7 @@ import (
 	"testing"
 	"time"
 
+	githubql "github.com/shurcooL/githubv4"
 	"k8s.io/apimachinery/pkg/util/sets"
 )
 
@@ -266,6 +267,77 @@ func TestDeleteComment(t *testing.T) {
 	}
 }
 
+type fakeGraphQL struct {
+	inputs []githubql.Input
+}
+
+func (f *fakeGraphQL) Query(ctx context.Context, q interface{}, vars map[string]interface{}) error {
+	return nil
+}
+
+func (f *fakeGraphQL) Mutate(ctx context.Context, m interface{}, input githubql.Input, vars map[string]interface{}) error {
+	f.inputs = append(f.inputs, input)
+	return nil
+}
+
+func TestMinimizeComment(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		if r.URL.Path != "/repos/k8s/kuber/issues/comments/123" {
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"id": 123, "node_id": "MDEyOklzc3VlQ29tbWVudDEyMw=="}`)
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	gql := &fakeGraphQL{}
+	c.gqlc = gql
+	if err := c.MinimizeComment("k8s", "kuber", 123); err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	}
+	expected := []githubql.Input{MinimizeCommentInput{SubjectID: githubql.ID("MDEyOklzc3VlQ29tbWVudDEyMw=="), Classifier: githubql.String("OUTDATED")}}
+	if !reflect.DeepEqual(gql.inputs, expected) {
+		t.Errorf("Expected mutation inputs %v, got %v", expected, gql.inputs)
+	}
+}
+
+func TestCreateIssue(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		if r.URL.Path != "/repos/k8s/kuber/issues" {
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Could not read request body: %v", err)
+		}
+		var issue struct {
+			Title  string   `json:"title"`
+			Body   string   `json:"body"`
+			Labels []string `json:"labels"`
+		}
+		if err := json.Unmarshal(b, &issue); err != nil {
+			t.Errorf("Could not unmarshal request: %v", err)
+		} else if issue.Title != "title" || issue.Body != "body" || !reflect.DeepEqual(issue.Labels, []string{"bug"}) {
+			t.Errorf("Wrong issue: %s", b)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"number": 42}`)
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	number, err := c.CreateIssue("k8s", "kuber", "title", "body", 0, []string{"bug"}, nil)
+	if err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	} else if number != 42 {
+		t.Errorf("Expected issue 42, got %d", number)
+	}
+}
+
 func TestGetPullRequest(t *testing.T) {
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -1086,6 +1158,49 @@ func TestFindIssues(t *testing.T) {
 	}
 }
 
+func TestFindAllIssues(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		var issues []Issue
+		if r.URL.Path == "/search/issues" {
+			if q := r.URL.Query().Get("q"); q != "org:k8s is:pr" {
+				t.Errorf("Bad query: %s", q)
+			}
+			if sort, order := r.URL.Query().Get("sort"), r.URL.Query().Get("order"); sort != "updated" || order != "asc" {
+				t.Errorf("Bad sort %q and order %q", sort, order)
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<blorp>; rel="first", <https://%s/someotherpath>; rel="next"`, r.Host))
+			issues = []Issue{{Number: 1, RepositoryURL: "https://api.github.com/repos/k8s/kuber"}}
+		} else if r.URL.Path == "/someotherpath" {
+			issues = []Issue{{Number: 2, RepositoryURL: "https://api.github.com/repos/k8s/other"}}
+		} else {
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+		b, err := json.Marshal(&IssuesSearchResult{Total: 2, Issues: issues})
+		if err != nil {
+			t.Fatalf("Didn't expect error: %v", err)
+		}
+		fmt.Fprint(w, string(b))
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	issues, err := c.FindAllIssues("org:k8s is:pr", "updated", true)
+	if err != nil {
+		t.Fatalf("Didn't expect error: %v", err)
+	}
+	if len(issues) != 2 {
+		t.Fatalf("Expected two issues, found %d: %v", len(issues), issues)
+	}
+	if issues[0].Number != 1 || issues[1].Number != 2 {
+		t.Errorf("Wrong issue numbers: %v", issues)
+	}
+	if issues[1].RepositoryURL != "https://api.github.com/repos/k8s/other" {
+		t.Errorf("Wrong repository URL: %s", issues[1].RepositoryURL)
+	}
+}
+
 func TestGetFile(t *testing.T) {
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -1718,3 +1833,129 @@ func TestCombinedStatus(t *testing.T) {
 		t.Errorf("Wrong review IDs: %v", combined.Statuses)
 	}
 }
+
+func TestCreateCheckRun(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		if r.URL.Path != "/repos/k8s/kuber/check-runs" {
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+		if accept := r.Header.Get("Accept"); accept != "application/vnd.github.antiope-preview+json" {
+			t.Errorf("Bad Accept header: %s", accept)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Could not read request body: %v", err)
+		}
+		var opt CheckRunOptions
+		if err := json.Unmarshal(b, &opt); err != nil {
+			t.Errorf("Could not unmarshal request: %v", err)
+		} else if opt.Name != "c" || opt.HeadSHA != "abcdef" || opt.Status != CheckRunInProgress {
+			t.Errorf("Wrong check run: %+v", opt)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": 42}`)
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	id, err := c.CreateCheckRun("k8s", "kuber", CheckRunOptions{Name: "c", HeadSHA: "abcdef", Status: CheckRunInProgress})
+	if err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	} else if id != 42 {
+		t.Errorf("Wrong check run ID: %d", id)
+	}
+}
+
+func TestCreateDeployment(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		if r.URL.Path != "/repos/k8s/kuber/deployments" {
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Could not read request body: %v", err)
+		}
+		// An empty required_contexts and auto_merge must be sent, or GitHub
+		// checks statuses and merges the default branch.
+		if expected := `{"ref":"abcdef","auto_merge":false,"required_contexts":[],"environment":"prod"}`; string(b) != expected {
+			t.Errorf("Wrong deployment %s, expected %s", b, expected)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": 42}`)
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	id, err := c.CreateDeployment("k8s", "kuber", DeploymentOptions{Ref: "abcdef", Environment: "prod"})
+	if err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	} else if id != 42 {
+		t.Errorf("Wrong deployment ID: %d", id)
+	}
+}
+
+func TestCreateDeploymentStatus(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		if r.URL.Path != "/repos/k8s/kuber/deployments/42/statuses" {
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+		if accept := r.Header.Get("Accept"); !strings.Contains(accept, "application/vnd.github.flash-preview+json") {
+			t.Errorf("Bad Accept header: %s", accept)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Could not read request body: %v", err)
+		}
+		var opt DeploymentStatusOptions
+		if err := json.Unmarshal(b, &opt); err != nil {
+			t.Errorf("Could not unmarshal request: %v", err)
+		} else if opt.State != DeploymentStateInProgress || opt.LogURL != "https://example.com/log" {
+			t.Errorf("Wrong deployment status: %+v", opt)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": 1}`)
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	if err := c.CreateDeploymentStatus("k8s", "kuber", 42, DeploymentStatusOptions{State: DeploymentStateInProgress, LogURL: "https://example.com/log"}); err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	}
+}
+
+func TestUpdateCheckRun(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			t.Errorf("Bad method: %s", r.Method)
+		}
+		if r.URL.Path != "/repos/k8s/kuber/check-runs/42" {
+			t.Errorf("Bad request path: %s", r.URL.Path)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Could not read request body: %v", err)
+		}
+		var opt CheckRunOptions
+		if err := json.Unmarshal(b, &opt); err != nil {
+			t.Errorf("Could not unmarshal request: %v", err)
+		} else if opt.Conclusion != CheckRunSuccess || opt.Output == nil || opt.Output.Text != "all good" {
+			t.Errorf("Wrong check run: %+v", opt)
+		}
+		fmt.Fprint(w, `{"id": 42}`)
+	}))
+	defer ts.Close()
+	c := getClient(ts.URL)
+	if err := c.UpdateCheckRun("k8s", "kuber", 42, CheckRunOptions{
+		Status:     CheckRunCompleted,
+		Conclusion: CheckRunSuccess,
+		Output:     &CheckRunOutput{Title: "t", Summary: "s", Text: "all good"},
+	}); err != nil {
+		t.Errorf("Didn't expect error: %v", err)
+	}
+}
@@ -61,6 +61,8 @@ type FakeClient struct {
 	IssueCommentsAdded []string
 	// org/repo#issuecommentid
 	IssueCommentsDeleted []string
+	// org/repo#issuecommentid
+	IssueCommentsMinimized []string
 
 	// org/repo#issuecommentid:reaction
 	IssueReactionsAdded   []string
@@ -83,6 +85,22 @@ type FakeClient struct {
 
 	// A list of refs that got deleted via DeleteRef
 	RefsDeleted []struct{ Org, Repo, Ref string }
+
+	// org/repo of repos forked via CreateFork
+	ReposForked []string
+	// org/repo#number:head->base of PRs opened via CreatePullRequest
+	PullRequestsCreated []string
+	// org/repo#number:title of issues opened via CreateIssue
+	IssuesCreated []string
+
+	// CheckRuns maps the IDs of check runs to their latest options, with
+	// fields left empty by updates keeping their value.
+	CheckRuns map[int64]*github.CheckRunOptions
+
+	// Deployments maps the IDs of deployments to their options, and
+	// DeploymentStatuses to the statuses added to them, in order.
+	Deployments        map[int64]*github.DeploymentOptions
+	DeploymentStatuses map[int64][]github.DeploymentStatusOptions
 }
 
 // BotName returns authenticated login.
@@ -90,6 +108,114 @@ func (f *FakeClient) BotName() (string, error) {
 	return botName, nil
 }
 
+// CreateFork records the fork of owner/repo.
+func (f *FakeClient) CreateFork(owner, repo string) error {
+	f.ReposForked = append(f.ReposForked, fmt.Sprintf("%s/%s", owner, repo))
+	return nil
+}
+
+// CreatePullRequest adds the PR to PullRequests and returns its number.
+func (f *FakeClient) CreatePullRequest(org, repo, title, body, head, base string, canModify bool) (int, error) {
+	if f.PullRequests == nil {
+		f.PullRequests = map[int]*github.PullRequest{}
+	}
+	number := len(f.PullRequests) + 1
+	f.PullRequests[number] = &github.PullRequest{
+		Number: number,
+		Title:  title,
+		Body:   body,
+		Head:   github.PullRequestBranch{Ref: head},
+		Base:   github.PullRequestBranch{Ref: base},
+	}
+	f.PullRequestsCreated = append(f.PullRequestsCreated, fmt.Sprintf("%s/%s#%d:%s->%s", org, repo, number, head, base))
+	return number, nil
+}
+
+// CreateIssue adds the issue to Issues and returns its number.
+func (f *FakeClient) CreateIssue(org, repo, title, body string, milestone int, labels, assignees []string) (int, error) {
+	number := len(f.Issues) + 1
+	issue := github.Issue{Number: number, Title: title, Body: body, State: "open"}
+	for _, label := range labels {
+		issue.Labels = append(issue.Labels, github.Label{Name: label})
+	}
+	f.Issues = append(f.Issues, issue)
+	f.IssuesCreated = append(f.IssuesCreated, fmt.Sprintf("%s/%s#%d:%s", org, repo, number, title))
+	return number, nil
+}
+
+// CreateCheckRun adds the check run to CheckRuns and returns its ID.
+func (f *FakeClient) CreateCheckRun(org, repo string, opt github.CheckRunOptions) (int64, error) {
+	if f.CheckRuns == nil {
+		f.CheckRuns = map[int64]*github.CheckRunOptions{}
+	}
+	id := int64(len(f.CheckRuns) + 1)
+	f.CheckRuns[id] = &opt
+	return id, nil
+}
+
+// CreateDeployment adds the deployment to Deployments and returns its ID.
+func (f *FakeClient) CreateDeployment(org, repo string, opt github.DeploymentOptions) (int64, error) {
+	if f.Deployments == nil {
+		f.Deployments = map[int64]*github.DeploymentOptions{}
+	}
+	id := int64(len(f.Deployments) + 1)
+	f.Deployments[id] = &opt
+	return id, nil
+}
+
+// CreateDeploymentStatus appends the status to those of the deployment in
+// DeploymentStatuses.
+func (f *FakeClient) CreateDeploymentStatus(org, repo string, deploymentID int64, opt github.DeploymentStatusOptions) error {
+	if _, ok := f.Deployments[deploymentID]; !ok {
+		return fmt.Errorf("deployment %d not found", deploymentID)
+	}
+	if f.DeploymentStatuses == nil {
+		f.DeploymentStatuses = map[int64][]github.DeploymentStatusOptions{}
+	}
+	f.DeploymentStatuses[deploymentID] = append(f.DeploymentStatuses[deploymentID], opt)
+	return nil
+}
+
+// UpdateCheckRun merges opt into the check run in CheckRuns.
+func (f *FakeClient) UpdateCheckRun(org, repo string, checkRunID int64, opt github.CheckRunOptions) error {
+	checkRun, ok := f.CheckRuns[checkRunID]
+	if !ok {
+		return fmt.Errorf("check run %d not found", checkRunID)
+	}
+	for _, field := range []struct{ from, to *string }{
+		{&opt.Name, &checkRun.Name},
+		{&opt.HeadSHA, &checkRun.HeadSHA},
+		{&opt.DetailsURL, &checkRun.DetailsURL},
+		{&opt.ExternalID, &checkRun.ExternalID},
+		{&opt.Status, &checkRun.Status},
+		{&opt.Conclusion, &checkRun.Conclusion},
+	} {
+		if *field.from != "" {
+			*field.to = *field.from
+		}
+	}
+	if opt.StartedAt != nil {
+		checkRun.StartedAt = opt.StartedAt
+	}
+	if opt.CompletedAt != nil {
+		checkRun.CompletedAt = opt.CompletedAt
+	}
+	if opt.Output != nil {
+		checkRun.Output = opt.Output
+	}
+	return nil
+}
+
+// GetRepo returns the repo, with master as its default branch.
+func (f *FakeClient) GetRepo(owner, name string) (github.Repo, error) {
+	return github.Repo{
+		Owner:         github.User{Login: owner},
+		Name:          name,
+		FullName:      owner + "/" + name,
+		DefaultBranch: "master",
+	}, nil
+}
+
 // IsMember returns true if user is in org.
 func (f *FakeClient) IsMember(org, user string) (bool, error) {
 	for _, m := range f.OrgMembers[org] {
@@ -169,6 +295,12 @@ func (f *FakeClient) DeleteComment(owner, repo string, ID int) error {
 	return fmt.Errorf("could not find issue comment %d", ID)
 }
 
+// MinimizeComment hides a comment.
+func (f *FakeClient) MinimizeComment(owner, repo string, ID int) error {
+	f.IssueCommentsMinimized = append(f.IssueCommentsMinimized, fmt.Sprintf("%s/%s#%d", owner, repo, ID))
+	return nil
+}
+
 // DeleteStaleComments deletes comments flagged by isStale.
 func (f *FakeClient) DeleteStaleComments(org, repo string, number int, comments []github.IssueComment, isStale func(github.IssueComment) bool) error {
 	if comments == nil {
@@ -303,6 +435,11 @@ func (f *FakeClient) FindIssues(query, sort string, asc bool) ([]github.Issue, e
 	return f.Issues, nil
 }
 
+// FindAllIssues returns f.Issues.
+func (f *FakeClient) FindAllIssues(query, sort string, asc bool) ([]github.Issue, error) {
+	return f.Issues, nil
+}
+
 // AssignIssue adds assignees.
 func (f *FakeClient) AssignIssue(owner, repo string, number int, assignees []string) error {
 	var m github.MissingUsers
@@ -19,21 +19,30 @@ package github
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"hash"
 	"strings"
 )
 
 // ValidatePayload ensures that the request payload signature matches the key.
+// The signature is either HMAC-SHA256, from X-Hub-Signature-256, or
+// HMAC-SHA1, from X-Hub-Signature, as told by its sha256= or sha1= prefix.
 func ValidatePayload(payload []byte, sig string, key []byte) bool {
-	if !strings.HasPrefix(sig, "sha1=") {
+	var newHash func() hash.Hash
+	switch {
+	case strings.HasPrefix(sig, "sha256="):
+		newHash, sig = sha256.New, strings.TrimPrefix(sig, "sha256=")
+	case strings.HasPrefix(sig, "sha1="):
+		newHash, sig = sha1.New, strings.TrimPrefix(sig, "sha1=")
+	default:
 		return false
 	}
-	sig = sig[5:]
 	sb, err := hex.DecodeString(sig)
 	if err != nil {
 		return false
 	}
-	mac := hmac.New(sha1.New, key)
+	mac := hmac.New(newHash, key)
 	mac.Write(payload)
 	expected := mac.Sum(nil)
 	return hmac.Equal(sb, expected)
@@ -64,6 +64,30 @@ func TestValidatePayload(t *testing.T) {
 			"abc",
 			false,
 		},
+		{
+			"{}",
+			"sha256=19092633e5aa9a849dfcc9d2df4e76db2df1fcba7f38915f2c7833bd8a510f2f",
+			"abc",
+			true,
+		},
+		{
+			"",
+			"sha256=b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad",
+			"",
+			true,
+		},
+		{
+			"{}",
+			"sha256=db5c76f4264d0ad96cf21baec394964b4b8ce580",
+			"abc",
+			false,
+		},
+		{
+			"{}",
+			"sha1=19092633e5aa9a849dfcc9d2df4e76db2df1fcba7f38915f2c7833bd8a510f2f",
+			"abc",
+			false,
+		},
 	}
 	for _, tc := range testcases {
 		if ValidatePayload([]byte(tc.payload), tc.sig, []byte(tc.key)) != tc.valid {
@@ -66,6 +66,8 @@ const (
 	ReactionConfused                  = "confused"
 	ReactionHeart                     = "heart"
 	ReactionHooray                    = "hooray"
+	ReactionRocket                    = "rocket"
+	ReactionEyes                      = "eyes"
 	stateCannotBeChangedMessagePrefix = "state cannot be changed."
 )
 
@@ -138,6 +140,77 @@ type Status struct {
 	Context     string `json:"context,omitempty"`
 }
 
+// Check run statuses and conclusions.
+const (
+	CheckRunQueued     = "queued"
+	CheckRunInProgress = "in_progress"
+	CheckRunCompleted  = "completed"
+
+	CheckRunSuccess        = "success"
+	CheckRunFailure        = "failure"
+	CheckRunNeutral        = "neutral"
+	CheckRunCancelled      = "cancelled"
+	CheckRunTimedOut       = "timed_out"
+	CheckRunActionRequired = "action_required"
+)
+
+// CheckRunOptions are the fields set when creating or updating a check run.
+// Conclusion and CompletedAt are required once Status is completed.
+type CheckRunOptions struct {
+	Name        string          `json:"name,omitempty"`
+	HeadSHA     string          `json:"head_sha,omitempty"`
+	DetailsURL  string          `json:"details_url,omitempty"`
+	ExternalID  string          `json:"external_id,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Conclusion  string          `json:"conclusion,omitempty"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	Output      *CheckRunOutput `json:"output,omitempty"`
+}
+
+// CheckRunOutput is shown on the page of a check run. Text may use
+// Markdown.
+type CheckRunOutput struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+	Text    string `json:"text,omitempty"`
+}
+
+// Deployment statuses.
+const (
+	DeploymentStatePending    = "pending"
+	DeploymentStateQueued     = "queued"
+	DeploymentStateInProgress = "in_progress"
+	DeploymentStateSuccess    = "success"
+	DeploymentStateFailure    = "failure"
+	DeploymentStateError      = "error"
+	DeploymentStateInactive   = "inactive"
+)
+
+// DeploymentOptions are the fields set when creating a deployment.
+// RequiredContexts must be empty rather than nil to skip checking the
+// statuses of Ref, and AutoMerge is sent even when false, as GitHub merges
+// the default branch into Ref unless told not to.
+type DeploymentOptions struct {
+	Ref                   string   `json:"ref"`
+	Task                  string   `json:"task,omitempty"`
+	AutoMerge             bool     `json:"auto_merge"`
+	RequiredContexts      []string `json:"required_contexts"`
+	Environment           string   `json:"environment,omitempty"`
+	Description           string   `json:"description,omitempty"`
+	TransientEnvironment  bool     `json:"transient_environment,omitempty"`
+	ProductionEnvironment bool     `json:"production_environment,omitempty"`
+}
+
+// DeploymentStatusOptions are the fields set when creating a deployment
+// status.
+type DeploymentStatusOptions struct {
+	State          string `json:"state"`
+	LogURL         string `json:"log_url,omitempty"`
+	Description    string `json:"description,omitempty"`
+	EnvironmentURL string `json:"environment_url,omitempty"`
+}
+
 // CombinedStatus is the latest statuses for a ref.
 type CombinedStatus struct {
 	SHA      string   `json:"sha"`
@@ -214,8 +287,10 @@ type PullRequest struct {
 	Body               string            `json:"body"`
 	RequestedReviewers []User            `json:"requested_reviewers"`
 	Assignees          []User            `json:"assignees"`
+	Labels             []Label           `json:"labels"`
 	State              string            `json:"state"`
 	Merged             bool              `json:"merged"`
+	ChangedFiles       int               `json:"changed_files"`
 	CreatedAt          time.Time         `json:"created_at,omitempty"`
 	UpdatedAt          time.Time         `json:"updated_at,omitempty"`
 	// ref https://developer.github.com/v3/pulls/#get-a-single-pull-request
@@ -456,6 +531,9 @@ type Issue struct {
 
 	// This will be non-nil if it is a pull request.
 	PullRequest *struct{} `json:"pull_request,omitempty"`
+
+	// RepositoryURL is the API URL of the repo, only set in search results.
+	RepositoryURL string `json:"repository_url,omitempty"`
 }
 
 // IsAssignee checks if a user is assigned to the issue.
@@ -19,6 +19,7 @@ package github
 import (
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -51,7 +52,12 @@ func ValidateWebhook(w http.ResponseWriter, r *http.Request, hmacSecret []byte)
 		responseHTTPError(w, http.StatusBadRequest, "400 Bad Request: Missing X-GitHub-Delivery Header")
 		return "", "", nil, false, http.StatusBadRequest
 	}
-	sig := r.Header.Get("X-Hub-Signature")
+	// GitHub recommends the SHA-256 signature, which older installations
+	// do not send. Each header only carries its own algorithm.
+	sig, prefix := r.Header.Get("X-Hub-Signature-256"), "sha256="
+	if sig == "" {
+		sig, prefix = r.Header.Get("X-Hub-Signature"), "sha1="
+	}
 	if sig == "" {
 		responseHTTPError(w, http.StatusForbidden, "403 Forbidden: Missing X-Hub-Signature")
 		return "", "", nil, false, http.StatusForbidden
@@ -67,7 +73,7 @@ func ValidateWebhook(w http.ResponseWriter, r *http.Request, hmacSecret []byte)
 		return "", "", nil, false, http.StatusInternalServerError
 	}
 	// Validate the payload with our HMAC secret.
-	if !ValidatePayload(payload, sig, hmacSecret) {
+	if !strings.HasPrefix(sig, prefix) || !ValidatePayload(payload, sig, hmacSecret) {
 		responseHTTPError(w, http.StatusForbidden, "403 Forbidden: Invalid X-Hub-Signature")
 		return "", "", nil, false, http.StatusForbidden
 	}